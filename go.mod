@@ -4,6 +4,8 @@ go 1.21.4
 
 require (
 	github.com/dolthub/swiss v0.0.0-00010101000000-000000000000
+	github.com/kylelemons/godebug v1.1.0
+	github.com/mna/mainer v0.3.0
 	github.com/stretchr/testify v1.9.0
 	golang.org/x/exp v0.0.0-20240222234643-814bf88cf225
 )
@@ -12,8 +14,6 @@ require (
 	github.com/caarlos0/env/v6 v6.10.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dolthub/maphash v0.1.0 // indirect
-	github.com/kylelemons/godebug v1.1.0 // indirect
-	github.com/mna/mainer v0.3.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,64 @@
+package maincmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mna/mainer"
+	"github.com/mna/nenuphar/lang/compiler"
+)
+
+func (c *Cmd) Disasm(ctx context.Context, stdio mainer.Stdio, args []string) error {
+	return DisasmFiles(ctx, stdio, args...)
+}
+
+// DisasmFiles decodes the encoded programs in files and prints their
+// disassembled textual form. If isStdin(files) is true, the encoded program
+// is read from stdin instead.
+func DisasmFiles(ctx context.Context, stdio mainer.Stdio, files ...string) error {
+	if isStdin(files) {
+		files = []string{"-"}
+	}
+
+	for i, file := range files {
+		var b []byte
+		var err error
+		if file == "-" {
+			file = stdinName
+			b, err = io.ReadAll(stdio.Stdin)
+		} else {
+			b, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return printError(stdio, err)
+		}
+
+		prog, err := decodeProgram(file, b)
+		if err != nil {
+			return printError(stdio, err)
+		}
+		if i > 0 {
+			fmt.Fprintln(stdio.Stdout)
+		}
+		if _, err := stdio.Stdout.Write(compiler.Dasm(prog)); err != nil {
+			return printError(stdio, err)
+		}
+	}
+	return nil
+}
+
+// decodeProgram decodes the encoded program b read from file and verifies
+// that it can be safely executed, as it may not have been generated by the
+// compiler.
+func decodeProgram(file string, b []byte) (*compiler.Program, error) {
+	prog, err := compiler.DecodeProgram(b)
+	if err == nil {
+		err = compiler.Verify(prog)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return prog, nil
+}
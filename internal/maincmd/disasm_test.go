@@ -0,0 +1,71 @@
+package maincmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mna/mainer"
+	"github.com/mna/nenuphar/lang/compiler"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisasm(t *testing.T) {
+	dir := t.TempDir()
+	prog := compileSource(t, "prog.nen", `
+fn fact(n)
+	if n <= 1 then return 1 end
+	return n * fact(n - 1)
+end
+print(fact(5))
+`)
+	enc := prog.Encode()
+	file := filepath.Join(dir, "prog.nenc")
+	require.NoError(t, os.WriteFile(file, enc, 0o600))
+
+	t.Run("round-trip", func(t *testing.T) {
+		code, stdout, stderr := runMain(dir, "", "disasm", file)
+		require.Equal(t, mainer.Success, code, stderr)
+		require.Equal(t, string(compiler.Dasm(prog)), stdout)
+	})
+
+	t.Run("stdin", func(t *testing.T) {
+		code, stdout, stderr := runMain(dir, string(enc), "disasm")
+		require.Equal(t, mainer.Success, code, stderr)
+		require.Equal(t, string(compiler.Dasm(prog)), stdout)
+	})
+
+	t.Run("version mismatch", func(t *testing.T) {
+		// the version follows the 4-byte magic number
+		old := append([]byte(nil), enc...)
+		old[4] = compiler.Version - 1
+		file := filepath.Join(dir, "old.nenc")
+		require.NoError(t, os.WriteFile(file, old, 0o600))
+
+		code, stdout, stderr := runMain(dir, "", "disasm", file)
+		require.Equal(t, mainer.Failure, code)
+		require.Empty(t, stdout)
+		require.Contains(t, stderr, "old.nenc: compiled program version mismatch")
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		bad := *prog
+		bad.Names = nil
+		file := filepath.Join(dir, "corrupted.nenc")
+		require.NoError(t, os.WriteFile(file, bad.Encode(), 0o600))
+
+		code, stdout, stderr := runMain(dir, "", "disasm", file)
+		require.Equal(t, mainer.Failure, code)
+		require.Empty(t, stdout)
+		require.Contains(t, stderr, "corrupted.nenc: function prog.nen (#0): pc 8: universal: name index 0 out of range")
+	})
+
+	t.Run("source file", func(t *testing.T) {
+		file := filepath.Join(dir, "prog.nen")
+		require.NoError(t, os.WriteFile(file, []byte(`print(1)`), 0o600))
+
+		code, _, stderr := runMain(dir, "", "disasm", file)
+		require.Equal(t, mainer.Failure, code)
+		require.Contains(t, stderr, "prog.nen: not a compiled program")
+	})
+}
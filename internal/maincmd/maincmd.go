@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"slices"
 	"strings"
 
 	"github.com/mna/mainer"
+	"github.com/mna/nenuphar/lang/token"
 )
 
 const binName = "nenuphar"
@@ -25,7 +27,12 @@ Run '%[1]s --help' for details.
 
 Compiler and all-in-one tool for the %[1]s programming language.
 
+The source code is read from the <path> files, or from stdin if no
+<path> is provided or if the single <path> is '-'.
+
 The <command> can be one of:
+       disasm                    Decode the compiled programs and print
+                                 their disassembled instructions.
        parse                     Execute the parser phase of the
                                  compilation and print the resulting
                                  abstract syntax tree (AST).
@@ -33,6 +40,10 @@ The <command> can be one of:
                                  compilation and print the resulting
                                  abstract syntax tree (AST) with symbol
                                  resolution information.
+       run                       Compile the source file, or load the
+                                 compiled program, and execute it. The
+                                 arguments after '--' are available to
+                                 the program in the 'args' tuple.
        tokenize                  Execute the scanner phase of the
                                  compilation and print the resulting
                                  tokens.
@@ -45,6 +56,13 @@ Valid flag options for the <parse> command are:
        --with-comments           Include comments in the AST (excluded
                                  by default).
 
+Valid flag options for the <tokenize>, <parse> and <resolve>
+commands are:
+       --max-files N             Fail if more than N files are provided
+                                 (no limit by default).
+       --max-bytes N             Fail if the files provided total more
+                                 than N bytes (no limit by default).
+
 More information on the %[1]s repository:
        https://github.com/mna/nenuphar
 `, binName)
@@ -58,10 +76,13 @@ type Cmd struct {
 	Version bool `flag:"v,version"`
 
 	WithComments bool `flag:"with-comments"`
+	MaxFiles     int  `flag:"max-files"`
+	MaxBytes     int  `flag:"max-bytes"`
 
-	args  []string
-	flags map[string]bool
-	cmdFn func(context.Context, mainer.Stdio, []string) error
+	args     []string
+	progArgs []string // arguments after "--", for the run command
+	flags    map[string]bool
+	cmdFn    func(context.Context, mainer.Stdio, []string) error
 }
 
 func (c *Cmd) SetArgs(args []string) {
@@ -89,20 +110,43 @@ func (c *Cmd) Validate() error {
 		return fmt.Errorf("unknown command: %s", c.args[0])
 	}
 
-	if cmdName == "tokenize" || cmdName == "parse" || cmdName == "resolve" {
-		// at least one file is required, or TODO: read from stdin
-		if len(c.args[1:]) == 0 {
-			return fmt.Errorf("%s: at least one file must be provided", cmdName)
-		}
+	// with no file, the source is read from stdin, as with the "-" file.
+	files := c.args[1:]
+	if len(files) > 1 && slices.Contains(files, "-") {
+		return fmt.Errorf("%s: stdin ('-') cannot be combined with other files", cmdName)
+	}
+	if cmdName == "run" && len(files) > 1 {
+		return fmt.Errorf("%s: at most one file can be provided", cmdName)
+	}
+	if len(c.progArgs) > 0 && cmdName != "run" {
+		return fmt.Errorf("%s: invalid program arguments", cmdName)
 	}
 
 	if c.flags["with-comments"] && cmdName != "parse" && cmdName != "resolve" {
 		return fmt.Errorf("%s: invalid flag 'with-comments'", cmdName)
 	}
 
+	for _, nm := range []string{"max-files", "max-bytes"} {
+		if c.flags[nm] && cmdName != "tokenize" && cmdName != "parse" && cmdName != "resolve" {
+			return fmt.Errorf("%s: invalid flag '%s'", cmdName, nm)
+		}
+	}
+	if c.MaxFiles < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("%s: source limits must not be negative", cmdName)
+	}
+
 	return nil
 }
 
+// sourceLimits returns the limits on the source files set by the flags, or
+// nil if there is no limit.
+func (c *Cmd) sourceLimits() *token.SourceLimits {
+	if c.MaxFiles == 0 && c.MaxBytes == 0 {
+		return nil
+	}
+	return &token.SourceLimits{MaxFiles: c.MaxFiles, MaxBytes: c.MaxBytes}
+}
+
 func printError(stdio mainer.Stdio, err error) error {
 	if err != nil {
 		fmt.Fprintf(stdio.Stderr, "%s\n", err)
@@ -111,6 +155,12 @@ func printError(stdio mainer.Stdio, err error) error {
 }
 
 func (c *Cmd) Main(args []string, stdio mainer.Stdio) mainer.ExitCode {
+	// the arguments after "--" are for the program to run, not for the parser
+	// that would treat them as non-flag arguments.
+	if i := slices.Index(args, "--"); i > 0 {
+		args, c.progArgs = args[:i], args[i+1:]
+	}
+
 	p := mainer.Parser{
 		EnvVars:   false, // leaving this here for now in case some flags can use this
 		EnvPrefix: binName + "_",
@@ -16,16 +16,16 @@ func (c *Cmd) Parse(ctx context.Context, stdio mainer.Stdio, args []string) erro
 	if c.WithComments {
 		parseMode |= parser.Comments
 	}
-	return ParseFiles(ctx, stdio, parseMode, token.PosLong, "", args...)
+	return ParseFiles(ctx, stdio, parseMode, token.PosLong, "", c.sourceLimits(), args...)
 }
 
-func ParseFiles(ctx context.Context, stdio mainer.Stdio, parseMode parser.Mode, posMode token.PosMode, nodeFmt string, files ...string) error {
+func ParseFiles(ctx context.Context, stdio mainer.Stdio, parseMode parser.Mode, posMode token.PosMode, nodeFmt string, limits *token.SourceLimits, files ...string) error {
 	printer := ast.Printer{
 		Output:  stdio.Stdout,
 		Pos:     posMode,
 		NodeFmt: nodeFmt,
 	}
-	fs, chunks, perr := parser.ParseFiles(ctx, parseMode, files...)
+	fs, chunks, perr := parseSources(ctx, stdio, parseMode, limits, files...)
 	for _, ch := range chunks {
 		start, _ := ch.Span()
 		file := fs.File(start)
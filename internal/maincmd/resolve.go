@@ -20,24 +20,24 @@ func (c *Cmd) Resolve(ctx context.Context, stdio mainer.Stdio, args []string) er
 	}
 	var resolveMode resolver.Mode
 	resolveMode |= resolver.NameBlocks
-	return ResolveFiles(ctx, stdio, parseMode, resolveMode, token.PosLong, "", args...)
+	return ResolveFiles(ctx, stdio, parseMode, resolveMode, token.PosLong, "", c.sourceLimits(), args...)
 }
 
 func ResolveFiles(ctx context.Context, stdio mainer.Stdio, parseMode parser.Mode,
-	resolveMode resolver.Mode, posMode token.PosMode, nodeFmt string, files ...string) error {
+	resolveMode resolver.Mode, posMode token.PosMode, nodeFmt string, limits *token.SourceLimits, files ...string) error {
 	printer := ast.Printer{
 		Output:  stdio.Stdout,
 		Pos:     posMode,
 		NodeFmt: nodeFmt,
 	}
-	fs, chunks, perr := parser.ParseFiles(ctx, parseMode, files...)
+	fs, chunks, perr := parseSources(ctx, stdio, parseMode, limits, files...)
 	if perr != nil {
 		// cannot resolve AST if parsing has errors
 		scanner.PrintError(stdio.Stderr, perr)
 		return perr
 	}
 
-	rerr := resolver.ResolveFiles(ctx, fs, chunks, resolveMode, nil, machine.IsUniverse)
+	rerr := resolver.ResolveFiles(ctx, fs, chunks, resolveMode, limits, nil, machine.IsUniverse)
 	for _, ch := range chunks {
 		start, _ := ch.Span()
 		file := fs.File(start)
@@ -0,0 +1,94 @@
+package maincmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mna/mainer"
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/compiler"
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/resolver"
+	"github.com/mna/nenuphar/lang/scanner"
+	"github.com/mna/nenuphar/lang/token"
+)
+
+func (c *Cmd) Run(ctx context.Context, stdio mainer.Stdio, args []string) error {
+	file := "-"
+	if len(args) > 0 {
+		file = args[0]
+	}
+	return RunFile(ctx, stdio, file, c.progArgs...)
+}
+
+// RunFile compiles the source file, or decodes it if it is an encoded
+// program, and runs it on a new thread that uses stdio for its standard I/O.
+// If file is "-", the source code or encoded program is read from stdin
+// instead. The program arguments are available to the program as the
+// predeclared args tuple of strings.
+func RunFile(ctx context.Context, stdio mainer.Stdio, file string, progArgs ...string) error {
+	var b []byte
+	var err error
+	if file == "-" {
+		file = stdinName
+		b, err = io.ReadAll(stdio.Stdin)
+	} else {
+		b, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return printError(stdio, err)
+	}
+
+	vargs := make([]machine.Value, len(progArgs))
+	for i, arg := range progArgs {
+		vargs[i] = machine.String(arg)
+	}
+	predeclared := map[string]machine.Value{"args": machine.NewTuple(vargs)}
+
+	var prog *compiler.Program
+	if compiler.IsEncodedProgram(b) {
+		if prog, err = decodeProgram(file, b); err != nil {
+			return printError(stdio, err)
+		}
+	} else {
+		fs := token.NewFileSet()
+		ch, err := parser.ParseChunk(ctx, 0, fs, file, b)
+		if err != nil {
+			scanner.PrintError(stdio.Stderr, err)
+			return err
+		}
+		chunks := []*ast.Chunk{ch}
+		isPredeclared := func(name string) bool { _, ok := predeclared[name]; return ok }
+		if err := resolver.ResolveFiles(ctx, fs, chunks, 0, nil, isPredeclared, machine.IsUniverse); err != nil {
+			scanner.PrintError(stdio.Stderr, err)
+			return err
+		}
+		progs, err := compiler.CompileFiles(ctx, fs, chunks, 0, nil)
+		if err != nil {
+			return printError(stdio, err)
+		}
+		prog = progs[0]
+	}
+
+	th := &machine.Thread{
+		Name:        file,
+		Stdout:      stdio.Stdout,
+		Stderr:      stdio.Stderr,
+		Stdin:       stdio.Stdin,
+		Predeclared: predeclared,
+	}
+	if _, err := th.RunProgram(ctx, prog); err != nil {
+		var e *machine.Error
+		if errors.As(err, &e) {
+			if filename, pos := e.Position(); pos.Line > 0 {
+				err = fmt.Errorf("%s:%d:%d: %w", filename, pos.Line, pos.Col, err)
+			}
+		}
+		return printError(stdio, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package maincmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mna/mainer"
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/compiler"
+	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/resolver"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/require"
+)
+
+// runMain runs the command with the provided arguments and stdin in the dir
+// working directory, and returns its exit code, stdout and stderr.
+func runMain(dir, stdin string, args ...string) (mainer.ExitCode, string, string) {
+	var stdout, stderr bytes.Buffer
+	stdio := mainer.Stdio{Cwd: dir, Stdin: strings.NewReader(stdin), Stdout: &stdout, Stderr: &stderr}
+	c := Cmd{}
+	code := c.Main(append([]string{binName}, args...), stdio)
+	return code, stdout.String(), stderr.String()
+}
+
+// compileSource parses, resolves and compiles src, with any undefined
+// identifier resolved as universal.
+func compileSource(t *testing.T, filename, src string) *compiler.Program {
+	t.Helper()
+
+	ctx := context.Background()
+	fs := token.NewFileSet()
+	ch, err := parser.ParseChunk(ctx, 0, fs, filename, []byte(src))
+	require.NoError(t, err)
+	chunks := []*ast.Chunk{ch}
+	require.NoError(t, resolver.ResolveFiles(ctx, fs, chunks, 0, nil, nil, func(string) bool { return true }))
+	progs, err := compiler.CompileFiles(ctx, fs, chunks, 0, nil)
+	require.NoError(t, err)
+	return progs[0]
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+		return file
+	}
+
+	run := func(args ...string) (mainer.ExitCode, string, string) {
+		return runMain(dir, "", args...)
+	}
+
+	t.Run("print", func(t *testing.T) {
+		file := writeFile("print.nen", `
+fn fact(n)
+	if n <= 1 then return 1 end
+	return n * fact(n - 1)
+end
+print(fact(5))
+`)
+		code, stdout, stderr := run("run", file)
+		require.Equal(t, mainer.Success, code, stderr)
+		require.Equal(t, "120\n", stdout)
+	})
+
+	t.Run("program arguments", func(t *testing.T) {
+		file := writeFile("args.nen", `print(args[0] == "a", args[1] == "--b")`)
+		code, stdout, stderr := run("run", file, "--", "a", "--b")
+		require.Equal(t, mainer.Success, code, stderr)
+		require.Equal(t, "true true\n", stdout)
+	})
+
+	t.Run("encoded program", func(t *testing.T) {
+		prog := compileSource(t, "prog.nen", `print(1 + 2)`)
+		file := writeFile("prog.nenc", string(prog.Encode()))
+
+		code, stdout, stderr := run("run", file)
+		require.Equal(t, mainer.Success, code, stderr)
+		require.Equal(t, "3\n", stdout)
+	})
+
+	t.Run("corrupted encoded program", func(t *testing.T) {
+		prog := compileSource(t, "prog.nen", `print(1 + 2)`)
+		prog.Constants = nil
+		file := writeFile("corrupted.nenc", string(prog.Encode()))
+
+		code, stdout, stderr := run("run", file)
+		require.Equal(t, mainer.Failure, code)
+		require.Empty(t, stdout)
+		require.Contains(t, stderr, "corrupted.nenc: function prog.nen (#0): pc 2: constant: constant index 0 out of range")
+	})
+
+	t.Run("runtime error", func(t *testing.T) {
+		file := writeFile("error.nen", "let x = 1\nprint(x // 0)\n")
+		code, stdout, stderr := run("run", file)
+		require.Equal(t, mainer.Failure, code)
+		require.Empty(t, stdout)
+		require.Contains(t, stderr, "error.nen:2:9: floored division by zero")
+	})
+
+	t.Run("resolve error", func(t *testing.T) {
+		file := writeFile("undefined.nen", "print(x)\n")
+		code, _, stderr := run("run", file)
+		require.Equal(t, mainer.Failure, code)
+		require.Contains(t, stderr, "undefined.nen:1:7: undefined: x")
+	})
+
+	t.Run("invalid arguments", func(t *testing.T) {
+		code, _, stderr := run("run", "a.nen", "b.nen")
+		require.Equal(t, mainer.InvalidArgs, code)
+		require.Contains(t, stderr, "run: at most one file can be provided")
+
+		code, _, stderr = run("parse", "x.nen", "--", "a")
+		require.Equal(t, mainer.InvalidArgs, code)
+		require.Contains(t, stderr, "parse: invalid program arguments")
+	})
+}
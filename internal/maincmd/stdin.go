@@ -0,0 +1,76 @@
+package maincmd
+
+import (
+	"context"
+	"io"
+
+	"github.com/mna/mainer"
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/scanner"
+	"github.com/mna/nenuphar/lang/token"
+)
+
+// stdinName is the file name of the source code read from stdin, used to
+// report positions.
+const stdinName = "<stdin>"
+
+// isStdin returns true if the source code must be read from stdin instead of
+// files, which is the case if no file is provided or if the single file is
+// "-".
+func isStdin(files []string) bool {
+	return len(files) == 0 || len(files) == 1 && files[0] == "-"
+}
+
+// readStdin reads the source code from stdio.Stdin. It fails if it exceeds
+// the bytes limit. The error, if non-nil, is guaranteed to be a
+// scanner.ErrorList.
+func readStdin(stdio mainer.Stdio, limits *token.SourceLimits) ([]byte, error) {
+	r := stdio.Stdin
+	if limits != nil && limits.MaxBytes > 0 {
+		// no need to read more than one byte past the limit to detect it
+		r = io.LimitReader(r, int64(limits.MaxBytes)+1)
+	}
+	b, err := io.ReadAll(r)
+	if err == nil {
+		err = limits.Check(1, len(b))
+	}
+	if err != nil {
+		var el scanner.ErrorList
+		el.Add(token.Position{Filename: stdinName}, err.Error())
+		return nil, el.Err()
+	}
+	return b, nil
+}
+
+// scanSources is like scanner.ScanFiles, except that it tokenizes the source
+// code read from stdin if isStdin(files) is true.
+func scanSources(ctx context.Context, stdio mainer.Stdio, limits *token.SourceLimits, files ...string) (*token.FileSet, [][]scanner.TokenAndValue, error) {
+	if !isStdin(files) {
+		return scanner.ScanFiles(ctx, limits, files...)
+	}
+
+	fs := token.NewFileSet()
+	b, err := readStdin(stdio, limits)
+	if err != nil {
+		return fs, nil, err
+	}
+	toks, err := scanner.ScanChunk(ctx, fs, stdinName, b)
+	return fs, [][]scanner.TokenAndValue{toks}, err
+}
+
+// parseSources is like parser.ParseFiles, except that it parses the source
+// code read from stdin if isStdin(files) is true.
+func parseSources(ctx context.Context, stdio mainer.Stdio, mode parser.Mode, limits *token.SourceLimits, files ...string) (*token.FileSet, []*ast.Chunk, error) {
+	if !isStdin(files) {
+		return parser.ParseFiles(ctx, mode, limits, files...)
+	}
+
+	fs := token.NewFileSet()
+	b, err := readStdin(stdio, limits)
+	if err != nil {
+		return fs, nil, err
+	}
+	ch, err := parser.ParseChunk(ctx, mode, fs, stdinName, b)
+	return fs, []*ast.Chunk{ch}, err
+}
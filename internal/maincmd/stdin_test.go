@@ -0,0 +1,42 @@
+package maincmd
+
+import (
+	"testing"
+
+	"github.com/mna/mainer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStdin(t *testing.T) {
+	dir := t.TempDir()
+
+	cases := []struct {
+		desc   string
+		stdin  string
+		args   []string
+		code   mainer.ExitCode
+		stdout string // expected to be contained in stdout
+		stderr string // expected to be contained in stderr
+	}{
+		{"tokenize dash", "let x", []string{"tokenize", "-"}, mainer.Success, "<stdin>:1:1: let", ""},
+		{"tokenize no path", "let x", []string{"tokenize"}, mainer.Success, "<stdin>:1:5: identifier x", ""},
+		{"tokenize error", "let $", []string{"tokenize"}, mainer.Failure, "", "<stdin>:1:5: "},
+		{"parse", "return 1", []string{"parse", "-"}, mainer.Success, "chunk <stdin>", ""},
+		{"parse error", "return )", []string{"parse"}, mainer.Failure, "", "<stdin>:1:8: "},
+		{"resolve", "let x = 1\nreturn x", []string{"resolve"}, mainer.Success, "[<stdin>:2:8::2:9] x | -> let", ""},
+		{"resolve error", "return x", []string{"resolve", "-"}, mainer.Failure, "", "<stdin>:1:8: undefined: x"},
+		{"run", "print(6 * 7)", []string{"run", "-"}, mainer.Success, "42\n", ""},
+		{"run no path", "print(args[0] == 'a')", []string{"run", "--", "a"}, mainer.Success, "true\n", ""},
+		{"run error", "let x = 1\nx = x // 0", []string{"run"}, mainer.Failure, "", "<stdin>:2:7: floored division by zero"},
+		{"bytes limit", "return 1234", []string{"parse", "--max-bytes", "5"}, mainer.Failure, "", "<stdin>: source bytes limit exceeded: 6 (max 5)"},
+		{"dash with files", "", []string{"parse", "-", "x.nen"}, mainer.InvalidArgs, "", "parse: stdin ('-') cannot be combined with other files"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			code, stdout, stderr := runMain(dir, c.stdin, c.args...)
+			require.Equal(t, c.code, code, stderr)
+			require.Contains(t, stdout, c.stdout)
+			require.Contains(t, stderr, c.stderr)
+		})
+	}
+}
@@ -10,11 +10,11 @@ import (
 )
 
 func (c *Cmd) Tokenize(ctx context.Context, stdio mainer.Stdio, args []string) error {
-	return TokenizeFiles(ctx, stdio, token.PosLong, args...)
+	return TokenizeFiles(ctx, stdio, token.PosLong, c.sourceLimits(), args...)
 }
 
-func TokenizeFiles(ctx context.Context, stdio mainer.Stdio, posMode token.PosMode, files ...string) error {
-	fs, toksByFile, err := scanner.ScanFiles(ctx, files...)
+func TokenizeFiles(ctx context.Context, stdio mainer.Stdio, posMode token.PosMode, limits *token.SourceLimits, files ...string) error {
+	fs, toksByFile, err := scanSources(ctx, stdio, limits, files...)
 	for _, toks := range toksByFile {
 		for _, tok := range toks {
 			fmt.Fprintf(stdio.Stdout, "%s: %s", token.FormatPos(posMode, fs.File(tok.Value.Pos), tok.Value.Pos, true), tok.Token)
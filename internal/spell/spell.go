@@ -0,0 +1,95 @@
+// Package spell implements a simple spelling suggestion for identifiers,
+// adapted from the Starlark source code:
+// https://github.com/google/starlark-go/tree/ee8ed142361c69d52fe8e9fb5e311d2a0a7c02de
+//
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package spell
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Nearest returns the element of candidates nearest to x using the
+// Levenshtein metric, or "" if none were promising. Case and underscores are
+// ignored when comparing names. If many candidates are at the same distance,
+// the first one is returned.
+func Nearest(x string, candidates []string) string {
+	fold := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r == '_' {
+				return -1
+			}
+			return unicode.ToLower(r)
+		}, s)
+	}
+
+	x = fold(x)
+
+	var best string
+	bestD := (len(x) + 1) / 2 // allow up to 50% typos
+	for _, c := range candidates {
+		d := levenshtein(x, fold(c), bestD)
+		if d < bestD {
+			bestD = d
+			best = c
+		}
+	}
+	return best
+}
+
+// levenshtein returns the non-negative Levenshtein edit distance between the
+// byte strings x and y. If the computed distance exceeds max, the function
+// may return early with an approximate value > max.
+func levenshtein(x, y string, max int) int {
+	// This implementation is derived from one by Laurent Le Brun in Bazel that
+	// uses the single-row space efficiency trick described at
+	// bitbucket.org/clearer/iosifovich.
+
+	// Let x be the shorter string.
+	if len(x) > len(y) {
+		x, y = y, x
+	}
+
+	// Remove common prefix.
+	var i int
+	for i < len(x) && x[i] == y[i] {
+		i++
+	}
+	x, y = x[i:], y[i:]
+	if x == "" {
+		return len(y)
+	}
+
+	if d := len(y) - len(x); d > max {
+		return d // excessive length divergence
+	}
+
+	row := make([]int, len(y)+1)
+	for i := range row {
+		row[i] = i
+	}
+
+	for i := 1; i <= len(x); i++ {
+		row[0] = i
+		best := i
+		prev := i - 1
+		for j := 1; j <= len(y); j++ {
+			a := prev // substitution
+			if x[i-1] != y[j-1] {
+				a++
+			}
+			b := 1 + row[j-1] // deletion
+			c := 1 + row[j]   // insertion
+			k := min(a, b, c)
+			prev, row[j] = row[j], k
+			best = min(best, k)
+		}
+		if best > max {
+			return best
+		}
+	}
+	return row[len(y)]
+}
@@ -0,0 +1,56 @@
+package spell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNearest(t *testing.T) {
+	candidates := []string{"counter", "total_value", "get", "Items", "as"}
+
+	cases := []struct {
+		x    string
+		want string
+	}{
+		{"countr", "counter"},
+		{"conuter", "counter"},
+		{"counterr", "counter"},
+		{"totalvalue", "total_value"},
+		{"TOTAL_VALUE", "total_value"},
+		{"items", "Items"},
+		{"gett", "get"},
+		{"counter", "counter"},
+		{"zzz", ""},
+		{"x", ""},
+		{"", ""},
+		{"abcdefghij", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.x, func(t *testing.T) {
+			require.Equal(t, c.want, Nearest(c.x, candidates))
+		})
+	}
+
+	require.Equal(t, "", Nearest("counter", nil))
+}
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		x, y string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "abc", 0},
+		{"abc", "abcd", 1},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+	}
+	for _, c := range cases {
+		t.Run(c.x+"/"+c.y, func(t *testing.T) {
+			require.Equal(t, c.want, levenshtein(c.x, c.y, 10))
+			require.Equal(t, c.want, levenshtein(c.y, c.x, 10))
+		})
+	}
+}
@@ -88,6 +88,12 @@ type (
 		End     token.Pos
 	}
 
+	NamedArg struct {
+		Name  *IdentExpr
+		Colon token.Pos
+		Value Expr
+	}
+
 	KeyVal struct {
 		Lbrack token.Pos // zero if not in brackets
 		Key    Expr      // *IdentExpr, *LiteralExpr or Expr inside brackets
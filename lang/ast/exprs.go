@@ -78,13 +78,14 @@ type (
 		Right Expr
 	}
 
-	// CallExpr represents a function call, e.g. x(y, z).
+	// CallExpr represents a function call, e.g. x(y, z) or x(y, name: z).
 	CallExpr struct {
 		Fn     Expr
 		Bang   token.Pos // 0 if no '!'
 		Lparen token.Pos // 0 if '!' or map/string single arg
 		Args   []Expr
-		Commas []token.Pos // len(Args)-1
+		Named  []*NamedArg // named arguments, always after the positional ones
+		Commas []token.Pos // len(Args)+len(Named)-1
 		Rparen token.Pos   // 0 if '!' or map/string single arg
 	}
 
@@ -93,6 +94,9 @@ type (
 		Class    token.Pos
 		Inherits *ClassInherit
 		Body     *ClassBody
+
+		// filled by the resolver
+		Function any // *resolver.Function of the class body, indirect to avoid cycles
 	}
 
 	// DotExpr represents a selector expression e.g. x.y.
@@ -130,12 +134,12 @@ type (
 		Rbrack token.Pos
 	}
 
-	// LiteralExpr represents a literal string, number, boolean or null.
+	// LiteralExpr represents a literal string, bytes, number, boolean or null.
 	LiteralExpr struct {
-		Type  token.Token // null, true, false, string, int or float
+		Type  token.Token // null, true, false, string, bytes, int or float
 		Start token.Pos
 		Raw   string      // uninterpreted text
-		Value interface{} // = string | int64 | float64 (nil for null/true/false)
+		Value interface{} // = string (also for bytes) | int64 | float64 (nil for null/true/false)
 	}
 
 	// MapExpr represents a map literal.
@@ -206,7 +210,11 @@ func (n *BinOpExpr) Walk(v Visitor) {
 func (n *BinOpExpr) expr() {}
 
 func (n *CallExpr) Format(f fmt.State, verb rune) {
-	format(f, verb, n, "call", map[string]int{"args": len(n.Args)})
+	counts := map[string]int{"args": len(n.Args)}
+	if len(n.Named) > 0 {
+		counts["named"] = len(n.Named)
+	}
+	format(f, verb, n, "call", counts)
 }
 func (n *CallExpr) Span() (start, end token.Pos) {
 	start, _ = n.Fn.Span()
@@ -224,6 +232,10 @@ func (n *CallExpr) Walk(v Visitor) {
 	for _, e := range n.Args {
 		Walk(v, e)
 	}
+	for _, arg := range n.Named {
+		Walk(v, arg.Name)
+		Walk(v, arg.Value)
+	}
 }
 func (n *CallExpr) expr() {}
 
@@ -25,6 +25,8 @@ type (
 		// Block is the block of statements contained in the chunk.
 		Block *Block
 		EOF   token.Pos // position of the EOF marker
+
+		Function any // *resolver.Function of the top-level, indirect to avoid cycles
 	}
 
 	// Comment represents a single comment, either short or long.
@@ -22,6 +22,16 @@ type Printer struct {
 	// supported (`-` only when a width is set, to pad with spaces on the right
 	// instead of the left). Defaults to `%v`.
 	NodeFmt string
+
+	// Width is the width of the node labels when NodeFmt is not set. If it is
+	// > 0, the labels are truncated or padded with spaces on the right to that
+	// width and followed by the node's counts, so that the counts are aligned
+	// (that is, NodeFmt defaults to `%#-<Width>v`).
+	Width int
+
+	// Indent is the string repeated once per depth level before each node.
+	// Defaults to ". ".
+	Indent string
 }
 
 // Print pretty-prints the AST node n from the specified file.
@@ -40,10 +50,17 @@ func (p *Printer) Print(n Node, file *token.File) error {
 		w:       p.Output,
 		pos:     p.Pos,
 		nodeFmt: p.NodeFmt,
+		indent:  p.Indent,
 		file:    file,
 	}
-	if p.NodeFmt == "" {
+	if pp.nodeFmt == "" {
 		pp.nodeFmt = "%v"
+		if p.Width > 0 {
+			pp.nodeFmt = fmt.Sprintf("%%#-%dv", p.Width)
+		}
+	}
+	if pp.indent == "" {
+		pp.indent = ". "
 	}
 
 	if ch, ok := n.(*Chunk); ok && len(ch.Comments) > 0 {
@@ -63,6 +80,7 @@ type printer struct {
 	w        io.Writer
 	pos      token.PosMode
 	nodeFmt  string
+	indent   string
 	comments map[Node][]*Comment
 	file     *token.File
 	depth    int
@@ -100,7 +118,7 @@ func (p *printer) printNode(n Node, indent int) {
 	}
 
 	format := "%s"
-	args := []interface{}{strings.Repeat(". ", indent)}
+	args := []interface{}{strings.Repeat(p.indent, indent)}
 	if p.pos != token.PosNone {
 		format += "[%s:%s] "
 		start, end := n.Span()
@@ -0,0 +1,56 @@
+package ast_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrinter(t *testing.T) {
+	const src = `
+fn add(a, b)
+	return a + b
+end
+`
+	fset := token.NewFileSet()
+	ch, err := parser.ParseChunk(context.Background(), 0, fset, "test", []byte(src))
+	require.NoError(t, err)
+
+	t.Run("default", func(t *testing.T) {
+		var buf strings.Builder
+		p := ast.Printer{Output: &buf}
+		require.NoError(t, p.Print(ch, nil))
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		require.Equal(t, "chunk test", lines[0])
+		require.Equal(t, ". block", lines[1])
+		require.Equal(t, ". . fn decl", lines[2])
+		require.Equal(t, ". . . add", lines[3])
+		require.Equal(t, ". . . . return", lines[7])
+		require.Equal(t, ". . . . . binary '+'", lines[8])
+	})
+
+	t.Run("width and indent", func(t *testing.T) {
+		var buf strings.Builder
+		p := ast.Printer{Output: &buf, Width: 8, Indent: "  "}
+		require.NoError(t, p.Print(ch, nil))
+
+		lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+		require.Equal(t, "chunk te", lines[0])
+		require.Equal(t, "  block    {stmts=1}", lines[1])
+		require.Equal(t, "    fn decl  {params=2}", lines[2])
+		require.Equal(t, "        return   {expr=1}", lines[7])
+		require.Equal(t, "          binary '", lines[8])
+		for _, l := range lines {
+			label := strings.TrimLeft(l, " ")
+			indent := len(l) - len(label)
+			require.Zero(t, indent%2, l)
+			require.GreaterOrEqual(t, len(label), 8, l)
+		}
+	})
+}
@@ -33,6 +33,9 @@ type (
 		Name     *IdentExpr
 		Inherits *ClassInherit
 		Body     *ClassBody
+
+		// filled by the resolver
+		Function any // *resolver.Function of the class body, indirect to avoid cycles
 	}
 
 	// ExprStmt represents an expression used as statement, which is only valid
@@ -110,6 +113,11 @@ type (
 		Next Stmt
 	}
 
+	// PassStmt represents a pass statement, an explicit no-op.
+	PassStmt struct {
+		Start token.Pos
+	}
+
 	// ReturnLikeStmt represents a return, break, continue, goto or throw.
 	ReturnLikeStmt struct {
 		Type  token.Token // return, break, continue, goto, throw
@@ -332,6 +340,14 @@ func (n *LabelStmt) Walk(v Visitor) {
 func (n *LabelStmt) BlockEnding() bool { return false }
 func (n *LabelStmt) IsLoop() bool      { return false }
 
+func (n *PassStmt) Format(f fmt.State, verb rune) { format(f, verb, n, "pass", nil) }
+func (n *PassStmt) Span() (start, end token.Pos) {
+	return n.Start, n.Start + token.Pos(len(token.PASS.String()))
+}
+func (n *PassStmt) Walk(v Visitor)    {}
+func (n *PassStmt) BlockEnding() bool { return false }
+func (n *PassStmt) IsLoop() bool      { return false }
+
 func (n *ReturnLikeStmt) Format(f fmt.State, verb rune) {
 	var exprCount int
 	if n.Expr != nil {
@@ -14,8 +14,8 @@ package compiler
 //
 //// This asm file implements a human-readable/writable form of a compiled
 //// program. This is mostly to support testing of the VM without going through
-//// the parsing and name resolution phases of a higher-level language. A
-//// disassembler is also implemented.
+//// the parsing and name resolution phases of a higher-level language. The
+//// disassembler is implemented by Dasm.
 ////
 //// The assembly format looks like this (indentation and spacing is arbitrary,
 //// but order of sections is important):
@@ -448,204 +448,3 @@ package compiler
 //	a.err = a.s.Err()
 //	return nil
 //}
-//
-//// Dasm writes a compiled program to its assembler textual format.
-//func Dasm(p *Program) ([]byte, error) {
-//	d := dasm{p: p, buf: new(bytes.Buffer)}
-//	d.program()
-//	d.write("\n")
-//
-//	if d.p.Toplevel == nil {
-//		d.err = errors.New("missing top-level function")
-//	}
-//	if d.err == nil {
-//		d.function(p.Toplevel)
-//		for _, fn := range p.Functions {
-//			d.write("\n")
-//			d.function(fn)
-//		}
-//	}
-//
-//	return d.buf.Bytes(), d.err
-//}
-//
-//type dasm struct {
-//	p   *Program
-//	buf *bytes.Buffer
-//	err error
-//}
-//
-//func (d *dasm) function(fn *Funcode) {
-//	if d.err != nil {
-//		return
-//	}
-//
-//	d.writef("function: %s %d %d", fn.Name, fn.MaxStack, fn.NumParams)
-//	if fn.HasVarargs {
-//		d.write(" +varargs")
-//	}
-//	d.write("\n")
-//
-//	if len(fn.Locals) > 0 {
-//		d.write("\tlocals:\n")
-//		for i, l := range fn.Locals {
-//			d.writef("\t\t%s\t# %03d\n", l.Name, i)
-//		}
-//	}
-//	if len(fn.Cells) > 0 {
-//		d.write("\tcells:\n")
-//		for i, c := range fn.Cells {
-//			d.writef("\t\t%s\t# %03d\n", fn.Locals[c].Name, i)
-//		}
-//	}
-//	if len(fn.Freevars) > 0 {
-//		d.write("\tfreevars:\n")
-//		for i, f := range fn.Freevars {
-//			d.writef("\t\t%s\t# %03d\n", f.Name, i)
-//		}
-//	}
-//
-//	// decode all instructions to translate addresses to index
-//	var insns []insn
-//	addrToIndex := make([]int, len(fn.Code))
-//	// initialize to -1 to identify invalid jumps
-//	for i := range addrToIndex {
-//		addrToIndex[i] = -1
-//	}
-//	var addr int
-//	for addr < len(fn.Code) {
-//		op := Opcode(fn.Code[addr])
-//		sz := 1
-//
-//		var arg uint32
-//		if op >= OpcodeArgMin {
-//			v, n := binary.Uvarint(fn.Code[addr+1:])
-//			if n <= 0 || v > math.MaxUint32 {
-//				d.err = fmt.Errorf("invalid uvarint argument in function %s code at index %d (%s)", fn.Name, addr, op)
-//				return
-//			}
-//			arg = uint32(v)
-//
-//			if isJump(op) && n < 4 {
-//				n = 4
-//			}
-//			sz += n
-//		}
-//
-//		addrToIndex[addr] = len(insns)
-//		insns = append(insns, insn{op: op, arg: arg})
-//		addr += sz
-//	}
-//
-//	if len(fn.Defers) > 0 {
-//		d.write("\tdefers:\n")
-//		for i, df := range fn.Defers {
-//			if err := translateDefer(addrToIndex, &df, "defer", fn.Name, i); err != nil { //nolint:gosec
-//				d.err = err
-//				return
-//			}
-//			d.writef("\t\t%03d %03d %03d\t# %03d\n", df.PC0, df.PC1, df.StartPC, i)
-//		}
-//	}
-//
-//	if len(fn.Catches) > 0 {
-//		d.write("\tcatches:\n")
-//		for i, c := range fn.Catches {
-//			if err := translateDefer(addrToIndex, &c, "catch", fn.Name, i); err != nil { //nolint:gosec
-//				d.err = err
-//				return
-//			}
-//			d.writef("\t\t%03d %03d %03d\t# %03d\n", c.PC0, c.PC1, c.StartPC, i)
-//		}
-//	}
-//
-//	if len(insns) > 0 {
-//		d.write("\tcode:\n")
-//		for i, insn := range insns {
-//			op, arg := insn.op, insn.arg
-//			if op >= OpcodeArgMin {
-//				if isJump(op) {
-//					if addrToIndex[arg] == -1 {
-//						d.err = fmt.Errorf("invalid jump address %d in function %s, instruction %d (%s)", arg, fn.Name, i, op)
-//						return
-//					}
-//					arg = uint32(addrToIndex[arg])
-//				}
-//				d.writef("\t\t%s %03d\t# %03d\n", op, arg, i)
-//			} else {
-//				d.writef("\t\t%s\t# %03d\n", op, i)
-//			}
-//		}
-//	}
-//}
-//
-//func translateDefer(addrToIndex []int, defr *Defer, label, fnName string, i int) error {
-//	if defr.PC0 >= uint32(len(addrToIndex)) {
-//		return fmt.Errorf("invalid %s.pc0 address in function %s, %s %d", label, fnName, label, i)
-//	}
-//	if defr.PC1 >= uint32(len(addrToIndex)) {
-//		return fmt.Errorf("invalid %s.pc1 address in function %s, %s %d", label, fnName, label, i)
-//	}
-//	if defr.StartPC >= uint32(len(addrToIndex)) {
-//		return fmt.Errorf("invalid %s.startpc address in function %s, %s %d", label, fnName, label, i)
-//	}
-//
-//	pc0, pc1, spc := addrToIndex[defr.PC0], addrToIndex[defr.PC1], addrToIndex[defr.StartPC]
-//	if pc0 < 0 {
-//		return fmt.Errorf("invalid %s.pc0 address in function %s, %s %d", label, fnName, label, i)
-//	}
-//	if pc1 < 0 {
-//		return fmt.Errorf("invalid %s.pc1 address in function %s, %s %d", label, fnName, label, i)
-//	}
-//	if spc < 0 {
-//		return fmt.Errorf("invalid %s.startpc address in function %s, %s %d", label, fnName, label, i)
-//	}
-//
-//	defr.PC0, defr.PC1, defr.StartPC = uint32(pc0), uint32(pc1), uint32(spc)
-//	return nil
-//}
-//
-//func (d *dasm) program() {
-//	d.write("program:")
-//	d.write("\n")
-//
-//	if len(d.p.Loads) > 0 {
-//		d.write("\tloads:\n")
-//		for i, l := range d.p.Loads {
-//			d.writef("\t\t%s\t# %03d\n", l.Name, i)
-//		}
-//	}
-//	if len(d.p.Names) > 0 {
-//		d.write("\tnames:\n")
-//		for i, n := range d.p.Names {
-//			d.writef("\t\t%s\t# %03d\n", n, i)
-//		}
-//	}
-//	if len(d.p.Constants) > 0 {
-//		d.write("\tconstants:\n")
-//		for i, c := range d.p.Constants {
-//			switch c := c.(type) {
-//			case string:
-//				d.writef("\t\tstring\t%q\t# %03d\n", c, i)
-//			case int64:
-//				d.writef("\t\tint\t%d\t# %03d\n", c, i)
-//			case float64:
-//				d.writef("\t\tfloat\t%g\t# %03d\n", c, i)
-//			default:
-//				d.err = fmt.Errorf("unsupported constant type: %T", c)
-//				return
-//			}
-//		}
-//	}
-//}
-//
-//func (d *dasm) writef(s string, args ...any) {
-//	d.write(fmt.Sprintf(s, args...))
-//}
-//
-//func (d *dasm) write(s string) {
-//	if d.err != nil {
-//		return
-//	}
-//	_, d.err = d.buf.WriteString(s)
-//}
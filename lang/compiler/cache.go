@@ -0,0 +1,118 @@
+package compiler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/token"
+)
+
+// cacheExt is the file extension of the compiled programs stored in a cache
+// directory by CompileCached.
+const cacheExt = ".nenc"
+
+// CompileCached is like CompileFiles, but it first looks for each chunk's
+// compiled Program in cacheDir and only compiles the chunks that are not
+// found there, storing the resulting program in cacheDir for subsequent
+// calls.
+//
+// A chunk's cache entry is keyed by the hash of its source file's content,
+// read from the file's name in fset, along with its filename, the
+// compilation mode, the limits and the bytecode Version, so that any change
+// to one of those results in a cache miss. A chunk that does not correspond
+// to a readable file of the same size (e.g. one parsed from an in-memory
+// source) is always compiled. A cache entry that cannot be decoded or that
+// fails Verify is ignored and overwritten.
+//
+// The cacheDir directory must exist. An error is returned if a compiled
+// program cannot be stored in it.
+func CompileCached(ctx context.Context, fset *token.FileSet, chunks []*ast.Chunk, mode Mode, limits *Limits, cacheDir string) ([]*Program, error) {
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+
+	lim := limits.orDefault()
+	if err := lim.checkSource(fset, chunks); err != nil {
+		return nil, err
+	}
+	progs := make([]*Program, len(chunks))
+	for i, ch := range chunks {
+		start, _ := ch.Span()
+		file := fset.File(start)
+
+		var cacheFile string
+		if key, ok := cacheKey(file, mode, lim); ok {
+			cacheFile = filepath.Join(cacheDir, key+cacheExt)
+			if b, err := os.ReadFile(cacheFile); err == nil {
+				if prog, err := DecodeProgram(b); err == nil && Verify(prog) == nil {
+					progs[i] = prog
+					continue
+				}
+			}
+		}
+
+		res, err := CompileFiles(ctx, fset, []*ast.Chunk{ch}, mode, limits)
+		if err != nil {
+			return nil, err
+		}
+		progs[i] = res[0]
+
+		if cacheFile != "" {
+			if err := writeCacheFile(cacheFile, res[0].Encode()); err != nil {
+				return nil, fmt.Errorf("%s: %w", file.Name(), err)
+			}
+		}
+	}
+	return progs, nil
+}
+
+// cacheKey returns the hex-encoded cache key of the file compiled with mode
+// and limits. It returns false if the source of the file cannot be read.
+func cacheKey(file *token.File, mode Mode, lim Limits) (string, bool) {
+	src, err := os.ReadFile(file.Name())
+	if err != nil || len(src) != file.Size() {
+		return "", false
+	}
+
+	h := sha256.New()
+	var buf []byte
+	buf = binary.AppendUvarint(buf, Version)
+	buf = binary.AppendUvarint(buf, uint64(mode))
+	buf = binary.AppendUvarint(buf, uint64(lim.MaxConstants))
+	buf = binary.AppendUvarint(buf, uint64(lim.MaxNames))
+	buf = binary.AppendUvarint(buf, uint64(lim.MaxFunctions))
+	buf = binary.AppendUvarint(buf, uint64(len(file.Name())))
+	buf = append(buf, file.Name()...)
+	h.Write(buf)
+	h.Write(src)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// writeCacheFile atomically writes b to the cache file name, so that a
+// concurrent reader never sees a partially written program.
+func writeCacheFile(name string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "*"+cacheExt+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package compiler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/resolver"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileCached(t *testing.T) {
+	srcDir, cacheDir := t.TempDir(), t.TempDir()
+	file := filepath.Join(srcDir, "test.nen")
+
+	compile := func(t *testing.T, mode Mode) *Program {
+		t.Helper()
+		ctx := context.Background()
+		fset, chunks, err := parser.ParseFiles(ctx, 0, nil, file)
+		require.NoError(t, err)
+		err = resolver.ResolveFiles(ctx, fset, chunks, 0, nil, func(string) bool { return true }, nil)
+		require.NoError(t, err)
+		progs, err := CompileCached(ctx, fset, chunks, mode, nil, cacheDir)
+		require.NoError(t, err)
+		require.Len(t, progs, 1)
+		return progs[0]
+	}
+	cacheEntries := func(t *testing.T) []string {
+		t.Helper()
+		names, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+		require.NoError(t, err)
+		return names
+	}
+
+	require.NoError(t, os.WriteFile(file, []byte(`return 1`), 0o600))
+	first := compile(t, 0)
+	entries := cacheEntries(t)
+	require.Len(t, entries, 1)
+	require.Equal(t, cacheExt, filepath.Ext(entries[0]))
+
+	// replace the cached program with a different one, an unchanged source must
+	// return it without recompiling.
+	planted := compileProgram(t, `return 2`)
+	planted.Filename = file
+	require.NoError(t, os.WriteFile(entries[0], planted.Encode(), 0o600))
+
+	hit := compile(t, 0)
+	require.Equal(t, planted.Constants, hit.Constants)
+	require.NotEqual(t, first.Constants, hit.Constants)
+	require.Len(t, cacheEntries(t), 1)
+
+	// a different mode misses the cache
+	compile(t, CompactJumps)
+	require.Len(t, cacheEntries(t), 2)
+
+	// editing the source misses the cache
+	require.NoError(t, os.WriteFile(file, []byte(`return 3`), 0o600))
+	miss := compile(t, 0)
+	require.Equal(t, []interface{}{int64(3)}, miss.Constants)
+	require.Len(t, cacheEntries(t), 3)
+
+	// an invalid cache entry is ignored and overwritten
+	entries = cacheEntries(t)
+	for _, e := range entries {
+		require.NoError(t, os.WriteFile(e, []byte("invalid"), 0o600))
+	}
+	got := compile(t, 0)
+	require.Equal(t, []interface{}{int64(3)}, got.Constants)
+	require.Len(t, cacheEntries(t), 3)
+	got = compile(t, 0)
+	require.Equal(t, []interface{}{int64(3)}, got.Constants)
+
+	// a cache entry that decodes but fails verification is ignored too
+	corrupted := compileProgram(t, `return 4`)
+	corrupted.Filename = file
+	corrupted.Constants = nil
+	for _, e := range entries {
+		require.NoError(t, os.WriteFile(e, corrupted.Encode(), 0o600))
+	}
+	got = compile(t, 0)
+	require.Equal(t, []interface{}{int64(3)}, got.Constants)
+}
+
+func TestCompileCachedInMemory(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	ctx := context.Background()
+	fset := token.NewFileSet()
+	ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(`return 1`))
+	require.NoError(t, err)
+	chunks := []*ast.Chunk{ch}
+	err = resolver.ResolveFiles(ctx, fset, chunks, 0, nil, func(string) bool { return true }, nil)
+	require.NoError(t, err)
+
+	progs, err := CompileCached(ctx, fset, chunks, 0, nil, cacheDir)
+	require.NoError(t, err)
+	require.Len(t, progs, 1)
+	require.Equal(t, []interface{}{int64(1)}, progs[0].Constants)
+
+	des, err := os.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.Empty(t, des)
+}
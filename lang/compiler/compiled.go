@@ -1,7 +1,9 @@
 package compiler
 
 import (
+	"fmt"
 	"go/token"
+	"strings"
 	"sync"
 )
 
@@ -19,30 +21,63 @@ func positionFromTokenPos(file *token.File, p token.Pos) Position {
 }
 
 // A Program is a source code file compiled in executable form. Programs are
-// serialized by the CompileFiles function, which must be updated whenever this
+// serialized by the Program.Encode method, which must be updated whenever this
 // declaration is changed.
 type Program struct {
 	Filename  string
 	Names     []string      // names of attributes and predeclared variables
-	Constants []interface{} // = string | int64 | float64
+	Constants []interface{} // = string | int64 | float64 | Bytes | Tuple
 	Functions []*Funcode    // funcode at index 0 is the top-level
 }
 
+// Bytes is a constant bytes value, compiled from a bytes literal.
+type Bytes string
+
+// Tuple is a constant tuple, compiled from a tuple or array literal whose
+// items are all constants. Its elements are nil, bool, int64, float64,
+// string, Bytes or Tuple values.
+type Tuple []interface{}
+
+// key returns a comparable value that uniquely identifies the tuple's
+// elements, so that identical tuples share the same constant.
+func (t Tuple) key() tupleKey {
+	var buf strings.Builder
+	buf.WriteByte('(')
+	for _, v := range t {
+		if tt, ok := v.(Tuple); ok {
+			buf.WriteString(string(tt.key()))
+		} else {
+			fmt.Fprintf(&buf, "%T:%#v", v, v)
+		}
+		buf.WriteByte(',')
+	}
+	buf.WriteByte(')')
+	return tupleKey(buf.String())
+}
+
+type tupleKey string
+
 // A Funcode is the code of a compiled function. Funcodes are serialized by the
-// pcomp.function method, which must be updated whenever this declaration is
+// encoder.function method, which must be updated whenever this declaration is
 // changed.
 type Funcode struct {
-	Prog      *Program
-	Name      string    // name of this function
-	Code      []byte    // the byte code
-	Locals    []Binding // locals, parameters first
-	Cells     []int     // indices of Locals that require cells
-	Freevars  []Binding // for tracing
-	Defers    []Defer   // defer blocks, nested ones must come after the more general ones
-	Catches   []Defer   // catch blocks, nested ones must come after the more general ones
-	MaxStack  int
-	NumParams int // includes the catchall vararg, if any
-	HasVarArg bool
+	Prog        *Program
+	Name        string    // name of this function
+	Code        []byte    // the byte code
+	Locals      []Binding // locals, parameters first
+	Cells       []int     // indices of Locals that require cells
+	Freevars    []Binding // for tracing
+	Defers      []Defer   // defer blocks, nested ones must come after the more general ones
+	Catches     []Defer   // catch blocks, nested ones must come after the more general ones
+	MaxStack    int
+	MaxDeferred int // maximum depth of the stack of running defer and catch blocks
+	NumParams   int // includes the catchall vararg, if any
+	HasVarArg   bool
+	Pure        bool // no side effects, as conservatively determined by the compiler
+
+	// CompactJumps is true if the jump arguments are not padded to 4 bytes, see
+	// the CompactJumps compiler mode.
+	CompactJumps bool
 
 	pos       Position // position of fn token
 	pclinetab []uint16 // mapping from pc to linenum
@@ -51,6 +86,8 @@ type Funcode struct {
 
 	lntOnce sync.Once
 	lnt     []pclinecol // decoded line number table
+	dixOnce sync.Once
+	dix     *deferIndex // index of Defers and Catches, see Deferred and Covered
 }
 
 type pclinecol struct {
@@ -141,8 +178,53 @@ type Binding struct {
 type Defer struct {
 	PC0, PC1 uint32 // start and end of protected instructions (inclusive), precondition: PC0 <= PC1
 	StartPC  uint32 // start of the defer/catch instructions
+	Stack    uint32 // depth of the operand stack at StartPC
+	Iters    uint32 // depth of the iterator stack at StartPC
 }
 
 func (c Defer) Covers(pc int64) bool {
 	return int64(c.PC0) <= pc && pc <= int64(c.PC1)
 }
+
+// An Instruction is a decoded instruction of a Funcode's byte code.
+type Instruction struct {
+	PC  uint32 // address of the instruction in Funcode.Code
+	Op  Opcode
+	Arg uint32 // argument of the opcode, only meaningful if Op >= OpcodeArgMin
+}
+
+func (insn Instruction) String() string {
+	if insn.Op >= OpcodeArgMin {
+		return fmt.Sprintf("%d\t%s %d", insn.PC, insn.Op, insn.Arg)
+	}
+	return fmt.Sprintf("%d\t%s", insn.PC, insn.Op)
+}
+
+// Instructions decodes the byte code of the function and returns the list of
+// its instructions, in order. The NOPs used to pad jump arguments (unless
+// fn.CompactJumps is set) are not included as they are part of the jump
+// instruction's encoding.
+func (fn *Funcode) Instructions() []Instruction {
+	var insns []Instruction
+	code := fn.Code
+	for pc := uint32(0); pc < uint32(len(code)); {
+		insn := Instruction{PC: pc, Op: Opcode(code[pc])}
+		pc++
+		if insn.Op >= OpcodeArgMin {
+			start := pc
+			for s := uint(0); pc < uint32(len(code)); s += 7 {
+				b := code[pc]
+				pc++
+				insn.Arg |= uint32(b&0x7f) << s
+				if b < 0x80 {
+					break
+				}
+			}
+			if isJump(insn.Op) && !fn.CompactJumps && pc < start+4 {
+				pc = start + 4
+			}
+		}
+		insns = append(insns, insn)
+	}
+	return insns
+}
@@ -13,28 +13,123 @@ package compiler
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"os"
+	"slices"
+	"sort"
 
 	"github.com/mna/nenuphar/lang/ast"
 	"github.com/mna/nenuphar/lang/resolver"
 	"github.com/mna/nenuphar/lang/token"
 )
 
+// Mode is a set of bit flags that configures the compilation. By default
+// (0), jump arguments are padded to a fixed size.
+type Mode uint
+
+// List of supported compiler modes, which can be combined with bitwise or.
+const (
+	// CompactJumps encodes jump arguments on as few bytes as possible instead
+	// of padding them with NOPs, which results in smaller and faster code at
+	// the cost of a longer compilation.
+	CompactJumps Mode = 1 << iota
+
+	// Optimize runs a peephole optimization pass that removes redundant
+	// instructions from the generated code, without altering its behavior
+	// nor the source position of the instructions that can fail. It also
+	// folds the operations on number and string literals that cannot fail
+	// into a single constant, and compiles a for..in loop over a call to the
+	// range built-in to a loop that does not allocate an iterator.
+	Optimize
+)
+
+// Limits defines the maximum number of entries in the pools of a compiled
+// Program. A zero value for a field means that the maximum supported by the
+// bytecode encoding is used (math.MaxUint32).
+//
+// It also defines the limits on the chunks compiled by a single call to
+// CompileFiles or CompileCached, where the zero value means no limit.
+type Limits struct {
+	MaxConstants uint32
+	MaxNames     uint32
+	MaxFunctions uint32
+	Source       token.SourceLimits
+}
+
+// List of errors returned when a pool limit is exceeded, or when a jump
+// address cannot be encoded.
+var (
+	ErrConstantPoolLimit = errors.New("constant pool limit exceeded")
+	ErrNamePoolLimit     = errors.New("name pool limit exceeded")
+	ErrFunctionPoolLimit = errors.New("function pool limit exceeded")
+	ErrJumpAddrLimit     = errors.New("jump address limit exceeded")
+)
+
+// limitError is used to abort the compilation of a program when a limit is
+// exceeded.
+type limitError struct {
+	err error
+	max uint32
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%s (max %d)", e.err, e.max)
+}
+
+func (e *limitError) Unwrap() error { return e.err }
+
+// orDefault returns a copy of the limits with zero values replaced by their
+// default (maximum) value. It is valid to call it with a nil receiver.
+func (l *Limits) orDefault() Limits {
+	var lim Limits
+	if l != nil {
+		lim = *l
+	}
+	for _, n := range []*uint32{&lim.MaxConstants, &lim.MaxNames, &lim.MaxFunctions} {
+		if *n == 0 {
+			*n = math.MaxUint32
+		}
+	}
+	return lim
+}
+
+// checkSource returns an error if the chunks exceed the source limits.
+func (l *Limits) checkSource(fset *token.FileSet, chunks []*ast.Chunk) error {
+	files := make([]*token.File, len(chunks))
+	for i, ch := range chunks {
+		start, _ := ch.Span()
+		files[i] = fset.File(start)
+	}
+	return l.Source.CheckFiles(files)
+}
+
 // CompileFiles takes the file set and corresponding list of chunks from
-// a successful resolve result and compiles the AST to bytecode.
+// a successful resolve result and compiles the AST to bytecode using the
+// provided mode. If limits is nil, the maximum supported pool sizes are used.
 //
 // An AST that resulted in errors in the resolve phase should never be
 // passed to the compiler, the behavior is undefined.
 //
-// Compiling files does not return an error as a valid resolved AST should
-// always generate a valid, executable compiled program. Failure to do so is a
-// bug that should be reported.
-func CompileFiles(ctx context.Context, fset *token.FileSet, chunks []*ast.Chunk) []*Program {
+// A valid resolved AST should always generate a valid, executable compiled
+// program, failure to do so is a bug that should be reported. The only
+// errors returned are when a program exceeds one of the limits, in which
+// case the compilation stops and the error wraps the corresponding
+// ErrConstantPoolLimit, ErrNamePoolLimit or ErrFunctionPoolLimit, or when a
+// function is too large for its jump addresses to be encoded, in which case
+// the error wraps ErrJumpAddrLimit. If the chunks exceed the source limits,
+// no chunk is compiled and the error wraps token.ErrFileLimit and/or
+// token.ErrByteLimit.
+func CompileFiles(ctx context.Context, fset *token.FileSet, chunks []*ast.Chunk, mode Mode, limits *Limits) ([]*Program, error) {
 	if len(chunks) == 0 {
-		return nil
+		return nil, nil
 	}
 
+	lim := limits.orDefault()
+	if err := lim.checkSource(fset, chunks); err != nil {
+		return nil, err
+	}
 	progs := make([]*Program, len(chunks))
 	for i, ch := range chunks {
 		start, _ := ch.Span()
@@ -44,28 +139,60 @@ func CompileFiles(ctx context.Context, fset *token.FileSet, chunks []*ast.Chunk)
 				Filename: file.Name(),
 			},
 			file:      file,
+			mode:      mode,
+			limits:    lim,
 			names:     make(map[string]uint32),
 			constants: make(map[interface{}]uint32),
 			functions: make(map[*Funcode]uint32),
 		}
-		topLevel := pcomp.function(pcomp.prog.Filename, start, ch.Block, nil, nil)
-		pcomp.prog.Functions[0] = topLevel
+		if err := pcomp.compile(ch); err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name(), err)
+		}
 		progs[i] = pcomp.prog
 	}
-	return progs
+	return progs, nil
+}
+
+// compile compiles the chunk to pcomp.prog. It returns an error if a pool
+// limit is exceeded.
+func (pcomp *pcomp) compile(ch *ast.Chunk) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			lerr, ok := e.(*limitError)
+			if !ok {
+				panic(e)
+			}
+			err = lerr
+		}
+	}()
+
+	// reserve index 0 for the top-level, nested functions get added while it
+	// is compiled.
+	start, _ := ch.Span()
+	pcomp.prog.Functions = []*Funcode{nil}
+	fn := ch.Function.(*resolver.Function)
+	topLevel := pcomp.function(pcomp.prog.Filename, start, ch.Block, fn.Locals, fn.FreeVars)
+	topLevel.Pure = pcomp.purity.isPure(fn)
+	pcomp.prog.Functions[0] = topLevel
+	return nil
 }
 
 // A pcomp holds the compiler state for a Program.
 type pcomp struct {
-	prog *Program    // what we're building
-	file *token.File // to resolve token.Pos positions
+	prog   *Program    // what we're building
+	file   *token.File // to resolve token.Pos positions
+	mode   Mode
+	limits Limits
+	purity purity
 
 	names     map[string]uint32
 	constants map[interface{}]uint32
 	functions map[*Funcode]uint32
 }
 
-func (pcomp *pcomp) function(name string, start token.Pos, block *ast.Block, locals, freevars []*resolver.Binding) *Funcode {
+// function compiles a function, the body is either an *ast.Block or the
+// *ast.ClassBody of a class.
+func (pcomp *pcomp) function(name string, start token.Pos, body any, locals, freevars []*resolver.Binding) *Funcode {
 	fnPos := positionFromTokenPos(pcomp.file, start)
 	fcomp := &fcomp{
 		pcomp: pcomp,
@@ -76,6 +203,8 @@ func (pcomp *pcomp) function(name string, start token.Pos, block *ast.Block, loc
 			Name:     name,
 			Locals:   bindings(pcomp.file, locals),
 			Freevars: bindings(pcomp.file, freevars),
+
+			CompactJumps: pcomp.mode&CompactJumps != 0,
 		},
 	}
 
@@ -89,129 +218,173 @@ func (pcomp *pcomp) function(name string, start token.Pos, block *ast.Block, loc
 	// Convert AST to a CFG of instructions.
 	entry := fcomp.newBlock()
 	fcomp.block = entry
-	fcomp.stmts(block.Stmts)
+	switch body := body.(type) {
+	case *ast.Block:
+		fcomp.stmts(body.Stmts)
+	case *ast.ClassBody:
+		fcomp.classBody(body)
+	default:
+		panic(fmt.Sprintf("invalid function body: %T", body))
+	}
 	if fcomp.block != nil {
 		fcomp.emit(NIL)
 		fcomp.emit(RETURN)
 	}
+	if pcomp.mode&Optimize != 0 {
+		fcomp.optimize(entry)
+	}
 
-	/*
-		var oops bool // something bad happened
+	// Linearize the CFG: compute the initial stack depth of each reachable
+	// block, then lay out the blocks in creation order, so that the blocks of
+	// a defer or catch region are contiguous, and compute their addresses.
+	var oops bool // something bad happened
+
+	setinitialstack := func(b *block, depth int) {
+		if b.initialstack == -1 {
+			b.initialstack = depth
+		} else if b.initialstack != depth {
+			fmt.Fprintf(os.Stderr, "%s block %d: setinitialstack: depth mismatch: %d vs %d\n",
+				name, b.seq, b.initialstack, depth)
+			oops = true
+		}
+	}
 
-		setinitialstack := func(b *block, depth int) {
-			if b.initialstack == -1 {
-				b.initialstack = depth
-			} else if b.initialstack != depth {
-				fmt.Fprintf(os.Stderr, "%d: setinitialstack: depth mismatch: %d vs %d\n",
-					b.index, b.initialstack, depth)
+	// thread returns the first non-empty block that b leads to. The empty
+	// blocks skipped still get their initial stack depth, as they may start a
+	// protected region. An empty cycle (e.g. an infinite loop with an empty
+	// body) is threaded up to the block that closes it, which then jumps to
+	// itself.
+	thread := func(b *block, depth int) *block {
+		var skipped []*block
+		for b.insns == nil && !slices.Contains(skipped, b) {
+			setinitialstack(b, depth)
+			skipped = append(skipped, b)
+			b = b.jmp
+		}
+		return b
+	}
+
+	var blocks []*block
+	var maxstack int
+	var visit func(b *block)
+	visit = func(b *block) {
+		if b.index >= 0 {
+			return // already visited
+		}
+		b.index = len(blocks)
+		blocks = append(blocks, b)
+
+		stack := b.initialstack
+		var isiterjmp int
+		for _, insn := range b.insns {
+			if insn.op == ITERJMP || insn.op == RANGEJMP {
+				isiterjmp = 1
+			}
+			stack += insn.stackeffect()
+			if stack < 0 {
+				fmt.Fprintf(os.Stderr, "%s block %d: %s: stack underflow\n", name, b.seq, insn.op)
 				oops = true
 			}
+			if stack+isiterjmp > maxstack {
+				maxstack = stack + isiterjmp
+			}
 		}
 
-		// Linearize the CFG:
-		// compute order, address, and initial
-		// stack depth of each reachable block.
-		var pc uint32
-		var blocks []*block
-		var maxstack int
-		var visit func(b *block)
-		visit = func(b *block) {
-			if b.index >= 0 {
-				return // already visited
+		// ITERJMP and RANGEJMP push the next value only when they fall through
+		// to jmp.
+		if b.jmp != nil {
+			b.jmp = thread(b.jmp, stack+isiterjmp)
+			setinitialstack(b.jmp, stack+isiterjmp)
+			visit(b.jmp)
+		}
+		if b.cjmp != nil {
+			b.cjmp = thread(b.cjmp, stack)
+			setinitialstack(b.cjmp, stack)
+			visit(b.cjmp)
+		}
+	}
+	setinitialstack(entry, 0)
+	visit(entry)
+
+	// The defer and catch instructions are not reached by a jump, they start
+	// with the stack depth of the code they protect. A region nested in the
+	// instructions of another one is only reachable once that other one has
+	// been visited.
+	regions := append(append([]region(nil), fcomp.defers...), fcomp.catches...)
+	for more := true; more; {
+		more = false
+		for _, r := range regions {
+			if r.start.index < 0 && r.protected.initialstack >= 0 {
+				setinitialstack(r.start, r.protected.initialstack)
+				visit(r.start)
+				more = true
 			}
-			b.index = len(blocks)
-			b.addr = pc
-			blocks = append(blocks, b)
+		}
+	}
 
-			stack := b.initialstack
-			if debug {
-				fmt.Fprintf(os.Stderr, "%s block %d: (stack = %d)\n", name, b.index, stack)
+	// Compute the address of each block, in creation order. With compact
+	// jumps, the size of a jump depends on the address of its target, so this
+	// is repeated until the addresses are stable. Addresses can only grow from
+	// one pass to the next, so this is guaranteed to terminate.
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].seq < blocks[j].seq })
+	for i, b := range blocks {
+		b.index = i
+	}
+	compact := fcomp.fn.CompactJumps
+	var pc uint32
+	for changed := true; changed; {
+		changed = false
+		pc = 0
+		for _, b := range blocks {
+			if b.addr != pc {
+				b.addr = pc
+				changed = true
 			}
-			var cjmpAddr *uint32
-			var isiterjmp int
 			for i, insn := range b.insns {
-				pc++
-
-				// Compute size of argument.
-				if insn.op >= OpcodeArgMin {
-					switch insn.op {
-					case ITERJMP:
-						isiterjmp = 1
-						fallthrough
-					case CJMP:
-						cjmpAddr = &b.insns[i].arg
-						pc += 4
-					default:
-						pc += uint32(varArgLen(insn.arg))
-					}
-				}
-
-				// Compute effect on stack.
-				se := insn.stackeffect()
-				if debug {
-					fmt.Fprintln(os.Stderr, "\t", insn.op, stack, stack+se)
-				}
-				stack += se
-				if stack < 0 {
-					fmt.Fprintf(os.Stderr, "After pc=%d: stack underflow\n", pc)
-					oops = true
-				}
-				if stack+isiterjmp > maxstack {
-					maxstack = stack + isiterjmp
+				arg := insn.arg
+				if b.cjmp != nil && i == len(b.insns)-1 {
+					arg = b.cjmp.addr
 				}
+				pc += uint32(encodedSize(insn.op, arg, compact))
 			}
-
-			// Place the jmp block next.
-			if b.jmp != nil {
-				// jump threading (empty cycles are impossible)
-				for b.jmp.insns == nil {
-					b.jmp = b.jmp.jmp
-				}
-
-				setinitialstack(b.jmp, stack+isiterjmp)
-				if b.jmp.index < 0 {
-					// Successor is not yet visited:
-					// place it next and fall through.
-					visit(b.jmp)
-				} else {
-					// Successor already visited;
-					// explicit backward jump required.
-					pc += 5
-				}
+			if b.hasExplicitJump() {
+				pc += uint32(encodedSize(JMP, b.jmp.addr, compact))
 			}
+		}
+	}
 
-			// Then the cjmp block.
-			if b.cjmp != nil {
-				// jump threading (empty cycles are impossible)
-				for b.cjmp.insns == nil {
-					b.cjmp = b.cjmp.jmp
-				}
-
-				setinitialstack(b.cjmp, stack)
-				visit(b.cjmp)
-
-				// Patch the CJMP/ITERJMP, if present.
-				if cjmpAddr != nil {
-					*cjmpAddr = b.cjmp.addr
-				}
-			}
+	// Patch the CJMP, ITERJMP, RANGEJMP and CATCHJMP, now that the addresses
+	// are known.
+	for _, b := range blocks {
+		if b.cjmp != nil {
+			b.insns[len(b.insns)-1].arg = b.cjmp.addr
 		}
-		setinitialstack(entry, 0)
-		visit(entry)
-	*/
+	}
 
 	fn := fcomp.fn
-	/*
-		fn.MaxStack = maxstack
+	fn.MaxStack = maxstack
+	var active []region // the regions that may run
+	for _, r := range fcomp.defers {
+		if d, ok := r.resolve(blocks, pc); ok {
+			fn.Defers = append(fn.Defers, d)
+			active = append(active, r)
+		}
+	}
+	for _, r := range fcomp.catches {
+		if d, ok := r.resolve(blocks, pc); ok {
+			fn.Catches = append(fn.Catches, d)
+			active = append(active, r)
+		}
+	}
+	fn.MaxDeferred = maxDeferred(active)
 
-		// Emit bytecode (and position table).
-		fcomp.generate(blocks, pc)
+	// Emit bytecode (and position table).
+	fcomp.generate(blocks, pc)
 
-		// Don't panic until we've completed printing of the function.
-		if oops {
-			panic("internal error")
-		}
-	*/
+	// Don't panic until we've completed printing of the function.
+	if oops {
+		panic("internal error")
+	}
 
 	return fn
 }
@@ -221,6 +394,7 @@ func (pcomp *pcomp) function(name string, start token.Pos, block *ast.Block, loc
 func (pcomp *pcomp) nameIndex(name string) uint32 {
 	index, ok := pcomp.names[name]
 	if !ok {
+		checkPoolLimit(len(pcomp.prog.Names), pcomp.limits.MaxNames, ErrNamePoolLimit)
 		index = uint32(len(pcomp.prog.Names))
 		pcomp.names[name] = index
 		pcomp.prog.Names = append(pcomp.prog.Names, name)
@@ -231,10 +405,15 @@ func (pcomp *pcomp) nameIndex(name string) uint32 {
 // constantIndex returns the index of the specified constant within the
 // constant pool, adding it if necessary.
 func (pcomp *pcomp) constantIndex(v interface{}) uint32 {
-	index, ok := pcomp.constants[v]
+	key := v
+	if t, ok := v.(Tuple); ok {
+		key = t.key()
+	}
+	index, ok := pcomp.constants[key]
 	if !ok {
+		checkPoolLimit(len(pcomp.prog.Constants), pcomp.limits.MaxConstants, ErrConstantPoolLimit)
 		index = uint32(len(pcomp.prog.Constants))
-		pcomp.constants[v] = index
+		pcomp.constants[key] = index
 		pcomp.prog.Constants = append(pcomp.prog.Constants, v)
 	}
 	return index
@@ -245,6 +424,7 @@ func (pcomp *pcomp) constantIndex(v interface{}) uint32 {
 func (pcomp *pcomp) functionIndex(fn *Funcode) uint32 {
 	index, ok := pcomp.functions[fn]
 	if !ok {
+		checkPoolLimit(len(pcomp.prog.Functions), pcomp.limits.MaxFunctions, ErrFunctionPoolLimit)
 		index = uint32(len(pcomp.prog.Functions))
 		pcomp.functions[fn] = index
 		pcomp.prog.Functions = append(pcomp.prog.Functions, fn)
@@ -252,6 +432,14 @@ func (pcomp *pcomp) functionIndex(fn *Funcode) uint32 {
 	return index
 }
 
+// checkPoolLimit aborts the compilation if adding an entry to a pool of
+// size n would exceed max.
+func checkPoolLimit(n int, max uint32, err error) {
+	if uint64(n) >= uint64(max) {
+		panic(&limitError{err: err, max: max})
+	}
+}
+
 // An fcomp holds the compiler state for a Funcode.
 type fcomp struct {
 	fn *Funcode // what we're building
@@ -260,20 +448,218 @@ type fcomp struct {
 	pos   Position // current position of generated code (not necessarily == to fn.pos)
 	loops []loop
 	block *block
-	// TODO(mna): probably needs to keep track of catch blocks during compilation?
+	// number of defer blocks that cover the code being generated, a RETURN
+	// must run them first.
+	activeDefers int
+	// number of blocks created so far, used to identify the range of blocks
+	// covered by a defer or catch.
+	nblocks int
+	// defer and catch regions, in the order they were started so that nested
+	// ones come after the more general ones.
+	defers, catches []region
+	// blocks of the labels, by label binding index. A label's block is created
+	// by the first of the label statement or a goto that refers to it.
+	labels map[int]*block
+	// number of loops that enclose the labels, by label binding index. It is
+	// recorded when the block that defines the label starts, so that it is
+	// known by a goto that jumps forward.
+	labelLoops map[int]int
+}
+
+// region is a range of blocks protected by a defer or catch block. The
+// blocks covered are those created between first and last, inclusively, as
+// identified by their sequence number. The instructions of the defer or catch
+// block are in the start block and in the blocks created between bodyFirst
+// and bodyLast, if any (there is none if bodyLast < bodyFirst).
+type region struct {
+	start               *block // first block of the defer or catch instructions
+	protected           *block // first block of the protected code
+	first, last         int
+	bodyFirst, bodyLast int
+	iters               int // number of active iterators of the enclosing loops
+}
+
+// runsIn returns true if the instructions of the defer or catch block of r
+// include some of the instructions protected by region p.
+func (r region) runsIn(p region) bool {
+	if p.first <= r.start.seq && r.start.seq <= p.last {
+		return true
+	}
+	return r.bodyFirst <= p.last && p.first <= r.bodyLast
+}
+
+// maxDeferred returns the maximum depth of the stack of deferred executions
+// of a function with the defer and catch regions. A defer or catch block
+// runs one level deeper than the instructions that it protects, which may
+// themselves be part of other blocks. This is the worst case, where every
+// block raises an error that triggers the next one.
+func maxDeferred(regions []region) int {
+	depths := make([]int, len(regions)) // 0 if not computed yet
+	var depth func(i int) int
+	depth = func(i int) int {
+		if depths[i] == 0 {
+			var inner int
+			for j, r := range regions {
+				if j != i && r.runsIn(regions[i]) {
+					inner = max(inner, depth(j))
+				}
+			}
+			depths[i] = inner + 1
+		}
+		return depths[i]
+	}
+
+	var n int
+	for i := range regions {
+		n = max(n, depth(i))
+	}
+	return n
+}
+
+// resolve returns the Defer that corresponds to the region once the blocks
+// are laid out and their addresses computed, end being the address past the
+// last block. It returns false if the region's instructions are unreachable
+// or if it does not cover any instruction.
+func (r region) resolve(blocks []*block, end uint32) (Defer, bool) {
+	if r.start.index < 0 {
+		return Defer{}, false
+	}
+
+	pc0, pc1 := int64(-1), int64(-1)
+	for i, b := range blocks {
+		if b.seq < r.first || b.seq > r.last {
+			continue
+		}
+		next := end
+		if i+1 < len(blocks) {
+			next = blocks[i+1].addr
+		}
+		if pc0 < 0 {
+			pc0 = int64(b.addr)
+		}
+		pc1 = int64(next) - 1
+	}
+	if pc0 < 0 || pc1 < pc0 {
+		return Defer{}, false
+	}
+	return Defer{
+		PC0:     uint32(pc0),
+		PC1:     uint32(pc1),
+		StartPC: r.start.addr,
+		Stack:   uint32(r.start.initialstack),
+		Iters:   uint32(r.iters),
+	}, true
 }
 
 // newBlock returns a new block.
-func (fcomp) newBlock() *block {
-	return &block{index: -1, initialstack: -1}
+func (fcomp *fcomp) newBlock() *block {
+	b := &block{seq: fcomp.nblocks, index: -1, initialstack: -1}
+	fcomp.nblocks++
+	return b
+}
+
+// protect starts a region, added to regions, that protects the code
+// generated until the returned function is called, and whose defer or catch
+// instructions are generated in the start block. The current block is set to
+// the first block of the protected code.
+func (fcomp *fcomp) protect(regions *[]region, start *block) (end func()) {
+	protected := fcomp.newBlock()
+	fcomp.jump(protected)
+	fcomp.block = protected
+
+	var iters int
+	for _, l := range fcomp.loops {
+		if l.exit == ITERPOP {
+			iters++
+		}
+	}
+
+	i := len(*regions)
+	*regions = append(*regions, region{start: start, protected: protected, first: protected.seq, bodyLast: -1, iters: iters})
+	return func() {
+		(*regions)[i].last = fcomp.nblocks - 1
+	}
 }
 
 func (fcomp *fcomp) stmts(stmts []ast.Stmt) {
 	for _, stmt := range stmts {
+		if stmt, ok := stmt.(*ast.LabelStmt); ok {
+			bind := stmt.Name.Binding.(*resolver.Binding)
+			if fcomp.labelLoops == nil {
+				fcomp.labelLoops = make(map[int]int)
+			}
+			fcomp.labelLoops[bind.Index] = len(fcomp.loops)
+		}
+	}
+
+	for i, stmt := range stmts {
+		if stmt, ok := stmt.(*ast.SimpleBlockStmt); ok && (stmt.Type == token.DEFER || stmt.Type == token.CATCH) {
+			// the defer or catch block protects the rest of the statements
+			fcomp.deferCatch(stmt, stmts[i+1:])
+			return
+		}
 		fcomp.stmt(stmt)
 	}
 }
 
+// deferCatch compiles a defer or catch block that protects the statements in
+// rest, up to the end of the enclosing block:
+//
+//	    JMP protected
+//	start:
+//	    <body>
+//	    DEFEREXIT                   (defer)
+//	    CATCHJMP after              (catch)
+//	protected:
+//	    <rest>
+//	    RUNDEFER; JMP after         (defer)
+//	    JMP after                   (catch)
+//	after:
+//
+// On return, the current block is after.
+func (fcomp *fcomp) deferCatch(stmt *ast.SimpleBlockStmt, rest []ast.Stmt) {
+	start := fcomp.newBlock()
+	regions := &fcomp.catches
+	if stmt.Type == token.DEFER {
+		regions = &fcomp.defers
+	}
+
+	i := len(*regions)
+	end := fcomp.protect(regions, start)
+	if stmt.Type == token.DEFER {
+		fcomp.activeDefers++
+	}
+	fcomp.stmts(rest)
+	if stmt.Type == token.DEFER {
+		fcomp.activeDefers--
+		if fcomp.block != nil {
+			// the machine only runs the defer blocks covering the JMP if it is
+			// immediately preceded by RUNDEFER.
+			fcomp.emit(RUNDEFER)
+		}
+	}
+	end()
+
+	after := fcomp.newBlock()
+	if fcomp.block != nil {
+		fcomp.jump(after)
+	}
+
+	fcomp.block = start
+	(*regions)[i].bodyFirst = fcomp.nblocks
+	fcomp.stmts(stmt.Body.Stmts)
+	(*regions)[i].bodyLast = fcomp.nblocks - 1
+	if fcomp.block != nil {
+		if stmt.Type == token.DEFER {
+			fcomp.emit(DEFEREXIT)
+			fcomp.block = nil
+		} else {
+			fcomp.catchjump(after)
+		}
+	}
+	fcomp.block = after
+}
+
 func (fcomp *fcomp) stmt(stmt ast.Stmt) {
 	switch stmt := stmt.(type) {
 	case *ast.ExprStmt:
@@ -282,170 +668,223 @@ func (fcomp *fcomp) stmt(stmt ast.Stmt) {
 		fcomp.expr(stmt.Expr)
 		fcomp.emit(POP)
 
-		/*
-			case *syntax.BranchStmt:
-				// Resolver invariant: break/continue appear only within loops.
-				switch stmt.Token {
-				case syntax.PASS:
-					// no-op
-				case syntax.BREAK:
-					b := fcomp.loops[len(fcomp.loops)-1].break_
-					fcomp.jump(b)
-					fcomp.block = fcomp.newBlock() // dead code
-				case syntax.CONTINUE:
-					b := fcomp.loops[len(fcomp.loops)-1].continue_
-					fcomp.jump(b)
-					fcomp.block = fcomp.newBlock() // dead code
-				}
+	case *ast.AssignStmt:
+		fcomp.assignStmt(stmt)
 
-			case *syntax.IfStmt:
-				// Keep consistent with CondExpr.
-				t := fcomp.newBlock()
-				f := fcomp.newBlock()
-				done := fcomp.newBlock()
-
-				fcomp.ifelse(stmt.Cond, t, f)
-
-				fcomp.block = t
-				fcomp.stmts(stmt.True)
-				fcomp.jump(done)
-
-				fcomp.block = f
-				fcomp.stmts(stmt.False)
-				fcomp.jump(done)
-
-				fcomp.block = done
-
-			case *syntax.AssignStmt:
-				switch stmt.Op {
-				case syntax.EQ:
-					// simple assignment: x = y
-					fcomp.expr(stmt.RHS)
-					fcomp.assign(stmt.OpPos, stmt.LHS)
-
-				case syntax.PLUS_EQ,
-					syntax.MINUS_EQ,
-					syntax.STAR_EQ,
-					syntax.SLASH_EQ,
-					syntax.SLASHSLASH_EQ,
-					syntax.PERCENT_EQ,
-					syntax.AMP_EQ,
-					syntax.PIPE_EQ,
-					syntax.CIRCUMFLEX_EQ,
-					syntax.LTLT_EQ,
-					syntax.GTGT_EQ:
-					// augmented assignment: x += y
-
-					var set func()
-
-					// Evaluate "address" of x exactly once to avoid duplicate side-effects.
-					switch lhs := unparen(stmt.LHS).(type) {
-					case *syntax.Ident:
-						// x = ...
-						fcomp.lookup(lhs)
-						set = func() {
-							fcomp.set(lhs)
-						}
-
-					case *syntax.IndexExpr:
-						// x[y] = ...
-						fcomp.expr(lhs.X)
-						fcomp.expr(lhs.Y)
-						fcomp.emit(DUP2)
-						fcomp.setPos(lhs.Lbrack)
-						fcomp.emit(INDEX)
-						set = func() {
-							fcomp.setPos(lhs.Lbrack)
-							fcomp.emit(SETINDEX)
-						}
-
-					case *syntax.DotExpr:
-						// x.f = ...
-						fcomp.expr(lhs.X)
-						fcomp.emit(DUP)
-						name := fcomp.pcomp.nameIndex(lhs.Name.Name)
-						fcomp.setPos(lhs.Dot)
-						fcomp.emit1(ATTR, name)
-						set = func() {
-							fcomp.setPos(lhs.Dot)
-							fcomp.emit1(SETFIELD, name)
-						}
-
-					default:
-						panic(lhs)
-					}
+	case *ast.FuncStmt:
+		// if the function refers to itself, its name is a cell that gets
+		// captured before it is set, which is fine as it is only read when the
+		// function is called.
+		fcomp.pcomp.purity.declare(stmt)
+		fcomp.function(stmt.Function.(*resolver.Function))
+		fcomp.set(stmt.Name)
+
+	case *ast.ClassStmt:
+		// as for function statements, methods that refer to the class capture
+		// its name before it is set.
+		fcomp.class(stmt.Class, stmt.Inherits, stmt.Function.(*resolver.Function))
+		fcomp.set(stmt.Name)
+
+	case *ast.ForInStmt:
+		if call := fcomp.rangeCall(stmt); call != nil {
+			fcomp.forRange(stmt, call)
+			break
+		}
 
-					fcomp.expr(stmt.RHS)
-
-					// In-place x+=y and x|=y have special semantics:
-					// the resulting x aliases the original x.
-					switch stmt.Op {
-					case syntax.PLUS_EQ:
-						fcomp.setPos(stmt.OpPos)
-						fcomp.emit(INPLACE_ADD)
-					case syntax.PIPE_EQ:
-						fcomp.setPos(stmt.OpPos)
-						fcomp.emit(INPLACE_PIPE)
-					default:
-						fcomp.binop(stmt.OpPos, stmt.Op-syntax.PLUS_EQ+syntax.PLUS)
-					}
-					set()
-				}
+		head := fcomp.newBlock()
+		body := fcomp.newBlock()
+		tail := fcomp.newBlock()
+
+		// multiple expressions on the right-hand side are iterated as a tuple
+		if len(stmt.Right) == 1 {
+			fcomp.expr(stmt.Right[0])
+		} else {
+			for _, e := range stmt.Right {
+				fcomp.expr(e)
+			}
+			fcomp.emit1(MAKETUPLE, uint32(len(stmt.Right)))
+		}
+		fcomp.setPos(stmt.For)
+		fcomp.emit(ITERPUSH)
+		fcomp.jump(head)
+
+		fcomp.block = head
+		fcomp.condjump(ITERJMP, tail, body)
+
+		fcomp.block = body
+		if len(stmt.Left) == 1 {
+			fcomp.assign(stmt.For, stmt.Left[0])
+		} else {
+			fcomp.assignSequence(stmt.For, stmt.Left)
+		}
+		fcomp.loops = append(fcomp.loops, loop{break_: tail, continue_: head, defers: fcomp.activeDefers, exit: ITERPOP, nexit: 1})
+		fcomp.stmts(stmt.Body.Stmts)
+		fcomp.loops = fcomp.loops[:len(fcomp.loops)-1]
+		fcomp.jump(head)
+
+		fcomp.block = tail
+		fcomp.emit(ITERPOP)
+
+	case *ast.ForLoopStmt:
+		// the resolver scopes Init-declared variables to the loop, there is
+		// nothing special to do here as those variables are only referenced by
+		// the loop.
+		if stmt.Init != nil {
+			fcomp.stmt(stmt.Init)
+		}
+
+		head := fcomp.newBlock()
+		body := fcomp.newBlock()
+		post := fcomp.newBlock()
+		done := fcomp.newBlock()
+
+		fcomp.jump(head)
+		fcomp.block = head
+		if stmt.Cond != nil {
+			fcomp.ifelse(stmt.Cond, body, done)
+		} else {
+			fcomp.jump(body)
+		}
 
-			case *syntax.DefStmt:
-				fcomp.function(stmt.Function.(*resolve.Function))
-				fcomp.set(stmt.Name)
-
-			case *syntax.ForStmt:
-				// Keep consistent with ForClause.
-				head := fcomp.newBlock()
-				body := fcomp.newBlock()
-				tail := fcomp.newBlock()
-
-				fcomp.expr(stmt.X)
-				fcomp.setPos(stmt.For)
-				fcomp.emit(ITERPUSH)
-				fcomp.jump(head)
-
-				fcomp.block = head
-				fcomp.condjump(ITERJMP, tail, body)
-
-				fcomp.block = body
-				fcomp.assign(stmt.For, stmt.Vars)
-				fcomp.loops = append(fcomp.loops, loop{break_: tail, continue_: head})
-				fcomp.stmts(stmt.Body)
-				fcomp.loops = fcomp.loops[:len(fcomp.loops)-1]
-				fcomp.jump(head)
-
-				fcomp.block = tail
-				fcomp.emit(ITERPOP)
-
-			case *syntax.WhileStmt:
-				head := fcomp.newBlock()
-				body := fcomp.newBlock()
-				done := fcomp.newBlock()
-
-				fcomp.jump(head)
-				fcomp.block = head
-				fcomp.ifelse(stmt.Cond, body, done)
-
-				fcomp.block = body
-				fcomp.loops = append(fcomp.loops, loop{break_: done, continue_: head})
-				fcomp.stmts(stmt.Body)
-				fcomp.loops = fcomp.loops[:len(fcomp.loops)-1]
-				fcomp.jump(head)
-
-				fcomp.block = done
-
-			case *syntax.ReturnStmt:
-				if stmt.Result != nil {
-					fcomp.expr(stmt.Result)
-				} else {
-					fcomp.emit(NONE)
+		fcomp.block = body
+		fcomp.loops = append(fcomp.loops, loop{break_: done, continue_: post, defers: fcomp.activeDefers})
+		fcomp.stmts(stmt.Body.Stmts)
+		fcomp.loops = fcomp.loops[:len(fcomp.loops)-1]
+		fcomp.jump(post)
+
+		fcomp.block = post
+		if stmt.Post != nil {
+			fcomp.stmt(stmt.Post)
+		}
+		fcomp.jump(head)
+
+		fcomp.block = done
+
+	case *ast.ReturnLikeStmt:
+		switch stmt.Type {
+		case token.BREAK, token.CONTINUE:
+			// Resolver invariant: break/continue appear only within loops.
+			if stmt.Expr != nil {
+				// TODO: labelled break and continue
+				fcomp.panicf(stmt.Start, "labelled %s not implemented", stmt.Type)
+			}
+			l := fcomp.loops[len(fcomp.loops)-1]
+			b := l.break_
+			if stmt.Type == token.CONTINUE {
+				b = l.continue_
+			}
+			if fcomp.activeDefers > l.defers {
+				// exiting the defer blocks declared inside the loop
+				fcomp.emit(RUNDEFER)
+			}
+			fcomp.jump(b)
+			fcomp.block = fcomp.newBlock() // dead code
+
+		case token.RETURN:
+			if stmt.Expr != nil {
+				fcomp.expr(stmt.Expr)
+			} else {
+				fcomp.emit(NIL)
+			}
+			if fcomp.activeDefers > 0 {
+				// the machine only runs the defer blocks covering the RETURN if it
+				// is immediately preceded by RUNDEFER.
+				fcomp.emit(RUNDEFER)
+			}
+			fcomp.emit(RETURN)
+			fcomp.block = fcomp.newBlock() // dead code
+
+		case token.GOTO:
+			// Resolver invariant: the label is visible from the goto and the jump
+			// does not enter the scope of a local variable, so the label is in one
+			// of the blocks that enclose the goto.
+			id := stmt.Expr.(*ast.IdentExpr)
+			b := fcomp.labelBlock(id)
+			// discard the state of the loops exited by the goto, innermost first.
+			for i := len(fcomp.loops) - 1; i >= fcomp.labelLoops[id.Binding.(*resolver.Binding).Index]; i-- {
+				for j := 0; j < fcomp.loops[i].nexit; j++ {
+					fcomp.emit(fcomp.loops[i].exit)
 				}
-				fcomp.emit(RETURN)
-				fcomp.block = fcomp.newBlock() // dead code
+			}
+			if fcomp.activeDefers > 0 {
+				// the machine runs the defer blocks that cover the goto but not the
+				// label, if any.
+				fcomp.emit(RUNDEFER)
+			}
+			fcomp.jump(b)
+			fcomp.block = fcomp.newBlock() // dead code
+
+		case token.THROW:
+			// Resolver invariant: a bare throw is only inside a catch block, it
+			// re-throws the error being handled, which THROW does with nil.
+			if stmt.Expr != nil {
+				fcomp.expr(stmt.Expr)
+			} else {
+				fcomp.emit(NIL)
+			}
+			fcomp.setPos(stmt.Start)
+			fcomp.emit(THROW)
+			fcomp.block = fcomp.newBlock() // dead code
+
+		default:
+			fcomp.panicf(stmt.Start, "unexpected %s stmt", stmt.Type)
+		}
+
+	case *ast.PassStmt:
+		// compiles to nothing
+
+	case *ast.LabelStmt:
+		// the block may have been created by a forward goto, it gets sequenced
+		// where the label is defined as this is what determines the defer and
+		// catch regions that cover it.
+		b := fcomp.labelBlock(stmt.Name)
+		b.seq = fcomp.nblocks
+		fcomp.nblocks++
+		fcomp.jump(b)
+		fcomp.block = b
+
+	case *ast.SimpleBlockStmt:
+		// the resolver scopes the variables declared in the block, there is
+		// nothing special to do here. Defer and catch blocks are compiled by
+		// stmts as they protect the rest of the enclosing block.
+		if stmt.Type != token.DO {
+			fcomp.panicf(stmt.Start, "unexpected %s block", stmt.Type)
+		}
+		fcomp.stmts(stmt.Body.Stmts)
 
+	case *ast.IfGuardStmt:
+		if stmt.Decl != nil {
+			// TODO: if-bind and guard-bind statements
+			fcomp.panicf(stmt.Start, "%s-bind not implemented", stmt.Type)
+		}
+
+		t := fcomp.newBlock()
+		f := fcomp.newBlock()
+		done := fcomp.newBlock()
+
+		if stmt.Type == token.GUARD {
+			// guard has no true block, execution continues after the statement if
+			// the condition is true.
+			fcomp.ifelse(stmt.Cond, done, f)
+		} else {
+			fcomp.ifelse(stmt.Cond, t, f)
+
+			fcomp.block = t
+			fcomp.stmts(stmt.True.Stmts)
+			fcomp.jump(done)
+		}
+
+		// an elseif is a False block with a single IfGuardStmt, it gets compiled
+		// as a nested if.
+		fcomp.block = f
+		if stmt.False != nil {
+			fcomp.stmts(stmt.False.Stmts)
+		}
+		fcomp.jump(done)
+
+		fcomp.block = done
+
+		/*
 			case *syntax.LoadStmt:
 				for i := range stmt.From {
 					fcomp.string(stmt.From[i].Name)
@@ -464,8 +903,8 @@ func (fcomp *fcomp) stmt(stmt ast.Stmt) {
 		*/
 
 	default:
-		// TODO: use a central function to panic with position information
-		panic(fmt.Sprintf("unexpected stmt %T", stmt))
+		start, _ := stmt.Span()
+		fcomp.panicf(start, "unexpected stmt %T", stmt)
 	}
 }
 
@@ -486,12 +925,19 @@ func (fcomp *fcomp) expr(e ast.Expr) {
 		case token.FALSE:
 			fcomp.emit(FALSE)
 		default:
-			// e.Value is int64, float64, string
-			v := e.Value
-			fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(v))
+			fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(literalValue(e)))
 		}
 
 	case *ast.ArrayLikeExpr:
+		// a literal of constants is built once, as a constant tuple, and copied
+		// to a new array each time if it is an array literal.
+		if t, ok := constantTuple(e); ok {
+			fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(t))
+			if e.Type == token.LBRACK {
+				fcomp.emit(COPYARRAY)
+			}
+			break
+		}
 		for _, v := range e.Items {
 			fcomp.expr(v)
 		}
@@ -516,7 +962,12 @@ func (fcomp *fcomp) expr(e ast.Expr) {
 		fcomp.emit1(MAKEMAP, uint32(len(e.Items)))
 		for _, kv := range e.Items {
 			fcomp.emit(DUP)
-			fcomp.expr(kv.Key)
+			if id, ok := kv.Key.(*ast.IdentExpr); ok && !kv.Lbrack.IsValid() {
+				// an unbracketed identifier key is a string of the same value
+				fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(id.Lit))
+			} else {
+				fcomp.expr(kv.Key)
+			}
 			fcomp.expr(kv.Value)
 			fcomp.setPos(kv.Colon)
 			fcomp.emit(SETMAP)
@@ -527,39 +978,51 @@ func (fcomp *fcomp) expr(e ast.Expr) {
 
 	case *ast.UnaryOpExpr:
 		switch e.Type {
-		case token.TRY:
-			// TODO: compile to:
-			// do # so that the tmp var is limited in scope
-			//   let tmp
-			//   do
-			//     catch
-			//       tmp = nil
-			//     end
-			//     tmp = expr
-			//   end
-			// end
-			// <stack value is tmp>
-			fcomp.openCatch()
-			fcomp.emit(NIL)
-			fcomp.set(e.TryMustInternalVar)
-			fcomp.closeCatch()
+		case token.TRY, token.MUST:
+			// try and must evaluate the expression in a catch region and store the
+			// result in an internal variable. If it fails, try stores nil instead,
+			// while must converts the error to a critical one:
+			//
+			//       JMP protected
+			//   catch:
+			//       NIL; SETLOCAL tmp; CATCHJMP after    (try)
+			//       CRITICAL                             (must)
+			//   protected:
+			//       <expr>; SETLOCAL tmp
+			//   after:
+			//       LOCAL tmp
+
+			tmp := e.TryMustInternalVar
+			catch := fcomp.newBlock()
+			end := fcomp.protect(&fcomp.catches, catch)
 			fcomp.expr(e.Right)
-			fcomp.set(e.TryMustInternalVar)
-
-		case token.MUST:
-			// TODO: compile to:
-			// do # so that the tmp var is limited in scope
-			//   let tmp
-			//   do
-			//     catch
-			//       <raise fatal error>
-			//     end
-			//     tmp = expr
-			//   end
-			// end
-			// <stack value is tmp>
+			fcomp.set(tmp)
+			end()
+
+			after := fcomp.newBlock()
+			fcomp.jump(after)
+
+			fcomp.block = catch
+			if e.Type == token.TRY {
+				fcomp.emit(NIL)
+				fcomp.set(tmp)
+				fcomp.catchjump(after)
+			} else {
+				fcomp.emit(CRITICAL)
+			}
+
+			fcomp.block = after
+			fcomp.lookup(tmp)
+
+		case token.NOT:
+			// NOT applies to any value and cannot fail
+			fcomp.expr(e.Right)
+			fcomp.emit(NOT)
 
 		default:
+			if fcomp.fold(e) {
+				break
+			}
 			fcomp.expr(e.Right)
 			fcomp.setPos(e.Op)
 			switch e.Type {
@@ -569,16 +1032,10 @@ func (fcomp *fcomp) expr(e ast.Expr) {
 				fcomp.emit(UMINUS)
 			case token.TILDE:
 				fcomp.emit(UTILDE)
-			case token.NOT:
-				fcomp.emit(NOT)
 			case token.POUND:
 				fcomp.emit(POUND)
-			case token.DOTDOTDOT:
-				// TODO: must use emit1 and know how many items we need to unpack...
-				//fcomp.emit(UNPACK)
-				panic("UNPACK not implemented")
 			default:
-				panic(fmt.Sprintf("%s: unexpected unary op: %s", fcomp.pcomp.file.Position(e.Op), e.Type))
+				fcomp.panicf(e.Op, "unexpected unary op: %s", e.Type)
 			}
 		}
 
@@ -586,7 +1043,7 @@ func (fcomp *fcomp) expr(e ast.Expr) {
 		fcomp.call(e)
 
 	case *ast.ClassExpr:
-		//fcomp.class(e)
+		fcomp.class(e.Class, e.Inherits, e.Function.(*resolver.Function))
 
 	case *ast.BinOpExpr:
 		switch e.Type {
@@ -597,12 +1054,12 @@ func (fcomp *fcomp) expr(e ast.Expr) {
 
 			fcomp.expr(e.Left)
 			fcomp.emit(DUP)
-			//fcomp.condjump(CJMP, done, y)
+			fcomp.condjump(CJMP, done, y)
 
 			fcomp.block = y
 			fcomp.emit(POP) // discard X
 			fcomp.expr(e.Right)
-			//fcomp.jump(done)
+			fcomp.jump(done)
 
 			fcomp.block = done
 
@@ -613,68 +1070,28 @@ func (fcomp *fcomp) expr(e ast.Expr) {
 
 			fcomp.expr(e.Left)
 			fcomp.emit(DUP)
-			//fcomp.condjump(CJMP, y, done)
+			fcomp.condjump(CJMP, y, done)
 
 			fcomp.block = y
 			fcomp.emit(POP) // discard Left
 			fcomp.expr(e.Right)
-			//fcomp.jump(done)
+			fcomp.jump(done)
 
 			fcomp.block = done
 
 		default:
+			// all other strict binary operators (includes comparisons)
+			if fcomp.fold(e) {
+				break
+			}
+			fcomp.expr(e.Left)
+			fcomp.expr(e.Right)
+			fcomp.binop(e.Op, e.Type)
 		}
 
-		/*
-			case *syntax.BinaryExpr:
-				switch e.Op {
-				// short-circuit operators
-				// TODO(adonovan): use ifelse to simplify conditions.
-				case syntax.OR:
-					// x or y  =>  if x then x else y
-					done := fcomp.newBlock()
-					y := fcomp.newBlock()
-
-					fcomp.expr(e.X)
-					fcomp.emit(DUP)
-					fcomp.condjump(CJMP, done, y)
-
-					fcomp.block = y
-					fcomp.emit(POP) // discard X
-					fcomp.expr(e.Y)
-					fcomp.jump(done)
-
-					fcomp.block = done
-
-				case syntax.AND:
-					// x and y  =>  if x then y else x
-					done := fcomp.newBlock()
-					y := fcomp.newBlock()
-
-					fcomp.expr(e.X)
-					fcomp.emit(DUP)
-					fcomp.condjump(CJMP, y, done)
-
-					fcomp.block = y
-					fcomp.emit(POP) // discard X
-					fcomp.expr(e.Y)
-					fcomp.jump(done)
-
-					fcomp.block = done
-
-				case syntax.PLUS:
-					fcomp.plus(e)
-
-				default:
-					// all other strict binary operator (includes comparisons)
-					fcomp.expr(e.X)
-					fcomp.expr(e.Y)
-					fcomp.binop(e.OpPos, e.Op)
-				}
-		*/
-
 	default:
-		panic(fmt.Sprintf("unexpected expr %T", e))
+		start, _ := e.Span()
+		fcomp.panicf(start, "unexpected expr %T", e)
 	}
 }
 
@@ -696,7 +1113,7 @@ func (fcomp *fcomp) function(f *resolver.Function) {
 	}
 	fcomp.emit1(MAKETUPLE, uint32(len(f.FreeVars)))
 
-	var body *ast.Block
+	var body any
 	var numParams int
 	switch fn := f.Definition.(type) {
 	case *ast.FuncExpr:
@@ -705,30 +1122,403 @@ func (fcomp *fcomp) function(f *resolver.Function) {
 	case *ast.FuncStmt:
 		body = fn.Body
 		numParams = len(fn.Sig.Params)
+	case *ast.ClassExpr:
+		body = fn.Body
+	case *ast.ClassStmt:
+		body = fn.Body
 	default:
-		panic(fmt.Sprintf("invalid function definition AST node: %T", f.Definition))
+		start, _ := f.Definition.Span()
+		fcomp.panicf(start, "invalid function definition AST node: %T", f.Definition)
 	}
 	start, _ := f.Definition.Span()
 	funcode := fcomp.pcomp.function(f.Name, start, body, f.Locals, f.FreeVars)
 
 	funcode.NumParams = numParams
 	funcode.HasVarArg = f.HasVarArg
+	funcode.Pure = fcomp.pcomp.purity.isPure(f)
 	fcomp.emit1(MAKEFUNC, fcomp.pcomp.functionIndex(funcode))
 }
 
+// class emits code to create a class. The class body is compiled as a
+// function that declares the fields and methods as its locals and returns
+// them, the class value is then created from those members and the inherited
+// value (nil if the class does not inherit).
+//
+//	[inherits | NIL]
+//	MAKEFUNC<body>
+//	CALL<0>
+//	MAKECLASS<name>
+func (fcomp *fcomp) class(pos token.Pos, inherits *ast.ClassInherit, f *resolver.Function) {
+	if inherits != nil && inherits.Expr != nil {
+		fcomp.expr(inherits.Expr)
+	} else {
+		fcomp.emit(NIL)
+	}
+	fcomp.function(f)
+	fcomp.setPos(pos)
+	fcomp.emit1(CALL, 0)
+	fcomp.emit1(MAKECLASS, fcomp.pcomp.nameIndex(f.Name))
+}
+
+// classBody emits the code of a class body function. It initializes the
+// fields and the methods in order of declaration and returns a tuple of name
+// and value pairs, one for each member. A member captured by a method is a
+// cell, and the cell itself is returned so that the class and its methods
+// share the same variable.
+func (fcomp *fcomp) classBody(body *ast.ClassBody) {
+	var members []*ast.IdentExpr
+	for _, f := range body.Fields {
+		fcomp.assignStmt(f)
+		for _, lhs := range f.Left {
+			members = append(members, lhs.(*ast.IdentExpr))
+		}
+	}
+	for _, m := range body.Methods {
+		fcomp.pcomp.purity.declare(m)
+		fcomp.function(m.Function.(*resolver.Function))
+		fcomp.set(m.Name)
+		members = append(members, m.Name)
+	}
+
+	for _, id := range members {
+		fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(id.Lit))
+		// LOCAL pushes the cell itself if the member is a cell
+		fcomp.emit1(LOCAL, uint32(id.Binding.(*resolver.Binding).Index))
+	}
+	fcomp.emit1(MAKETUPLE, uint32(2*len(members)))
+	fcomp.emit(RETURN)
+	fcomp.block = nil
+}
+
 func (fcomp *fcomp) call(call *ast.CallExpr) {
+	// resolver invariant: a spread argument can only be the last positional
+	// argument, its operand is pushed after the other positional arguments.
+	args := call.Args
+	var spread ast.Expr
+	if n := len(args); n > 0 {
+		if u, ok := args[n-1].(*ast.UnaryOpExpr); ok && u.Type == token.DOTDOTDOT {
+			spread = u.Right
+			args = args[:n-1]
+		}
+	}
+
 	fcomp.expr(call.Fn)
+	for _, arg := range args {
+		fcomp.expr(arg)
+	}
+	if spread != nil {
+		fcomp.expr(spread)
+	}
+	for _, arg := range call.Named {
+		fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(arg.Name.Lit))
+		fcomp.expr(arg.Value)
+	}
+
+	fcomp.setPos(callPos(call))
+
+	// Resolver invariant: there are at most 255 positional and named args.
+	op := CALL
+	if spread != nil {
+		op = CALL_VAR
+	}
+	fcomp.emit1(op, uint32(len(args)<<8|len(call.Named)))
+}
+
+// callPos returns the position where the runtime errors of the call are
+// reported: the opening parenthesis, the bang or the start of the single map
+// or string argument, depending on the form of the call.
+func callPos(call *ast.CallExpr) token.Pos {
+	pos := call.Lparen
+	if call.Bang.IsValid() {
+		pos = call.Bang
+	} else if !pos.IsValid() {
+		pos, _ = call.Args[0].Span()
+	}
+	return pos
+}
+
+// rangeCall returns the call of the for..in loop stmt if the Optimize mode
+// is set and the loop has a single variable that iterates over a call to
+// the range built-in with 2 or 3 positional arguments, nil otherwise.
+func (fcomp *fcomp) rangeCall(stmt *ast.ForInStmt) *ast.CallExpr {
+	if fcomp.pcomp.mode&Optimize == 0 || len(stmt.Left) != 1 || len(stmt.Right) != 1 {
+		return nil
+	}
+	call, ok := ast.Unwrap(stmt.Right[0]).(*ast.CallExpr)
+	if !ok || len(call.Named) > 0 || len(call.Args) < 2 || len(call.Args) > 3 {
+		return nil
+	}
+	if u, ok := call.Args[len(call.Args)-1].(*ast.UnaryOpExpr); ok && u.Type == token.DOTDOTDOT {
+		return nil
+	}
+	id, ok := call.Fn.(*ast.IdentExpr)
+	if !ok || id.Lit != "range" || id.Binding.(*resolver.Binding).Scope != resolver.Universal {
+		return nil
+	}
+	return call
+}
+
+// forRange compiles a for..in loop over a call to the range built-in (see
+// rangeCall). Instead of an iterator, the current value, stop and step of the
+// range are kept on the operand stack for the duration of the loop:
+//
+//	    <start> <stop> <step>
+//	    RANGEPUSH
+//	head:
+//	    RANGEJMP tail
+//	body:
+//	    <assign loop variable>
+//	    <body>
+//	    JMP head
+//	tail:
+//	    POP; POP; POP
+func (fcomp *fcomp) forRange(stmt *ast.ForInStmt, call *ast.CallExpr) {
+	head := fcomp.newBlock()
+	body := fcomp.newBlock()
+	tail := fcomp.newBlock()
+
 	for _, arg := range call.Args {
 		fcomp.expr(arg)
 	}
-	_, end := call.Fn.Span()
-	fcomp.setPos(end)
-	// TODO: cannot know the number of args statically, e.g. f(x, ...y, ...g())
-	// Need a way to dynamically get the start of the args slot on the stack.
-	// Also, CALL_VAR does not exist. Should the UNPACK opcode/operator be a
-	// special value on the stack instead, and unpacked only when necessary?
-	// Use a "set top of stack" opcode option like Lua?
-	fcomp.emit1(CALL, uint32(len(call.Args)))
+	if len(call.Args) == 2 {
+		fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(int64(1)))
+	}
+	fcomp.setPos(callPos(call))
+	fcomp.emit(RANGEPUSH)
+	fcomp.jump(head)
+
+	fcomp.block = head
+	fcomp.condjump(RANGEJMP, tail, body)
+
+	fcomp.block = body
+	fcomp.assign(stmt.For, stmt.Left[0])
+	fcomp.loops = append(fcomp.loops, loop{break_: tail, continue_: head, defers: fcomp.activeDefers, exit: POP, nexit: 3})
+	fcomp.stmts(stmt.Body.Stmts)
+	fcomp.loops = fcomp.loops[:len(fcomp.loops)-1]
+	fcomp.jump(head)
+
+	fcomp.block = tail
+	for i := 0; i < 3; i++ {
+		fcomp.emit(POP)
+	}
+}
+
+// assignStmt emits code for an assignment, augmented assignment or
+// declaration statement.
+func (fcomp *fcomp) assignStmt(stmt *ast.AssignStmt) {
+	if stmt.AssignTok.IsAugBinop() {
+		fcomp.augAssign(stmt)
+		return
+	}
+
+	switch {
+	case len(stmt.Right) == 0:
+		// declaration without values, all initialized to nil
+		for _, lhs := range stmt.Left {
+			fcomp.emit(NIL)
+			fcomp.assign(stmt.AssignPos, lhs)
+		}
+
+	case len(stmt.Left) == len(stmt.Right):
+		// evaluate all values first, then assign in reverse order
+		for _, rhs := range stmt.Right {
+			fcomp.expr(rhs)
+		}
+		for i := len(stmt.Left) - 1; i >= 0; i-- {
+			fcomp.assign(stmt.AssignPos, stmt.Left[i])
+		}
+
+	default:
+		// unpack the values of a single iterable, the resolver rejects other
+		// mismatches between the number of variables and values.
+		fcomp.expr(stmt.Right[0])
+		fcomp.assignSequence(stmt.AssignPos, stmt.Left)
+	}
+}
+
+// augAssign emits code for an augmented assignment, e.g. x += y.
+func (fcomp *fcomp) augAssign(stmt *ast.AssignStmt) {
+	var set func()
+
+	// Evaluate "address" of x exactly once to avoid duplicate side-effects.
+	switch lhs := ast.Unwrap(stmt.Left[0]).(type) {
+	case *ast.IdentExpr:
+		// x = ...
+		fcomp.lookup(lhs)
+		set = func() {
+			fcomp.set(lhs)
+		}
+
+	case *ast.IndexExpr:
+		// x[y] = ...
+		fcomp.expr(lhs.Prefix)
+		fcomp.expr(lhs.Index)
+		fcomp.emit(DUP2)
+		fcomp.setPos(lhs.Lbrack)
+		fcomp.emit(INDEX)
+		set = func() {
+			fcomp.setPos(lhs.Lbrack)
+			fcomp.emit(SETINDEX)
+		}
+
+	case *ast.DotExpr:
+		// x.f = ...
+		fcomp.expr(lhs.Left)
+		fcomp.emit(DUP)
+		name := fcomp.pcomp.nameIndex(lhs.Right.Lit)
+		fcomp.setPos(lhs.Dot)
+		fcomp.emit1(ATTR, name)
+		set = func() {
+			fcomp.setPos(lhs.Dot)
+			fcomp.emit1(SETFIELD, name)
+		}
+
+	default:
+		start, _ := lhs.Span()
+		fcomp.panicf(start, "unexpected augmented assignment target %T", lhs)
+	}
+
+	fcomp.expr(stmt.Right[0])
+	fcomp.binop(stmt.AssignPos, stmt.AssignTok-token.PLUSEQ+token.PLUS)
+	set()
+}
+
+// assign implements lhs = rhs for an arbitrary assignment target lhs, where
+// the value of rhs is on top of the stack.
+func (fcomp *fcomp) assign(pos token.Pos, lhs ast.Expr) {
+	switch lhs := lhs.(type) {
+	case *ast.ParenExpr:
+		// (lhs) = rhs
+		fcomp.assign(pos, lhs.Expr)
+
+	case *ast.IdentExpr:
+		// x = rhs
+		fcomp.set(lhs)
+
+	case *ast.IndexExpr:
+		// x[y] = rhs
+		fcomp.expr(lhs.Prefix)
+		fcomp.emit(EXCH)
+		fcomp.expr(lhs.Index)
+		fcomp.emit(EXCH)
+		fcomp.setPos(lhs.Lbrack)
+		fcomp.emit(SETINDEX)
+
+	case *ast.DotExpr:
+		// x.f = rhs
+		fcomp.expr(lhs.Left)
+		fcomp.emit(EXCH)
+		fcomp.setPos(lhs.Dot)
+		fcomp.emit1(SETFIELD, fcomp.pcomp.nameIndex(lhs.Right.Lit))
+
+	default:
+		start, _ := lhs.Span()
+		fcomp.panicf(start, "unexpected assignment target %T", lhs)
+	}
+}
+
+// assignSequence implements lhs1, ..., lhsN = rhs where rhs is an iterable
+// value on top of the stack that is unpacked to exactly N values.
+func (fcomp *fcomp) assignSequence(pos token.Pos, lhs []ast.Expr) {
+	fcomp.setPos(pos)
+	fcomp.emit1(UNPACK, uint32(len(lhs)))
+	for i := range lhs {
+		fcomp.assign(pos, lhs[i])
+	}
+}
+
+// binop emits a strict binary operator (not AND or OR), the operands are
+// expected to be on the stack.
+func (fcomp *fcomp) binop(pos token.Pos, op token.Token) {
+	fcomp.setPos(pos)
+	switch {
+	case op >= token.PLUS && op <= token.GTGT:
+		fcomp.emit(Opcode(op-token.PLUS) + PLUS)
+	case op >= token.EQEQ && op <= token.LE:
+		fcomp.emit(Opcode(op-token.EQEQ) + EQL)
+	case op == token.IN:
+		fcomp.emit(IN)
+	case op == token.NOTIN:
+		fcomp.emit(IN)
+		fcomp.emit(NOT)
+	default:
+		fcomp.panicf(pos, "unexpected binary operator %s", op)
+	}
+}
+
+// fold emits the constant value of the operation e and returns true if the
+// Optimize mode is set and e can be folded (see foldConstant).
+func (fcomp *fcomp) fold(e ast.Expr) bool {
+	if fcomp.pcomp.mode&Optimize == 0 {
+		return false
+	}
+	v, ok := foldConstant(e)
+	if ok {
+		fcomp.emit1(CONSTANT, fcomp.pcomp.constantIndex(v))
+	}
+	return ok
+}
+
+// literalValue returns the constant value of a string, bytes, int or float
+// literal.
+func literalValue(e *ast.LiteralExpr) interface{} {
+	if e.Type == token.BYTES {
+		return Bytes(e.Value.(string))
+	}
+	return e.Value // int64, float64, string
+}
+
+// constantTuple returns the constant tuple of the items of e if all of them
+// are constants, that is nil, booleans, numbers, strings or tuple literals of
+// constants. It returns false if e has no item.
+func constantTuple(e *ast.ArrayLikeExpr) (Tuple, bool) {
+	if len(e.Items) == 0 {
+		return nil, false
+	}
+
+	t := make(Tuple, 0, len(e.Items))
+	for _, item := range e.Items {
+		switch item := ast.Unwrap(item).(type) {
+		case *ast.LiteralExpr:
+			switch item.Type {
+			case token.NULL:
+				t = append(t, nil)
+			case token.TRUE:
+				t = append(t, true)
+			case token.FALSE:
+				t = append(t, false)
+			default:
+				t = append(t, literalValue(item))
+			}
+		case *ast.ArrayLikeExpr:
+			if item.Type == token.LBRACK {
+				return nil, false
+			}
+			tt, ok := constantTuple(item)
+			if !ok {
+				return nil, false
+			}
+			t = append(t, tt)
+		default:
+			return nil, false
+		}
+	}
+	return t, true
+}
+
+// labelBlock returns the block of the label identified by id, creating it if
+// necessary so that a goto can jump to a label that is not compiled yet.
+func (fcomp *fcomp) labelBlock(id *ast.IdentExpr) *block {
+	bind := id.Binding.(*resolver.Binding)
+	b := fcomp.labels[bind.Index]
+	if b == nil {
+		b = fcomp.newBlock()
+		if fcomp.labels == nil {
+			fcomp.labels = make(map[int]*block)
+		}
+		fcomp.labels[bind.Index] = b
+	}
+	return b
 }
 
 // lookup emits code to push the value of the specified variable.
@@ -749,7 +1539,7 @@ func (fcomp *fcomp) lookup(id *ast.IdentExpr) {
 	case resolver.Universal:
 		fcomp.emit1(UNIVERSAL, fcomp.pcomp.nameIndex(id.Lit))
 	default:
-		panic(fmt.Sprintf("%s: compiler.lookup(%s): scope = %d", fcomp.pcomp.file.Position(id.Start), id.Lit, bind.Scope))
+		fcomp.panicf(id.Start, "compiler.lookup(%s): scope = %d", id.Lit, bind.Scope)
 	}
 }
 
@@ -764,6 +1554,86 @@ func (fcomp *fcomp) emit(op Opcode) {
 	fcomp.pos.Col = 0
 }
 
+// jump emits a jump to the specified block. On return, the current block is
+// unset.
+func (fcomp *fcomp) jump(b *block) {
+	if b == fcomp.block {
+		panic("self-jump") // unreachable: a block can't jump to itself
+	}
+	fcomp.block.jmp = b
+	fcomp.block = nil
+}
+
+// catchjump emits a CATCHJMP that exits the current catch block and proceeds
+// to block b. On return, the current block is unset.
+func (fcomp *fcomp) catchjump(b *block) {
+	fcomp.emit1(CATCHJMP, 0) // fill in address later
+	fcomp.block.cjmp = b
+	fcomp.block = nil
+}
+
+// condjump emits a conditional jump (CJMP, ITERJMP or RANGEJMP) that
+// proceeds to block t if the condition holds, f otherwise. On return, the
+// current block is unset.
+func (fcomp *fcomp) condjump(op Opcode, t, f *block) {
+	if !isJump(op) {
+		panic(op)
+	}
+	fcomp.emit1(op, 0) // fill in address later
+	fcomp.block.cjmp = t
+	fcomp.jump(f)
+}
+
+// ifelse emits a Boolean control flow decision. On return, the current block
+// is unset.
+func (fcomp *fcomp) ifelse(cond ast.Expr, t, f *block) {
+	switch cond := cond.(type) {
+	case *ast.ParenExpr:
+		fcomp.ifelse(cond.Expr, t, f)
+		return
+
+	case *ast.UnaryOpExpr:
+		if cond.Type == token.NOT {
+			// if not x then goto t else goto f
+			//    =>
+			// if x then goto f else goto t
+			fcomp.ifelse(cond.Right, f, t)
+			return
+		}
+
+	case *ast.BinOpExpr:
+		switch cond.Type {
+		case token.AND:
+			// if x and y then goto t else goto f
+			//    =>
+			// if x then ifelse(y, t, f) else goto f
+			fcomp.expr(cond.Left)
+			y := fcomp.newBlock()
+			fcomp.condjump(CJMP, y, f)
+
+			fcomp.block = y
+			fcomp.ifelse(cond.Right, t, f)
+			return
+
+		case token.OR:
+			// if x or y then goto t else goto f
+			//    =>
+			// if x then goto t else ifelse(y, t, f)
+			fcomp.expr(cond.Left)
+			y := fcomp.newBlock()
+			fcomp.condjump(CJMP, t, y)
+
+			fcomp.block = y
+			fcomp.ifelse(cond.Right, t, f)
+			return
+		}
+	}
+
+	// general case
+	fcomp.expr(cond)
+	fcomp.condjump(CJMP, t, f)
+}
+
 // emit1 emits an instruction with an immediate operand.
 func (fcomp *fcomp) emit1(op Opcode, arg uint32) {
 	if op < OpcodeArgMin {
@@ -782,6 +1652,14 @@ func (fcomp *fcomp) setPos(pos token.Pos) {
 	fcomp.pos = positionFromTokenPos(fcomp.pcomp.file, pos)
 }
 
+// panicf panics with the formatted message prefixed with the source position
+// of pos, in fcomp.pcomp.file. It is used for internal compiler errors, such
+// as an unexpected AST node, so that they can be traced back to the source
+// code that triggered them.
+func (fcomp *fcomp) panicf(pos token.Pos, format string, args ...interface{}) {
+	panic(fmt.Sprintf("%s: %s", fcomp.pcomp.file.Position(pos), fmt.Sprintf(format, args...)))
+}
+
 // set emits code to store the top-of-stack value to the specified local or
 // cell variable.
 func (fcomp *fcomp) set(id *ast.IdentExpr) {
@@ -792,12 +1670,18 @@ func (fcomp *fcomp) set(id *ast.IdentExpr) {
 	case resolver.Cell:
 		fcomp.emit1(SETLOCALCELL, uint32(bind.Index))
 	default:
-		log.Panicf("%s: set(%s): not local/cell (%s)", id.Start, id.Lit, bind.Scope)
+		fcomp.panicf(id.Start, "set(%s): not local/cell (%s)", id.Lit, bind.Scope)
 	}
 }
 
 type loop struct {
 	break_, continue_ *block
+	defers            int // number of active defer blocks outside the loop
+	// instruction emitted nexit times to discard the state of the loop when a
+	// goto jumps out of it: ITERPOP for a for..in loop, POP for the values of a
+	// range loop, none for a for loop.
+	exit  Opcode
+	nexit int
 }
 
 // block is a block of code - every executable line of code is compiled inside
@@ -805,19 +1689,35 @@ type loop struct {
 type block struct {
 	insns []insn
 
-	// If the last insn is a RETURN, jmp and cjmp are nil.
-	// If the last insn is a CJMP or ITERJMP,
+	// If the last insn is a RETURN, THROW or CRITICAL, jmp and cjmp are nil.
+	// If the last insn is a CATCHJMP, cjmp is its target and jmp is nil.
+	// If the last insn is a CJMP, ITERJMP or RANGEJMP,
 	//  cjmp and jmp are the "true" and "false" successors.
 	// Otherwise, jmp is the sole successor.
 	jmp, cjmp *block
 
 	initialstack int // for stack depth computation
+	seq          int // creation order of the block in the function
 
 	// Used during encoding
 	index int // -1 => not encoded yet
 	addr  uint32
 }
 
+// hasExplicitJump returns true if the block must end with a JMP to its
+// successor, which is the case unless it is placed right before it. A block
+// that ends with RUNDEFER always needs it, as the machine only runs the
+// deferred code if RUNDEFER is immediately followed by the jump.
+func (b *block) hasExplicitJump() bool {
+	if b.jmp == nil {
+		return false
+	}
+	if n := len(b.insns); n > 0 && b.insns[n-1].op == RUNDEFER {
+		return true
+	}
+	return b.jmp.index != b.index+1
+}
+
 // bindings converts resolver.Bindings to compiled form.
 func bindings(file *token.File, bindings []*resolver.Binding) []Binding {
 	res := make([]Binding, len(bindings))
@@ -834,11 +1734,121 @@ type insn struct {
 	line, col uint32
 }
 
-func encodeInsn(code []byte, op Opcode, arg uint32) []byte {
+// stackeffect returns the effect of the instruction on the size of the
+// operand stack. For ITERJMP and RANGEJMP, the value pushed when the
+// iteration continues is accounted for by the caller.
+func (insn *insn) stackeffect() int {
+	se := int(stackEffect[insn.op])
+	if se == variableStackEffect {
+		arg := int(insn.arg)
+		switch insn.op {
+		case CALL:
+			se = -(arg>>8 + 2*(arg&0xff))
+		case CALL_VAR:
+			se = -(arg>>8 + 2*(arg&0xff) + 1)
+		case ITERJMP, RANGEJMP:
+			se = 0
+		case MAKEARRAY, MAKETUPLE:
+			se = 1 - arg
+		case UNPACK:
+			se = arg - 1
+		default:
+			panic(insn.op)
+		}
+	}
+	return se
+}
+
+// generate emits the byte code of the blocks, in order, and the pc-to-line
+// table of the function. The code is expected to be exactly size bytes long.
+func (fcomp *fcomp) generate(blocks []*block, size uint32) {
+	code := make([]byte, 0, size)
+	var pclinetab []uint16
+	prev := pclinecol{
+		pc:  0,
+		pos: fcomp.fn.pos,
+	}
+
+	for _, b := range blocks {
+		for _, insn := range b.insns {
+			if insn.line != 0 {
+				// Instruction has a source position. Delta-encode it.
+				// See Funcode.Pos for the encoding.
+				for {
+					var incomplete uint16
+
+					// Δpc, uint4
+					deltapc := uint32(len(code)) - prev.pc
+					if deltapc > 0x0f {
+						deltapc = 0x0f
+						incomplete = 1
+					}
+					prev.pc += deltapc
+
+					// Δline, int5
+					deltaline, ok := clip(int32(insn.line)-int32(prev.pos.Line), -0x10, 0x0f)
+					if !ok {
+						incomplete = 1
+					}
+					prev.pos.Line = uint32(int32(prev.pos.Line) + deltaline)
+
+					// Δcol, int6
+					deltacol, ok := clip(int32(insn.col)-int32(prev.pos.Col), -0x20, 0x1f)
+					if !ok {
+						incomplete = 1
+					}
+					prev.pos.Col = uint32(int32(prev.pos.Col) + deltacol)
+
+					entry := uint16(deltapc<<12) | uint16(deltaline&0x1f)<<7 | uint16(deltacol&0x3f)<<1 | incomplete
+					pclinetab = append(pclinetab, entry)
+					if incomplete == 0 {
+						break
+					}
+				}
+			}
+			code = encodeInsn(code, insn.op, insn.arg, fcomp.fn.CompactJumps)
+		}
+
+		if b.hasExplicitJump() {
+			code = encodeInsn(code, JMP, b.jmp.addr, fcomp.fn.CompactJumps)
+		}
+	}
+
+	if uint32(len(code)) != size {
+		panic("internal error: wrong code size")
+	}
+
+	fcomp.fn.pclinetab = pclinetab
+	fcomp.fn.Code = code
+}
+
+// clip returns the value nearest x in the range [min, max] and reports
+// whether it is in range.
+func clip(x, min, max int32) (int32, bool) {
+	if x > max {
+		return max, false
+	} else if x < min {
+		return min, false
+	}
+	return x, true
+}
+
+// encodeInsn appends the encoded instruction to code. If compact is true,
+// jump arguments are not padded to 4 bytes.
+func encodeInsn(code []byte, op Opcode, arg uint32, compact bool) []byte {
 	code = append(code, byte(op))
 	if op >= OpcodeArgMin {
 		if isJump(op) {
-			code = addUint32(code, arg, 4) // pad arg to 4 bytes
+			if arg > maxJumpAddr {
+				// abort rather than emit a jump argument larger than 4 bytes, which
+				// would corrupt the addresses computed for the following code.
+				panic(&limitError{err: ErrJumpAddrLimit, max: maxJumpAddr})
+			}
+			min := 4 // pad arg to 4 bytes
+			if compact {
+				min = 0
+			}
+			code = addUint32(code, arg, min)
 		} else {
 			code = addUint32(code, arg, 0)
 		}
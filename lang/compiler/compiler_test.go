@@ -0,0 +1,2477 @@
+package compiler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/resolver"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/require"
+)
+
+// compileCFG parses, resolves and compiles the top-level statements of src to
+// a control-flow graph of blocks, without linearization. It returns the entry
+// block. Any identifier that is not declared in src resolves as predeclared.
+func compileCFG(t *testing.T, src string) *block {
+	t.Helper()
+	return compileCFGWith(t, src, nil)
+}
+
+// compileCFGWith is like compileCFG but calls setup, if non-nil, with the
+// function compiler before the statements are compiled.
+func compileCFGWith(t *testing.T, src string, setup func(*fcomp)) *block {
+	t.Helper()
+
+	ctx := context.Background()
+	fset := token.NewFileSet()
+	ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(src))
+	require.NoError(t, err)
+	err = resolver.ResolveFiles(ctx, fset, []*ast.Chunk{ch}, 0, nil,
+		func(string) bool { return true }, nil)
+	require.NoError(t, err)
+
+	start, _ := ch.Span()
+	file := fset.File(start)
+	pcomp := &pcomp{
+		prog:      &Program{Filename: file.Name(), Functions: []*Funcode{nil}},
+		file:      file,
+		limits:    (*Limits)(nil).orDefault(),
+		names:     make(map[string]uint32),
+		constants: make(map[interface{}]uint32),
+		functions: make(map[*Funcode]uint32),
+	}
+	fcomp := &fcomp{
+		pcomp: pcomp,
+		fn:    &Funcode{Prog: pcomp.prog, Name: "test"},
+	}
+	if setup != nil {
+		setup(fcomp)
+	}
+	entry := fcomp.newBlock()
+	fcomp.block = entry
+	fcomp.stmts(ch.Block.Stmts)
+	if fcomp.block != nil {
+		fcomp.emit(NIL)
+		fcomp.emit(RETURN)
+	}
+	return entry
+}
+
+// dumpCFG returns a textual representation of the blocks reachable from
+// entry, in the order the linearization would visit them. Each block is
+// printed with its index followed by its instructions, jump instructions
+// reference the index of their target block, and the unconditional jump to
+// the successor block (if any) is printed as a JMP at the end of the block.
+// Empty blocks are skipped, as in the linearization. The catch blocks, which
+// are not reachable from entry, are visited after it.
+func dumpCFG(entry *block, catches ...*block) string {
+	thread := func(b *block) *block {
+		for b != nil && b.insns == nil {
+			b = b.jmp
+		}
+		return b
+	}
+
+	indices := make(map[*block]int)
+	var blocks []*block
+	var visit func(b *block)
+	visit = func(b *block) {
+		if _, ok := indices[b]; ok {
+			return
+		}
+		indices[b] = len(blocks)
+		blocks = append(blocks, b)
+		if jmp := thread(b.jmp); jmp != nil {
+			visit(jmp)
+		}
+		if cjmp := thread(b.cjmp); cjmp != nil {
+			visit(cjmp)
+		}
+	}
+	visit(thread(entry))
+	for _, b := range catches {
+		visit(thread(b))
+	}
+
+	var sb strings.Builder
+	for i, b := range blocks {
+		fmt.Fprintf(&sb, "%d:\n", i)
+		for _, insn := range b.insns {
+			op := strings.ToUpper(insn.op.String())
+			switch {
+			case isJump(insn.op):
+				fmt.Fprintf(&sb, "\t%s %d\n", op, indices[thread(b.cjmp)])
+			case insn.op >= OpcodeArgMin:
+				fmt.Fprintf(&sb, "\t%s %d\n", op, insn.arg)
+			default:
+				fmt.Fprintf(&sb, "\t%s\n", op)
+			}
+		}
+		if jmp := thread(b.jmp); jmp != nil {
+			fmt.Fprintf(&sb, "\tJMP %d\n", indices[jmp])
+		}
+	}
+	return sb.String()
+}
+
+// regionOps returns, for each region, the opcodes of the blocks it covers that
+// are reachable from entry or from the start of a defer or catch block of fc,
+// in creation order.
+func regionOps(entry *block, fc *fcomp, regions []region) []string {
+	blocks := make(map[int]*block)
+	var collect func(b *block)
+	collect = func(b *block) {
+		if b == nil || blocks[b.seq] != nil {
+			return
+		}
+		blocks[b.seq] = b
+		collect(b.jmp)
+		collect(b.cjmp)
+	}
+	collect(entry)
+	for _, r := range fc.defers {
+		collect(r.start)
+	}
+	for _, r := range fc.catches {
+		collect(r.start)
+	}
+
+	var res []string
+	for _, r := range regions {
+		var ops []string
+		for seq := r.first; seq <= r.last; seq++ {
+			if b := blocks[seq]; b != nil {
+				for _, insn := range b.insns {
+					ops = append(ops, strings.ToUpper(insn.op.String()))
+				}
+			}
+		}
+		res = append(res, strings.Join(ops, " "))
+	}
+	return res
+}
+
+func TestCompileIf(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want string
+	}{
+		{"if", `
+if x then
+	f()
+end
+`, `
+0:
+	PREDECLARED 0
+	CJMP 2
+	JMP 1
+1:
+	NIL
+	RETURN
+2:
+	PREDECLARED 1
+	CALL 0
+	POP
+	JMP 1
+`},
+
+		{"if else", `
+if x then
+	f()
+else
+	g()
+end
+`, `
+0:
+	PREDECLARED 0
+	CJMP 3
+	JMP 1
+1:
+	PREDECLARED 2
+	CALL 0
+	POP
+	JMP 2
+2:
+	NIL
+	RETURN
+3:
+	PREDECLARED 1
+	CALL 0
+	POP
+	JMP 2
+`},
+
+		{"if elseif else", `
+if x then
+	f()
+elseif y then
+	g()
+else
+	h()
+end
+`, `
+0:
+	PREDECLARED 0
+	CJMP 5
+	JMP 1
+1:
+	PREDECLARED 2
+	CJMP 4
+	JMP 2
+2:
+	PREDECLARED 4
+	CALL 0
+	POP
+	JMP 3
+3:
+	NIL
+	RETURN
+4:
+	PREDECLARED 3
+	CALL 0
+	POP
+	JMP 3
+5:
+	PREDECLARED 1
+	CALL 0
+	POP
+	JMP 3
+`},
+
+		{"if not", `
+if not x then
+	f()
+end
+`, `
+0:
+	PREDECLARED 0
+	CJMP 2
+	JMP 1
+1:
+	PREDECLARED 1
+	CALL 0
+	POP
+	JMP 2
+2:
+	NIL
+	RETURN
+`},
+
+		{"if and", `
+if x and y then
+	f()
+end
+`, `
+0:
+	PREDECLARED 0
+	CJMP 2
+	JMP 1
+1:
+	NIL
+	RETURN
+2:
+	PREDECLARED 1
+	CJMP 3
+	JMP 1
+3:
+	PREDECLARED 2
+	CALL 0
+	POP
+	JMP 1
+`},
+
+		{"guard", `
+guard x else
+	f()
+end
+g()
+`, `
+0:
+	PREDECLARED 0
+	CJMP 2
+	JMP 1
+1:
+	PREDECLARED 1
+	CALL 0
+	POP
+	JMP 2
+2:
+	PREDECLARED 2
+	CALL 0
+	POP
+	NIL
+	RETURN
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			entry := compileCFG(t, c.src)
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+		})
+	}
+}
+
+func TestCompileForLoop(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want string
+	}{
+		{"three-part sum", `
+let n = 10
+let sum = 0
+for let i = 1; i <= n; i += 1 do
+	sum += i
+end
+`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	CONSTANT 1
+	SETLOCAL 1
+	CONSTANT 2
+	SETLOCAL 2
+	JMP 1
+1:
+	LOCAL 2
+	LOCAL 0
+	LE
+	CJMP 3
+	JMP 2
+2:
+	NIL
+	RETURN
+3:
+	LOCAL 1
+	LOCAL 2
+	PLUS
+	SETLOCAL 1
+	JMP 4
+4:
+	LOCAL 2
+	CONSTANT 2
+	PLUS
+	SETLOCAL 2
+	JMP 1
+`},
+
+		{"condition-only sum", `
+let n = 10
+let sum = 0
+let i = 1
+for i <= n do
+	sum = sum + i
+	i = i + 1
+end
+`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	CONSTANT 1
+	SETLOCAL 1
+	CONSTANT 2
+	SETLOCAL 2
+	JMP 1
+1:
+	LOCAL 2
+	LOCAL 0
+	LE
+	CJMP 3
+	JMP 2
+2:
+	NIL
+	RETURN
+3:
+	LOCAL 1
+	LOCAL 2
+	PLUS
+	SETLOCAL 1
+	LOCAL 2
+	CONSTANT 2
+	PLUS
+	SETLOCAL 2
+	JMP 1
+`},
+
+		{"break and continue", `
+let i = 0
+for ;; do
+	i += 1
+	if i > 10 then
+		break
+	end
+	if i == 5 then
+		continue
+	end
+	f(i)
+end
+`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	JMP 1
+1:
+	LOCAL 0
+	CONSTANT 1
+	PLUS
+	SETLOCAL 0
+	LOCAL 0
+	CONSTANT 2
+	GT
+	CJMP 4
+	JMP 2
+2:
+	LOCAL 0
+	CONSTANT 3
+	EQL
+	CJMP 1
+	JMP 3
+3:
+	PREDECLARED 0
+	LOCAL 0
+	CALL 256
+	POP
+	JMP 1
+4:
+	NIL
+	RETURN
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			entry := compileCFG(t, c.src)
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+		})
+	}
+}
+
+func TestCompileForIn(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want string
+	}{
+		{"array", `
+let sum = 0
+for x in [1, 2, 3] do
+	sum += x
+end
+`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	CONSTANT 1
+	COPYARRAY
+	ITERPUSH
+	JMP 1
+1:
+	ITERJMP 3
+	JMP 2
+2:
+	SETLOCAL 1
+	LOCAL 0
+	LOCAL 1
+	PLUS
+	SETLOCAL 0
+	JMP 1
+3:
+	ITERPOP
+	NIL
+	RETURN
+`},
+
+		{"tuple", `
+let arr = []
+for x in (1, 2) do
+	f(arr, x)
+end
+`, `
+0:
+	MAKEARRAY 0
+	SETLOCAL 0
+	CONSTANT 0
+	ITERPUSH
+	JMP 1
+1:
+	ITERJMP 3
+	JMP 2
+2:
+	SETLOCAL 1
+	PREDECLARED 0
+	LOCAL 0
+	LOCAL 1
+	CALL 512
+	POP
+	JMP 1
+3:
+	ITERPOP
+	NIL
+	RETURN
+`},
+
+		{"multiple variables", `
+for k, v in m do
+	if k then
+		continue
+	end
+	if v then
+		break
+	end
+end
+`, `
+0:
+	PREDECLARED 0
+	ITERPUSH
+	JMP 1
+1:
+	ITERJMP 4
+	JMP 2
+2:
+	UNPACK 2
+	SETLOCAL 0
+	SETLOCAL 1
+	LOCAL 0
+	CJMP 1
+	JMP 3
+3:
+	LOCAL 1
+	CJMP 4
+	JMP 1
+4:
+	ITERPOP
+	NIL
+	RETURN
+`},
+
+		{"multiple values", `
+for x in a, b do
+	f(x)
+end
+`, `
+0:
+	PREDECLARED 0
+	PREDECLARED 1
+	MAKETUPLE 2
+	ITERPUSH
+	JMP 1
+1:
+	ITERJMP 3
+	JMP 2
+2:
+	SETLOCAL 0
+	PREDECLARED 2
+	LOCAL 0
+	CALL 256
+	POP
+	JMP 1
+3:
+	ITERPOP
+	NIL
+	RETURN
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			entry := compileCFG(t, c.src)
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+		})
+	}
+}
+
+func TestCompileReturn(t *testing.T) {
+	cases := []struct {
+		desc     string
+		src      string
+		deferred bool
+		want     string
+	}{
+		{"naked", `return`, false, `
+0:
+	NIL
+	RETURN
+`},
+
+		{"value", `
+let x = 1
+return x + 2
+`, false, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	LOCAL 0
+	CONSTANT 1
+	PLUS
+	RETURN
+`},
+
+		{"in if", `
+let x = 1
+if x then
+	return x
+end
+return
+`, false, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	LOCAL 0
+	CJMP 2
+	JMP 1
+1:
+	NIL
+	RETURN
+2:
+	LOCAL 0
+	RETURN
+`},
+
+		{"in loop", `
+for x in [1, 2] do
+	return x
+end
+`, false, `
+0:
+	CONSTANT 0
+	COPYARRAY
+	ITERPUSH
+	JMP 1
+1:
+	ITERJMP 3
+	JMP 2
+2:
+	SETLOCAL 0
+	LOCAL 0
+	RETURN
+3:
+	ITERPOP
+	NIL
+	RETURN
+`},
+
+		{"naked with defer", `return`, true, `
+0:
+	NIL
+	RUNDEFER
+	RETURN
+`},
+
+		{"value with defer", `
+let x = 1
+if x then
+	return x
+end
+`, true, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	LOCAL 0
+	CJMP 2
+	JMP 1
+1:
+	NIL
+	RETURN
+2:
+	LOCAL 0
+	RUNDEFER
+	RETURN
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			entry := compileCFGWith(t, c.src, func(fcomp *fcomp) {
+				if c.deferred {
+					// simulate a return point covered by a defer block
+					fcomp.activeDefers = 1
+				}
+			})
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+		})
+	}
+}
+
+func TestCompileThrow(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want string
+	}{
+		{"value", `throw "oops"`, `
+0:
+	CONSTANT 0
+	THROW
+`},
+
+		{"in if", `
+let x = 1
+if x then
+	throw x
+end
+return x
+`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	LOCAL 0
+	CJMP 2
+	JMP 1
+1:
+	LOCAL 0
+	RETURN
+2:
+	LOCAL 0
+	THROW
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			entry := compileCFGWith(t, c.src, nil)
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+		})
+	}
+
+	t.Run("naked in catch", func(t *testing.T) {
+		prog := compileProgram(t, `
+catch
+	throw
+end
+return 1
+`)
+		want := `
+0	jmp 7
+5	nil
+6	throw
+7	constant 0
+9	return
+`
+		require.Equal(t, strings.TrimSpace(want), strings.TrimSpace(disasm(prog.Functions[0])))
+		require.Equal(t, []Defer{{PC0: 7, PC1: 9, StartPC: 5}}, prog.Functions[0].Catches)
+	})
+}
+
+func TestCompileEmpty(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+	}{
+		{"empty", ``},
+		{"whitespace", " \n\t\n  \n"},
+		{"comments", "-- a comment\n  --[[ a long\ncomment ]]\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			fset := token.NewFileSet()
+			ch, err := parser.ParseChunk(ctx, parser.Comments, fset, "test", []byte(c.src))
+			require.NoError(t, err)
+			require.Empty(t, ch.Block.Stmts)
+
+			chunks := []*ast.Chunk{ch}
+			require.NoError(t, resolver.ResolveFiles(ctx, fset, chunks, 0, nil, nil, nil))
+			fn := ch.Function.(*resolver.Function)
+			require.Empty(t, fn.Locals)
+			require.Empty(t, fn.FreeVars)
+
+			progs, err := CompileFiles(ctx, fset, chunks, 0, nil)
+			require.NoError(t, err)
+			require.Len(t, progs, 1)
+			prog := progs[0]
+			require.Equal(t, "test", prog.Filename)
+			require.Len(t, prog.Functions, 1)
+			require.NotNil(t, prog.Functions[0])
+			require.Empty(t, prog.Names)
+			require.Empty(t, prog.Constants)
+
+			top := prog.Functions[0]
+			require.Equal(t, 0, top.NumParams)
+			require.Empty(t, top.Locals)
+			require.Empty(t, top.Defers)
+			require.Empty(t, top.Catches)
+
+			// the top-level implicitly returns nil
+			entry := compileCFG(t, c.src)
+			require.Equal(t, "0:\n\tNIL\n\tRETURN", strings.TrimSpace(dumpCFG(entry)))
+		})
+	}
+
+	t.Run("no chunks", func(t *testing.T) {
+		progs, err := CompileFiles(context.Background(), token.NewFileSet(), nil, 0, nil)
+		require.NoError(t, err)
+		require.Nil(t, progs)
+	})
+}
+
+func TestCompilePass(t *testing.T) {
+	t.Run("function body", func(t *testing.T) {
+		ctx := context.Background()
+		fset := token.NewFileSet()
+		ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(`fn f() pass end`))
+		require.NoError(t, err)
+
+		chunks := []*ast.Chunk{ch}
+		require.NoError(t, resolver.ResolveFiles(ctx, fset, chunks, 0, nil, nil, nil))
+		progs, err := CompileFiles(ctx, fset, chunks, 0, nil)
+		require.NoError(t, err)
+		require.Len(t, progs[0].Functions, 2)
+
+		// the function is empty, it implicitly returns nil
+		fn := progs[0].Functions[1]
+		require.Equal(t, "f", fn.Name)
+		require.Equal(t, []byte{byte(NIL), byte(RETURN)}, fn.Code)
+	})
+
+	t.Run("branch body", func(t *testing.T) {
+		withPass := compileCFG(t, `
+if x then
+	pass
+else
+	g()
+end
+`)
+		empty := compileCFG(t, `
+if x then
+else
+	g()
+end
+`)
+		require.Equal(t, dumpCFG(empty), dumpCFG(withPass))
+	})
+}
+
+func TestCompileLimits(t *testing.T) {
+	// generate a program with 10 distinct constants, 10 distinct names and 10
+	// functions (the top-level and 9 nested ones).
+	var sb strings.Builder
+	for i := 0; i < 9; i++ {
+		fmt.Fprintf(&sb, "x%d.a%d = %d\n", i, i, i)
+	}
+	fmt.Fprintf(&sb, "let s = 'abc'\n")
+	for i := 0; i < 9; i++ {
+		fmt.Fprintf(&sb, "let f%d = fn() end\n", i)
+	}
+	src := sb.String()
+
+	cases := []struct {
+		desc   string
+		limits *Limits
+		err    error
+		errMsg string
+	}{
+		{"no limit", nil, nil, ""},
+		{"zero limits", &Limits{}, nil, ""},
+		{"exact limits", &Limits{MaxConstants: 10, MaxNames: 18, MaxFunctions: 10}, nil, ""},
+		{"constants", &Limits{MaxConstants: 9}, ErrConstantPoolLimit, "test: constant pool limit exceeded (max 9)"},
+		{"no constant", &Limits{MaxConstants: 1, MaxNames: 1, MaxFunctions: 1}, ErrNamePoolLimit, "test: name pool limit exceeded (max 1)"},
+		{"names", &Limits{MaxNames: 17}, ErrNamePoolLimit, "test: name pool limit exceeded (max 17)"},
+		{"functions", &Limits{MaxFunctions: 9}, ErrFunctionPoolLimit, "test: function pool limit exceeded (max 9)"},
+		{"top-level only", &Limits{MaxFunctions: 1}, ErrFunctionPoolLimit, "test: function pool limit exceeded (max 1)"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			fset := token.NewFileSet()
+			ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(src))
+			require.NoError(t, err)
+			chunks := []*ast.Chunk{ch}
+			err = resolver.ResolveFiles(ctx, fset, chunks, 0, nil, func(string) bool { return true }, nil)
+			require.NoError(t, err)
+
+			progs, err := CompileFiles(ctx, fset, chunks, 0, c.limits)
+			if c.err != nil {
+				require.ErrorIs(t, err, c.err)
+				require.EqualError(t, err, c.errMsg)
+				require.Nil(t, progs)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, progs, 1)
+			require.Len(t, progs[0].Constants, 10)
+			require.Len(t, progs[0].Names, 18)
+			require.Len(t, progs[0].Functions, 10)
+		})
+	}
+}
+
+func TestCompileSourceLimits(t *testing.T) {
+	ctx := context.Background()
+	fset := token.NewFileSet()
+	var chunks []*ast.Chunk
+	for i := 0; i < 3; i++ {
+		ch, err := parser.ParseChunk(ctx, 0, fset, fmt.Sprintf("test%d", i), []byte("let x = 1\n"))
+		require.NoError(t, err)
+		chunks = append(chunks, ch)
+	}
+	require.NoError(t, resolver.ResolveFiles(ctx, fset, chunks, 0, nil, nil, nil))
+
+	progs, err := CompileFiles(ctx, fset, chunks, 0, &Limits{Source: token.SourceLimits{MaxFiles: 3, MaxBytes: 30}})
+	require.NoError(t, err)
+	require.Len(t, progs, 3)
+
+	_, err = CompileFiles(ctx, fset, chunks, 0, &Limits{Source: token.SourceLimits{MaxFiles: 2}})
+	require.ErrorIs(t, err, token.ErrFileLimit)
+	_, err = CompileFiles(ctx, fset, chunks, 0, &Limits{Source: token.SourceLimits{MaxBytes: 29}})
+	require.ErrorIs(t, err, token.ErrByteLimit)
+	_, err = CompileCached(ctx, fset, chunks, 0, &Limits{Source: token.SourceLimits{MaxFiles: 1}}, t.TempDir())
+	require.ErrorIs(t, err, token.ErrFileLimit)
+}
+
+func TestCompileNumberLiterals(t *testing.T) {
+	cases := []struct {
+		src  string
+		want interface{}
+	}{
+		{`0x1.8p3`, float64(12)},
+		{`0x.8p1`, float64(1)},
+		{`0X1P-2`, float64(0.25)},
+		{`0x_1f.f_fp+4`, float64(511.9375)},
+		{`0x1p0`, float64(1)},
+		{`1.5e2`, float64(150)},
+		{`0x1f`, int64(31)},
+	}
+	for _, c := range cases {
+		t.Run(c.src, func(t *testing.T) {
+			ctx := context.Background()
+			fset := token.NewFileSet()
+			ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte("return "+c.src))
+			require.NoError(t, err)
+			chunks := []*ast.Chunk{ch}
+			require.NoError(t, resolver.ResolveFiles(ctx, fset, chunks, 0, nil, nil, nil))
+
+			progs, err := CompileFiles(ctx, fset, chunks, 0, nil)
+			require.NoError(t, err)
+			require.Len(t, progs, 1)
+			require.Equal(t, []interface{}{c.want}, progs[0].Constants)
+		})
+	}
+}
+
+func TestCompileConstantLiterals(t *testing.T) {
+	cases := []struct {
+		desc      string
+		src       string
+		want      string
+		constants []interface{}
+	}{
+		{"tuple", `return (1, "a", (2.5, true, null))`, `
+0:
+	CONSTANT 0
+	RETURN
+`, []interface{}{Tuple{int64(1), "a", Tuple{2.5, true, nil}}}},
+
+		{"array", `return [1, 2]`, `
+0:
+	CONSTANT 0
+	COPYARRAY
+	RETURN
+`, []interface{}{Tuple{int64(1), int64(2)}}},
+
+		{"shared", `return ([1, 2], (1, 2), (1.0, 2))`, `
+0:
+	CONSTANT 0
+	COPYARRAY
+	CONSTANT 0
+	CONSTANT 1
+	MAKETUPLE 3
+	RETURN
+`, []interface{}{Tuple{int64(1), int64(2)}, Tuple{float64(1), int64(2)}}},
+
+		{"nested array", `return ([1], 2)`, `
+0:
+	CONSTANT 0
+	COPYARRAY
+	CONSTANT 1
+	MAKETUPLE 2
+	RETURN
+`, []interface{}{Tuple{int64(1)}, int64(2)}},
+
+		{"bytes", `return (b"a", "a", b"a")`, `
+0:
+	CONSTANT 0
+	RETURN
+`, []interface{}{Tuple{Bytes("a"), "a", Bytes("a")}}},
+
+		{"bytes and string", `let x = b"a" return "a"`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	CONSTANT 1
+	RETURN
+`, []interface{}{Bytes("a"), "a"}},
+
+		{"not constant", `return (1, x)`, `
+0:
+	CONSTANT 0
+	PREDECLARED 0
+	MAKETUPLE 2
+	RETURN
+`, []interface{}{int64(1)}},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			prog := compileProgram(t, c.src)
+			require.Equal(t, c.constants, prog.Constants)
+
+			entry := compileCFG(t, c.src)
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+		})
+	}
+}
+
+func TestCompileFuncStmt(t *testing.T) {
+	cases := []struct {
+		desc  string
+		src   string
+		want  string
+		cells []int    // cells of the top-level
+		funcs []string // name:params:freevars of the functions
+	}{
+		{"declare and call", `
+fn add(a, b)
+	return a + b
+end
+return add(1, 2)
+`, `
+0:
+	MAKETUPLE 0
+	MAKEFUNC 1
+	SETLOCAL 0
+	LOCAL 0
+	CONSTANT 0
+	CONSTANT 1
+	CALL 512
+	RETURN
+`, nil, []string{"test:0:0", "add:2:0"}},
+
+		{"recursive", `
+fn fact(n)
+	if n <= 1 then
+		return 1
+	end
+	return n * fact(n - 1)
+end
+return fact(5)
+`, `
+0:
+	LOCAL 0
+	MAKETUPLE 1
+	MAKEFUNC 1
+	SETLOCALCELL 0
+	LOCALCELL 0
+	CONSTANT 1
+	CALL 256
+	RETURN
+`, []int{0}, []string{"test:0:0", "fact:1:1"}},
+
+		{"nested", `
+fn outer()
+	fn inner() end
+	return inner
+end
+`, `
+0:
+	MAKETUPLE 0
+	MAKEFUNC 2
+	SETLOCAL 0
+	NIL
+	RETURN
+`, nil, []string{"test:0:0", "inner:0:0", "outer:0:0"}},
+
+		// the inner function captures a through the outer one
+		{"capture through enclosing", `
+let a = 1
+fn outer()
+	fn inner() return a end
+	return inner
+end
+`, `
+0:
+	CONSTANT 0
+	SETLOCALCELL 0
+	LOCAL 0
+	MAKETUPLE 1
+	MAKEFUNC 2
+	SETLOCAL 1
+	NIL
+	RETURN
+`, []int{0}, []string{"test:0:0", "inner:0:1", "outer:0:1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			fset := token.NewFileSet()
+			ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(c.src))
+			require.NoError(t, err)
+			chunks := []*ast.Chunk{ch}
+			require.NoError(t, resolver.ResolveFiles(ctx, fset, chunks, 0, nil, nil, nil))
+			progs, err := CompileFiles(ctx, fset, chunks, 0, nil)
+			require.NoError(t, err)
+
+			prog := progs[0]
+			require.Equal(t, c.cells, prog.Functions[0].Cells)
+			var funcs []string
+			for _, fn := range prog.Functions {
+				funcs = append(funcs, fmt.Sprintf("%s:%d:%d", fn.Name, fn.NumParams, len(fn.Freevars)))
+			}
+			require.Equal(t, c.funcs, funcs)
+			require.NoError(t, Verify(prog))
+
+			entry := compileCFG(t, c.src)
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+		})
+	}
+
+	t.Run("const name", func(t *testing.T) {
+		ctx := context.Background()
+		fset := token.NewFileSet()
+		ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte("fn f() end\nf = 1"))
+		require.NoError(t, err)
+		err = resolver.ResolveFiles(ctx, fset, []*ast.Chunk{ch}, 0, nil, nil, nil)
+		require.ErrorContains(t, err, "assignment to immutable variable: f")
+	})
+}
+
+func TestCompileClass(t *testing.T) {
+	cases := []struct {
+		desc  string
+		src   string
+		want  string
+		cells [][]int  // cells of each function
+		funcs []string // name:params:freevars of the functions
+	}{
+		{"statement", `
+class Foo!
+	let x = 1
+	fn get() return x end
+end
+return Foo.get()
+`, `
+0:
+	NIL
+	MAKETUPLE 0
+	MAKEFUNC 2
+	CALL 0
+	MAKECLASS 0
+	SETLOCAL 0
+	LOCAL 0
+	ATTR 1
+	CALL 0
+	RETURN
+`, [][]int{nil, nil, {0}}, []string{"test:0:0", "get:0:1", "Foo:0:0"}},
+
+		{"inherits", `
+class Foo! end
+class Bar(Foo)
+	const y = 2
+end
+`, `
+0:
+	NIL
+	MAKETUPLE 0
+	MAKEFUNC 1
+	CALL 0
+	MAKECLASS 0
+	SETLOCAL 0
+	LOCAL 0
+	MAKETUPLE 0
+	MAKEFUNC 2
+	CALL 0
+	MAKECLASS 1
+	SETLOCAL 1
+	NIL
+	RETURN
+`, [][]int{nil, nil, nil}, []string{"test:0:0", "Foo:0:0", "Bar:0:0"}},
+
+		{"expression", `
+let a = 1
+return class!
+	fn f() return a end
+end
+`, `
+0:
+	CONSTANT 0
+	SETLOCALCELL 0
+	NIL
+	LOCAL 0
+	MAKETUPLE 1
+	MAKEFUNC 2
+	CALL 0
+	MAKECLASS 0
+	RETURN
+`, [][]int{{0}, nil, nil}, []string{"test:0:0", "f:0:1", "anonymous:0:1"}},
+
+		{"method refers to class", `
+class Foo!
+	fn new() return Foo end
+end
+`, `
+0:
+	NIL
+	LOCAL 0
+	MAKETUPLE 1
+	MAKEFUNC 2
+	CALL 0
+	MAKECLASS 0
+	SETLOCALCELL 0
+	NIL
+	RETURN
+`, [][]int{{0}, nil, nil}, []string{"test:0:0", "new:0:1", "Foo:0:1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			fset := token.NewFileSet()
+			ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(c.src))
+			require.NoError(t, err)
+			chunks := []*ast.Chunk{ch}
+			require.NoError(t, resolver.ResolveFiles(ctx, fset, chunks, 0, nil, nil, nil))
+			progs, err := CompileFiles(ctx, fset, chunks, 0, nil)
+			require.NoError(t, err)
+
+			prog := progs[0]
+			var funcs []string
+			var cells [][]int
+			for _, fn := range prog.Functions {
+				funcs = append(funcs, fmt.Sprintf("%s:%d:%d", fn.Name, fn.NumParams, len(fn.Freevars)))
+				cells = append(cells, fn.Cells)
+			}
+			require.Equal(t, c.funcs, funcs)
+			require.Equal(t, c.cells, cells)
+			require.NoError(t, Verify(prog))
+
+			entry := compileCFG(t, c.src)
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+		})
+	}
+}
+
+func TestCompileUnpack(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want string
+	}{
+		{"single iterable", `let a, b = x`, `
+0:
+	PREDECLARED 0
+	UNPACK 2
+	SETLOCAL 0
+	SETLOCAL 1
+	NIL
+	RETURN
+`},
+
+		{"targets", `a.b, c[0] = x`, `
+0:
+	PREDECLARED 0
+	UNPACK 2
+	PREDECLARED 1
+	EXCH
+	SETFIELD 2
+	PREDECLARED 3
+	EXCH
+	CONSTANT 0
+	EXCH
+	SETINDEX
+	NIL
+	RETURN
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			entry := compileCFG(t, c.src)
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+		})
+	}
+}
+
+func TestCompileCall(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want string
+		col  uint32 // column of the CALL instruction
+	}{
+		{"args", `f(1, 2)`, `
+0:
+	PREDECLARED 0
+	CONSTANT 0
+	CONSTANT 1
+	CALL 512
+	POP
+	NIL
+	RETURN
+`, 2},
+
+		{"spread", `f(1, ...x, a: 2)`, `
+0:
+	PREDECLARED 0
+	CONSTANT 0
+	PREDECLARED 1
+	CONSTANT 1
+	CONSTANT 2
+	CALL_VAR 257
+	POP
+	NIL
+	RETURN
+`, 2},
+
+		{"no arg", `f()`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	POP
+	NIL
+	RETURN
+`, 2},
+
+		{"bang", `f!`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	POP
+	NIL
+	RETURN
+`, 2},
+
+		{"string", `f"str"`, `
+0:
+	PREDECLARED 0
+	CONSTANT 0
+	CALL 256
+	POP
+	NIL
+	RETURN
+`, 2},
+
+		{"map", `f{a: 1, [a]: 2}`, `
+0:
+	PREDECLARED 0
+	MAKEMAP 2
+	DUP
+	CONSTANT 0
+	CONSTANT 1
+	SETMAP
+	DUP
+	PREDECLARED 1
+	CONSTANT 2
+	SETMAP
+	CALL 256
+	POP
+	NIL
+	RETURN
+`, 2},
+
+		{"nested", `x.f(g!, 1)`, `
+0:
+	PREDECLARED 0
+	ATTR 1
+	PREDECLARED 2
+	CALL 0
+	CONSTANT 0
+	CALL 512
+	POP
+	NIL
+	RETURN
+`, 4},
+
+		{"named", `f(1, b: 2, a: x)`, `
+0:
+	PREDECLARED 0
+	CONSTANT 0
+	CONSTANT 1
+	CONSTANT 2
+	CONSTANT 3
+	PREDECLARED 1
+	CALL 258
+	POP
+	NIL
+	RETURN
+`, 2},
+
+		{"named only", `f(a: 1)`, `
+0:
+	PREDECLARED 0
+	CONSTANT 0
+	CONSTANT 1
+	CALL 1
+	POP
+	NIL
+	RETURN
+`, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			entry := compileCFG(t, c.src)
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+
+			var calls []insn
+			for _, insn := range entry.insns {
+				if insn.op == CALL || insn.op == CALL_VAR {
+					calls = append(calls, insn)
+				}
+			}
+			last := calls[len(calls)-1]
+			require.Equal(t, uint32(1), last.line)
+			require.Equal(t, c.col, last.col)
+		})
+	}
+}
+
+func TestCompileUnary(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want string
+		pos  bool // whether the unary op records a position
+	}{
+		{"plus", `let x = 1; return +x`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	LOCAL 0
+	UPLUS
+	RETURN
+`, true},
+
+		{"minus", `let x = 1; return -x`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	LOCAL 0
+	UMINUS
+	RETURN
+`, true},
+
+		{"tilde", `let x = 1; return ~x`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	LOCAL 0
+	UTILDE
+	RETURN
+`, true},
+
+		{"not", `let x = 1; return not x`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	LOCAL 0
+	NOT
+	RETURN
+`, false},
+
+		{"len", `let s = 'abc'; return #s`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	LOCAL 0
+	POUND
+	RETURN
+`, true},
+
+		{"nested", `let x = 1; return -~x`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	LOCAL 0
+	UTILDE
+	UMINUS
+	RETURN
+`, true},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			entry := compileCFG(t, c.src)
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry)))
+
+			// the last operator is the one before the RETURN
+			op := entry.insns[len(entry.insns)-2]
+			if c.pos {
+				require.Equal(t, uint32(1), op.line)
+				col := strings.Index(c.src, "return ") + len("return ") + 1
+				require.Equal(t, uint32(col), op.col)
+			} else {
+				require.Zero(t, op.line)
+				require.Zero(t, op.col)
+			}
+		})
+	}
+}
+
+func TestCompileTryMust(t *testing.T) {
+	cases := []struct {
+		desc      string
+		src       string
+		want      string
+		protected []string // instructions of the blocks protected by each catch, in creation order
+	}{
+		{"try", `return try f()`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	SETLOCAL 0
+	JMP 1
+1:
+	LOCAL 0
+	RETURN
+2:
+	NIL
+	SETLOCAL 0
+	CATCHJMP 1
+`, []string{"PREDECLARED CALL SETLOCAL"}},
+
+		{"must", `return must f()`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	SETLOCAL 0
+	JMP 1
+1:
+	LOCAL 0
+	RETURN
+2:
+	CRITICAL
+`, []string{"PREDECLARED CALL SETLOCAL"}},
+
+		{"try in binary", `let x = 1 + try f(); return x`, `
+0:
+	CONSTANT 0
+	JMP 1
+1:
+	PREDECLARED 0
+	CALL 0
+	SETLOCAL 0
+	JMP 2
+2:
+	LOCAL 0
+	PLUS
+	SETLOCAL 1
+	LOCAL 1
+	RETURN
+3:
+	NIL
+	SETLOCAL 0
+	CATCHJMP 2
+`, []string{"PREDECLARED CALL SETLOCAL"}},
+
+		{"nested", `return try (must f())`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	SETLOCAL 0
+	JMP 1
+1:
+	LOCAL 0
+	SETLOCAL 1
+	JMP 2
+2:
+	LOCAL 1
+	RETURN
+3:
+	NIL
+	SETLOCAL 1
+	CATCHJMP 2
+4:
+	CRITICAL
+`, []string{
+			"CRITICAL PREDECLARED CALL SETLOCAL LOCAL SETLOCAL",
+			"PREDECLARED CALL SETLOCAL",
+		}},
+
+		{"with condition", `return try (f() and g())`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	DUP
+	CJMP 3
+	JMP 1
+1:
+	SETLOCAL 0
+	JMP 2
+2:
+	LOCAL 0
+	RETURN
+3:
+	POP
+	PREDECLARED 1
+	CALL 0
+	JMP 1
+4:
+	NIL
+	SETLOCAL 0
+	CATCHJMP 2
+`, []string{"PREDECLARED CALL DUP CJMP SETLOCAL POP PREDECLARED CALL"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			var fc *fcomp
+			entry := compileCFGWith(t, c.src, func(f *fcomp) { fc = f })
+
+			var starts []*block
+			for _, r := range fc.catches {
+				starts = append(starts, r.start)
+			}
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry, starts...)))
+
+			require.Equal(t, c.protected, regionOps(entry, fc, fc.catches))
+		})
+	}
+}
+
+func TestCompileDeferCatch(t *testing.T) {
+	cases := []struct {
+		desc    string
+		src     string
+		want    string
+		defers  []string // instructions of the blocks protected by each defer, in creation order
+		catches []string // same for each catch
+	}{
+		{"defer", `defer g() end; f()`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	POP
+	RUNDEFER
+	JMP 1
+1:
+	NIL
+	RETURN
+2:
+	PREDECLARED 1
+	CALL 0
+	POP
+	DEFEREXIT
+`, []string{"PREDECLARED CALL POP RUNDEFER"}, nil},
+
+		{"catch", `catch g() end; f()`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	POP
+	JMP 1
+1:
+	NIL
+	RETURN
+2:
+	PREDECLARED 1
+	CALL 0
+	POP
+	CATCHJMP 1
+`, nil, []string{"PREDECLARED CALL POP"}},
+
+		{"defer and return", `defer g() end; return f()`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	RUNDEFER
+	RETURN
+1:
+	PREDECLARED 1
+	CALL 0
+	POP
+	DEFEREXIT
+`, []string{"PREDECLARED CALL RUNDEFER RETURN"}, nil},
+
+		{"defer in loop", `for ;; do defer g() end; if x then break end; f() end`, `
+0:
+	PREDECLARED 0
+	CJMP 2
+	JMP 1
+1:
+	PREDECLARED 1
+	CALL 0
+	POP
+	RUNDEFER
+	JMP 0
+2:
+	RUNDEFER
+	JMP 3
+3:
+	NIL
+	RETURN
+4:
+	PREDECLARED 2
+	CALL 0
+	POP
+	DEFEREXIT
+`, []string{"PREDECLARED CJMP RUNDEFER PREDECLARED CALL POP RUNDEFER"}, nil},
+
+		{"defer and catch", `defer a() end; catch b() end; f()`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	POP
+	JMP 1
+1:
+	RUNDEFER
+	JMP 2
+2:
+	NIL
+	RETURN
+3:
+	PREDECLARED 2
+	CALL 0
+	POP
+	DEFEREXIT
+4:
+	PREDECLARED 1
+	CALL 0
+	POP
+	CATCHJMP 1
+`, []string{"PREDECLARED CALL POP CATCHJMP PREDECLARED CALL POP RUNDEFER"}, []string{"PREDECLARED CALL POP"}},
+
+		{"return in catch", `defer a() end; catch return 1 end; f()`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	POP
+	JMP 1
+1:
+	RUNDEFER
+	JMP 2
+2:
+	NIL
+	RETURN
+3:
+	PREDECLARED 1
+	CALL 0
+	POP
+	DEFEREXIT
+4:
+	CONSTANT 0
+	RUNDEFER
+	RETURN
+`, []string{"CONSTANT RUNDEFER RETURN PREDECLARED CALL POP RUNDEFER"}, []string{"PREDECLARED CALL POP"}},
+
+		{"catch in if", `if x then catch a() end f() end; b()`, `
+0:
+	PREDECLARED 0
+	CJMP 2
+	JMP 1
+1:
+	PREDECLARED 3
+	CALL 0
+	POP
+	NIL
+	RETURN
+2:
+	PREDECLARED 1
+	CALL 0
+	POP
+	JMP 1
+3:
+	PREDECLARED 2
+	CALL 0
+	POP
+	CATCHJMP 1
+`, nil, []string{"PREDECLARED CALL POP"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			var fc *fcomp
+			entry := compileCFGWith(t, c.src, func(f *fcomp) { fc = f })
+
+			var starts []*block
+			for _, r := range fc.defers {
+				starts = append(starts, r.start)
+			}
+			for _, r := range fc.catches {
+				starts = append(starts, r.start)
+			}
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry, starts...)))
+			require.Equal(t, c.defers, regionOps(entry, fc, fc.defers))
+			require.Equal(t, c.catches, regionOps(entry, fc, fc.catches))
+			require.Zero(t, fc.activeDefers)
+		})
+	}
+}
+
+func TestCompileMaxDeferred(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want int
+	}{
+		{"none", `f()`, 0},
+		{"defer", `defer g() end; f()`, 1},
+		{"sequential", `defer g() end; catch h() end; f()`, 2},
+		{"sibling defers", `
+do defer f() end; g() end
+do defer h() end; g() end
+`, 1},
+		{"sibling catches", `
+do catch f() end; g() end
+do catch h() end; g() end
+`, 1},
+		{"sibling try", `let x = try f(); let y = try g()`, 1},
+		{"nested try", `let x = try (1 + try f())`, 2},
+		{"defer in defer", `
+defer
+	defer f() end
+	g()
+end
+h()
+`, 2},
+		{"try in defer", `
+defer
+	if x then f() end
+	let y = try g()
+end
+h()
+`, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			prog := compileProgram(t, c.src)
+			require.Equal(t, c.want, prog.Functions[0].MaxDeferred)
+		})
+	}
+}
+
+func TestCompileGoto(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want string
+	}{
+		{"forward", `
+if f() then goto skip end
+g()
+::skip::
+h()
+`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	CJMP 2
+	JMP 1
+1:
+	PREDECLARED 1
+	CALL 0
+	POP
+	JMP 2
+2:
+	PREDECLARED 2
+	CALL 0
+	POP
+	NIL
+	RETURN
+`},
+
+		{"backward", `
+let i = 0
+::again::
+i = i + 1
+if i < 10 then
+	goto again
+end
+return i
+`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	JMP 1
+1:
+	LOCAL 0
+	CONSTANT 1
+	PLUS
+	SETLOCAL 0
+	LOCAL 0
+	CONSTANT 2
+	LT
+	CJMP 1
+	JMP 2
+2:
+	LOCAL 0
+	RETURN
+`},
+
+		{"forward out of block", `
+do
+	if f() then goto done end
+	g()
+end
+::done::
+h()
+`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	CJMP 2
+	JMP 1
+1:
+	PREDECLARED 1
+	CALL 0
+	POP
+	JMP 2
+2:
+	PREDECLARED 2
+	CALL 0
+	POP
+	NIL
+	RETURN
+`},
+
+		{"out of defer", `
+do
+	defer f() end
+	goto done
+end
+::done::
+g()
+`, `
+0:
+	RUNDEFER
+	JMP 1
+1:
+	PREDECLARED 1
+	CALL 0
+	POP
+	NIL
+	RETURN
+2:
+	PREDECLARED 0
+	CALL 0
+	POP
+	DEFEREXIT
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			var fc *fcomp
+			entry := compileCFGWith(t, c.src, func(f *fcomp) { fc = f })
+
+			var starts []*block
+			for _, r := range fc.defers {
+				starts = append(starts, r.start)
+			}
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry, starts...)))
+		})
+	}
+}
+
+func TestCompileDo(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want string
+	}{
+		// the inner x is a distinct local, the outer one is returned
+		{"shadowing", `let x = 1; do let x = 2; f(x) end; return x`, `
+0:
+	CONSTANT 0
+	SETLOCAL 0
+	CONSTANT 1
+	SETLOCAL 1
+	PREDECLARED 0
+	LOCAL 1
+	CALL 256
+	POP
+	LOCAL 0
+	RETURN
+`},
+
+		{"return", `do return 1 end; f()`, `
+0:
+	CONSTANT 0
+	RETURN
+`},
+
+		{"defer", `do defer g() end; f() end; h()`, `
+0:
+	PREDECLARED 0
+	CALL 0
+	POP
+	RUNDEFER
+	JMP 1
+1:
+	PREDECLARED 2
+	CALL 0
+	POP
+	NIL
+	RETURN
+2:
+	PREDECLARED 1
+	CALL 0
+	POP
+	DEFEREXIT
+`},
+
+		{"empty", `do end`, `
+0:
+	NIL
+	RETURN
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			var fc *fcomp
+			entry := compileCFGWith(t, c.src, func(f *fcomp) { fc = f })
+
+			var starts []*block
+			for _, r := range fc.defers {
+				starts = append(starts, r.start)
+			}
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(dumpCFG(entry, starts...)))
+		})
+	}
+}
+
+// compileProgram parses, resolves and compiles src to a program. Any
+// identifier that is not declared in src resolves as predeclared.
+func compileProgram(t *testing.T, src string) *Program {
+	t.Helper()
+	return compileProgramMode(t, src, 0)
+}
+
+// compileProgramMode is like compileProgram but compiles with the provided
+// mode.
+func compileProgramMode(t *testing.T, src string, mode Mode) *Program {
+	t.Helper()
+
+	ctx := context.Background()
+	fset := token.NewFileSet()
+	ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(src))
+	require.NoError(t, err)
+	chunks := []*ast.Chunk{ch}
+	err = resolver.ResolveFiles(ctx, fset, chunks, 0, nil, func(string) bool { return true }, nil)
+	require.NoError(t, err)
+	progs, err := CompileFiles(ctx, fset, chunks, mode, nil)
+	require.NoError(t, err)
+	require.NoError(t, Verify(progs[0]))
+	return progs[0]
+}
+
+// disasm returns the instructions of fn, one per line.
+func disasm(fn *Funcode) string {
+	var buf strings.Builder
+	for _, insn := range fn.Instructions() {
+		fmt.Fprintln(&buf, insn)
+	}
+	return buf.String()
+}
+
+// AssertDasmEqual compiles src and asserts that the disassembly of the
+// resulting program is wantDasm. The disassembly lists each function of the
+// program in order, as a "function <name>" line followed by its
+// instructions. Whitespace is normalized before the comparison, so wantDasm
+// may be indented and aligned freely.
+func AssertDasmEqual(t *testing.T, src, wantDasm string) {
+	t.Helper()
+
+	prog := compileProgram(t, src)
+	var buf strings.Builder
+	for _, fn := range prog.Functions {
+		fmt.Fprintf(&buf, "function %s\n", fn.Name)
+		buf.WriteString(disasm(fn))
+	}
+	require.Equal(t, normalizeDasm(wantDasm), normalizeDasm(buf.String()))
+}
+
+// normalizeDasm returns the non-empty lines of s with their leading and
+// trailing whitespace removed and the other runs of whitespace replaced by a
+// single space.
+func normalizeDasm(s string) string {
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		if fields := strings.Fields(l); len(fields) > 0 {
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestCompileDasm(t *testing.T) {
+	t.Run("assignment", func(t *testing.T) {
+		AssertDasmEqual(t, `
+let x, y = 1, "a"
+x, y = y, x
+x += 2
+`, `
+			function test
+				0   constant 0
+				2   constant 1
+				4   setlocal 1
+				6   setlocal 0
+				8   local 1
+				10  local 0
+				12  setlocal 1
+				14  setlocal 0
+				16  local 0
+				18  constant 2
+				20  plus
+				21  setlocal 0
+				23  nil
+				24  return
+		`)
+	})
+
+	t.Run("if", func(t *testing.T) {
+		AssertDasmEqual(t, `
+fn sign(x)
+	if x < 0 then
+		return -1
+	elseif x > 0 then
+		return 1
+	end
+	return 0
+end
+return sign(y)
+`, `
+			function test
+				0   maketuple 0
+				2   makefunc 1
+				4   setlocal 0
+				6   local 0
+				8   predeclared 0
+				10  call 256
+				13  return
+			function sign
+				0   local 0
+				2   constant 0
+				4   lt
+				5   cjmp 15
+				10  jmp 19
+				15  constant 1
+				17  uminus
+				18  return
+				19  local 0
+				21  constant 0
+				23  gt
+				24  cjmp 32
+				29  constant 0
+				31  return
+				32  constant 1
+				34  return
+		`)
+	})
+}
+
+func TestCompileLinearize(t *testing.T) {
+	cases := []struct {
+		desc     string
+		src      string
+		want     string
+		maxStack int
+		defers   []Defer
+		catches  []Defer
+	}{
+		{"if else", `
+let x = 1
+if x then
+	x = 2
+else
+	x = 3
+end
+return x
+`, `
+0	constant 0
+2	setlocal 0
+4	local 0
+6	cjmp 16
+11	jmp 25
+16	constant 1
+18	setlocal 0
+20	jmp 29
+25	constant 2
+27	setlocal 0
+29	local 0
+31	return
+`, 1, nil, nil},
+
+		{"for in", `
+let s = 0
+for x in y do
+	s = s + x
+end
+return s
+`, `
+0	constant 0
+2	setlocal 0
+4	predeclared 0
+6	iterpush
+7	iterjmp 26
+12	setlocal 1
+14	local 0
+16	local 1
+18	plus
+19	setlocal 0
+21	jmp 7
+26	iterpop
+27	local 0
+29	return
+`, 2, nil, nil},
+
+		{"defer", `
+defer
+	f()
+end
+g()
+`, `
+0	jmp 11
+5	predeclared 1
+7	call 0
+9	pop
+10	deferexit
+11	predeclared 0
+13	call 0
+15	pop
+16	rundefer
+17	jmp 22
+22	nil
+23	return
+`, 1, []Defer{{PC0: 11, PC1: 21, StartPC: 5}}, nil},
+
+		{"try", `
+let x = 1 + try f()
+return x
+`, `
+0	constant 0
+2	jmp 15
+7	nil
+8	setlocal 0
+10	catchjmp 21
+15	predeclared 0
+17	call 0
+19	setlocal 0
+21	local 0
+23	plus
+24	setlocal 1
+26	local 1
+28	return
+`, 2, nil, []Defer{{PC0: 15, PC1: 20, StartPC: 7, Stack: 1}}},
+
+		{"catch in for in", `
+for x in y do
+	catch end
+	f(x)
+end
+`, `
+0	predeclared 0
+2	iterpush
+3	iterjmp 15
+8	setlocal 0
+10	jmp 23
+15	iterpop
+16	nil
+17	return
+18	catchjmp 3
+23	predeclared 1
+25	local 0
+27	call 256
+30	pop
+31	jmp 3
+`, 2, nil, []Defer{{PC0: 23, PC1: 35, StartPC: 18, Iters: 1}}},
+
+		{"goto backward", `
+let x = 0
+::top::
+x = x + 1
+if x < 3 then goto top end
+return x
+`, `
+0	constant 0
+2	setlocal 0
+4	local 0
+6	constant 1
+8	plus
+9	setlocal 0
+11	local 0
+13	constant 2
+15	lt
+16	cjmp 4
+21	local 0
+23	return
+`, 2, nil, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			prog := compileProgram(t, c.src)
+			fn := prog.Functions[0]
+			require.Equal(t, strings.TrimSpace(c.want), strings.TrimSpace(disasm(fn)))
+			require.Equal(t, c.maxStack, fn.MaxStack)
+			require.Equal(t, c.defers, fn.Defers)
+			require.Equal(t, c.catches, fn.Catches)
+		})
+	}
+}
+
+func TestCompilePositions(t *testing.T) {
+	// the comment lines and the long names force deltas that do not fit in a
+	// single entry of the pc-to-line table.
+	src := `let x = 1
+let y = x + f(x,
+	2)
+` + strings.Repeat("-- comment\n", 40) + `let a_very_long_name_to_push_the_column = 1
+let z = a_very_long_name_to_push_the_column + a_very_long_name_to_push_the_column.b
+return z // g(y)
+`
+	prog := compileProgram(t, src)
+	fn := prog.Functions[0]
+
+	var got []string
+	for _, insn := range fn.Instructions() {
+		switch insn.Op {
+		case PLUS, ATTR, CALL, SLASHSLASH:
+			pos := fn.Pos(insn.PC)
+			got = append(got, fmt.Sprintf("%s %d:%d", insn.Op, pos.Line, pos.Col))
+		}
+	}
+	want := []string{
+		"call 2:14",
+		"plus 2:11",
+		"attr 45:82",
+		"plus 45:45",
+		"call 46:14",
+		"slashslash 46:10",
+	}
+	require.Equal(t, want, got)
+}
+
+func TestCompileCompactJumps(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+	}{
+		{"if else", `
+let x = 1
+if x then x = 2 elseif x > 3 then x = 4 else x = 5 end
+return x
+`},
+		{"loops", `
+let n = 0
+for i in 10 do
+	if i == 3 then continue end
+	if i == 8 then break end
+	for n < i do n = n + 1 end
+end
+return n
+`},
+		{"defer catch", `
+fn f(x)
+	defer x = x + 1 end
+	catch return 1 end
+	for i in x do
+		if i > 2 then return i end
+	end
+end
+`},
+		{"long jump", `
+let x = 0
+if x then
+	` + strings.Repeat("x = x + 1\n", 100) + `
+end
+return x
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			padded := compileProgramMode(t, c.src, 0)
+			compact := compileProgramMode(t, c.src, CompactJumps)
+			require.Equal(t, len(padded.Functions), len(compact.Functions))
+
+			for i, pfn := range padded.Functions {
+				cfn := compact.Functions[i]
+				require.False(t, pfn.CompactJumps)
+				require.True(t, cfn.CompactJumps)
+				require.LessOrEqual(t, len(cfn.Code), len(pfn.Code))
+				require.Equal(t, pfn.MaxStack, cfn.MaxStack)
+				require.Equal(t, len(pfn.Defers), len(cfn.Defers))
+				require.Equal(t, len(pfn.Catches), len(cfn.Catches))
+
+				// same instructions, only the jump addresses differ
+				pinsns, cinsns := pfn.Instructions(), cfn.Instructions()
+				require.Equal(t, len(pinsns), len(cinsns))
+				var hasJump bool
+				for j, pinsn := range pinsns {
+					cinsn := cinsns[j]
+					require.Equal(t, pinsn.Op, cinsn.Op)
+					require.NotEqual(t, NOP, cinsn.Op)
+					if isJump(pinsn.Op) {
+						hasJump = true
+					} else {
+						require.Equal(t, pinsn.Arg, cinsn.Arg)
+					}
+					require.Equal(t, pfn.Pos(pinsn.PC), cfn.Pos(cinsn.PC))
+				}
+				if hasJump {
+					require.Less(t, len(cfn.Code), len(pfn.Code))
+				}
+			}
+		})
+	}
+}
+
+func TestCompileParenExpr(t *testing.T) {
+	cases := []struct {
+		src, same string
+	}{
+		{"(f)(1)", "f(1)"},
+		{"((f))(1)", "f(1)"},
+		{"(f.g)(1)", "f.g(1)"},
+		{"let x = (1)", "let x = 1"},
+		{"let x (x) = 1", "let x x = 1"},
+		{"(f).x = 1", "f.x = 1"},
+		{"(f)[0] = 1", "f[0] = 1"},
+	}
+	for _, c := range cases {
+		t.Run(c.src, func(t *testing.T) {
+			got := compileProgram(t, c.src)
+			want := compileProgram(t, c.same)
+			require.Equal(t, disasm(want.Functions[0]), disasm(got.Functions[0]))
+			require.Equal(t, want.Constants, got.Constants)
+		})
+	}
+
+	t.Run("one-element tuple", func(t *testing.T) {
+		paren := compileProgram(t, "let x = (1)")
+		tuple := compileProgram(t, "let x = (1,)")
+		require.Equal(t, []interface{}{int64(1)}, paren.Constants)
+		require.Equal(t, []interface{}{Tuple{int64(1)}}, tuple.Constants)
+	})
+}
+
+// unknownStmt and unknownExpr are AST nodes that the compiler does not
+// support, they behave like the node they wrap otherwise.
+type (
+	unknownStmt struct{ ast.Stmt }
+	unknownExpr struct{ ast.Expr }
+)
+
+func TestCompilePanicPosition(t *testing.T) {
+	cases := []struct {
+		desc    string
+		replace func(stmts []ast.Stmt)
+		want    string
+	}{
+		{"stmt", func(stmts []ast.Stmt) {
+			stmts[1] = unknownStmt{stmts[1]}
+		}, "test:2:2: unexpected stmt compiler.unknownStmt"},
+		{"expr", func(stmts []ast.Stmt) {
+			ret := stmts[2].(*ast.ReturnLikeStmt)
+			ret.Expr = unknownExpr{ret.Expr}
+		}, "test:3:8: unexpected expr compiler.unknownExpr"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			fset := token.NewFileSet()
+			ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte("let x = 1\n\tf(x)\nreturn x + 1\n"))
+			require.NoError(t, err)
+			chunks := []*ast.Chunk{ch}
+			err = resolver.ResolveFiles(ctx, fset, chunks, 0, nil, func(string) bool { return true }, nil)
+			require.NoError(t, err)
+
+			c.replace(ch.Block.Stmts)
+			require.PanicsWithValue(t, c.want, func() {
+				_, _ = CompileFiles(ctx, fset, chunks, 0, nil)
+			})
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dasm returns the human-readable textual form of a compiled program, e.g. to
+// inspect an encoded program. It lists the names and constants of the
+// program, followed by each function with its variables, defer and catch
+// blocks and decoded instructions. The instructions are listed with their
+// address, which is what the jump arguments and the defer and catch blocks
+// refer to. Each defer and catch block lists the first and last addresses it
+// covers, the address of its code and the depths of the operand stack and of
+// the iterator stack when its code starts.
+//
+// The format looks like this, where the comments are the index of the entry:
+//
+//	program: NAME
+//		names:
+//			fail	# 000
+//		constants:
+//			string	"abc"	# 000
+//			int	1234	# 001
+//
+//	function: NAME <maxstack> <numparams> [+varargs]
+//		locals:
+//			x	# 000
+//		cells:
+//			x	# 000
+//		freevars:
+//			y	# 000
+//		defers:
+//			<pc0> <pc1> <startpc> <stack> <iters>	# 000
+//		catches:
+//			<pc0> <pc1> <startpc> <stack> <iters>	# 000
+//		code:
+//			0	predeclared 0
+//			2	call 0
+func Dasm(p *Program) []byte {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "program: %s\n", p.Filename)
+	if len(p.Names) > 0 {
+		sb.WriteString("\tnames:\n")
+		for i, n := range p.Names {
+			fmt.Fprintf(&sb, "\t\t%s\t# %03d\n", n, i)
+		}
+	}
+	if len(p.Constants) > 0 {
+		sb.WriteString("\tconstants:\n")
+		for i, c := range p.Constants {
+			typ, s := dasmConstant(c)
+			fmt.Fprintf(&sb, "\t\t%s\t%s\t# %03d\n", typ, s, i)
+		}
+	}
+
+	for _, fn := range p.Functions {
+		sb.WriteByte('\n')
+		dasmFunction(&sb, fn)
+	}
+	return []byte(sb.String())
+}
+
+func dasmFunction(sb *strings.Builder, fn *Funcode) {
+	fmt.Fprintf(sb, "function: %s %d %d", fn.Name, fn.MaxStack, fn.NumParams)
+	if fn.HasVarArg {
+		sb.WriteString(" +varargs")
+	}
+	sb.WriteByte('\n')
+
+	if len(fn.Locals) > 0 {
+		sb.WriteString("\tlocals:\n")
+		for i, l := range fn.Locals {
+			fmt.Fprintf(sb, "\t\t%s\t# %03d\n", l.Name, i)
+		}
+	}
+	if len(fn.Cells) > 0 {
+		sb.WriteString("\tcells:\n")
+		for i, c := range fn.Cells {
+			fmt.Fprintf(sb, "\t\t%s\t# %03d\n", fn.Locals[c].Name, i)
+		}
+	}
+	if len(fn.Freevars) > 0 {
+		sb.WriteString("\tfreevars:\n")
+		for i, f := range fn.Freevars {
+			fmt.Fprintf(sb, "\t\t%s\t# %03d\n", f.Name, i)
+		}
+	}
+	for _, blocks := range []struct {
+		label  string
+		defers []Defer
+	}{{"defers", fn.Defers}, {"catches", fn.Catches}} {
+		if len(blocks.defers) > 0 {
+			fmt.Fprintf(sb, "\t%s:\n", blocks.label)
+			for i, d := range blocks.defers {
+				fmt.Fprintf(sb, "\t\t%d %d %d %d %d\t# %03d\n", d.PC0, d.PC1, d.StartPC, d.Stack, d.Iters, i)
+			}
+		}
+	}
+
+	if insns := fn.Instructions(); len(insns) > 0 {
+		sb.WriteString("\tcode:\n")
+		for _, insn := range insns {
+			fmt.Fprintf(sb, "\t\t%s\n", insn)
+		}
+	}
+}
+
+// dasmConstant returns the type and the textual form of the constant c.
+func dasmConstant(c interface{}) (typ, s string) {
+	switch c := c.(type) {
+	case nil:
+		return "nil", "null"
+	case bool:
+		return "bool", strconv.FormatBool(c)
+	case string:
+		return "string", strconv.Quote(c)
+	case Bytes:
+		return "bytes", "b" + strconv.Quote(string(c))
+	case int64:
+		return "int", strconv.FormatInt(c, 10)
+	case float64:
+		return "float", strconv.FormatFloat(c, 'g', -1, 64)
+	case Tuple:
+		items := make([]string, len(c))
+		for i, v := range c {
+			_, items[i] = dasmConstant(v)
+		}
+		if len(items) == 1 {
+			return "tuple", "(" + items[0] + ",)"
+		}
+		return "tuple", "(" + strings.Join(items, ", ") + ")"
+	default:
+		return fmt.Sprintf("%T", c), fmt.Sprintf("%v", c)
+	}
+}
@@ -0,0 +1,64 @@
+package compiler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDasm(t *testing.T) {
+	prog := compileProgram(t, `
+let t = (1, "a", b"b", (2.5,), null, true)
+fn f(x, ...rest)
+	catch
+		return t
+	end
+	g(x)
+end
+return f`)
+	prog.Filename = "test.nen"
+
+	want := `
+program: test.nen
+	names:
+		g	# 000
+	constants:
+		tuple	(1, "a", b"b", (2.5,), null, true)	# 000
+
+function: test 1 0
+	locals:
+		t	# 000
+		f	# 001
+	cells:
+		t	# 000
+	code:
+		0	constant 0
+		2	setlocalcell 0
+		4	local 0
+		6	maketuple 1
+		8	makefunc 1
+		10	setlocal 1
+		12	local 1
+		14	return
+
+function: f 2 2 +varargs
+	locals:
+		x	# 000
+		rest	# 001
+	freevars:
+		t	# 000
+	catches:
+		8 15 5 0 0	# 000
+	code:
+		0	jmp 8
+		5	freecell 0
+		7	return
+		8	predeclared 0
+		10	local 0
+		12	call 256
+		15	pop
+		16	nil
+		17	return
+`
+	require.Equal(t, want[1:], string(Dasm(prog)))
+}
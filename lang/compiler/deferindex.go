@@ -0,0 +1,137 @@
+package compiler
+
+import "sort"
+
+// deferIndexThreshold is the number of defer and catch blocks of a function
+// above which Deferred and Covered look up the covering blocks in an index
+// instead of scanning all of them. Functions rarely have more than a few
+// blocks, in which case the index is not worth building.
+const deferIndexThreshold = 8
+
+// Deferred returns the defer block that covers pc from but not pc to, or the
+// catch block if catches is true, with to set to -1 for an exit of the
+// function. If many blocks qualify, the one with the highest StartPC is
+// returned, the first one in Defers and then Catches in case of a tie. It
+// returns false if no block qualifies.
+func (fn *Funcode) Deferred(from, to int64, catches bool) (Defer, bool) {
+	if len(fn.Defers)+len(fn.Catches) <= deferIndexThreshold {
+		return fn.deferredScan(from, to, catches)
+	}
+	fn.dixOnce.Do(func() { fn.dix = newDeferIndex(fn.Defers, fn.Catches) })
+	return fn.dix.lookup(from, to, catches)
+}
+
+// Covered returns true if pc is covered by any defer or catch block.
+func (fn *Funcode) Covered(pc int64) bool {
+	if len(fn.Defers)+len(fn.Catches) <= deferIndexThreshold {
+		return fn.coveredScan(pc)
+	}
+	fn.dixOnce.Do(func() { fn.dix = newDeferIndex(fn.Defers, fn.Catches) })
+	return fn.dix.covered(pc)
+}
+
+// coveredScan implements Covered by scanning all blocks.
+func (fn *Funcode) coveredScan(pc int64) bool {
+	for _, blocks := range [][]Defer{fn.Defers, fn.Catches} {
+		for _, d := range blocks {
+			if d.Covers(pc) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deferredScan implements Deferred by scanning all blocks.
+func (fn *Funcode) deferredScan(from, to int64, catches bool) (Defer, bool) {
+	var found Defer
+	target := -1
+	scan := func(blocks []Defer) {
+		for _, d := range blocks {
+			if d.Covers(from) && !d.Covers(to) && int(d.StartPC) > target {
+				target = int(d.StartPC)
+				found = d
+			}
+		}
+	}
+	scan(fn.Defers)
+	if catches {
+		scan(fn.Catches)
+	}
+	return found, target >= 0
+}
+
+// deferIndex indexes defer and catch blocks by the pc ranges they cover. The
+// pcs are split in segments at the bounds of the blocks, so that the same
+// blocks cover all pcs of a segment.
+type deferIndex struct {
+	starts []int64       // first pc of each segment, in increasing order
+	blocks [][]deferSpan // blocks covering each segment, by decreasing StartPC
+}
+
+type deferSpan struct {
+	Defer
+	catch bool
+}
+
+func newDeferIndex(defers, catches []Defer) *deferIndex {
+	spans := make([]deferSpan, 0, len(defers)+len(catches))
+	for _, d := range defers {
+		spans = append(spans, deferSpan{Defer: d})
+	}
+	for _, d := range catches {
+		spans = append(spans, deferSpan{Defer: d, catch: true})
+	}
+	// a stable sort keeps the tie-break order of deferredScan
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].StartPC > spans[j].StartPC
+	})
+
+	bounds := make(map[int64]bool, 2*len(spans))
+	for _, sp := range spans {
+		bounds[int64(sp.PC0)] = true
+		bounds[int64(sp.PC1)+1] = true
+	}
+	var dix deferIndex
+	for pc := range bounds {
+		dix.starts = append(dix.starts, pc)
+	}
+	sort.Slice(dix.starts, func(i, j int) bool { return dix.starts[i] < dix.starts[j] })
+
+	dix.blocks = make([][]deferSpan, len(dix.starts))
+	for i, pc := range dix.starts {
+		for _, sp := range spans {
+			if sp.Covers(pc) {
+				dix.blocks[i] = append(dix.blocks[i], sp)
+			}
+		}
+	}
+	return &dix
+}
+
+// segment returns the index of the segment that contains pc, or -1 if pc is
+// before the first segment.
+func (dix *deferIndex) segment(pc int64) int {
+	return sort.Search(len(dix.starts), func(i int) bool { return dix.starts[i] > pc }) - 1
+}
+
+func (dix *deferIndex) covered(pc int64) bool {
+	i := dix.segment(pc)
+	return i >= 0 && len(dix.blocks[i]) > 0
+}
+
+func (dix *deferIndex) lookup(from, to int64, catches bool) (Defer, bool) {
+	i := dix.segment(from)
+	if i < 0 {
+		return Defer{}, false
+	}
+	for _, sp := range dix.blocks[i] {
+		if sp.catch && !catches {
+			continue
+		}
+		if !sp.Covers(to) {
+			return sp.Defer, true
+		}
+	}
+	return Defer{}, false
+}
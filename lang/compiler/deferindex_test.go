@@ -0,0 +1,108 @@
+package compiler
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// nestedDefers returns n defer blocks nested in one another, each one
+// covering 10 fewer instructions on both sides than its parent, with the
+// deferred code of the inner blocks laid out after that of the outer ones.
+func nestedDefers(n int) []Defer {
+	size := uint32(20*n + 10)
+	defers := make([]Defer, n)
+	for i := range defers {
+		off := uint32(10 * i)
+		defers[i] = Defer{PC0: off, PC1: size - off, StartPC: size + 1 + off, Stack: uint32(i)}
+	}
+	return defers
+}
+
+func requireSameDeferred(t *testing.T, fn *Funcode, maxPC int64) {
+	t.Helper()
+	for from := int64(0); from <= maxPC; from++ {
+		require.Equal(t, fn.coveredScan(from), fn.Covered(from), "pc=%d", from)
+		for to := int64(-1); to <= maxPC; to++ {
+			for _, catches := range []bool{false, true} {
+				want, wantOK := fn.deferredScan(from, to, catches)
+				got, gotOK := fn.Deferred(from, to, catches)
+				require.Equal(t, wantOK, gotOK, "from=%d to=%d catches=%t", from, to, catches)
+				require.Equal(t, want, got, "from=%d to=%d catches=%t", from, to, catches)
+			}
+		}
+	}
+}
+
+func TestDeferredIndex(t *testing.T) {
+	t.Run("nested", func(t *testing.T) {
+		defers := nestedDefers(deferIndexThreshold + 2)
+		fn := &Funcode{Defers: defers[:5], Catches: defers[5:]}
+		requireSameDeferred(t, fn, int64(defers[0].PC1)+2)
+		require.NotNil(t, fn.dix)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		random := func(n int) []Defer {
+			ds := make([]Defer, n)
+			for i := range ds {
+				pc0 := uint32(rnd.Intn(50))
+				ds[i] = Defer{
+					PC0:     pc0,
+					PC1:     pc0 + uint32(rnd.Intn(20)),
+					StartPC: uint32(rnd.Intn(10)), // many ties
+					Stack:   uint32(i),
+				}
+			}
+			return ds
+		}
+		for i := 0; i < 20; i++ {
+			// always above the threshold so that the index is used
+			fn := &Funcode{
+				Defers:  random(deferIndexThreshold/2 + rnd.Intn(10)),
+				Catches: random(deferIndexThreshold/2 + 1 + rnd.Intn(10)),
+			}
+			requireSameDeferred(t, fn, 72)
+		}
+	})
+
+	t.Run("compiled", func(t *testing.T) {
+		var sb strings.Builder
+		for i := 0; i < deferIndexThreshold; i++ {
+			fmt.Fprintf(&sb, "do\ndefer f(%d) end\ncatch g(%d) end\n", i, i)
+		}
+		sb.WriteString("h()\n")
+		sb.WriteString(strings.Repeat("end\n", deferIndexThreshold))
+
+		prog := compileProgram(t, sb.String())
+		fn := prog.Functions[0]
+		require.Len(t, fn.Defers, deferIndexThreshold)
+		require.Len(t, fn.Catches, deferIndexThreshold)
+		requireSameDeferred(t, fn, int64(len(fn.Code)))
+	})
+}
+
+func BenchmarkDeferred(b *testing.B) {
+	for _, n := range []int{2, 8, 32, 128} {
+		defers := nestedDefers(n)
+		fn := &Funcode{Defers: defers}
+		from := int64(defers[n-1].PC0) // covered by all blocks
+
+		b.Run(fmt.Sprintf("scan/n=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				fn.deferredScan(from, -1, true)
+			}
+		})
+		b.Run(fmt.Sprintf("index/n=%d", n), func(b *testing.B) {
+			dix := newDeferIndex(fn.Defers, fn.Catches)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dix.lookup(from, -1, true)
+			}
+		})
+	}
+}
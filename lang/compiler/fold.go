@@ -0,0 +1,242 @@
+package compiler
+
+import (
+	"math"
+
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/token"
+)
+
+// foldConstant returns the constant value of e if it is a unary or binary
+// operation whose operands are number, string or bytes literals, or such
+// operations themselves, evaluated with the same rules as machine.Unary and
+// machine.Binary. It returns false if e cannot be folded, which includes all
+// operations that fail at runtime (e.g. a division by zero or a float
+// without an exact integer representation used in a bitwise operation) so
+// that the error is raised when the code runs.
+//
+// Results that cannot be stored in the constant pool without altering them
+// are not folded either: a NaN float and a negative zero float, which would
+// be merged with the positive zero constant.
+func foldConstant(e ast.Expr) (interface{}, bool) {
+	var v interface{}
+	switch e := ast.Unwrap(e).(type) {
+	case *ast.LiteralExpr:
+		switch e.Type {
+		case token.INT, token.FLOAT, token.STRING, token.BYTES:
+			return literalValue(e), true
+		}
+		return nil, false
+
+	case *ast.UnaryOpExpr:
+		x, ok := foldConstant(e.Right)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = foldUnary(e.Type, x); !ok {
+			return nil, false
+		}
+
+	case *ast.BinOpExpr:
+		l, ok := foldConstant(e.Left)
+		if !ok {
+			return nil, false
+		}
+		r, ok := foldConstant(e.Right)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = foldBinary(e.Type, l, r); !ok {
+			return nil, false
+		}
+
+	default:
+		return nil, false
+	}
+
+	if f, ok := v.(float64); ok && (math.IsNaN(f) || f == 0 && math.Signbit(f)) {
+		return nil, false
+	}
+	return v, true
+}
+
+func foldUnary(op token.Token, x interface{}) (interface{}, bool) {
+	switch op {
+	case token.PLUS:
+		switch x := x.(type) {
+		case int64, float64:
+			return x, true
+		}
+	case token.MINUS:
+		switch x := x.(type) {
+		case int64:
+			return -x, true
+		case float64:
+			return -x, true
+		}
+	case token.TILDE:
+		if x, ok := foldInt(x); ok {
+			return int64(^uint64(x)), true
+		}
+	case token.POUND:
+		switch x := x.(type) {
+		case string:
+			return int64(len(x)), true
+		case Bytes:
+			return int64(len(x)), true
+		}
+	}
+	return nil, false
+}
+
+func foldBinary(op token.Token, l, r interface{}) (interface{}, bool) {
+	switch op {
+	case token.PLUS:
+		switch l := l.(type) {
+		case string:
+			if r, ok := r.(string); ok {
+				return l + r, true
+			}
+			return nil, false
+		case Bytes:
+			if r, ok := r.(Bytes); ok {
+				return l + r, true
+			}
+			return nil, false
+		}
+	case token.AMPERSAND, token.PIPE, token.TILDE, token.LTLT, token.GTGT:
+		li, ok := foldInt(l)
+		if !ok {
+			return nil, false
+		}
+		ri, ok := foldInt(r)
+		if !ok {
+			return nil, false
+		}
+		return foldBitwise(op, li, ri)
+	}
+
+	// the remaining operators are arithmetic, int if both operands are ints
+	// (except for / and ^), float otherwise.
+	li, lint := l.(int64)
+	ri, rint := r.(int64)
+	if lint && rint && op != token.SLASH && op != token.CIRCUMFLEX {
+		switch op {
+		case token.PLUS:
+			return li + ri, true
+		case token.MINUS:
+			return li - ri, true
+		case token.STAR:
+			return li * ri, true
+		case token.SLASHSLASH:
+			if ri == 0 {
+				return nil, false
+			}
+			if ri < 0 {
+				li, ri = -li, -ri
+			}
+			m := li % ri
+			if m < 0 {
+				m += ri
+			}
+			return (li - m) / ri, true
+		case token.PERCENT:
+			if ri == 0 {
+				return nil, false
+			}
+			return (li%ri + ri) % ri, true
+		}
+		return nil, false
+	}
+
+	lf, ok := foldFloat(l)
+	if !ok {
+		return nil, false
+	}
+	rf, ok := foldFloat(r)
+	if !ok {
+		return nil, false
+	}
+	switch op {
+	case token.PLUS:
+		return lf + rf, true
+	case token.MINUS:
+		return lf - rf, true
+	case token.STAR:
+		return lf * rf, true
+	case token.SLASH:
+		if rf == 0 {
+			return nil, false
+		}
+		return lf / rf, true
+	case token.SLASHSLASH:
+		if rf == 0 {
+			return nil, false
+		}
+		return math.Floor(lf / rf), true
+	case token.PERCENT:
+		if rf == 0 {
+			return nil, false
+		}
+		v := math.Mod(lf, rf)
+		if v != 0 && (v < 0) != (rf < 0) {
+			v += rf
+		}
+		return v, true
+	case token.CIRCUMFLEX:
+		return math.Pow(lf, rf), true
+	}
+	return nil, false
+}
+
+func foldBitwise(op token.Token, l, r int64) (interface{}, bool) {
+	if op == token.GTGT {
+		// a right shift is a left shift by the opposite count
+		if r == math.MinInt64 {
+			return nil, false
+		}
+		op, r = token.LTLT, -r
+	}
+
+	switch op {
+	case token.AMPERSAND:
+		return l & r, true
+	case token.PIPE:
+		return l | r, true
+	case token.TILDE:
+		return l ^ r, true
+	case token.LTLT:
+		if r == math.MinInt64 {
+			return nil, false
+		}
+		if r < 0 {
+			return int64(uint64(l) >> -r), true
+		}
+		return l << r, true
+	}
+	return nil, false
+}
+
+// foldInt returns the int value of the number v, which must be an int or a
+// float with an exact integer representation.
+func foldInt(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case float64:
+		i := int64(v)
+		return i, float64(i) == v
+	}
+	return 0, false
+}
+
+// foldFloat returns the float value of the number v.
+func foldFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
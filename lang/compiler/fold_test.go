@@ -0,0 +1,90 @@
+package compiler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileFold(t *testing.T) {
+	cases := []struct {
+		desc   string
+		src    string
+		want   string
+		consts []interface{}
+	}{
+		{"int arithmetic", `return 1 + 2 * 3`, `
+			0 constant 0
+			2 return
+		`, []interface{}{int64(7)}},
+		{"nested parens", `return -(2 // (1 - 3)) % 4`, `
+			0 constant 0
+			2 return
+		`, []interface{}{int64(1)}},
+		{"float division", `return 1 / 4`, `
+			0 constant 0
+			2 return
+		`, []interface{}{0.25}},
+		{"mixed", `return 2 ^ 3 + 1`, `
+			0 constant 0
+			2 return
+		`, []interface{}{9.0}},
+		{"bitwise", `return ~0 >> 60 | 1.0 << 4`, `
+			0 constant 0
+			2 return
+		`, []interface{}{int64(31)}},
+		{"string", `return #("ab" + "c")`, `
+			0 constant 0
+			2 return
+		`, []interface{}{int64(3)}},
+		{"division by zero", `return 1 / 0`, `
+			0 constant 0
+			2 constant 1
+			4 slash
+			5 return
+		`, []interface{}{int64(1), int64(0)}},
+		{"partial", `return (1 + 1) // (2 - 2)`, `
+			0 constant 0
+			2 constant 1
+			4 slashslash
+			5 return
+		`, []interface{}{int64(2), int64(0)}},
+		{"inexact float", `return 1.5 & 1`, `
+			0 constant 0
+			2 constant 1
+			4 ampersand
+			5 return
+		`, []interface{}{1.5, int64(1)}},
+		{"negative zero", `return -0.0`, `
+			0 constant 0
+			2 uminus
+			3 return
+		`, []interface{}{0.0}},
+		{"string and int", `return "a" + 1`, `
+			0 constant 0
+			2 constant 1
+			4 plus
+			5 return
+		`, []interface{}{"a", int64(1)}},
+		{"variable", `return x + 1 + 2`, `
+			0 predeclared 0
+			2 constant 0
+			4 plus
+			5 constant 1
+			7 plus
+			8 return
+		`, []interface{}{int64(1), int64(2)}},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			prog := compileProgramMode(t, c.src, Optimize)
+			require.Equal(t, normalizeDasm(c.want), normalizeDasm(disasm(prog.Functions[0])))
+			require.Equal(t, c.consts, prog.Constants)
+		})
+	}
+
+	t.Run("not optimized", func(t *testing.T) {
+		prog := compileProgramMode(t, `return 1 + 2`, 0)
+		require.Equal(t, []interface{}{int64(1), int64(2)}, prog.Constants)
+	})
+}
@@ -3,7 +3,7 @@ package compiler
 import "fmt"
 
 // Increment this to force recompilation of saved bytecode files.
-const Version = 0
+const Version = 7
 
 type Opcode uint8
 
@@ -65,6 +65,12 @@ const ( //nolint:revive
 	RUNDEFER  //              - RUNDEFER     -      next opcode must run deferred blocks
 	DEFEREXIT //              - DEFEREXIT    -      run next deferred block or if no more deferred block to execute, resume
 	LOAD      //            mod LOAD         modval
+	CRITICAL  //              - CRITICAL     -      converts the in-flight error to a critical (non-catchable) one
+	COPYARRAY //          tuple COPYARRAY    array  new array with the elements of a constant tuple
+	THROW     //              x THROW        -      raises x as error, or re-raises the error being handled if x is nil
+	APPEND    //     array elem APPEND       -      appends elem to array in place
+	IN        //            x y IN           bool   x in y, membership test
+	RANGEPUSH //  start stop step RANGEPUSH  start stop step  [validates the arguments of range, see RANGEJMP]
 
 	// --- opcodes with an argument must go below this line ---
 
@@ -74,12 +80,15 @@ const ( //nolint:revive
 	ITERJMP //            - ITERJMP<addr> elem   (and fall through) [acts on topmost iterator]
 	//----> // or:        - ITERJMP<addr> -      (and jump)
 	CATCHJMP //           - CATCHJMP<addr> -     (jump to addr on catch block exit)
+	RANGEJMP //  cur stop step RANGEJMP<addr> next stop step cur  (and fall through) [iterates range(cur, stop, step)]
+	//-----> // or:              RANGEJMP<addr> -                  (and jump)
 
 	CONSTANT     //                 - CONSTANT<constant>  value
 	MAKETUPLE    //         x1 ... xn MAKETUPLE<n>        tuple
 	MAKEARRAY    //         x1 ... xn MAKEARRAY<n>        array
 	MAKEFUNC     //  freevars (tuple) MAKEFUNC<func>      fn
 	MAKEMAP      //                   MAKEMAP<n>          map
+	MAKECLASS    //  inherits members MAKECLASS<name>     class       members is a tuple of name and value pairs
 	SETLOCAL     //             value SETLOCAL<local>     -
 	LOCAL        //                 - LOCAL<local>        value
 	FREE         //                 - FREE<freevar>       cell
@@ -90,27 +99,31 @@ const ( //nolint:revive
 	UNIVERSAL    //                 - UNIVERSAL<name>     value       universe = part of the language, all programs have access to those
 	ATTR         //                 x ATTR<name>          y           y = x.name, fallbacks to x["name"]
 	SETFIELD     //               x y SETFIELD<name>      -           x.name = y, fallbacks to x["name"] = y
-	//UNPACK       //          iterable UNPACK<n>           vn ... v1
+	UNPACK       //          iterable UNPACK<n>        vn ... v1
 
-	// n is #args excluding vararg in both cases.
-	CALL // fn positional                CALL<n>        result
-	//CALL_VAR // fn positional *args          CALL_VAR<n>    result
+	// n>>8 is #positional args (excluding spread) and n&0xff is #named args
+	// (pairs of name constant and value on the stack) in both cases.
+	CALL     // fn positional named          CALL<n>        result
+	CALL_VAR // fn positional spread named   CALL_VAR<n>    result     (spread is an iterable expanded in positional)
 
 	OpcodeArgMin = JMP
-	OpcodeMax    = CALL
+	OpcodeMax    = CALL_VAR
 	opcodeJMPMin = JMP
-	opcodeJMPMax = CATCHJMP
+	opcodeJMPMax = RANGEJMP
 )
 
 var opcodeNames = [...]string{
-	AMPERSAND: "ampersand",
-	ATTR:      "attr",
-	CALL:      "call",
-	//CALL_VAR:     "call_var",
+	AMPERSAND:    "ampersand",
+	APPEND:       "append",
+	ATTR:         "attr",
+	CALL:         "call",
+	CALL_VAR:     "call_var",
 	CATCHJMP:     "catchjmp",
 	CIRCUMFLEX:   "circumflex",
 	CJMP:         "cjmp",
 	CONSTANT:     "constant",
+	COPYARRAY:    "copyarray",
+	CRITICAL:     "critical",
 	DEFEREXIT:    "deferexit",
 	DUP2:         "dup2",
 	DUP:          "dup",
@@ -122,6 +135,7 @@ var opcodeNames = [...]string{
 	GE:           "ge",
 	GT:           "gt",
 	GTGT:         "gtgt",
+	IN:           "in",
 	INDEX:        "index",
 	ITERJMP:      "iterjmp",
 	ITERPOP:      "iterpop",
@@ -134,6 +148,7 @@ var opcodeNames = [...]string{
 	LT:           "lt",
 	LTLT:         "ltlt",
 	MAKEMAP:      "makemap",
+	MAKECLASS:    "makeclass",
 	MAKEFUNC:     "makefunc",
 	MAKEARRAY:    "makearray",
 	MAKETUPLE:    "maketuple",
@@ -148,6 +163,8 @@ var opcodeNames = [...]string{
 	POP:          "pop",
 	POUND:        "pound",
 	PREDECLARED:  "predeclared",
+	RANGEJMP:     "rangejmp",
+	RANGEPUSH:    "rangepush",
 	RETURN:       "return",
 	RUNDEFER:     "rundefer",
 	SETMAP:       "setmap",
@@ -158,13 +175,14 @@ var opcodeNames = [...]string{
 	SLASH:        "slash",
 	SLASHSLASH:   "slashslash",
 	STAR:         "star",
+	THROW:        "throw",
 	TILDE:        "tilde",
 	TRUE:         "true",
 	UMINUS:       "uminus",
 	UNIVERSAL:    "universal",
-	//UNPACK:       "unpack",
-	UPLUS:  "uplus",
-	UTILDE: "utilde",
+	UNPACK:       "unpack",
+	UPLUS:        "uplus",
+	UTILDE:       "utilde",
 }
 
 var reverseLookupOpcode = func() map[string]Opcode {
@@ -175,16 +193,20 @@ var reverseLookupOpcode = func() map[string]Opcode {
 	return m
 }()
 
+// maxJumpAddr is the largest address that can be encoded as a jump argument,
+// which is always 4 bytes of 7-bit varint.
+const maxJumpAddr = 1<<28 - 1
+
 func isJump(op Opcode) bool {
-	// Jump op argument is always encoded with 4 bytes
+	// Jump op argument is encoded with 4 bytes, unless jumps are compact
 	return opcodeJMPMin <= op && op <= opcodeJMPMax
 }
 
 // returns the number of bytes required to encode the Opcode with its argument
-// (if it applies).
-func encodedSize(op Opcode, arg uint32) int {
+// (if it applies). If compact is true, jump arguments are not padded.
+func encodedSize(op Opcode, arg uint32, compact bool) int {
 	if op >= OpcodeArgMin {
-		if isJump(op) {
+		if isJump(op) && !compact {
 			// jumps are always encoded on 4 bytes, padded with NOPs if the jump
 			// requires less.
 			return 1 + 4
@@ -209,14 +231,17 @@ const variableStackEffect = 0x7f
 // stackEffect records the effect on the size of the operand stack of
 // each kind of instruction. For some instructions this requires computation.
 var stackEffect = [...]int8{
-	AMPERSAND: -1,
-	ATTR:      0,
-	CALL:      variableStackEffect,
-	//CALL_VAR:     variableStackEffect,
+	AMPERSAND:    -1,
+	APPEND:       -2,
+	ATTR:         0,
+	CALL:         variableStackEffect,
+	CALL_VAR:     variableStackEffect,
 	CATCHJMP:     0,
 	CIRCUMFLEX:   -1,
 	CJMP:         -1,
 	CONSTANT:     +1,
+	COPYARRAY:    0,
+	CRITICAL:     0,
 	DEFEREXIT:    0,
 	DUP2:         +2,
 	DUP:          +1,
@@ -228,6 +253,7 @@ var stackEffect = [...]int8{
 	GE:           -1,
 	GT:           -1,
 	GTGT:         -1,
+	IN:           -1,
 	INDEX:        -1,
 	ITERJMP:      variableStackEffect,
 	ITERPOP:      0,
@@ -241,6 +267,7 @@ var stackEffect = [...]int8{
 	LT:           -1,
 	LTLT:         -1,
 	MAKEMAP:      +1,
+	MAKECLASS:    -1,
 	MAKEFUNC:     0,
 	MAKEARRAY:    variableStackEffect,
 	MAKETUPLE:    variableStackEffect,
@@ -254,6 +281,8 @@ var stackEffect = [...]int8{
 	PLUS:         -1,
 	POP:          -1,
 	PREDECLARED:  +1,
+	RANGEJMP:     variableStackEffect,
+	RANGEPUSH:    0,
 	RETURN:       -1,
 	RUNDEFER:     0,
 	SETLOCALCELL: -1,
@@ -264,13 +293,14 @@ var stackEffect = [...]int8{
 	SLASH:        -1,
 	SLASHSLASH:   -1,
 	STAR:         -1,
+	THROW:        -1,
 	TILDE:        0,
 	TRUE:         +1,
 	UMINUS:       0,
 	UNIVERSAL:    +1,
-	//UNPACK:       variableStackEffect,
-	UPLUS:  0,
-	UTILDE: 0,
+	UNPACK:       variableStackEffect,
+	UPLUS:        0,
+	UTILDE:       0,
 }
 
 func (op Opcode) String() string {
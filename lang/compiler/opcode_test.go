@@ -1,6 +1,7 @@
 package compiler
 
 import (
+	"errors"
 	"strings"
 	"testing"
 )
@@ -15,3 +16,58 @@ func TestOpcodeString(t *testing.T) {
 		}
 	}
 }
+
+func TestFuncodeInstructions(t *testing.T) {
+	var code []byte
+	code = encodeInsn(code, CONSTANT, 1, false)
+	code = encodeInsn(code, JMP, 9, false)
+	code = encodeInsn(code, LOCAL, 300, false)
+	code = encodeInsn(code, PLUS, 0, false)
+	code = encodeInsn(code, RETURN, 0, false)
+
+	fn := &Funcode{Code: code}
+	want := []Instruction{
+		{PC: 0, Op: CONSTANT, Arg: 1},
+		{PC: 2, Op: JMP, Arg: 9},
+		{PC: 7, Op: LOCAL, Arg: 300},
+		{PC: 10, Op: PLUS},
+		{PC: 11, Op: RETURN},
+	}
+	got := fn.Instructions()
+	if len(got) != len(want) {
+		t.Fatalf("want %d instructions, got %d: %v", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("instruction %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestEncodeJumpAddrLimit(t *testing.T) {
+	for _, op := range []Opcode{JMP, CJMP, ITERJMP, CATCHJMP} {
+		t.Run(op.String(), func(t *testing.T) {
+			code := encodeInsn(nil, op, maxJumpAddr, false)
+			if len(code) != 5 {
+				t.Fatalf("want 5 bytes, got %d: %v", len(code), code)
+			}
+			insns := (&Funcode{Code: code}).Instructions()
+			if len(insns) != 1 || insns[0].Arg != maxJumpAddr {
+				t.Fatalf("want a single jump to %d, got %v", maxJumpAddr, insns)
+			}
+
+			defer func() {
+				e := recover()
+				err, ok := e.(*limitError)
+				if !ok {
+					t.Fatalf("want a limit error, got %v", e)
+				}
+				if !errors.Is(err, ErrJumpAddrLimit) {
+					t.Fatalf("want ErrJumpAddrLimit, got %v", err)
+				}
+			}()
+			code = encodeInsn(nil, op, maxJumpAddr+1, false)
+			t.Fatalf("want a panic, got %v", code)
+		})
+	}
+}
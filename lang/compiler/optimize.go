@@ -0,0 +1,130 @@
+package compiler
+
+import "slices"
+
+// optimize runs a peephole optimization pass over the blocks of the CFG
+// reachable from entry or from the start of a defer or catch block, before
+// they are laid out. Only instructions that cannot fail are removed, so that
+// the behavior of the function is unchanged.
+//
+// Jumps to the next instruction and chains of jumps need no special
+// treatment: a block emptied by the pass is threaded like any other empty
+// block when the CFG is linearized, and a block only ends with an explicit
+// JMP if its successor is not laid out right after it.
+func (fcomp *fcomp) optimize(entry *block) {
+	seen := make(map[*block]bool)
+	var visit func(b *block)
+	visit = func(b *block) {
+		if b == nil || seen[b] {
+			return
+		}
+		seen[b] = true
+		peephole(b)
+		visit(b.jmp)
+		visit(b.cjmp)
+	}
+
+	visit(entry)
+	for _, r := range fcomp.defers {
+		visit(r.start)
+	}
+	for _, r := range fcomp.catches {
+		visit(r.start)
+	}
+}
+
+// peephole applies the peephole optimizations to the instructions of b until
+// none applies:
+//
+//   - a value pushed without side effect and popped right away is removed
+//     (e.g. CONSTANT POP or DUP POP), as is a NOT of a value popped right
+//     away;
+//   - a NOT before the final CJMP is removed and the successors of the
+//     block are swapped, so that NOT NOT CJMP becomes CJMP;
+//   - a final CJMP with the same successor for both outcomes becomes a POP.
+//
+// The source position of a removed instruction is moved to the instruction
+// that follows it in the block, which would otherwise have inherited it. A
+// removal that would lose it, because no instruction follows in the block,
+// is not done.
+func peephole(b *block) {
+	for changed := true; changed; {
+		changed = false
+
+		n := len(b.insns)
+		if n > 0 && b.insns[n-1].op == CJMP {
+			if dest(b.cjmp) == dest(b.jmp) {
+				// the condition does not matter
+				b.insns[n-1] = insn{op: POP, line: b.insns[n-1].line, col: b.insns[n-1].col}
+				b.cjmp = nil
+				changed = true
+				continue
+			}
+			if n > 1 && b.insns[n-2].op == NOT {
+				b.removeInsns(n-2, 1)
+				b.jmp, b.cjmp = b.cjmp, b.jmp
+				changed = true
+				continue
+			}
+		}
+
+		for i := 0; i+1 < len(b.insns); i++ {
+			if b.insns[i+1].op != POP {
+				continue
+			}
+			if isPureLoad(b.insns[i].op) && b.removeInsns(i, 2) ||
+				b.insns[i].op == NOT && b.removeInsns(i, 1) {
+				changed = true
+				break
+			}
+		}
+	}
+
+	if len(b.insns) == 0 {
+		// an empty block must have nil insns to be threaded
+		b.insns = nil
+	}
+}
+
+// removeInsns removes the n instructions of b starting at index i, if their
+// source position, if any, can be moved to the next instruction. It returns
+// true if the instructions were removed.
+func (b *block) removeInsns(i, n int) bool {
+	var line, col uint32
+	for _, insn := range b.insns[i : i+n] {
+		if insn.line != 0 {
+			line, col = insn.line, insn.col
+		}
+	}
+	if line != 0 {
+		if i+n >= len(b.insns) {
+			return false
+		}
+		if next := &b.insns[i+n]; next.line == 0 {
+			next.line, next.col = line, col
+		}
+	}
+	b.insns = append(b.insns[:i], b.insns[i+n:]...)
+	return true
+}
+
+// isPureLoad returns true if op pushes a value on the operand stack without
+// any other effect and cannot fail.
+func isPureLoad(op Opcode) bool {
+	switch op {
+	case NIL, TRUE, FALSE, CONSTANT, DUP:
+		return true
+	}
+	return false
+}
+
+// dest returns the first non-empty block that b leads to, or the block that
+// closes an empty cycle.
+func dest(b *block) *block {
+	var skipped []*block
+	for b.insns == nil && !slices.Contains(skipped, b) {
+		skipped = append(skipped, b)
+		b = b.jmp
+	}
+	return b
+}
@@ -0,0 +1,225 @@
+package compiler
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/resolver"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeephole(t *testing.T) {
+	// each instruction is "OP", "OP@line" or "OP arg"
+	parse := func(s string) []insn {
+		var insns []insn
+		for _, f := range strings.Split(s, ";") {
+			var in insn
+			op, arg, _ := strings.Cut(strings.TrimSpace(f), " ")
+			if name, line, ok := strings.Cut(op, "@"); ok {
+				op = name
+				in.line, in.col = uint32(line[0]-'0'), 1
+			}
+			for o, name := range opcodeNames {
+				if strings.EqualFold(name, op) {
+					in.op = Opcode(o)
+				}
+			}
+			if arg != "" {
+				in.arg = uint32(arg[0] - '0')
+			}
+			insns = append(insns, in)
+		}
+		return insns
+	}
+
+	cases := []struct {
+		desc    string
+		insns   string
+		want    string
+		swapped bool // successors are swapped
+	}{
+		{"constant pop", "CONSTANT 0; POP; NIL; RETURN", "NIL; RETURN", false},
+		{"load pops", "NIL; POP; TRUE; POP; FALSE; POP; LOCAL 0; DUP; POP; RETURN", "LOCAL 0; RETURN", false},
+		{"failing load", "LOCAL 0; POP; NIL; RETURN", "LOCAL 0; POP; NIL; RETURN", false},
+		{"position moved", "CONSTANT@3 0; POP; PREDECLARED 1; CALL 0; RETURN", "PREDECLARED@3 1; CALL 0; RETURN", false},
+		{"position kept", "CONSTANT@3 0; POP; PREDECLARED@4 1; RETURN", "PREDECLARED@4 1; RETURN", false},
+		{"position at end", "LOCAL 0; DUP@2; POP", "LOCAL 0; DUP@2; POP", false},
+		{"no position at end", "LOCAL 0; DUP; POP", "LOCAL 0", false},
+		{"not cjmp", "LOCAL 0; NOT; CJMP", "LOCAL 0; CJMP", true},
+		{"not not cjmp", "LOCAL 0; NOT; NOT; CJMP", "LOCAL 0; CJMP", false},
+		{"not not", "LOCAL 0; NOT; NOT; RETURN", "LOCAL 0; NOT; NOT; RETURN", false},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			b := &block{insns: parse(c.insns)}
+			t1, f1 := &block{insns: parse("TRUE; RETURN")}, &block{insns: parse("FALSE; RETURN")}
+			if n := len(b.insns); b.insns[n-1].op == CJMP {
+				b.cjmp, b.jmp = t1, f1
+			}
+			peephole(b)
+
+			require.Equal(t, parse(c.want), b.insns)
+			if b.cjmp != nil {
+				if c.swapped {
+					t1, f1 = f1, t1
+				}
+				require.Same(t, t1, b.cjmp)
+				require.Same(t, f1, b.jmp)
+			}
+		})
+	}
+
+	t.Run("same successors", func(t *testing.T) {
+		// the successors lead to the same block via an empty one
+		next := &block{insns: parse("NIL; RETURN")}
+		b := &block{insns: parse("TRUE; NOT; CJMP"), cjmp: next, jmp: &block{jmp: next}}
+		peephole(b)
+		require.Nil(t, b.insns)
+		require.Nil(t, b.cjmp)
+		require.Equal(t, next, dest(b.jmp))
+	})
+}
+
+func TestCompileOptimize(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want string
+	}{
+		{"empty if", `if x == 1 then end`, `
+			0 predeclared 0
+			2 constant 0
+			4 eql
+			5 pop
+			6 nil
+			7 return
+		`},
+		{"empty if else", `if x then else end; f()`, `
+			0 predeclared 0
+			2 pop
+			3 predeclared 1
+			5 call 0
+			7 pop
+			8 nil
+			9 return
+		`},
+		{"empty loop", `for do end`, `0 jmp 0`},
+		{"empty loop in if", `if x then for do end end`, `
+			0 predeclared 0
+			2 cjmp 9
+			7 nil
+			8 return
+			9 jmp 9
+		`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			prog := compileProgramMode(t, c.src, Optimize)
+			require.Equal(t, normalizeDasm(c.want), normalizeDasm(disasm(prog.Functions[0])))
+
+			// the optimized code is never larger
+			unopt := compileProgramMode(t, c.src, 0)
+			require.LessOrEqual(t, len(prog.Functions[0].Code), len(unopt.Functions[0].Code))
+		})
+	}
+}
+
+func TestCompileRangeLoop(t *testing.T) {
+	// compile resolves range as the universal built-in
+	compile := func(t *testing.T, src string, mode Mode) *Program {
+		ctx := context.Background()
+		fset := token.NewFileSet()
+		ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(src))
+		require.NoError(t, err)
+		chunks := []*ast.Chunk{ch}
+		err = resolver.ResolveFiles(ctx, fset, chunks, 0, nil, nil, func(name string) bool { return name == "range" })
+		require.NoError(t, err)
+		progs, err := CompileFiles(ctx, fset, chunks, mode, nil)
+		require.NoError(t, err)
+		require.NoError(t, Verify(progs[0]))
+		return progs[0]
+	}
+
+	cases := []struct {
+		desc string
+		src  string
+		want string // empty if the loop is not specialized
+	}{
+		{"start stop", `for i in range(1, 3) do end`, `
+			0 constant 0
+			2 constant 1
+			4 constant 0
+			6 rangepush
+			7 rangejmp 19
+			12 setlocal 0
+			14 jmp 7
+			19 pop
+			20 pop
+			21 pop
+			22 nil
+			23 return
+		`},
+		{"start stop step", `for i in range(3, 0, -1) do end`, `
+			0 constant 0
+			2 constant 1
+			4 constant 2
+			6 rangepush
+			7 rangejmp 19
+			12 setlocal 0
+			14 jmp 7
+			19 pop
+			20 pop
+			21 pop
+			22 nil
+			23 return
+		`},
+		{"goto out of loop", `let n = 3; for i in range(0, n) do if i == 1 then goto done end end ::done::`, `
+			0 constant 0
+			2 setlocal 0
+			4 constant 1
+			6 local 0
+			8 constant 2
+			10 rangepush
+			11 rangejmp 33
+			16 setlocal 1
+			18 local 1
+			20 constant 2
+			22 eql
+			23 cjmp 41
+			28 jmp 11
+			33 pop
+			34 pop
+			35 pop
+			36 jmp 44
+			41 pop
+			42 pop
+			43 pop
+			44 nil
+			45 return
+		`},
+		{"one argument", `for i in range(3) do end`, ""},
+		{"named argument", `for i in range(1, 3, step: 1) do end`, ""},
+		{"spread argument", `let x = [3]; for i in range(1, ...x) do end`, ""},
+		{"many variables", `for i, j in range(1, 3) do end`, ""},
+		{"many expressions", `for i in range(1, 3), 4 do end`, ""},
+		{"shadowed range", `let range = 1; for i in range(1, 3) do end`, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			unopt := compile(t, c.src, 0)
+			require.NotContains(t, disasm(unopt.Functions[0]), "rangejmp")
+
+			prog := compile(t, c.src, Optimize)
+			got := disasm(prog.Functions[0])
+			if c.want == "" {
+				require.NotContains(t, got, "rangejmp")
+				return
+			}
+			require.Equal(t, normalizeDasm(c.want), normalizeDasm(got))
+		})
+	}
+}
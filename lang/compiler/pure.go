@@ -0,0 +1,160 @@
+package compiler
+
+import (
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/resolver"
+	"github.com/mna/nenuphar/lang/token"
+)
+
+// purity is a conservative analysis of the side effects of functions. A
+// function is pure if it:
+//   - does not assign to a variable that is not local to the function;
+//   - does not assign to an index or a field (it may mutate a non-local
+//     value);
+//   - does not read a predeclared or a non-constant free variable (its result
+//     may depend on external state);
+//   - only calls functions declared with a function statement (thus bound to
+//     a constant) that are themselves pure, which means that built-ins (such
+//     as print) and methods are never considered pure;
+//   - does not throw errors nor declare classes.
+//
+// Operators are assumed to be free of side effects, even though they may
+// dispatch to metamethods. Creating a closure is also considered pure, the
+// purity of the closure itself is only relevant if it is called.
+type purity struct {
+	// function statements seen so far, by the identifier that declares their
+	// name.
+	decls map[*ast.IdentExpr]*resolver.Function
+	// results of the analysis, a function is assumed pure while it is being
+	// analyzed so that recursive calls do not make it impure.
+	memo map[*resolver.Function]bool
+}
+
+// declare records the function statement so that calls to it can be
+// analyzed.
+func (p *purity) declare(stmt *ast.FuncStmt) {
+	if p.decls == nil {
+		p.decls = make(map[*ast.IdentExpr]*resolver.Function)
+	}
+	p.decls[stmt.Name] = stmt.Function.(*resolver.Function)
+}
+
+// isPure returns true if the function fn is pure, as defined by the
+// analysis.
+func (p *purity) isPure(fn *resolver.Function) bool {
+	if pure, ok := p.memo[fn]; ok {
+		return pure
+	}
+	if p.memo == nil {
+		p.memo = make(map[*resolver.Function]bool)
+	}
+
+	var body *ast.Block
+	switch def := fn.Definition.(type) {
+	case *ast.Chunk:
+		body = def.Block
+	case *ast.FuncStmt:
+		body = def.Body
+	case *ast.FuncExpr:
+		body = def.Body
+	default:
+		p.memo[fn] = false
+		return false
+	}
+
+	p.memo[fn] = true
+	pure := true
+	var v ast.VisitorFunc
+	v = func(n ast.Node, dir ast.VisitDirection) ast.Visitor {
+		if !pure || dir == ast.VisitExit {
+			return nil
+		}
+		switch n := n.(type) {
+		case *ast.FuncStmt:
+			p.declare(n)
+			return nil
+
+		case *ast.FuncExpr:
+			return nil
+
+		case *ast.ClassStmt, *ast.ClassExpr:
+			pure = false
+
+		case *ast.ReturnLikeStmt:
+			if n.Type == token.THROW {
+				pure = false
+			}
+
+		case *ast.AssignStmt:
+			for _, lhs := range n.Left {
+				if !p.isLocalTarget(lhs) {
+					pure = false
+				}
+			}
+
+		case *ast.DotExpr:
+			// the right-hand side is a field name, not a variable
+			ast.Walk(v, n.Left)
+			return nil
+
+		case *ast.CallExpr:
+			if !p.isPureCallee(n.Fn) {
+				pure = false
+			}
+
+		case *ast.IdentExpr:
+			bdg, ok := n.Binding.(*resolver.Binding)
+			if !ok {
+				break
+			}
+			switch bdg.Scope {
+			case resolver.Predeclared:
+				pure = false
+			case resolver.Free:
+				if !bdg.Const {
+					pure = false
+				}
+			}
+		}
+		return v
+	}
+	ast.Walk(v, body)
+
+	p.memo[fn] = pure
+	return pure
+}
+
+// isLocalTarget returns true if the assignment target lhs is a local variable
+// of the function.
+func (p *purity) isLocalTarget(lhs ast.Expr) bool {
+	switch lhs := lhs.(type) {
+	case *ast.ParenExpr:
+		return p.isLocalTarget(lhs.Expr)
+	case *ast.IdentExpr:
+		bdg := lhs.Binding.(*resolver.Binding)
+		return bdg.Scope == resolver.Local || bdg.Scope == resolver.Cell
+	}
+	return false
+}
+
+// isPureCallee returns true if fn refers to a known pure function.
+func (p *purity) isPureCallee(fn ast.Expr) bool {
+	for {
+		paren, ok := fn.(*ast.ParenExpr)
+		if !ok {
+			break
+		}
+		fn = paren.Expr
+	}
+
+	id, ok := fn.(*ast.IdentExpr)
+	if !ok {
+		return false
+	}
+	bdg := id.Binding.(*resolver.Binding)
+	if !bdg.Const {
+		return false
+	}
+	callee := p.decls[bdg.Decl]
+	return callee != nil && p.isPure(callee)
+}
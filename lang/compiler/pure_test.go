@@ -0,0 +1,158 @@
+package compiler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/resolver"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPureFunctions(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want map[string]bool
+	}{
+		{"local arithmetic", `
+fn add(a, b)
+	let c = a * 2
+	c += 1
+	return c + b
+end
+`, map[string]bool{"test": true, "add": true}},
+
+		{"calls print", `
+fn show(x)
+	print(x)
+end
+`, map[string]bool{"test": true, "show": false}},
+
+		{"transitive pure", `
+fn sq(x) return x * x end
+fn sumsq(a, b) return sq(a) + sq(b) end
+let x = sumsq(1, 2)
+`, map[string]bool{"test": true, "sq": true, "sumsq": true}},
+
+		{"transitive impure", `
+fn log(x) print(x) end
+fn id(x)
+	log(x)
+	return x
+end
+fn twice(x) return id(id(x)) end
+`, map[string]bool{"test": true, "log": false, "id": false, "twice": false}},
+
+		{"recursive", `
+fn fact(n)
+	if n <= 1 then
+		return 1
+	end
+	return n * fact(n - 1)
+end
+`, map[string]bool{"test": true, "fact": true}},
+
+		{"nested", `
+fn outer(x)
+	fn inner(y) return y + 1 end
+	return inner(x)
+end
+`, map[string]bool{"test": true, "inner": true, "outer": true}},
+
+		{"closure creation", `
+fn mk()
+	return fn() print(1) end
+end
+`, map[string]bool{"test": true, "mk": true, "anonymous": false}},
+
+		{"method call", `
+fn m(t) return t.size() end
+`, map[string]bool{"test": true, "m": false}},
+
+		{"read free variable", `
+let n = 0
+const m = 1
+fn getn() return n end
+fn getm() return m end
+`, map[string]bool{"test": true, "getn": false, "getm": true}},
+
+		{"read predeclared", `
+fn get() return G end
+`, map[string]bool{"test": true, "get": false}},
+
+		{"field and index", `
+fn setf(t) t.x = 1 end
+fn seti(t) t[1] = 1 end
+fn getf(t) return t.x + t[1] end
+`, map[string]bool{"test": true, "setf": false, "seti": false, "getf": true}},
+
+		{"variable callee", `
+fn sq(x) return x * x end
+fn f(x)
+	let g = sq
+	return g(x)
+end
+`, map[string]bool{"test": true, "sq": true, "f": false}},
+
+		{"impure top-level", `
+fn sq(x) return x * x end
+print(sq(2))
+`, map[string]bool{"test": false, "sq": true}},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			fset := token.NewFileSet()
+			ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(c.src))
+			require.NoError(t, err)
+			chunks := []*ast.Chunk{ch}
+			err = resolver.ResolveFiles(ctx, fset, chunks, 0, nil,
+				func(s string) bool { return s == "G" },
+				func(s string) bool { return s == "print" })
+			require.NoError(t, err)
+			progs, err := CompileFiles(ctx, fset, chunks, 0, nil)
+			require.NoError(t, err)
+
+			got := make(map[string]bool)
+			for _, fn := range progs[0].Functions {
+				got[fn.Name] = fn.Pure
+			}
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestPureAnalysis(t *testing.T) {
+	// those statements are not supported yet by the compiler, so the analysis
+	// is tested on its own.
+	cases := []struct {
+		desc string
+		src  string
+	}{
+		{"write free variable", `
+let n = 0
+fn f() n += 1 end
+`},
+		{"throw", `
+let n = 0
+fn f() throw 'oops' end
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			fset := token.NewFileSet()
+			ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(c.src))
+			require.NoError(t, err)
+			require.NoError(t, resolver.ResolveFiles(ctx, fset, []*ast.Chunk{ch}, 0, nil, nil, nil))
+
+			var p purity
+			f := ch.Block.Stmts[1].(*ast.FuncStmt)
+			require.False(t, p.isPure(f.Function.(*resolver.Function)))
+			require.True(t, p.isPure(ch.Function.(*resolver.Function)))
+		})
+	}
+}
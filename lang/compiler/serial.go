@@ -0,0 +1,437 @@
+package compiler
+
+// This file defines functions to read and write a compiled program as a
+// byte string, adapted from the Starlark source code.
+//
+// Encoding:
+//
+//	Program:
+//		"nen!"		[4]byte		# magic number
+//		version		varint		# must be Version
+//		filename	string
+//		numnames	varint
+//		names		[]string
+//		numconsts	varint
+//		consts		[]Constant
+//		numfuncs	varint
+//		funcs		[]Funcode	# funcode at index 0 is the top-level
+//		EOF
+//
+//	Funcode:
+//		name		string
+//		pos		Position
+//		code		[]byte
+//		pclinetablen	varint
+//		pclinetab	[]varint
+//		numlocals	varint
+//		locals		[]Binding
+//		numcells	varint
+//		cells		[]int
+//		numfreevars	varint
+//		freevar		[]Binding
+//		numdefers	varint
+//		defers		[]Defer
+//		numcatches	varint
+//		catches		[]Defer
+//		maxstack	varint
+//		maxdeferred	varint
+//		numparams	varint
+//		flags		varint		# 1=hasvararg, 2=pure, 4=compactjumps
+//
+//	Binding:
+//		name		string
+//		pos		Position
+//
+//	Position:
+//		line		varint
+//		col		varint
+//
+//	Defer:
+//		pc0		varint
+//		pc1		varint
+//		startpc		varint
+//		stack		varint
+//		iters		varint
+//
+//	Constant:				# type	data
+//		type		varint		# 0=string	string
+//		data		...		# 1=int64	varint
+//						# 2=float64	varint (bits)
+//						# 3=nil		-
+//						# 4=false	-
+//						# 5=true	-
+//						# 6=tuple	numelems varint; elems []Constant
+//						# 7=bytes	string
+//
+//	string:
+//		len		varint
+//		data		[]byte
+//
+// All integers are encoded as unsigned varints, except int64 constants which
+// use the zig-zag encoding of signed varints.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const magic = "nen!"
+
+// ErrVersionMismatch is the error wrapped by DecodeProgram when the encoded
+// program was compiled with a different version of the compiler, in which
+// case its source code must be compiled again.
+var ErrVersionMismatch = errors.New("compiled program version mismatch")
+
+const (
+	constString = iota
+	constInt
+	constFloat
+	constNil
+	constFalse
+	constTrue
+	constTuple
+	constBytes
+)
+
+const (
+	flagHasVarArg = 1 << iota
+	flagPure
+	flagCompactJumps
+)
+
+// Encode encodes a compiled program.
+func (prog *Program) Encode() []byte {
+	var e encoder
+	e.p = append(e.p, magic...)
+	e.int(Version)
+	e.string(prog.Filename)
+	e.int(len(prog.Names))
+	for _, name := range prog.Names {
+		e.string(name)
+	}
+	e.int(len(prog.Constants))
+	for _, c := range prog.Constants {
+		e.constant(c)
+	}
+	e.int(len(prog.Functions))
+	for _, fn := range prog.Functions {
+		e.function(fn)
+	}
+	return e.p
+}
+
+type encoder struct {
+	p []byte // encoded program
+}
+
+func (e *encoder) int(x int) {
+	e.uint64(uint64(x))
+}
+
+func (e *encoder) uint64(x uint64) {
+	e.p = binary.AppendUvarint(e.p, x)
+}
+
+func (e *encoder) string(s string) {
+	e.int(len(s))
+	e.p = append(e.p, s...)
+}
+
+func (e *encoder) position(pos Position) {
+	e.uint64(uint64(pos.Line))
+	e.uint64(uint64(pos.Col))
+}
+
+func (e *encoder) bindings(binds []Binding) {
+	e.int(len(binds))
+	for _, bind := range binds {
+		e.string(bind.Name)
+		e.position(bind.Pos)
+	}
+}
+
+func (e *encoder) defers(defers []Defer) {
+	e.int(len(defers))
+	for _, d := range defers {
+		e.uint64(uint64(d.PC0))
+		e.uint64(uint64(d.PC1))
+		e.uint64(uint64(d.StartPC))
+		e.uint64(uint64(d.Stack))
+		e.uint64(uint64(d.Iters))
+	}
+}
+
+func (e *encoder) constant(c interface{}) {
+	switch c := c.(type) {
+	case string:
+		e.int(constString)
+		e.string(c)
+	case int64:
+		e.int(constInt)
+		e.p = binary.AppendVarint(e.p, c)
+	case float64:
+		e.int(constFloat)
+		e.uint64(math.Float64bits(c))
+	case nil:
+		e.int(constNil)
+	case bool:
+		if c {
+			e.int(constTrue)
+		} else {
+			e.int(constFalse)
+		}
+	case Bytes:
+		e.int(constBytes)
+		e.string(string(c))
+	case Tuple:
+		e.int(constTuple)
+		e.int(len(c))
+		for _, v := range c {
+			e.constant(v)
+		}
+	default:
+		panic(fmt.Sprintf("unexpected constant %T: %[1]v", c))
+	}
+}
+
+func (e *encoder) function(fn *Funcode) {
+	e.string(fn.Name)
+	e.position(fn.pos)
+	e.string(string(fn.Code))
+	e.int(len(fn.pclinetab))
+	for _, x := range fn.pclinetab {
+		e.uint64(uint64(x))
+	}
+	e.bindings(fn.Locals)
+	e.int(len(fn.Cells))
+	for _, index := range fn.Cells {
+		e.int(index)
+	}
+	e.bindings(fn.Freevars)
+	e.defers(fn.Defers)
+	e.defers(fn.Catches)
+	e.int(fn.MaxStack)
+	e.int(fn.MaxDeferred)
+	e.int(fn.NumParams)
+	var flags int
+	if fn.HasVarArg {
+		flags |= flagHasVarArg
+	}
+	if fn.Pure {
+		flags |= flagPure
+	}
+	if fn.CompactJumps {
+		flags |= flagCompactJumps
+	}
+	e.int(flags)
+}
+
+// IsEncodedProgram returns true if data starts with the magic number of an
+// encoded program, so that it can be decoded by DecodeProgram instead of
+// being compiled as source code.
+func IsEncodedProgram(data []byte) bool {
+	return len(data) >= len(magic) && string(data[:len(magic)]) == magic
+}
+
+// DecodeProgram decodes a compiled program from its binary form. If the
+// program was encoded by a different version of the compiler, the returned
+// error wraps ErrVersionMismatch.
+func DecodeProgram(data []byte) (_ *Program, err error) {
+	if !IsEncodedProgram(data) {
+		return nil, errors.New("not a compiled program: no magic number")
+	}
+
+	defer func() {
+		if x := recover(); x != nil {
+			err, _ = x.(error)
+			if err == nil {
+				panic(x)
+			}
+		}
+	}()
+
+	d := decoder{p: data[len(magic):]}
+	if v := d.int(); v != Version {
+		return nil, fmt.Errorf("%w: version %d, want %d", ErrVersionMismatch, v, Version)
+	}
+
+	prog := &Program{Filename: d.string()}
+	if n := d.count(); n > 0 {
+		prog.Names = make([]string, n)
+		for i := range prog.Names {
+			prog.Names[i] = d.string()
+		}
+	}
+	if n := d.count(); n > 0 {
+		prog.Constants = make([]interface{}, n)
+		for i := range prog.Constants {
+			prog.Constants[i] = d.constant()
+		}
+	}
+	if n := d.count(); n > 0 {
+		prog.Functions = make([]*Funcode, n)
+		for i := range prog.Functions {
+			prog.Functions[i] = d.function(prog)
+		}
+	}
+	if len(d.p) > 0 {
+		return nil, errors.New("internal error: unconsumed compiled program data")
+	}
+	return prog, nil
+}
+
+type decoder struct {
+	p     []byte // remaining undecoded data
+	depth int    // nesting depth of the tuple constant being decoded
+}
+
+// maxTupleDepth is the maximum nesting depth of a tuple constant accepted by
+// the decoder, so that a crafted program cannot exhaust the Go stack.
+const maxTupleDepth = 1000
+
+var errTruncated = errors.New("truncated compiled program")
+
+func (d *decoder) uint64() uint64 {
+	x, n := binary.Uvarint(d.p)
+	if n <= 0 {
+		panic(errTruncated)
+	}
+	d.p = d.p[n:]
+	return x
+}
+
+func (d *decoder) int() int {
+	x := d.uint64()
+	if x > math.MaxInt32 {
+		panic(fmt.Errorf("invalid compiled program: integer %d out of range", x))
+	}
+	return int(x)
+}
+
+// count decodes the number of elements of a list. As each element is encoded
+// on at least one byte, a count larger than the remaining data is rejected
+// before anything gets allocated for the list.
+func (d *decoder) count() int {
+	n := d.int()
+	if n > len(d.p) {
+		panic(errTruncated)
+	}
+	return n
+}
+
+func (d *decoder) uint32() uint32 {
+	return uint32(d.int())
+}
+
+func (d *decoder) string() string {
+	n := d.int()
+	if n > len(d.p) {
+		panic(errTruncated)
+	}
+	s := string(d.p[:n])
+	d.p = d.p[n:]
+	return s
+}
+
+func (d *decoder) position() Position {
+	line := d.uint32()
+	col := d.uint32()
+	return Position{Line: line, Col: col}
+}
+
+func (d *decoder) bindings() []Binding {
+	binds := make([]Binding, d.count())
+	for i := range binds {
+		binds[i].Name = d.string()
+		binds[i].Pos = d.position()
+	}
+	return binds
+}
+
+func (d *decoder) defers() []Defer {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	defers := make([]Defer, n)
+	for i := range defers {
+		defers[i].PC0 = d.uint32()
+		defers[i].PC1 = d.uint32()
+		defers[i].StartPC = d.uint32()
+		defers[i].Stack = d.uint32()
+		defers[i].Iters = d.uint32()
+	}
+	return defers
+}
+
+func (d *decoder) constant() interface{} {
+	switch typ := d.int(); typ {
+	case constString:
+		return d.string()
+	case constInt:
+		x, n := binary.Varint(d.p)
+		if n <= 0 {
+			panic(errTruncated)
+		}
+		d.p = d.p[n:]
+		return x
+	case constFloat:
+		return math.Float64frombits(d.uint64())
+	case constNil:
+		return nil
+	case constFalse:
+		return false
+	case constTrue:
+		return true
+	case constBytes:
+		return Bytes(d.string())
+	case constTuple:
+		if d.depth >= maxTupleDepth {
+			panic(fmt.Errorf("invalid compiled program: tuple constant nested deeper than %d", maxTupleDepth))
+		}
+		d.depth++
+		t := make(Tuple, d.count())
+		for i := range t {
+			t[i] = d.constant()
+		}
+		d.depth--
+		return t
+	default:
+		panic(fmt.Errorf("invalid compiled program: unknown constant type %d", typ))
+	}
+}
+
+func (d *decoder) function(prog *Program) *Funcode {
+	fn := &Funcode{
+		Prog: prog,
+		Name: d.string(),
+		pos:  d.position(),
+		Code: []byte(d.string()),
+	}
+	if n := d.count(); n > 0 {
+		fn.pclinetab = make([]uint16, n)
+		for i := range fn.pclinetab {
+			fn.pclinetab[i] = uint16(d.int())
+		}
+	}
+	fn.Locals = d.bindings()
+	if n := d.count(); n > 0 {
+		fn.Cells = make([]int, n)
+		for i := range fn.Cells {
+			fn.Cells[i] = d.int()
+		}
+	}
+	fn.Freevars = d.bindings()
+	fn.Defers = d.defers()
+	fn.Catches = d.defers()
+	fn.MaxStack = d.int()
+	fn.MaxDeferred = d.int()
+	fn.NumParams = d.int()
+	flags := d.int()
+	fn.HasVarArg = flags&flagHasVarArg != 0
+	fn.Pure = flags&flagPure != 0
+	fn.CompactJumps = flags&flagCompactJumps != 0
+	return fn
+}
@@ -0,0 +1,182 @@
+package compiler
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecodeProgram(t *testing.T) {
+	src := `
+let x = (1, "a", (2.5, true, null))
+let b = b"a\xff"
+class Foo!
+	let y = [-3, 4]
+	fn get(a, ...b) return y end
+end
+fn f()
+	let z = 0
+	defer
+		z = 1
+	end
+	catch
+		return 2
+	end
+	return 1 + try Foo.get()
+end
+return f()
+`
+	for _, mode := range []Mode{0, CompactJumps} {
+		prog := compileProgramMode(t, src, mode)
+		b := prog.Encode()
+
+		got, err := DecodeProgram(b)
+		require.NoError(t, err)
+		require.Equal(t, prog, got)
+		require.NoError(t, Verify(got))
+		for i, fn := range prog.Functions {
+			for _, insn := range fn.Instructions() {
+				require.Equal(t, fn.Pos(insn.PC), got.Functions[i].Pos(insn.PC))
+			}
+		}
+
+		// encoding is deterministic
+		require.Equal(t, b, got.Encode())
+	}
+}
+
+func TestDecodeProgramErrors(t *testing.T) {
+	b := compileProgram(t, "return 1").Encode()
+
+	t.Run("version", func(t *testing.T) {
+		bumped := append([]byte(nil), b...)
+		bumped[len(magic)] = Version + 1
+		_, err := DecodeProgram(bumped)
+		require.ErrorIs(t, err, ErrVersionMismatch)
+	})
+
+	t.Run("magic", func(t *testing.T) {
+		_, err := DecodeProgram([]byte("nope"))
+		require.ErrorContains(t, err, "not a compiled program")
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		_, err := DecodeProgram(b[:len(b)-2])
+		require.ErrorContains(t, err, "truncated compiled program")
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		_, err := DecodeProgram(append(b, 0))
+		require.ErrorContains(t, err, "unconsumed compiled program data")
+	})
+}
+
+func TestDecodeProgramHugeCounts(t *testing.T) {
+	// header returns an encoder with the magic number, version and filename.
+	header := func() *encoder {
+		var e encoder
+		e.p = append(e.p, magic...)
+		e.int(Version)
+		e.string("test")
+		return &e
+	}
+	// function returns an encoder with a single function whose encoding
+	// starts with the name, position and code.
+	function := func() *encoder {
+		e := header()
+		e.int(0) // names
+		e.int(0) // constants
+		e.int(1) // functions
+		e.string("f")
+		e.position(Position{})
+		e.string("")
+		return e
+	}
+
+	cases := []struct {
+		desc string
+		enc  func() *encoder
+		err  string
+	}{
+		{"names", func() *encoder {
+			e := header()
+			e.int(math.MaxInt32)
+			return e
+		}, "truncated compiled program"},
+		{"constants", func() *encoder {
+			e := header()
+			e.int(0)
+			e.int(math.MaxInt32)
+			return e
+		}, "truncated compiled program"},
+		{"functions", func() *encoder {
+			e := header()
+			e.int(0)
+			e.int(0)
+			e.int(math.MaxInt32)
+			return e
+		}, "truncated compiled program"},
+		{"tuple", func() *encoder {
+			e := header()
+			e.int(0)
+			e.int(1)
+			e.int(constTuple)
+			e.int(math.MaxInt32)
+			return e
+		}, "truncated compiled program"},
+		{"nested tuples", func() *encoder {
+			e := header()
+			e.int(0)
+			e.int(1)
+			for i := 0; i <= maxTupleDepth; i++ {
+				e.int(constTuple)
+				e.int(1)
+			}
+			e.int(constNil)
+			e.int(0)
+			return e
+		}, "tuple constant nested deeper than"},
+		{"pclinetab", func() *encoder {
+			e := function()
+			e.int(math.MaxInt32)
+			return e
+		}, "truncated compiled program"},
+		{"locals", func() *encoder {
+			e := function()
+			e.int(0)
+			e.int(math.MaxInt32)
+			return e
+		}, "truncated compiled program"},
+		{"cells", func() *encoder {
+			e := function()
+			e.int(0)
+			e.int(0)
+			e.int(math.MaxInt32)
+			return e
+		}, "truncated compiled program"},
+		{"freevars", func() *encoder {
+			e := function()
+			e.int(0)
+			e.int(0)
+			e.int(0)
+			e.int(math.MaxInt32)
+			return e
+		}, "truncated compiled program"},
+		{"defers", func() *encoder {
+			e := function()
+			e.int(0)
+			e.int(0)
+			e.int(0)
+			e.int(0)
+			e.int(math.MaxInt32)
+			return e
+		}, "truncated compiled program"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			_, err := DecodeProgram(c.enc().p)
+			require.ErrorContains(t, err, c.err)
+		})
+	}
+}
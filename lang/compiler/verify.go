@@ -0,0 +1,393 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Verify checks that the compiled program p is well-formed and can be safely
+// executed by the virtual machine. This is mostly useful for programs that
+// were not generated by the compiler, e.g. hand-written assembly or decoded
+// programs, as the compiler should always generate valid programs. It returns
+// an error listing all the problems found, or nil if the program is valid.
+func Verify(p *Program) error {
+	if len(p.Functions) == 0 {
+		return errors.New("no function")
+	}
+
+	var errs []error
+	for i, fn := range p.Functions {
+		v := verifier{fn: fn, index: i}
+		v.verify()
+		errs = append(errs, v.errs...)
+	}
+	return errors.Join(errs...)
+}
+
+type verifier struct {
+	fn    *Funcode
+	index int
+	insns []Instruction
+	at    map[uint32]int // index in insns of the instruction at each pc
+	errs  []error
+}
+
+func (v *verifier) errorf(pc uint32, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	v.errs = append(v.errs, fmt.Errorf("function %s (#%d): pc %d: %s", v.fn.Name, v.index, pc, msg))
+}
+
+// fnErrorf is like errorf for a problem that is not tied to an instruction.
+func (v *verifier) fnErrorf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	v.errs = append(v.errs, fmt.Errorf("function %s (#%d): %s", v.fn.Name, v.index, msg))
+}
+
+func (v *verifier) verify() {
+	v.verifyLocals()
+	v.insns = v.fn.Instructions()
+	if len(v.insns) == 0 {
+		v.errorf(0, "no instruction")
+		return
+	}
+	v.at = make(map[uint32]int, len(v.insns))
+	for i, insn := range v.insns {
+		v.at[insn.PC] = i
+	}
+
+	v.verifyEncoding()
+	v.verifyArgs()
+	v.verifyRegions("defer", v.fn.Defers)
+	v.verifyRegions("catch", v.fn.Catches)
+	v.verifyRunDefer()
+	v.verifyStack()
+}
+
+// verifyLocals checks that the parameters and the cells are locals of the
+// function.
+func (v *verifier) verifyLocals() {
+	if v.fn.NumParams < 0 || v.fn.NumParams > len(v.fn.Locals) {
+		v.fnErrorf("%d parameters, want at most %d (number of locals)", v.fn.NumParams, len(v.fn.Locals))
+	}
+	for i, ix := range v.fn.Cells {
+		if ix < 0 || ix >= len(v.fn.Locals) {
+			v.fnErrorf("cell #%d: local index %d out of range", i, ix)
+		}
+	}
+}
+
+// verifyEncoding checks that each instruction has a valid opcode and a
+// complete argument and, for jumps that are not compact, that the argument
+// is padded with NOPs, as the machine executes the padding.
+func (v *verifier) verifyEncoding() {
+	code := v.fn.Code
+	for i, insn := range v.insns {
+		if insn.Op > OpcodeMax {
+			v.errorf(insn.PC, "invalid opcode %d", uint8(insn.Op))
+			continue
+		}
+		if insn.Op < OpcodeArgMin {
+			continue
+		}
+
+		end := uint32(len(code))
+		if i+1 < len(v.insns) {
+			end = v.insns[i+1].PC
+		}
+		pc := insn.PC + 1
+		for pc < end && code[pc] >= 0x80 {
+			pc++
+		}
+		if pc == end {
+			v.errorf(insn.PC, "%s: truncated argument", insn.Op)
+			continue
+		}
+		for pc++; pc < end; pc++ {
+			if code[pc] != byte(NOP) {
+				v.errorf(insn.PC, "%s: argument padding is not %s", insn.Op, NOP)
+				break
+			}
+		}
+	}
+}
+
+// verifyArgs checks that the argument of each instruction is in range for
+// the table it indexes, that jumps target an instruction, and that cell
+// locals are only used with the cell instructions (and vice versa).
+func (v *verifier) verifyArgs() {
+	cells := make(map[uint32]bool, len(v.fn.Cells))
+	for _, ix := range v.fn.Cells {
+		cells[uint32(ix)] = true
+	}
+
+	prog := v.fn.Prog
+	for i, insn := range v.insns {
+		var kind string
+		var max int
+		switch insn.Op {
+		case LOCAL, SETLOCAL, LOCALCELL, SETLOCALCELL:
+			kind, max = "local", len(v.fn.Locals)
+		case FREE, FREECELL:
+			kind, max = "free variable", len(v.fn.Freevars)
+		case CONSTANT:
+			kind, max = "constant", len(prog.Constants)
+		case PREDECLARED, UNIVERSAL, ATTR, SETFIELD, MAKECLASS:
+			kind, max = "name", len(prog.Names)
+		case MAKEFUNC:
+			kind, max = "function", len(prog.Functions)
+		case JMP, CJMP, ITERJMP, RANGEJMP, CATCHJMP:
+			if _, ok := v.at[insn.Arg]; !ok {
+				v.errorf(insn.PC, "%s: jump target %d is not an instruction", insn.Op, insn.Arg)
+			}
+		}
+		if kind != "" && insn.Arg >= uint32(max) {
+			v.errorf(insn.PC, "%s: %s index %d out of range", insn.Op, kind, insn.Arg)
+			continue
+		}
+
+		switch insn.Op {
+		case LOCAL:
+			// a cell local can only be loaded with LOCAL (which loads the cell
+			// itself, not its content) to be captured by a closure.
+			if cells[insn.Arg] && !isCapture(v.insns[i:]) && !(i > 0 && isClassMembers(v.insns[i-1:])) {
+				v.errorf(insn.PC, "%s of cell local %s, want %s", insn.Op, v.localName(insn.Arg), LOCALCELL)
+			}
+		case SETLOCAL:
+			if cells[insn.Arg] {
+				v.errorf(insn.PC, "%s of cell local %s, want %s", insn.Op, v.localName(insn.Arg), SETLOCALCELL)
+			}
+		case LOCALCELL, SETLOCALCELL:
+			if !cells[insn.Arg] {
+				v.errorf(insn.PC, "%s of non-cell local %s", insn.Op, v.localName(insn.Arg))
+			}
+		}
+	}
+}
+
+// verifyRegions checks that each defer or catch region (depending on kind)
+// protects at least one instruction and that its defer or catch block starts
+// at an instruction outside of the protected range, as otherwise the block
+// could never run as expected. The block must not be reached by falling
+// through the instruction before it (the compiler emits a JMP over it) and a
+// defer block must exit with DEFEREXIT, never with RETURN.
+func (v *verifier) verifyRegions(kind string, regions []Defer) {
+	for i, d := range regions {
+		var covered bool
+		for _, insn := range v.insns {
+			if d.Covers(int64(insn.PC)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			v.regionErrorf(kind, i, "empty protected range [%d, %d]", d.PC0, d.PC1)
+		}
+
+		start, ok := v.at[d.StartPC]
+		if !ok {
+			v.regionErrorf(kind, i, "start pc %d is not an instruction", d.StartPC)
+			continue
+		}
+		if d.Covers(int64(d.StartPC)) {
+			v.regionErrorf(kind, i, "start pc %d is inside the protected range [%d, %d]", d.StartPC, d.PC0, d.PC1)
+		}
+		if start == 0 {
+			v.regionErrorf(kind, i, "start pc %d is the function entry", d.StartPC)
+		} else if prev := v.insns[start-1]; fallsThrough(prev.Op) {
+			v.regionErrorf(kind, i, "start pc %d is reached by falling through %s at pc %d", d.StartPC, prev.Op, prev.PC)
+		}
+
+		if kind == "defer" {
+			v.walk(start, func(j int) bool {
+				if insn := v.insns[j]; insn.Op == RETURN {
+					v.regionErrorf(kind, i, "%s at pc %d, want %s", insn.Op, insn.PC, DEFEREXIT)
+					return false
+				}
+				return true
+			})
+		}
+	}
+}
+
+// verifyRunDefer checks that each RETURN covered by a defer region, and each
+// jump from inside a defer region to outside of it, is immediately preceded
+// by RUNDEFER, as otherwise the machine does not run the defer block.
+func (v *verifier) verifyRunDefer() {
+	for i, insn := range v.insns {
+		if i > 0 && v.insns[i-1].Op == RUNDEFER {
+			continue
+		}
+		for j, d := range v.fn.Defers {
+			if !d.Covers(int64(insn.PC)) {
+				continue
+			}
+			leaves := insn.Op == RETURN || isJump(insn.Op) && insn.Op != CATCHJMP && !d.Covers(int64(insn.Arg))
+			if leaves {
+				v.errorf(insn.PC, "%s out of defer #%d not preceded by %s", insn.Op, j, RUNDEFER)
+				break
+			}
+		}
+	}
+}
+
+// verifyStack checks that the operand stack never underflows nor exceeds
+// MaxStack, that it has the same depth whenever an instruction is reached
+// and that the code does not fall through past its end. The function starts
+// with an empty stack and the defer and catch blocks with the depth recorded
+// in their region.
+func (v *verifier) verifyStack() {
+	depths := make(map[int]int, len(v.insns))
+	var overflow bool // only the first overflow is reported
+	var visit func(i, depth int)
+	visit = func(i, depth int) {
+		in := v.insns[i]
+		if want, ok := depths[i]; ok {
+			if depth != want {
+				v.errorf(in.PC, "inconsistent stack depth %d, want %d", depth, want)
+			}
+			return
+		}
+		depths[i] = depth
+		if in.Op > OpcodeMax {
+			return
+		}
+
+		depth += (&insn{op: in.Op, arg: in.Arg}).stackeffect()
+		if depth < 0 {
+			v.errorf(in.PC, "%s: stack underflow", in.Op)
+			return
+		}
+		// ITERJMP and RANGEJMP push one more value when they fall through
+		if peak := depth + b2i(in.Op == ITERJMP || in.Op == RANGEJMP); peak > v.fn.MaxStack && !overflow {
+			overflow = true
+			v.errorf(in.PC, "%s: stack depth %d exceeds MaxStack %d", in.Op, peak, v.fn.MaxStack)
+		}
+		if fallsThrough(in.Op) && i+1 == len(v.insns) {
+			v.errorf(in.PC, "%s falls through past the end of the code", in.Op)
+		}
+		for _, next := range v.successors(i) {
+			if next == i+1 && (in.Op == ITERJMP || in.Op == RANGEJMP) {
+				// ITERJMP and RANGEJMP push the next value only when they fall
+				// through
+				visit(next, depth+1)
+				continue
+			}
+			visit(next, depth)
+		}
+	}
+
+	visit(0, 0)
+	for _, regions := range []struct {
+		label  string
+		defers []Defer
+	}{{"defer", v.fn.Defers}, {"catch", v.fn.Catches}} {
+		for j, d := range regions.defers {
+			if int64(d.Stack) > int64(v.fn.MaxStack) {
+				v.fnErrorf("%s #%d: stack depth %d exceeds MaxStack %d", regions.label, j, d.Stack, v.fn.MaxStack)
+				continue
+			}
+			if start, ok := v.at[d.StartPC]; ok {
+				visit(start, int(d.Stack))
+			}
+		}
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// walk calls fn with the index of each instruction reachable from the one
+// at index start, in depth-first order, until fn returns false.
+func (v *verifier) walk(start int, fn func(i int) bool) {
+	seen := make(map[int]bool)
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		if seen[i] {
+			return true
+		}
+		seen[i] = true
+		if !fn(i) {
+			return false
+		}
+		for _, next := range v.successors(i) {
+			if !visit(next) {
+				return false
+			}
+		}
+		return true
+	}
+	visit(start)
+}
+
+// successors returns the indices of the instructions that may execute after
+// the one at index i, ignoring jump targets that are not instructions.
+func (v *verifier) successors(i int) []int {
+	insn := v.insns[i]
+	var next []int
+	if fallsThrough(insn.Op) && i+1 < len(v.insns) {
+		next = append(next, i+1)
+	}
+	if isJump(insn.Op) {
+		if target, ok := v.at[insn.Arg]; ok {
+			next = append(next, target)
+		}
+	}
+	return next
+}
+
+// fallsThrough returns true if the instruction op may be followed by the
+// next one in the code.
+func fallsThrough(op Opcode) bool {
+	switch op {
+	case JMP, CATCHJMP, RETURN, THROW, CRITICAL, DEFEREXIT:
+		return false
+	}
+	return true
+}
+
+func (v *verifier) regionErrorf(kind string, index int, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	v.errs = append(v.errs, fmt.Errorf("function %s (#%d): %s #%d: %s", v.fn.Name, v.index, kind, index, msg))
+}
+
+func (v *verifier) localName(ix uint32) string {
+	return v.fn.Locals[ix].Name
+}
+
+// isCapture returns true if insns starts with the sequence of instructions
+// that captures the free variables of a closure: any number of LOCAL and FREE
+// followed by MAKETUPLE and MAKEFUNC.
+func isCapture(insns []Instruction) bool {
+	for i, insn := range insns {
+		switch insn.Op {
+		case LOCAL, FREE:
+			continue
+		case MAKETUPLE:
+			return i+1 < len(insns) && insns[i+1].Op == MAKEFUNC
+		}
+		return false
+	}
+	return false
+}
+
+// isClassMembers returns true if insns starts with the sequence of
+// instructions that returns the members of a class body: any number of
+// CONSTANT followed by LOCAL or FREE, followed by MAKETUPLE and RETURN.
+func isClassMembers(insns []Instruction) bool {
+	for i := 0; i < len(insns); i += 2 {
+		switch insns[i].Op {
+		case CONSTANT:
+			if i+1 < len(insns) && (insns[i+1].Op == LOCAL || insns[i+1].Op == FREE) {
+				continue
+			}
+		case MAKETUPLE:
+			return i+1 < len(insns) && insns[i+1].Op == RETURN
+		}
+		return false
+	}
+	return false
+}
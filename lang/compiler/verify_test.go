@@ -0,0 +1,311 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCells(t *testing.T) {
+	type ins struct {
+		op  Opcode
+		arg uint32
+	}
+
+	cases := []struct {
+		desc  string
+		code  []ins
+		cells []int
+		errs  []string
+	}{
+		{"valid plain locals", []ins{{NIL, 0}, {SETLOCAL, 0}, {LOCAL, 0}, {RETURN, 0}}, nil, nil},
+		{"valid cell locals", []ins{{NIL, 0}, {SETLOCALCELL, 0}, {LOCALCELL, 0}, {RETURN, 0}}, []int{0}, nil},
+		{"valid capture", []ins{{LOCAL, 1}, {FREE, 0}, {LOCAL, 0}, {MAKETUPLE, 3}, {MAKEFUNC, 1}, {RETURN, 0}}, []int{0}, nil},
+		{"load cell as plain", []ins{{LOCAL, 0}, {RETURN, 0}}, []int{0},
+			[]string{"function f (#0): pc 0: local of cell local a, want localcell"}},
+		{"store cell as plain", []ins{{NIL, 0}, {SETLOCAL, 1}, {NIL, 0}, {RETURN, 0}}, []int{0, 1},
+			[]string{"function f (#0): pc 1: setlocal of cell local b, want setlocalcell"}},
+		{"load plain as cell", []ins{{LOCALCELL, 1}, {RETURN, 0}}, []int{0},
+			[]string{"function f (#0): pc 0: localcell of non-cell local b"}},
+		{"store plain as cell", []ins{{NIL, 0}, {SETLOCALCELL, 0}, {NIL, 0}, {RETURN, 0}}, nil,
+			[]string{"function f (#0): pc 1: setlocalcell of non-cell local a"}},
+		{"capture without makefunc", []ins{{LOCAL, 0}, {MAKETUPLE, 1}, {RETURN, 0}}, []int{0},
+			[]string{"function f (#0): pc 0: local of cell local a, want localcell"}},
+		{"class members", []ins{{CONSTANT, 0}, {LOCAL, 0}, {MAKETUPLE, 2}, {RETURN, 0}}, []int{0}, nil},
+		{"out of range", []ins{{LOCAL, 2}, {RETURN, 0}}, nil,
+			[]string{"function f (#0): pc 0: local: local index 2 out of range"}},
+		{"many errors", []ins{{LOCAL, 0}, {LOCALCELL, 1}, {SETLOCAL, 0}, {NIL, 0}, {RETURN, 0}}, []int{0},
+			[]string{
+				"function f (#0): pc 0: local of cell local a, want localcell",
+				"function f (#0): pc 2: localcell of non-cell local b",
+				"function f (#0): pc 4: setlocal of cell local a, want setlocalcell",
+			}},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			var code []byte
+			for _, in := range c.code {
+				code = encodeInsn(code, in.op, in.arg, false)
+			}
+			p := &Program{Constants: []interface{}{"x"}}
+			p.Functions = []*Funcode{{
+				Prog:     p,
+				Name:     "f",
+				Code:     code,
+				Locals:   []Binding{{Name: "a"}, {Name: "b"}},
+				Freevars: []Binding{{Name: "c"}},
+				Cells:    c.cells,
+				MaxStack: 3,
+			}, {
+				Prog:     p,
+				Name:     "g",
+				Code:     []byte{byte(NIL), byte(RETURN)},
+				MaxStack: 1,
+			}}
+
+			err := Verify(p)
+			if len(c.errs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, c.errs, strings.Split(err.Error(), "\n"))
+		})
+	}
+}
+
+func TestVerifyRegions(t *testing.T) {
+	// 0: JMP 6; 5: DEFEREXIT; 6: NIL; 7: RUNDEFER; 8: RETURN (jump args are
+	// padded)
+	const start, protected, last = 5, 6, 8
+	var code []byte
+	code = encodeInsn(code, JMP, protected, false)
+	code = encodeInsn(code, DEFEREXIT, 0, false)
+	code = encodeInsn(code, NIL, 0, false)
+	code = encodeInsn(code, RUNDEFER, 0, false)
+	code = encodeInsn(code, RETURN, 0, false)
+	require.Len(t, code, last+1)
+
+	cases := []struct {
+		desc    string
+		defers  []Defer
+		catches []Defer
+		errs    []string
+	}{
+		{"valid", []Defer{{PC0: protected, PC1: last, StartPC: start}}, []Defer{{PC0: protected, PC1: last, StartPC: start}}, nil},
+		{"empty range", []Defer{{PC0: last, PC1: protected, StartPC: start}}, nil,
+			[]string{"function f (#0): defer #0: empty protected range [8, 6]"}},
+		{"empty range past end", nil, []Defer{{PC0: protected, PC1: last, StartPC: start}, {PC0: last + 1, PC1: last + 4, StartPC: start}},
+			[]string{"function f (#0): catch #1: empty protected range [9, 12]"}},
+		{"orphaned start", []Defer{{PC0: protected, PC1: last, StartPC: 1}}, nil,
+			[]string{"function f (#0): defer #0: start pc 1 is not an instruction"}},
+		{"start out of code", nil, []Defer{{PC0: protected, PC1: last, StartPC: 42}},
+			[]string{"function f (#0): catch #0: start pc 42 is not an instruction"}},
+		{"start inside range", []Defer{{PC0: start, PC1: last, StartPC: start}}, nil,
+			[]string{"function f (#0): defer #0: start pc 5 is inside the protected range [5, 8]"}},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			p := &Program{}
+			p.Functions = []*Funcode{{
+				Prog:     p,
+				Name:     "f",
+				Code:     code,
+				Defers:   c.defers,
+				Catches:  c.catches,
+				MaxStack: 1,
+			}}
+
+			err := Verify(p)
+			if len(c.errs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, c.errs, strings.Split(err.Error(), "\n"))
+		})
+	}
+}
+
+func TestVerifyCode(t *testing.T) {
+	type ins struct {
+		op  Opcode
+		arg uint32
+	}
+	enc := func(insns ...ins) []byte {
+		var code []byte
+		for _, in := range insns {
+			code = encodeInsn(code, in.op, in.arg, false)
+		}
+		return code
+	}
+
+	cases := []struct {
+		desc   string
+		code   []byte
+		defers []Defer
+		errs   []string
+	}{
+		{"valid", enc(ins{CONSTANT, 0}, ins{PREDECLARED, 0}, ins{SETFIELD, 0}, ins{NIL, 0}, ins{RETURN, 0}), nil, nil},
+		{"bad constant index", enc(ins{CONSTANT, 1}, ins{RETURN, 0}), nil,
+			[]string{"function f (#0): pc 0: constant: constant index 1 out of range"}},
+		{"bad name index", enc(ins{UNIVERSAL, 3}, ins{RETURN, 0}), nil,
+			[]string{"function f (#0): pc 0: universal: name index 3 out of range"}},
+		{"bad function index", enc(ins{NIL, 0}, ins{MAKEFUNC, 1}, ins{RETURN, 0}), nil,
+			[]string{"function f (#0): pc 1: makefunc: function index 1 out of range"}},
+		{"bad free variable index", enc(ins{FREE, 0}, ins{RETURN, 0}), nil,
+			[]string{"function f (#0): pc 0: free: free variable index 0 out of range"}},
+		{"invalid opcode", []byte{0xff, 0, byte(NIL), byte(RETURN)}, nil,
+			[]string{"function f (#0): pc 0: invalid opcode 255"}},
+		{"truncated argument", []byte{byte(NIL), byte(CONSTANT), 0x80}, nil,
+			[]string{
+				"function f (#0): pc 1: constant: truncated argument",
+				"function f (#0): pc 1: constant falls through past the end of the code",
+			}},
+		{"bad jump padding", []byte{byte(JMP), 5, byte(NIL), 0, 0, byte(NIL), byte(RETURN)}, nil,
+			[]string{"function f (#0): pc 0: jmp: argument padding is not nop"}},
+		// 0: JMP 6; 5: MAKEMAP 200; 8: RETURN, the argument of MAKEMAP is
+		// encoded on 2 bytes.
+		{"jump into varint", enc(ins{JMP, 6}, ins{MAKEMAP, 200}, ins{RETURN, 0}), nil,
+			[]string{"function f (#0): pc 0: jmp: jump target 6 is not an instruction"}},
+		{"jump out of code", enc(ins{NIL, 0}, ins{CJMP, 42}, ins{NIL, 0}, ins{RETURN, 0}), nil,
+			[]string{"function f (#0): pc 1: cjmp: jump target 42 is not an instruction"}},
+		{"stack underflow", enc(ins{NIL, 0}, ins{SETINDEX, 0}, ins{RETURN, 0}), nil,
+			[]string{"function f (#0): pc 1: setindex: stack underflow"}},
+		// 0: NIL; 1: CJMP 7; 6: NIL; 7: NIL; 8: RETURN
+		{"inconsistent stack", enc(ins{NIL, 0}, ins{CJMP, 7}, ins{NIL, 0}, ins{NIL, 0}, ins{RETURN, 0}), nil,
+			[]string{"function f (#0): pc 7: inconsistent stack depth 0, want 1"}},
+		{"fall through end", enc(ins{NIL, 0}, ins{POP, 0}), nil,
+			[]string{"function f (#0): pc 1: pop falls through past the end of the code"}},
+		{"no instruction", nil, nil,
+			[]string{"function f (#0): pc 0: no instruction"}},
+
+		// 0: JMP 6; 5: DEFEREXIT; 6: NIL; 7: RETURN
+		{"defer without rundefer", enc(ins{JMP, 6}, ins{DEFEREXIT, 0}, ins{NIL, 0}, ins{RETURN, 0}),
+			[]Defer{{PC0: 6, PC1: 7, StartPC: 5}},
+			[]string{"function f (#0): pc 7: return out of defer #0 not preceded by rundefer"}},
+		// 0: JMP 6; 5: DEFEREXIT; 6: JMP 11; 11: NIL; 12: RETURN
+		{"jump out of defer without rundefer", enc(ins{JMP, 6}, ins{DEFEREXIT, 0}, ins{JMP, 11}, ins{NIL, 0}, ins{RETURN, 0}),
+			[]Defer{{PC0: 6, PC1: 10, StartPC: 5}},
+			[]string{"function f (#0): pc 6: jmp out of defer #0 not preceded by rundefer"}},
+		// 0: NIL; 1: POP; 2: DEFEREXIT; 3: NIL; 4: RUNDEFER; 5: RETURN
+		{"defer without jump over", enc(ins{NIL, 0}, ins{POP, 0}, ins{DEFEREXIT, 0}, ins{NIL, 0}, ins{RUNDEFER, 0}, ins{RETURN, 0}),
+			[]Defer{{PC0: 3, PC1: 5, StartPC: 2}},
+			[]string{"function f (#0): defer #0: start pc 2 is reached by falling through pop at pc 1"}},
+		// 0: JMP 7; 5: NIL; 6: RETURN; 7: NIL; 8: RUNDEFER; 9: RETURN
+		{"defer without deferexit", enc(ins{JMP, 7}, ins{NIL, 0}, ins{RETURN, 0}, ins{NIL, 0}, ins{RUNDEFER, 0}, ins{RETURN, 0}),
+			[]Defer{{PC0: 7, PC1: 9, StartPC: 5}},
+			[]string{"function f (#0): defer #0: return at pc 6, want deferexit"}},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			p := &Program{Names: []string{"a"}, Constants: []interface{}{"x"}}
+			p.Functions = []*Funcode{{
+				Prog:     p,
+				Name:     "f",
+				Code:     c.code,
+				Defers:   c.defers,
+				MaxStack: 2,
+			}}
+
+			err := Verify(p)
+			if len(c.errs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, c.errs, strings.Split(err.Error(), "\n"))
+		})
+	}
+}
+
+func TestVerifyFunction(t *testing.T) {
+	// 0: JMP 6; 5: DEFEREXIT; 6: NIL; 7: NIL; 8: POP; 9: RUNDEFER; 10: RETURN
+	var code []byte
+	code = encodeInsn(code, JMP, 6, false)
+	code = encodeInsn(code, DEFEREXIT, 0, false)
+	code = encodeInsn(code, NIL, 0, false)
+	code = encodeInsn(code, NIL, 0, false)
+	code = encodeInsn(code, POP, 0, false)
+	code = encodeInsn(code, RUNDEFER, 0, false)
+	code = encodeInsn(code, RETURN, 0, false)
+
+	cases := []struct {
+		desc       string
+		maxStack   int
+		numParams  int
+		cells      []int
+		deferStack uint32
+		errs       []string
+	}{
+		{"valid", 2, 2, []int{1}, 0, nil},
+		{"max stack too small", 1, 0, nil, 0,
+			[]string{"function f (#0): pc 7: nil: stack depth 2 exceeds MaxStack 1"}},
+		{"defer stack too deep", 2, 0, nil, 3,
+			[]string{"function f (#0): defer #0: stack depth 3 exceeds MaxStack 2"}},
+		{"cell out of range", 2, 0, []int{0, 2}, 0,
+			[]string{"function f (#0): cell #1: local index 2 out of range"}},
+		{"too many parameters", 2, 3, nil, 0,
+			[]string{"function f (#0): 3 parameters, want at most 2 (number of locals)"}},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			p := &Program{}
+			p.Functions = []*Funcode{{
+				Prog:      p,
+				Name:      "f",
+				Code:      code,
+				Locals:    []Binding{{Name: "a"}, {Name: "b"}},
+				Cells:     c.cells,
+				Defers:    []Defer{{PC0: 6, PC1: 10, StartPC: 5, Stack: c.deferStack}},
+				MaxStack:  c.maxStack,
+				NumParams: c.numParams,
+			}}
+
+			err := Verify(p)
+			if len(c.errs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Equal(t, c.errs, strings.Split(err.Error(), "\n"))
+		})
+	}
+
+	t.Run("no function", func(t *testing.T) {
+		require.EqualError(t, Verify(&Program{}), "no function")
+	})
+}
+
+func TestVerifyCompiled(t *testing.T) {
+	src := `
+		let x = 1
+		fn f(a, ...rest)
+			let n = 0
+			defer
+				n = n + 1
+			end
+			for i in rest do
+				if i == a then break end
+				catch
+					return err
+				end
+				f(i)
+			end
+			return fn() return a end
+		end
+		class C!
+			let y = x
+		end
+		for x < 10 do
+			defer x = x + 1 end
+			if x == 5 then continue end
+		end
+		return f(x, 1, 2, 3)
+	`
+	for _, mode := range []Mode{0, Optimize, CompactJumps, Optimize | CompactJumps} {
+		prog := compileProgramMode(t, src, mode)
+		require.NoError(t, Verify(prog))
+	}
+}
@@ -2,12 +2,14 @@ package machine
 
 import (
 	"fmt"
+	"sort"
 )
 
 // An *Array represents a list of values. Iteration over an array yields each
 // of the array's values in order.
 type Array struct {
-	elems []Value
+	elems  []Value
+	frozen bool
 }
 
 var (
@@ -16,6 +18,8 @@ var (
 	_ HasSetIndex = (*Array)(nil)
 	_ Iterable    = (*Array)(nil)
 	_ Sequence    = (*Array)(nil)
+	_ HasAttrs    = (*Array)(nil)
+	_ Freezable   = (*Array)(nil)
 )
 
 // NewArray returns an array containing the specified elements. Callers should
@@ -32,10 +36,48 @@ func (a *Array) Iterate() Iterator {
 }
 
 func (a *Array) SetIndex(i int, v Value) error {
+	if a.frozen {
+		return frozenError(a)
+	}
 	a.elems[i] = v
 	return nil
 }
 
+// Append adds v at the end of the array. It fails if the array is frozen.
+func (a *Array) Append(v Value) error {
+	if a.frozen {
+		return frozenError(a)
+	}
+	a.elems = append(a.elems, v)
+	return nil
+}
+
+func (a *Array) Frozen() bool { return a.frozen }
+func (a *Array) Freeze() {
+	if a.frozen {
+		return
+	}
+	a.frozen = true
+	for _, v := range a.elems {
+		Freeze(v)
+	}
+}
+
+// Attr returns the method of the array bound to a as receiver, or nil if
+// there is no such method.
+func (a *Array) Attr(name string) (Value, error) {
+	m := arrayMethods[name]
+	if m == nil {
+		return nil, nil
+	}
+	return NewBuiltin("array."+name, func(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+		return m(th, b, a, args)
+	}), nil
+}
+
+// AttrNames returns the sorted names of the methods of an array.
+func (a *Array) AttrNames() []string { return arrayMethodNames }
+
 type arrayIterator struct {
 	a *Array
 	i int
@@ -51,3 +93,33 @@ func (it *arrayIterator) Next(p *Value) bool {
 }
 
 func (it *arrayIterator) Done() {}
+
+// arrayMethods maps the name of each array method to its implementation,
+// which is called with the thread, the bound builtin, the receiver and the
+// arguments.
+var arrayMethods = map[string]func(th *Thread, b *Builtin, a *Array, args *Tuple) (Value, error){
+	"append": arrayAppend,
+}
+
+var arrayMethodNames = func() []string {
+	names := make([]string, 0, len(arrayMethods))
+	for name := range arrayMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}()
+
+// a.append(x) adds x at the end of the array a and returns nil.
+func arrayAppend(th *Thread, b *Builtin, a *Array, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	if err := th.checkCollectionSize(a.Type(), a.Len()+1); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	if err := a.Append(args.Index(0)); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	return Nil, nil
+}
@@ -0,0 +1,113 @@
+package machine_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/compiler"
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArrayAppend(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"append", `
+let a = [1]
+a.append(2)
+a.append("x")
+return (a[1], a[2], a[-1])
+`, machine.NewTuple([]machine.Value{machine.Int(2), machine.String("x"), machine.String("x")}), ""},
+		{"append empty", `
+let a = []
+let r = a.append(null)
+return (r, a[0])
+`, machine.NewTuple([]machine.Value{machine.Nil, machine.Nil}), ""},
+		{"append no arg", `let a = [] a.append()`, nil, "array.append: got 0 arguments, want at least 1"},
+		{"append too many", `let a = [] a.append(1, 2)`, nil, "array.append: got 2 arguments, want at most 1"},
+		{"unknown method", `let a = [] a.push(1)`, nil, "array has no .push field or method"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestAppendOpcode(t *testing.T) {
+	newProgram := func(code ...byte) *compiler.Program {
+		p := &compiler.Program{
+			Filename:  "test.nen",
+			Constants: []interface{}{int64(1), int64(2)},
+		}
+		p.Functions = []*compiler.Funcode{{
+			Prog:     p,
+			Name:     "top",
+			Code:     code,
+			Locals:   []compiler.Binding{{Name: "a"}},
+			MaxStack: 2,
+		}}
+		return p
+	}
+
+	t.Run("array", func(t *testing.T) {
+		var th machine.Thread
+		res, err := th.RunProgram(context.Background(), newProgram(
+			byte(compiler.MAKEARRAY), 0,
+			byte(compiler.SETLOCAL), 0,
+			byte(compiler.LOCAL), 0,
+			byte(compiler.CONSTANT), 0,
+			byte(compiler.APPEND),
+			byte(compiler.LOCAL), 0,
+			byte(compiler.CONSTANT), 1,
+			byte(compiler.APPEND),
+			byte(compiler.LOCAL), 0,
+			byte(compiler.RETURN),
+		))
+		require.NoError(t, err)
+		arr, ok := res.(*machine.Array)
+		require.True(t, ok)
+		require.Equal(t, 2, arr.Len())
+		require.Equal(t, machine.Int(1), arr.Index(0))
+		require.Equal(t, machine.Int(2), arr.Index(1))
+	})
+
+	t.Run("not an array", func(t *testing.T) {
+		var th machine.Thread
+		_, err := th.RunProgram(context.Background(), newProgram(
+			byte(compiler.MAKETUPLE), 0,
+			byte(compiler.CONSTANT), 0,
+			byte(compiler.APPEND),
+			byte(compiler.NIL),
+			byte(compiler.RETURN),
+		))
+		require.EqualError(t, err, "append: want array, got tuple")
+	})
+
+	t.Run("frozen array", func(t *testing.T) {
+		arr := machine.NewArray(nil)
+		arr.Freeze()
+		th := machine.Thread{Predeclared: map[string]machine.Value{"arr": arr}}
+		p := newProgram(
+			byte(compiler.PREDECLARED), 0,
+			byte(compiler.CONSTANT), 0,
+			byte(compiler.APPEND),
+			byte(compiler.NIL),
+			byte(compiler.RETURN),
+		)
+		p.Names = []string{"arr"}
+		_, err := th.RunProgram(context.Background(), p)
+		require.EqualError(t, err, "cannot modify frozen array")
+		require.Equal(t, 0, arr.Len())
+	})
+}
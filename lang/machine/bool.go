@@ -8,10 +8,11 @@ const (
 	True  Bool = true
 )
 
-// Bool is an ordered value.
+// Bool is an ordered, hashable value.
 var (
-	_ Value   = True
-	_ Ordered = True
+	_ Value    = True
+	_ Ordered  = True
+	_ Hashable = True
 )
 
 func (b Bool) String() string {
@@ -23,6 +24,8 @@ func (b Bool) String() string {
 
 func (b Bool) Type() string { return "bool" }
 
+func (b Bool) Hash() (uint32, error) { return uint32(b2i(bool(b))), nil }
+
 func (b Bool) Cmp(y Value) (int, error) {
 	b2 := y.(Bool)
 	return b2i(bool(b)) - b2i(bool(b2)), nil
@@ -0,0 +1,144 @@
+package machine
+
+import (
+	"fmt"
+)
+
+// A Builtin is a function implemented in Go.
+type Builtin struct {
+	name string
+	fn   BuiltinFunc
+}
+
+// BuiltinFunc is the Go implementation of a Builtin. It is called with the
+// Builtin being called, so that the same implementation can be shared by
+// many builtins and use its name e.g. in error messages.
+type BuiltinFunc func(th *Thread, b *Builtin, args *Tuple) (Value, error)
+
+var (
+	_ Value    = (*Builtin)(nil)
+	_ Callable = (*Builtin)(nil)
+)
+
+// NewBuiltin returns a new Builtin value with the specified name and
+// implementation.
+func NewBuiltin(name string, fn BuiltinFunc) *Builtin {
+	return &Builtin{name: name, fn: fn}
+}
+
+// RegisterBuiltins adds to m a Builtin for each name and implementation in
+// fns, replacing any existing value with the same name. It is typically used
+// to populate the Thread.Predeclared map of an application (Universe is
+// reserved for the built-ins of the language).
+func RegisterBuiltins(m map[string]Value, fns map[string]BuiltinFunc) {
+	for name, fn := range fns {
+		m[name] = NewBuiltin(name, fn)
+	}
+}
+
+func (b *Builtin) String() string { return fmt.Sprintf("builtin(%s)", b.name) }
+func (b *Builtin) Type() string   { return "builtin" }
+func (b *Builtin) Name() string   { return b.name }
+func (b *Builtin) CallInternal(th *Thread, args *Tuple) (Value, error) {
+	return b.fn(th, b, args)
+}
+
+// checkArity returns an error if the number of arguments in args is not in
+// the [min, max] range.
+func checkArity(b *Builtin, args *Tuple, min, max int) error {
+	n := args.Len()
+	if n < min {
+		return fmt.Errorf("%s: got %d arguments, want at least %d", b.name, n, min)
+	}
+	if n > max {
+		return fmt.Errorf("%s: got %d arguments, want at most %d", b.name, n, max)
+	}
+	return nil
+}
+
+// stringArg returns the argument at index i as a string, or an error if it is
+// not a string.
+func stringArg(b *Builtin, args *Tuple, i int) (string, error) {
+	s, ok := AsString(args.Index(i))
+	if !ok {
+		return "", fmt.Errorf("%s: argument #%d: want string, got %s", b.name, i+1, args.Index(i).Type())
+	}
+	return s, nil
+}
+
+// intArg returns the argument at index i as an int, or an error if it cannot
+// be converted to an exact integer.
+func intArg(b *Builtin, args *Tuple, i int) (int, error) {
+	n, err := AsExactInt(args.Index(i))
+	if err != nil {
+		return 0, fmt.Errorf("%s: argument #%d: %w", b.name, i+1, err)
+	}
+	return n, nil
+}
+
+// UnpackArgs unpacks the arguments of a call to builtin b into the variables
+// pointed to by vars, in order. The first min variables are required, the
+// others are optional and left unchanged if the corresponding argument is
+// not provided. It returns an error if the number of arguments is not valid
+// or if an argument cannot be stored in its variable.
+//
+// Each variable must be one of *Value (any value), *string (a String),
+// *int (an exact integer), *float64 (a number), *bool (the truth value of
+// any value), *Callable, *Iterable or *Mapping (a value that implements the
+// interface).
+func UnpackArgs(b *Builtin, args *Tuple, min int, vars ...any) error {
+	if err := checkArity(b, args, min, len(vars)); err != nil {
+		return err
+	}
+	for i := 0; i < args.Len(); i++ {
+		if err := unpackArg(args.Index(i), vars[i]); err != nil {
+			return fmt.Errorf("%s: argument #%d: %w", b.name, i+1, err)
+		}
+	}
+	return nil
+}
+
+func unpackArg(v Value, ptr any) error {
+	var (
+		ok   bool
+		want string
+	)
+	switch p := ptr.(type) {
+	case *Value:
+		*p, ok = v, true
+	case *string:
+		*p, ok = AsString(v)
+		want = "string"
+	case *int:
+		n, err := AsExactInt(v)
+		if err != nil {
+			return err
+		}
+		*p, ok = n, true
+	case *float64:
+		switch v := v.(type) {
+		case Int:
+			*p, ok = float64(v), true
+		case Float:
+			*p, ok = float64(v), true
+		}
+		want = "number"
+	case *bool:
+		*p, ok = bool(Truth(v)), true
+	case *Callable:
+		*p, ok = v.(Callable)
+		want = "callable"
+	case *Iterable:
+		*p, ok = v.(Iterable)
+		want = "iterable"
+	case *Mapping:
+		*p, ok = v.(Mapping)
+		want = "mapping"
+	default:
+		panic(fmt.Sprintf("unsupported UnpackArgs variable type %T", ptr))
+	}
+	if !ok {
+		return fmt.Errorf("want %s, got %s", want, v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/mna/nenuphar/lang/token"
+)
+
+func init() {
+	Universe["bisect"] = NewBuiltin("bisect", builtinBisectRight)
+	Universe["bisect_left"] = NewBuiltin("bisect_left", builtinBisectLeft)
+	Universe["bisect_right"] = NewBuiltin("bisect_right", builtinBisectRight)
+}
+
+// bisect_left(seq, x) returns the index where x should be inserted in the
+// sorted indexable seq to keep it sorted. If seq contains values equal to x,
+// the returned index is that of the leftmost one. The result is in the range
+// [0, #seq], so 0 is returned for an empty sequence.
+func builtinBisectLeft(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	return bisect(th, b, args, token.LT)
+}
+
+// bisect_right(seq, x), also available as bisect(seq, x), is like
+// bisect_left but if seq contains values equal to x, the returned index is
+// past the rightmost one.
+func builtinBisectRight(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	return bisect(th, b, args, token.LE)
+}
+
+// bisect implements the bisect built-ins with a binary search that moves
+// past any element e for which "e op x" is true.
+func bisect(th *Thread, b *Builtin, args *Tuple, op token.Token) (Value, error) {
+	if err := checkArity(b, args, 2, 2); err != nil {
+		return nil, err
+	}
+	seq, ok := args.Index(0).(Indexable)
+	if !ok {
+		return nil, fmt.Errorf("%s: argument #1: want indexable, got %s", b.name, args.Index(0).Type())
+	}
+	x := args.Index(1)
+
+	lo, hi := 0, seq.Len()
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		before, err := Compare(th, op, seq.Index(mid), x)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		if before {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return Int(lo), nil
+}
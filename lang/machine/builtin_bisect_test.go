@@ -0,0 +1,60 @@
+package machine_test
+
+import (
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinBisect(t *testing.T) {
+	type I = machine.Int
+
+	sorted := machine.NewArray([]machine.Value{I(1), I(3), I(3), I(3), I(7), I(9)})
+	empty := machine.NewArray(nil)
+	cases := []struct {
+		desc  string
+		seq   machine.Value
+		x     machine.Value
+		left  machine.Value
+		right machine.Value
+	}{
+		{"below", sorted, I(0), I(0), I(0)},
+		{"equal first", sorted, I(1), I(0), I(1)},
+		{"within", sorted, I(5), I(4), I(4)},
+		{"equal repeated", sorted, I(3), I(1), I(4)},
+		{"within float", sorted, machine.Float(3.5), I(4), I(4)},
+		{"equal last", sorted, I(9), I(5), I(6)},
+		{"above", sorted, I(10), I(6), I(6)},
+		{"empty", empty, I(1), I(0), I(0)},
+		{"range", machine.NewRange(0, 10, 2), I(4), I(2), I(3)},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := callUniverse(t, "bisect_left", c.seq, c.x)
+			require.NoError(t, err)
+			require.Equal(t, c.left, got, "left")
+
+			got, err = callUniverse(t, "bisect_right", c.seq, c.x)
+			require.NoError(t, err)
+			require.Equal(t, c.right, got, "right")
+
+			got, err = callUniverse(t, "bisect", c.seq, c.x)
+			require.NoError(t, err)
+			require.Equal(t, c.right, got, "bisect")
+		})
+	}
+
+	t.Run("not indexable", func(t *testing.T) {
+		_, err := callUniverse(t, "bisect", machine.NewMap(0), I(1))
+		require.EqualError(t, err, "bisect: argument #1: want indexable, got map")
+	})
+	t.Run("incomparable", func(t *testing.T) {
+		_, err := callUniverse(t, "bisect_left", sorted, machine.String("a"))
+		require.ErrorContains(t, err, "bisect_left: ")
+	})
+	t.Run("arity", func(t *testing.T) {
+		_, err := callUniverse(t, "bisect_right", sorted)
+		require.EqualError(t, err, "bisect_right: got 1 arguments, want at least 2")
+	})
+}
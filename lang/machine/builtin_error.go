@@ -0,0 +1,22 @@
+package machine
+
+func init() {
+	Universe["error"] = NewBuiltin("error", builtinError)
+}
+
+// error() returns the error handled by the running catch or defer block, or
+// nil if there is none. The block does not need to be in the calling
+// function, the error of the nearest function on the call stack that is
+// running a catch or defer block for an error is returned.
+func builtinError(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 0, 0); err != nil {
+		return nil, err
+	}
+	// the top of the stack is the frame of the built-in itself
+	for i := len(th.callStack) - 2; i >= 0; i-- {
+		if err := th.callStack[i].err; err != nil {
+			return asError(err), nil
+		}
+	}
+	return Nil, nil
+}
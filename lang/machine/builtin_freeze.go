@@ -0,0 +1,18 @@
+package machine
+
+func init() {
+	Universe["freeze"] = NewBuiltin("freeze", builtinFreeze)
+}
+
+// freeze(x) makes x and, transitively, the values it contains immutable, and
+// returns x. Any subsequent attempt to modify a frozen value fails. It does
+// nothing for values that cannot be frozen, such as numbers and strings, as
+// they are already immutable.
+func builtinFreeze(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	x := args.Index(0)
+	Freeze(x)
+	return x, nil
+}
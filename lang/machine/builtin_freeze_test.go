@@ -0,0 +1,112 @@
+package machine_test
+
+import (
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinFreeze(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"nested array in map", `
+let a = [1, 2]
+let m = {a: a}
+freeze(m)
+a[0] = 3
+`, nil, "cannot modify frozen array"},
+		{"nested append", `
+let m = {a: [1]}
+freeze(m)
+m.a.append(2)
+`, nil, "array.append: cannot modify frozen array"},
+		{"map set key", `
+let m = {a: [1]}
+freeze(m)
+m["b"] = 1
+`, nil, "cannot modify frozen map"},
+		{"map set field", `
+let m = {a: [1]}
+freeze(m)
+m.a = 1
+`, nil, "cannot modify frozen map"},
+		{"read frozen", `
+let m = freeze({a: [1, 2]})
+return m.a[1]
+`, machine.Int(2), ""},
+		{"unfrozen sibling", `
+let a = [1]
+let m = freeze({a: [a]})
+let b = [1]
+b[0] = 2
+return b[0]
+`, machine.Int(2), ""},
+		{"tuple elements", `
+let a = [1]
+let t = (a, 2)
+freeze(t)
+a[0] = 2
+`, nil, "cannot modify frozen array"},
+		{"cycle", `
+let a = [null]
+a[0] = a
+freeze(a)
+a[0] = 1
+`, nil, "cannot modify frozen array"},
+		{"class", `
+class Foo!
+	let value = [1]
+end
+freeze(Foo)
+Foo.value = 2
+`, nil, "cannot modify frozen class"},
+		{"class attr value", `
+class Foo!
+	let value = [1]
+end
+freeze(Foo)
+Foo.value[0] = 2
+`, nil, "cannot modify frozen array"},
+		{"setmetamap", `
+let m = freeze({})
+setmetamap(m, {})
+`, nil, "setmetamap: cannot modify frozen map"},
+		{"immutable value", `return freeze(1)`, machine.Int(1), ""},
+		{"arity", `return freeze()`, nil, "freeze: got 0 arguments, want at least 1"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestFreezeValues(t *testing.T) {
+	inner := machine.NewArray([]machine.Value{machine.Int(1)})
+	m := machine.NewMap(1)
+	require.NoError(t, m.SetKey(machine.String("a"), inner))
+	tup := machine.NewTuple([]machine.Value{m, machine.String("x")})
+	require.False(t, tup.Frozen())
+
+	machine.Freeze(tup)
+	require.True(t, m.Frozen())
+	require.True(t, inner.Frozen())
+	require.True(t, tup.Frozen())
+	require.EqualError(t, inner.Append(machine.Int(2)), "cannot modify frozen array")
+	require.EqualError(t, m.SetKey(machine.String("b"), machine.Nil), "cannot modify frozen map")
+
+	// freezing an already frozen value is a no-op
+	machine.Freeze(m)
+	require.True(t, m.Frozen())
+}
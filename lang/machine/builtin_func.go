@@ -0,0 +1,42 @@
+package machine
+
+import (
+	"fmt"
+	"math"
+)
+
+func init() {
+	Universe["compose"] = NewBuiltin("compose", builtinCompose)
+}
+
+// compose(f, g, ...) returns a callable that calls the functions from right
+// to left, the last one with the arguments of the call and each other one
+// with the result of the function on its right, so that compose(f, g)(x) is
+// f(g(x)). With a single function, it returns that function.
+func builtinCompose(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, math.MaxInt); err != nil {
+		return nil, err
+	}
+	fns := make([]Callable, args.Len())
+	for i := range fns {
+		fn, ok := args.Index(i).(Callable)
+		if !ok {
+			return nil, fmt.Errorf("%s: argument #%d: want callable, got %s", b.name, i+1, args.Index(i).Type())
+		}
+		fns[i] = fn
+	}
+	if len(fns) == 1 {
+		return fns[0], nil
+	}
+
+	return NewBuiltin(b.name, func(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+		v, err := Call(th, fns[len(fns)-1], args)
+		for i := len(fns) - 2; err == nil && i >= 0; i-- {
+			v, err = Call(th, fns[i], NewTuple([]Value{v}))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		return v, nil
+	}), nil
+}
@@ -0,0 +1,55 @@
+package machine_test
+
+import (
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinCompose(t *testing.T) {
+	type I = machine.Int
+
+	const funcs = `
+fn inc(x) return x + 1 end
+fn double(x) return x * 2 end
+`
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"two functions", `return compose(inc, double)(3) == inc(double(3))`, machine.True, ""},
+		{"right to left", `return compose(inc, double)(3)`, I(7), ""},
+		{"three functions", `return compose(double, inc, double)(3)`, I(14), ""},
+		{"single function", `return compose(inc) == inc`, machine.True, ""},
+		{"builtin", `return compose(sorted, set)([3, 1, 3])`, machine.NewArray([]machine.Value{I(1), I(3)}), ""},
+		{"many arguments", `return compose(inc, fn(a, b) return a - b end)(5, 2)`, I(4), ""},
+		{"nested", `return compose(compose(inc, inc), double)(1)`, I(4), ""},
+		{"not callable", `compose(inc, 1)`, nil, "compose: argument #2: want callable, got int"},
+		{"not callable before call", `
+let f = try compose(inc, double, "x")
+return f
+`, machine.Nil, ""},
+		{"no argument", `compose()`, nil, "compose: got 0 arguments, want at least 1"},
+		{"call error", `compose(inc, fn(x) return fail() end)(1)`, nil, "compose: failed"},
+		{"inner call error", `compose(inc, double)("a")`, nil, "compose: unsupported binary op: string + int"},
+		{"nested call error", `compose(inc, compose(double, fail))(1)`, nil, "compose: compose: failed"},
+		{"caught error", `
+let f = compose(inc, fail)
+return (try f(1)) == null
+`, machine.True, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, funcs+c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
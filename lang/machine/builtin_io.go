@@ -0,0 +1,28 @@
+package machine
+
+import (
+	"fmt"
+	"strings"
+)
+
+func init() {
+	Universe["print"] = NewBuiltin("print", builtinPrint)
+}
+
+// print(...) writes the string of each argument, separated by a space and
+// followed by a newline, to the standard output of the thread.
+func builtinPrint(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	var sb strings.Builder
+	for i := 0; i < args.Len(); i++ {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(args.Index(i).String())
+	}
+	sb.WriteByte('\n')
+
+	if _, err := th.stdout.Write([]byte(sb.String())); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	return Nil, nil
+}
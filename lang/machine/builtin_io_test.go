@@ -0,0 +1,35 @@
+package machine_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestBuiltinPrint(t *testing.T) {
+	t.Run("values", func(t *testing.T) {
+		var buf bytes.Buffer
+		th := &machine.Thread{Stdout: &buf}
+		got, err := runSourceThread(t, th, `
+print("a", 1, 2.5, true, null, b"x")
+print()
+return print("done")
+`)
+		require.NoError(t, err)
+		require.Equal(t, machine.Nil, got)
+		require.Equal(t, "\"a\" 1 2.5 true nil b\"x\"\n\n\"done\"\n", buf.String())
+	})
+
+	t.Run("write error", func(t *testing.T) {
+		th := &machine.Thread{Stdout: failWriter{}}
+		_, err := runSourceThread(t, th, `print("a")`)
+		require.EqualError(t, err, "print: write failed")
+	})
+}
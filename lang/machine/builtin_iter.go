@@ -0,0 +1,351 @@
+package machine
+
+import (
+	"fmt"
+	"math"
+)
+
+func init() {
+	Universe["chain"] = NewBuiltin("chain", builtinChain)
+	Universe["drop"] = NewBuiltin("drop", builtinDrop)
+	Universe["flatten"] = NewBuiltin("flatten", builtinFlatten)
+	Universe["islice"] = NewBuiltin("islice", builtinIslice)
+	Universe["take"] = NewBuiltin("take", builtinTake)
+	Universe["zip_longest"] = NewBuiltin("zip_longest", builtinZipLongest)
+}
+
+// chain(a, b, ...) returns a lazy iterable that produces the values of a,
+// then those of b, and so on. With no argument, it produces no value.
+func builtinChain(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	iterables, err := iterableArgs(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &lazyIterable{
+		name: b.name,
+		iterate: func() Iterator {
+			return &chainIterator{th: th, iterables: iterables}
+		},
+	}, nil
+}
+
+// flatten(x) returns a lazy iterable that produces the values of each
+// element of x in turn, flattening it one level deep. The iteration fails if
+// an element of x is not iterable.
+func builtinFlatten(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	var iterable Iterable
+	if err := UnpackArgs(b, args, 1, &iterable); err != nil {
+		return nil, err
+	}
+	return &lazyIterable{
+		name: b.name,
+		iterate: func() Iterator {
+			return &flattenIterator{th: th, name: b.name, outer: iterable.Iterate()}
+		},
+	}, nil
+}
+
+// zip_longest(fill, a, b, ...) returns a lazy iterable that produces a tuple
+// with the next value of each of a, b, etc. until all of them are exhausted.
+// The values of the iterables that are exhausted before the longest one are
+// replaced by fill. With only the fill argument, it produces no value.
+func builtinZipLongest(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, math.MaxInt); err != nil {
+		return nil, err
+	}
+	iterables, err := iterableArgs(b, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	fill := args.Index(0)
+	return &lazyIterable{
+		name: b.name,
+		iterate: func() Iterator {
+			its := make([]Iterator, len(iterables))
+			for i, x := range iterables {
+				its[i] = x.Iterate()
+			}
+			return &zipLongestIterator{th: th, fill: fill, its: its}
+		},
+	}, nil
+}
+
+// take(x, n) returns a lazy iterable that produces the first n values of x,
+// or all of them if x produces fewer values. It stops iterating over x once
+// it produced n values, so that x may be infinite.
+func builtinTake(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	var iterable Iterable
+	var n int
+	if err := UnpackArgs(b, args, 2, &iterable, &n); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("%s: argument #2: want non-negative int, got %d", b.name, n)
+	}
+	return sliceIterable(th, b.name, iterable, 0, n, 1), nil
+}
+
+// drop(x, n) returns a lazy iterable that skips the first n values of x and
+// produces the remaining ones.
+func builtinDrop(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	var iterable Iterable
+	var n int
+	if err := UnpackArgs(b, args, 2, &iterable, &n); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("%s: argument #2: want non-negative int, got %d", b.name, n)
+	}
+	return sliceIterable(th, b.name, iterable, n, -1, 1), nil
+}
+
+// islice(x, start, stop=nil, step=1) returns a lazy iterable that produces
+// the values of x at index start (included) to stop (excluded) by increments
+// of step, the index being the position of the value in the iteration over
+// x. If stop is nil, it produces values until x is exhausted. The start and
+// stop indices must not be negative and the step must be positive.
+func builtinIslice(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	var iterable Iterable
+	var stopv Value = Nil
+	start, stop, step := 0, -1, 1
+	if err := UnpackArgs(b, args, 2, &iterable, &start, &stopv, &step); err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("%s: argument #2: want non-negative int, got %d", b.name, start)
+	}
+	if stopv != Nil {
+		n, err := AsExactInt(stopv)
+		if err != nil {
+			return nil, fmt.Errorf("%s: argument #3: %w", b.name, err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("%s: argument #3: want non-negative int, got %d", b.name, n)
+		}
+		stop = n
+	}
+	if step <= 0 {
+		return nil, fmt.Errorf("%s: argument #4: want positive int, got %d", b.name, step)
+	}
+	return sliceIterable(th, b.name, iterable, start, stop, step), nil
+}
+
+// sliceIterable returns a lazy iterable that produces the values of x at
+// index start to stop (excluded, or until x is exhausted if stop is -1) by
+// increments of step.
+func sliceIterable(th *Thread, name string, x Iterable, start, stop, step int) Value {
+	return &lazyIterable{
+		name: name,
+		iterate: func() Iterator {
+			return &sliceIterator{th: th, next: start, stop: stop, step: step, it: x.Iterate()}
+		},
+	}
+}
+
+// iterableArgs returns the arguments of a call to builtin b starting at index
+// start, or an error if one of them is not Iterable.
+func iterableArgs(b *Builtin, args *Tuple, start int) ([]Iterable, error) {
+	iterables := make([]Iterable, 0, args.Len()-start)
+	for i := start; i < args.Len(); i++ {
+		x, ok := args.Index(i).(Iterable)
+		if !ok {
+			return nil, fmt.Errorf("%s: argument #%d: want iterable, got %s", b.name, i+1, args.Index(i).Type())
+		}
+		iterables = append(iterables, x)
+	}
+	return iterables, nil
+}
+
+// lazyIterable is the Iterable value returned by built-ins that produce their
+// values on demand, such as chain, flatten and zip_longest. Each call to Iterate
+// starts a new iteration over its inputs.
+type lazyIterable struct {
+	name    string
+	iterate func() Iterator
+}
+
+var _ Iterable = (*lazyIterable)(nil)
+
+func (l *lazyIterable) String() string    { return fmt.Sprintf("%s(%p)", l.name, l) }
+func (l *lazyIterable) Type() string      { return l.name }
+func (l *lazyIterable) Iterate() Iterator { return l.iterate() }
+
+// chainIterator produces the values of each iterable in turn. It stops early
+// if the thread is cancelled.
+type chainIterator struct {
+	th        *Thread
+	iterables []Iterable
+	cur       Iterator
+	err       error
+}
+
+var _ ErrIterator = (*chainIterator)(nil)
+
+func (it *chainIterator) Next(p *Value) bool {
+	for it.err == nil && !it.th.isCancelled() {
+		if it.cur == nil {
+			if len(it.iterables) == 0 {
+				return false
+			}
+			it.cur = it.iterables[0].Iterate()
+			it.iterables = it.iterables[1:]
+		}
+		if it.cur.Next(p) {
+			return true
+		}
+		it.err = iterErr(it.cur)
+		it.cur.Done()
+		it.cur = nil
+	}
+	return false
+}
+
+func (it *chainIterator) Err() error { return it.err }
+
+func (it *chainIterator) Done() {
+	if it.cur != nil {
+		it.cur.Done()
+		it.cur = nil
+	}
+}
+
+// flattenIterator produces the values of each element of the outer iterator
+// in turn. It fails if an element is not iterable, and stops early if the
+// thread is cancelled.
+type flattenIterator struct {
+	th    *Thread
+	name  string
+	outer Iterator
+	cur   Iterator
+	err   error
+}
+
+var _ ErrIterator = (*flattenIterator)(nil)
+
+func (it *flattenIterator) Next(p *Value) bool {
+	for it.err == nil && !it.th.isCancelled() {
+		if it.cur == nil {
+			var x Value
+			if !it.outer.Next(&x) {
+				it.err = iterErr(it.outer)
+				return false
+			}
+			if it.cur = Iterate(x); it.cur == nil {
+				it.err = fmt.Errorf("%s: want iterable element, got %s", it.name, x.Type())
+				return false
+			}
+		}
+		if it.cur.Next(p) {
+			return true
+		}
+		it.err = iterErr(it.cur)
+		it.cur.Done()
+		it.cur = nil
+	}
+	return false
+}
+
+func (it *flattenIterator) Err() error { return it.err }
+
+func (it *flattenIterator) Done() {
+	if it.cur != nil {
+		it.cur.Done()
+		it.cur = nil
+	}
+	it.outer.Done()
+}
+
+// zipLongestIterator produces a tuple of the next value of each iterator,
+// with fill for those that are exhausted. It stops when all iterators are
+// exhausted, or early if the thread is cancelled.
+type zipLongestIterator struct {
+	th   *Thread
+	fill Value
+	its  []Iterator // exhausted iterators are set to nil
+	err  error
+}
+
+var _ ErrIterator = (*zipLongestIterator)(nil)
+
+func (it *zipLongestIterator) Next(p *Value) bool {
+	if it.err != nil || it.th.isCancelled() {
+		return false
+	}
+
+	var more bool
+	elems := make([]Value, len(it.its))
+	for i, iter := range it.its {
+		if iter != nil && iter.Next(&elems[i]) {
+			more = true
+			continue
+		}
+		if iter != nil {
+			if it.err = iterErr(iter); it.err != nil {
+				return false
+			}
+			iter.Done()
+			it.its[i] = nil
+		}
+		elems[i] = it.fill
+	}
+	if !more {
+		return false
+	}
+	*p = NewTuple(elems)
+	return true
+}
+
+func (it *zipLongestIterator) Err() error { return it.err }
+
+func (it *zipLongestIterator) Done() {
+	for i, iter := range it.its {
+		if iter != nil {
+			iter.Done()
+			it.its[i] = nil
+		}
+	}
+}
+
+// sliceIterator produces the values of the iterator at the indices from next
+// to stop by increments of step. It stops reading from the iterator once it
+// reaches stop, and early if the thread is cancelled.
+type sliceIterator struct {
+	th   *Thread
+	it   Iterator
+	i    int // index of the next value read from it
+	next int // index of the next value to produce, -1 if none
+	stop int // -1 if none
+	step int
+	err  error
+}
+
+var _ ErrIterator = (*sliceIterator)(nil)
+
+func (it *sliceIterator) Next(p *Value) bool {
+	if it.err != nil || it.next < 0 || it.stop >= 0 && it.next >= it.stop {
+		return false
+	}
+	for !it.th.isCancelled() {
+		var x Value
+		if !it.it.Next(&x) {
+			it.err = iterErr(it.it)
+			it.next = -1
+			return false
+		}
+		i := it.i
+		it.i++
+		if i == it.next {
+			if it.next > math.MaxInt-it.step {
+				it.next = -1
+			} else {
+				it.next += it.step
+			}
+			*p = x
+			return true
+		}
+	}
+	return false
+}
+
+func (it *sliceIterator) Err() error { return it.err }
+func (it *sliceIterator) Done()      { it.it.Done() }
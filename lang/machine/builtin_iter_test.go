@@ -0,0 +1,246 @@
+package machine_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterBuiltins(t *testing.T) {
+	type I = machine.Int
+	tup := func(vs ...machine.Value) machine.Value { return machine.NewTuple(vs) }
+	arr := func(vs ...machine.Value) machine.Value { return machine.NewArray(vs) }
+
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"chain", `
+let r = []
+for x in chain([1, 2], [3]) do r.append(x) end
+return r
+`, arr(I(1), I(2), I(3)), ""},
+		{"chain empty inputs", `
+let r = []
+for x in chain([], [1], (), "") do r.append(x) end
+return r
+`, arr(I(1)), ""},
+		{"chain no argument", `
+for x in chain() do return false end
+return true
+`, machine.True, ""},
+		{"chain reiterate", `
+let c, r = chain([1], [2]), []
+for x in c do r.append(x) end
+for x in c do r.append(x) end
+return r
+`, arr(I(1), I(2), I(1), I(2)), ""},
+		{"flatten", `
+let r = []
+for x in flatten([ [1, 2], [3], [] ]) do r.append(x) end
+return r
+`, arr(I(1), I(2), I(3)), ""},
+		{"flatten one level", `
+let r = []
+for x in flatten(([1, [2]], (), "ab")) do r.append(x) end
+return r
+`, arr(I(1), arr(I(2)), machine.String("a"), machine.String("b")), ""},
+		{"flatten empty", `
+for x in flatten([]) do return false end
+return true
+`, machine.True, ""},
+		{"flatten not iterable", `flatten(1.5)`, nil, "flatten: argument #1: want iterable, got float"},
+		{"flatten element not iterable", `
+let r = []
+for x in flatten([ [1], 2.5, [3] ]) do r.append(x) end
+`, nil, "flatten: want iterable element, got float"},
+		{"flatten element ints", `
+let r = []
+for x in flatten((2, [5])) do r.append(x) end
+return r
+`, arr(I(0), I(1), I(5)), ""},
+		{"flatten error with try", `
+return try sorted(flatten(([1], true)))
+`, machine.Nil, ""},
+		{"flatten error in sorted", `
+return sorted(flatten(([2, 1], true)))
+`, nil, "sorted: flatten: want iterable element, got bool"},
+		{"chain flatten error", `
+return set(chain([1], flatten([true])))
+`, nil, "set: flatten: want iterable element, got bool"},
+		{"zip_longest flatten error", `
+for x in zip_longest(null, [1, 2], flatten(([1], null))) do end
+`, nil, "flatten: want iterable element, got nil"},
+		{"unpack flatten error", `
+let a, b = flatten(([1], true))
+`, nil, "flatten: want iterable element, got bool"},
+		{"zip_longest", `
+let r = []
+for x in zip_longest(null, [1], [2, 3]) do r.append(x) end
+return r
+`, arr(tup(I(1), I(2)), tup(machine.Nil, I(3))), ""},
+		{"zip_longest fill", `
+let r = []
+for x in zip_longest(0, [1, 2, 3], [], [4]) do r.append(x) end
+return r
+`, arr(tup(I(1), I(0), I(4)), tup(I(2), I(0), I(0)), tup(I(3), I(0), I(0))), ""},
+		{"zip_longest all empty", `
+for x in zip_longest(null, [], ()) do return false end
+return true
+`, machine.True, ""},
+		{"zip_longest no iterable", `
+for x in zip_longest(null) do return false end
+return true
+`, machine.True, ""},
+		{"zip_longest no argument", `zip_longest()`, nil, "zip_longest: got 0 arguments, want at least 1"},
+		{"take", `
+let r = []
+for x in take(range(0, 1000000), 3) do r.append(x) end
+return r
+`, arr(I(0), I(1), I(2)), ""},
+		{"take more than available", `
+let r = []
+for x in take([1, 2], 5) do r.append(x) end
+return r
+`, arr(I(1), I(2)), ""},
+		{"take zero", `
+for x in take([1, 2], 0) do return false end
+return true
+`, machine.True, ""},
+		{"take reiterate", `
+let t, r = take([1, 2, 3], 2), []
+for x in t do r.append(x) end
+for x in t do r.append(x) end
+return r
+`, arr(I(1), I(2), I(1), I(2)), ""},
+		{"drop", `
+let r = []
+for x in drop(range(0, 6), 4) do r.append(x) end
+return r
+`, arr(I(4), I(5)), ""},
+		{"drop all", `
+for x in drop([1, 2], 3) do return false end
+return true
+`, machine.True, ""},
+		{"islice step", `
+let r = []
+for x in islice(range(0, 20), 2, 11, 3) do r.append(x) end
+return r
+`, arr(I(2), I(5), I(8)), ""},
+		{"islice no stop", `
+let r = []
+for x in islice("abcdefg", 1, null, 2) do r.append(x) end
+return r
+`, arr(machine.String("b"), machine.String("d"), machine.String("f")), ""},
+		{"islice start only", `
+let r = []
+for x in islice([1, 2, 3], 1) do r.append(x) end
+return r
+`, arr(I(2), I(3)), ""},
+		{"islice empty", `
+for x in islice([1, 2, 3], 2, 1) do return false end
+return true
+`, machine.True, ""},
+		{"take of flatten error", `
+let r = []
+for x in take(flatten(([1], true)), 2) do r.append(x) end
+`, nil, "flatten: want iterable element, got bool"},
+		{"take of flatten before error", `
+let r = []
+for x in take(flatten(([1], true)), 1) do r.append(x) end
+return r
+`, arr(I(1)), ""},
+		{"take negative", `take([1], -1)`, nil, "take: argument #2: want non-negative int, got -1"},
+		{"drop negative", `drop([1], -2)`, nil, "drop: argument #2: want non-negative int, got -2"},
+		{"islice negative start", `islice([1], -1, 2)`, nil, "islice: argument #2: want non-negative int, got -1"},
+		{"islice negative stop", `islice([1], 0, -1)`, nil, "islice: argument #3: want non-negative int, got -1"},
+		{"islice zero step", `islice([1], 0, 1, 0)`, nil, "islice: argument #4: want positive int, got 0"},
+		{"islice stop not int", `islice([1], 0, "a")`, nil, "islice: argument #3: "},
+		{"take not iterable", `take(true, 1)`, nil, "take: argument #1: want iterable, got bool"},
+		{"chain not iterable", `chain([1], true)`, nil, "chain: argument #2: want iterable, got bool"},
+		{"zip_longest not iterable", `zip_longest(null, [1], true)`, nil, "zip_longest: argument #3: want iterable, got bool"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+// countingIterable is an infinite Iterable of ints that records the number of
+// values produced and the number of iterators closed.
+type countingIterable struct{ next, done int }
+
+func (c *countingIterable) String() string { return "countingIterable" }
+func (c *countingIterable) Type() string   { return "countingIterable" }
+func (c *countingIterable) Iterate() machine.Iterator {
+	return &countingIterator{c: c}
+}
+
+type countingIterator struct{ c *countingIterable }
+
+func (it *countingIterator) Next(p *machine.Value) bool {
+	*p = machine.Int(it.c.next)
+	it.c.next++
+	return true
+}
+
+func (it *countingIterator) Done() { it.c.done++ }
+
+func TestSliceBuiltinsLazy(t *testing.T) {
+	type I = machine.Int
+	arr := func(vs ...machine.Value) machine.Value { return machine.NewArray(vs) }
+
+	cases := []struct {
+		src  string
+		want machine.Value
+		next int
+	}{
+		{`take(it, 3)`, arr(I(0), I(1), I(2)), 3},
+		{`take(drop(it, 2), 2)`, arr(I(2), I(3)), 4},
+		{`islice(it, 1, 8, 3)`, arr(I(1), I(4), I(7)), 8},
+		{`take(islice(it, 5, null, 10), 2)`, arr(I(5), I(15)), 16},
+		{`take(it, 0)`, arr([]machine.Value{}...), 0},
+	}
+	for _, c := range cases {
+		t.Run(c.src, func(t *testing.T) {
+			it := &countingIterable{}
+			th := &machine.Thread{Predeclared: map[string]machine.Value{"it": it}}
+			got, err := runSourceThread(t, th, `
+let r = []
+for x in `+c.src+` do r.append(x) end
+return r
+`)
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+			require.Equal(t, c.next, it.next)
+			require.Equal(t, 1, it.done)
+		})
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		// drop never produces a value from the infinite iterable, it only stops
+		// reading from it when the thread is cancelled.
+		it := &countingIterable{}
+		pre := map[string]machine.Value{"it": it}
+		prog := compileSource(t, `for x in drop(it, 9223372036854775807) do end`, 0, pre)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		th := &machine.Thread{Predeclared: pre}
+		_, err := th.RunProgram(ctx, prog)
+		require.ErrorContains(t, err, "thread cancelled")
+		require.Equal(t, 1, it.done)
+	})
+}
@@ -0,0 +1,192 @@
+package machine
+
+import (
+	"fmt"
+	"sort"
+)
+
+func init() {
+	Universe["count"] = NewBuiltin("count", builtinCount)
+	Universe["get"] = NewBuiltin("get", builtinGet)
+	Universe["group_by"] = NewBuiltin("group_by", builtinGroupBy)
+	Universe["most_common"] = NewBuiltin("most_common", builtinMostCommon)
+	Universe["setdefault"] = NewBuiltin("setdefault", builtinSetDefault)
+}
+
+// count(x) returns a new map from each distinct value produced by iterating
+// over x to the number of times it was produced. The keys of the map are in
+// the order they were first produced, and they must be hashable.
+func builtinCount(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	var iterable Iterable
+	if err := UnpackArgs(b, args, 1, &iterable); err != nil {
+		return nil, err
+	}
+
+	counts := NewMap(0)
+	it := iterable.Iterate()
+	defer it.Done()
+	var x Value
+	for it.Next(&x) {
+		v, found, err := counts.Get(x)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		if !found {
+			if err := th.checkMapKey(counts, x); err != nil {
+				return nil, fmt.Errorf("%s: %w", b.name, err)
+			}
+			v = Int(0)
+		}
+		if err := counts.SetKey(x, v.(Int)+1); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+	}
+	if err := iterErr(it); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	return counts, nil
+}
+
+// most_common(m, n) returns a new array of the (key, count) tuples of the n
+// entries of the map m with the highest counts, in decreasing order of count,
+// typically with a map returned by count. Entries with the same count are in
+// the order of the map. If n is greater than the number of entries, all
+// entries are returned. The values of the map must be ints.
+func builtinMostCommon(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	var v Value
+	var n int
+	if err := UnpackArgs(b, args, 2, &v, &n); err != nil {
+		return nil, err
+	}
+	m, ok := v.(*Map)
+	if !ok {
+		return nil, fmt.Errorf("%s: argument #1: want map, got %s", b.name, v.Type())
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("%s: argument #2: want non-negative int, got %d", b.name, n)
+	}
+
+	items := m.Items()
+	for _, item := range items {
+		if _, ok := item.Index(1).(Int); !ok {
+			return nil, fmt.Errorf("%s: want int count, got %s", b.name, item.Index(1).Type())
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Index(1).(Int) > items[j].Index(1).(Int)
+	})
+
+	top := make([]Value, min(n, len(items)))
+	for i := range top {
+		top[i] = items[i]
+	}
+	return NewArray(top), nil
+}
+
+// get(m, k, default=nil) returns the value of key k in the mapping m, or
+// default if m does not contain k. Unlike m[k], it never fails on a missing
+// key, regardless of the thread's StrictIndex setting.
+func builtinGet(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 2, 3); err != nil {
+		return nil, err
+	}
+	m, ok := args.Index(0).(Mapping)
+	if !ok {
+		return nil, fmt.Errorf("%s: argument #1: want mapping, got %s", b.name, args.Index(0).Type())
+	}
+	v, found, err := m.Get(args.Index(1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	if found {
+		return v, nil
+	}
+	if args.Len() > 2 {
+		return args.Index(2), nil
+	}
+	return Nil, nil
+}
+
+// group_by(x, key) returns a new map from each key computed by calling key
+// with a value produced by iterating over x, to an array of the values for
+// which it computed that key. The keys of the map and the values of each
+// array are in the order they were first produced. The keys must be
+// hashable.
+func builtinGroupBy(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	var iterable Iterable
+	var key Callable
+	if err := UnpackArgs(b, args, 2, &iterable, &key); err != nil {
+		return nil, err
+	}
+
+	groups := NewMap(0)
+	it := iterable.Iterate()
+	defer it.Done()
+	var x Value
+	for it.Next(&x) {
+		k, err := Call(th, key, NewTuple([]Value{x}))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		v, found, err := groups.Get(k)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		if !found {
+			if err := th.checkMapKey(groups, k); err != nil {
+				return nil, fmt.Errorf("%s: %w", b.name, err)
+			}
+			v = NewArray(nil)
+			if err := groups.SetKey(k, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", b.name, err)
+			}
+		}
+		group := v.(*Array)
+		if err := th.checkCollectionSize(group.Type(), group.Len()+1); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		if err := group.Append(x); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+	}
+	if err := iterErr(it); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	return groups, nil
+}
+
+// setdefault(m, k, default=nil) returns the value of key k in the mapping m if
+// it exists, otherwise it sets k to default in m and returns default. The
+// mapping must support key assignment, and any error reported by its SetKey
+// method (e.g. because it cannot be mutated) is returned.
+func builtinSetDefault(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 2, 3); err != nil {
+		return nil, err
+	}
+	m, ok := args.Index(0).(HasSetKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: argument #1: want mutable mapping, got %s", b.name, args.Index(0).Type())
+	}
+	k := args.Index(1)
+	v, found, err := m.Get(k)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	if found {
+		return v, nil
+	}
+
+	var def Value = Nil
+	if args.Len() > 2 {
+		def = args.Index(2)
+	}
+	if m, ok := m.(*Map); ok {
+		if err := th.checkMapKey(m, k); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+	}
+	if err := m.SetKey(k, def); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	return def, nil
+}
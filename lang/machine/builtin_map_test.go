@@ -0,0 +1,338 @@
+package machine_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinGet(t *testing.T) {
+	m := machine.NewMap(2)
+	require.NoError(t, m.SetKey(machine.String("a"), machine.Int(1)))
+	require.NoError(t, m.SetKey(machine.String("n"), machine.Nil))
+
+	cases := []struct {
+		desc string
+		args []machine.Value
+		want machine.Value
+		err  string
+	}{
+		{"found", []machine.Value{m, machine.String("a"), machine.Int(2)}, machine.Int(1), ""},
+		{"found nil", []machine.Value{m, machine.String("n"), machine.Int(2)}, machine.Nil, ""},
+		{"default", []machine.Value{m, machine.String("x"), machine.Int(2)}, machine.Int(2), ""},
+		{"no default", []machine.Value{m, machine.String("x")}, machine.Nil, ""},
+		{"not a mapping", []machine.Value{machine.NewArray(nil), machine.Int(0)}, nil, "get: argument #1: want mapping, got array"},
+		{"arity", []machine.Value{m}, nil, "get: got 1 arguments, want at least 2"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := callUniverse(t, "get", c.args...)
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+// strMapping is a read-only Mapping implementation distinct from the base Map,
+// that only supports string keys.
+type strMapping map[string]machine.Value
+
+func (m strMapping) String() string { return "strmapping" }
+func (m strMapping) Type() string   { return "strmapping" }
+
+func (m strMapping) Get(k machine.Value) (machine.Value, bool, error) {
+	s, ok := k.(machine.String)
+	if !ok {
+		return nil, false, errors.New("strmapping: key must be a string")
+	}
+	v, ok := m[string(s)]
+	return v, ok, nil
+}
+
+func TestBuiltinGetMapping(t *testing.T) {
+	m := strMapping{"a": machine.Int(1)}
+
+	cases := []struct {
+		desc string
+		args []machine.Value
+		want machine.Value
+		err  string
+	}{
+		{"found", []machine.Value{m, machine.String("a"), machine.Int(2)}, machine.Int(1), ""},
+		{"default", []machine.Value{m, machine.String("x"), machine.Int(2)}, machine.Int(2), ""},
+		{"no default", []machine.Value{m, machine.String("x")}, machine.Nil, ""},
+		{"get error", []machine.Value{m, machine.Int(1), machine.Int(2)}, nil, "get: strmapping: key must be a string"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := callUniverse(t, "get", c.args...)
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestStrictIndex(t *testing.T) {
+	cases := []struct {
+		desc   string
+		src    string
+		strict bool
+		want   machine.Value
+		err    string
+	}{
+		{"missing key", `
+let m = {a: 1}
+return m["b"]
+`, false, machine.Nil, ""},
+
+		{"missing key strict", `
+let m = {a: 1}
+return m["b"]
+`, true, nil, `key not found in map: "b"`},
+
+		{"missing field strict", `
+let m = {a: 1}
+return m.b
+`, true, nil, `key not found in map: "b"`},
+
+		{"present key strict", `
+let m = {a: null}
+return m["a"]
+`, true, machine.Nil, ""},
+
+		{"get strict", `
+let m = {a: 1}
+return get(m, "b", 2) + get(m, "a")
+`, true, machine.Int(3), ""},
+
+		{"missing key strict catchable", `
+let m = {a: 1}
+let v = try m.b
+return v
+`, true, machine.Nil, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			th := &machine.Thread{StrictIndex: c.strict}
+			got, err := runSourceThread(t, th, c.src)
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+// frozenMapping is a strMapping that supports key assignment, but always fails
+// to do so as if it was frozen.
+type frozenMapping struct{ strMapping }
+
+func (m frozenMapping) SetKey(k, v machine.Value) error {
+	return errors.New("cannot insert into frozen strmapping")
+}
+
+func TestBuiltinSetDefault(t *testing.T) {
+	t.Run("existing", func(t *testing.T) {
+		m := machine.NewMap(1)
+		require.NoError(t, m.SetKey(machine.String("a"), machine.Int(1)))
+
+		got, err := callUniverse(t, "setdefault", m, machine.String("a"), machine.Int(2))
+		require.NoError(t, err)
+		require.Equal(t, machine.Int(1), got)
+
+		v, _, _ := m.Get(machine.String("a"))
+		require.Equal(t, machine.Int(1), v)
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		m := machine.NewMap(0)
+		got, err := callUniverse(t, "setdefault", m, machine.String("a"), machine.Int(2))
+		require.NoError(t, err)
+		require.Equal(t, machine.Int(2), got)
+
+		v, found, _ := m.Get(machine.String("a"))
+		require.True(t, found)
+		require.Equal(t, machine.Int(2), v)
+	})
+
+	t.Run("absent no default", func(t *testing.T) {
+		m := machine.NewMap(0)
+		got, err := callUniverse(t, "setdefault", m, machine.String("a"))
+		require.NoError(t, err)
+		require.Equal(t, machine.Nil, got)
+
+		_, found, _ := m.Get(machine.String("a"))
+		require.True(t, found)
+	})
+
+	t.Run("frozen", func(t *testing.T) {
+		m := frozenMapping{strMapping{"a": machine.Int(1)}}
+		got, err := callUniverse(t, "setdefault", m, machine.String("a"), machine.Int(2))
+		require.NoError(t, err)
+		require.Equal(t, machine.Int(1), got)
+
+		_, err = callUniverse(t, "setdefault", m, machine.String("b"), machine.Int(2))
+		require.EqualError(t, err, "setdefault: cannot insert into frozen strmapping")
+	})
+
+	t.Run("not mutable", func(t *testing.T) {
+		_, err := callUniverse(t, "setdefault", strMapping{}, machine.String("a"))
+		require.EqualError(t, err, "setdefault: argument #1: want mutable mapping, got strmapping")
+	})
+
+	t.Run("memoize", func(t *testing.T) {
+		got, err := runSource(t, `
+let cache = {}
+let n = 0
+fn f(k)
+	return setdefault(cache, k, k * 10)
+end
+n = f(1) + f(2) + f(1)
+return n + get(cache, 2)
+`)
+		require.NoError(t, err)
+		require.Equal(t, machine.Int(60), got)
+	})
+}
+
+func TestBuiltinGroupBy(t *testing.T) {
+	type I = machine.Int
+	type S = machine.String
+	arr := func(vs ...machine.Value) *machine.Array { return machine.NewArray(vs) }
+	group := func(k machine.Value, vs ...machine.Value) machine.Value {
+		return machine.NewTuple([]machine.Value{k, arr(vs...)})
+	}
+
+	// the groups are returned as an array of (key, values) tuples, in the
+	// iteration order of the map.
+	const items = `
+let r = []
+for k in m do r.append((k, m[k])) end
+return r
+`
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"parity", `
+let m = group_by([3, 1, 4, 1, 5, 9, 2, 6], fn(x) return x % 2 end)
+` + items, arr(group(I(1), I(3), I(1), I(1), I(5), I(9)), group(I(0), I(4), I(2), I(6))), ""},
+		{"first character", `
+let m = group_by(("banana", "apple", "blueberry", "avocado", "cherry"), fn(s) return runes_of(s)[0] end)
+` + items, arr(
+			group(S("b"), S("banana"), S("blueberry")),
+			group(S("a"), S("apple"), S("avocado")),
+			group(S("c"), S("cherry")),
+		), ""},
+		{"empty", `
+let m = group_by([], fn(x) return x end)
+` + items, arr([]machine.Value{}...), ""},
+		{"unhashable key", `
+group_by([1, 2], fn(x) return [x] end)
+`, nil, "group_by: unhashable type: array"},
+		{"key error", `
+group_by([1, 2], fn(x) return x + "a" end)
+`, nil, "unsupported binary op: int + string"},
+		{"not callable", `group_by([1], 1)`, nil, "group_by: argument #2: want callable, got int"},
+		{"not iterable", `group_by(1.5, fn(x) return x end)`, nil, "group_by: argument #1: want iterable, got float"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+
+	t.Run("collection size", func(t *testing.T) {
+		_, err := runSourceThread(t, &machine.Thread{MaxCollectionSize: 2}, `group_by(3, fn(x) return x end)`)
+		require.ErrorContains(t, err, "group_by: collection size limit exceeded: map of 3 elements, max 2")
+		_, err = runSourceThread(t, &machine.Thread{MaxCollectionSize: 2}, `group_by(3, fn(x) return 0 end)`)
+		require.ErrorContains(t, err, "group_by: collection size limit exceeded: array of 3 elements, max 2")
+	})
+}
+
+func TestBuiltinCount(t *testing.T) {
+	type I = machine.Int
+	type S = machine.String
+	tup := func(vs ...machine.Value) machine.Value { return machine.NewTuple(vs) }
+	arr := func(vs ...machine.Value) *machine.Array { return machine.NewArray(vs) }
+
+	// the counts are returned as an array of (key, count) tuples, in the
+	// iteration order of the map.
+	const items = `
+let r = []
+for k in m do r.append((k, m[k])) end
+return r
+`
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"duplicates", `
+let m = count(["b", "a", "b", "c", "a", "b"])
+` + items, arr(tup(S("b"), I(3)), tup(S("a"), I(2)), tup(S("c"), I(1))), ""},
+		{"int and float keys", `
+let m = count([1, 1.0, 2.5])
+` + items, arr(tup(I(1), I(2)), tup(machine.Float(2.5), I(1))), ""},
+		{"empty", `
+let m = count([])
+` + items, arr([]machine.Value{}...), ""},
+		{"unhashable element", `count([1, [2]])`, nil, "count: unhashable type: array"},
+		{"not iterable", `count(true)`, nil, "count: argument #1: want iterable, got bool"},
+		{"most_common", `
+return most_common(count([1, 2, 3, 2, 3, 3, 4]), 2)
+`, arr(tup(I(3), I(3)), tup(I(2), I(2))), ""},
+		{"most_common ties", `
+return most_common(count("abcbca"), 3)
+`, arr(tup(S("a"), I(2)), tup(S("b"), I(2)), tup(S("c"), I(2))), ""},
+		{"most_common ties first seen", `
+return most_common(count([4, 1, 2, 1, 2, 3]), 3)
+`, arr(tup(I(1), I(2)), tup(I(2), I(2)), tup(I(4), I(1))), ""},
+		{"most_common all", `
+return most_common(count([1, 1, 2]), 10)
+`, arr(tup(I(1), I(2)), tup(I(2), I(1))), ""},
+		{"most_common zero", `
+return most_common(count([1]), 0)
+`, arr([]machine.Value{}...), ""},
+		{"most_common negative", `most_common({}, -1)`, nil, "most_common: argument #2: want non-negative int, got -1"},
+		{"most_common not map", `most_common([1], 1)`, nil, "most_common: argument #1: want map, got array"},
+		{"most_common not int count", `most_common({"a": 1, "b": "x"}, 1)`, nil, "most_common: want int count, got string"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+
+	t.Run("collection size", func(t *testing.T) {
+		_, err := runSourceThread(t, &machine.Thread{MaxCollectionSize: 2}, `count(3)`)
+		require.ErrorContains(t, err, "count: collection size limit exceeded: map of 3 elements, max 2")
+	})
+}
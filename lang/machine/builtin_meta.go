@@ -0,0 +1,51 @@
+package machine
+
+import (
+	"fmt"
+)
+
+func init() {
+	Universe["getmetamap"] = NewBuiltin("getmetamap", builtinGetMetamap)
+	Universe["setmetamap"] = NewBuiltin("setmetamap", builtinSetMetamap)
+}
+
+// getmetamap(x) returns the metamap of x, or nil if x has no metamap or does
+// not support metamaps.
+func builtinGetMetamap(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	if x, ok := args.Index(0).(HasMetamap); ok {
+		if meta := x.Metamap(); meta != nil {
+			return meta, nil
+		}
+	}
+	return Nil, nil
+}
+
+// setmetamap(x, m) sets the metamap of x to the map m, or clears it if m is
+// nil. It returns x. It fails if x is frozen.
+func builtinSetMetamap(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 2, 2); err != nil {
+		return nil, err
+	}
+	x, ok := args.Index(0).(HasMetamap)
+	if !ok {
+		return nil, fmt.Errorf("%s: argument #1: %s value does not support metamaps", b.name, args.Index(0).Type())
+	}
+
+	if f, ok := x.(Freezable); ok && f.Frozen() {
+		return nil, fmt.Errorf("%s: %w", b.name, frozenError(x))
+	}
+
+	var meta *Map
+	switch m := args.Index(1).(type) {
+	case *Map:
+		meta = m
+	case NilType:
+	default:
+		return nil, fmt.Errorf("%s: argument #2: want map or nil, got %s", b.name, m.Type())
+	}
+	x.SetMetamap(meta)
+	return x, nil
+}
@@ -0,0 +1,133 @@
+package machine_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/compiler"
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinMetamap(t *testing.T) {
+	// __add adds the "n" field of the map operand(s) to the other operand
+	fieldOf := func(v machine.Value) machine.Value {
+		if m, ok := v.(*machine.Map); ok {
+			n, _, _ := m.Get(machine.String("n"))
+			return n
+		}
+		return v
+	}
+	meta := machine.NewMap(1)
+	require.NoError(t, meta.SetKey(machine.String("__add"), &testFunc{
+		name: "__add",
+		fn: func(th *machine.Thread, args *machine.Tuple) (machine.Value, error) {
+			return machine.Binary(th, token.PLUS, fieldOf(args.Index(0)), fieldOf(args.Index(1)))
+		},
+	}))
+
+	newObj := func(n int) *machine.Map {
+		m := machine.NewMap(1)
+		require.NoError(t, m.SetKey(machine.String("n"), machine.Int(n)))
+		return m
+	}
+
+	t.Run("get without metamap", func(t *testing.T) {
+		got, err := callUniverse(t, "getmetamap", newObj(1))
+		require.NoError(t, err)
+		assert.Equal(t, machine.Nil, got)
+
+		got, err = callUniverse(t, "getmetamap", machine.Int(1))
+		require.NoError(t, err)
+		assert.Equal(t, machine.Nil, got)
+	})
+
+	t.Run("set and get", func(t *testing.T) {
+		var th machine.Thread
+		obj := newObj(10)
+		_, err := machine.Binary(&th, token.PLUS, obj, machine.Int(1))
+		require.EqualError(t, err, "unsupported binary op: map + int")
+
+		got, err := callUniverse(t, "setmetamap", obj, meta)
+		require.NoError(t, err)
+		assert.Same(t, obj, got)
+
+		got, err = callUniverse(t, "getmetamap", obj)
+		require.NoError(t, err)
+		assert.Same(t, meta, got)
+
+		// left, right and both operands
+		res, err := machine.Binary(&th, token.PLUS, obj, machine.Int(1))
+		require.NoError(t, err)
+		assert.Equal(t, machine.Int(11), res)
+		res, err = machine.Binary(&th, token.PLUS, machine.Int(2), obj)
+		require.NoError(t, err)
+		assert.Equal(t, machine.Int(12), res)
+		res, err = machine.Binary(&th, token.PLUS, obj, obj)
+		require.NoError(t, err)
+		assert.Equal(t, machine.Int(20), res)
+
+		// only __add is defined
+		_, err = machine.Binary(&th, token.MINUS, obj, machine.Int(1))
+		require.EqualError(t, err, "unsupported binary op: map - int (no __sub metamethod defined)")
+
+		// clear the metamap
+		_, err = callUniverse(t, "setmetamap", obj, machine.Nil)
+		require.NoError(t, err)
+		got, err = callUniverse(t, "getmetamap", obj)
+		require.NoError(t, err)
+		assert.Equal(t, machine.Nil, got)
+		_, err = machine.Binary(&th, token.PLUS, obj, machine.Int(1))
+		require.EqualError(t, err, "unsupported binary op: map + int")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cases := []struct {
+			fn   string
+			args []machine.Value
+			err  string
+		}{
+			{"getmetamap", nil, "getmetamap: got 0 arguments, want at least 1"},
+			{"setmetamap", []machine.Value{newObj(1)}, "setmetamap: got 1 arguments, want at least 2"},
+			{"setmetamap", []machine.Value{machine.Int(1), meta}, "setmetamap: argument #1: int value does not support metamaps"},
+			{"setmetamap", []machine.Value{newObj(1), machine.Int(1)}, "setmetamap: argument #2: want map or nil, got int"},
+		}
+		for _, c := range cases {
+			t.Run(fmt.Sprintf("%s %d", c.fn, len(c.args)), func(t *testing.T) {
+				_, err := callUniverse(t, c.fn, c.args...)
+				require.EqualError(t, err, c.err)
+			})
+		}
+	})
+
+	t.Run("machine", func(t *testing.T) {
+		// setmetamap(obj, meta) + 1
+		p := &compiler.Program{
+			Filename:  "test.nen",
+			Names:     []string{"setmetamap", "obj", "meta"},
+			Constants: []interface{}{int64(1)},
+		}
+		p.Functions = []*compiler.Funcode{{
+			Prog: p,
+			Name: "top",
+			Code: []byte{
+				byte(compiler.UNIVERSAL), 0,
+				byte(compiler.PREDECLARED), 1,
+				byte(compiler.PREDECLARED), 2,
+				byte(compiler.CALL), 0x80, 0x04, // 2 positional args
+				byte(compiler.CONSTANT), 0,
+				byte(compiler.PLUS),
+				byte(compiler.RETURN),
+			},
+			MaxStack: 3,
+		}}
+
+		th := machine.Thread{Predeclared: map[string]machine.Value{"obj": newObj(41), "meta": meta}}
+		res, err := th.RunProgram(context.Background(), p)
+		require.NoError(t, err)
+		assert.Equal(t, machine.Int(42), res)
+	})
+}
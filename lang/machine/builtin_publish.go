@@ -0,0 +1,23 @@
+package machine
+
+import (
+	"fmt"
+)
+
+func init() {
+	Universe["publish"] = NewBuiltin("publish", builtinPublish)
+}
+
+// publish(x) deep-freezes x and returns it, so that it can be safely handed
+// to the host or to another thread. It fails if x contains a value that
+// cannot be shared, such as a handle (see Publish).
+func builtinPublish(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	x := args.Index(0)
+	if err := Publish(x); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	return x, nil
+}
@@ -0,0 +1,70 @@
+package machine_test
+
+import (
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinPublish(t *testing.T) {
+	t.Run("across threads", func(t *testing.T) {
+		var th1 machine.Thread
+		v, err := runSourceThread(t, &th1, `
+let inner = [1, 2]
+return publish({a: inner, t: (inner, "x")})
+`)
+		require.NoError(t, err)
+		require.True(t, v.(machine.Freezable).Frozen())
+
+		th2 := machine.Thread{Predeclared: map[string]machine.Value{"v": v}}
+		got, err := runSourceThread(t, &th2, `return v.a[1] + v.t[0][0]`)
+		require.NoError(t, err)
+		require.Equal(t, machine.Int(3), got)
+
+		th3 := machine.Thread{Predeclared: map[string]machine.Value{"v": v}}
+		_, err = runSourceThread(t, &th3, `v.a[0] = 3`)
+		require.ErrorContains(t, err, "cannot modify frozen array")
+	})
+
+	t.Run("handle", func(t *testing.T) {
+		var th machine.Thread
+		arr := machine.NewArray([]machine.Value{machine.Int(1)})
+		h := machine.NewHandle(&th, "file", nil, nil)
+		th.Predeclared = map[string]machine.Value{"arr": arr, "h": h}
+		_, err := runSourceThread(t, &th, `return publish({a: arr, b: [h]})`)
+		require.ErrorContains(t, err, "publish: cannot publish file value: handles are bound to their thread")
+		require.False(t, arr.Frozen())
+	})
+
+	t.Run("set", func(t *testing.T) {
+		v, err := runSource(t, `return publish(set([1, "a"]))`)
+		require.NoError(t, err)
+		require.True(t, v.(machine.Freezable).Frozen())
+		require.ErrorContains(t, v.(*machine.Set).Add(machine.Int(2)), "cannot modify frozen set")
+	})
+
+	t.Run("catch", func(t *testing.T) {
+		var th machine.Thread
+		th.Predeclared = map[string]machine.Value{"h": machine.NewHandle(&th, "file", nil, nil)}
+		got, err := runSourceThread(t, &th, `return try publish((1, h))`)
+		require.NoError(t, err)
+		require.Equal(t, machine.Nil, got)
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		got, err := runSource(t, `
+let a = [null]
+a[0] = a
+let p = publish(a)
+return p[0][0] == a
+`)
+		require.NoError(t, err)
+		require.Equal(t, machine.True, got)
+	})
+
+	t.Run("arity", func(t *testing.T) {
+		_, err := runSource(t, `publish()`)
+		require.ErrorContains(t, err, "publish: got 0 arguments, want at least 1")
+	})
+}
@@ -0,0 +1,27 @@
+package machine
+
+import (
+	"fmt"
+)
+
+func init() {
+	Universe["range"] = rangeBuiltin
+}
+
+// rangeBuiltin is the range built-in, it also validates the arguments of the
+// loops over a range compiled to RANGEPUSH and RANGEJMP.
+var rangeBuiltin = NewBuiltin("range", builtinRange)
+
+// range(start, stop [, step]) returns the Range of integers from start
+// (included) to stop (excluded) by increments of step, which defaults to 1
+// and may be negative but not 0.
+func builtinRange(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	start, stop, step := 0, 0, 1
+	if err := UnpackArgs(b, args, 2, &start, &stop, &step); err != nil {
+		return nil, err
+	}
+	if step == 0 {
+		return nil, fmt.Errorf("%s: step cannot be zero", b.name)
+	}
+	return NewRange(start, stop, step), nil
+}
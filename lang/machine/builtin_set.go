@@ -0,0 +1,41 @@
+package machine
+
+import "fmt"
+
+func init() {
+	Universe["set"] = NewBuiltin("set", builtinSet)
+}
+
+// set(x=nil) returns a new set with the distinct values produced by
+// iterating over x, or an empty set if x is not provided.
+func builtinSet(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	var iterable Iterable
+	if err := UnpackArgs(b, args, 0, &iterable); err != nil {
+		return nil, err
+	}
+
+	if iterable == nil {
+		return NewSet(0), nil
+	}
+
+	var size int
+	if seq, ok := iterable.(Sequence); ok {
+		size = min(seq.Len(), maxPrealloc)
+	}
+	s := NewSet(size)
+	it := iterable.Iterate()
+	defer it.Done()
+	var x Value
+	for it.Next(&x) {
+		if err := th.checkSetValue(s, x); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		if err := s.Add(x); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+	}
+	if err := iterErr(it); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	return s, nil
+}
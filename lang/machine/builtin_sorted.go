@@ -0,0 +1,57 @@
+package machine
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mna/nenuphar/lang/token"
+)
+
+func init() {
+	Universe["sorted"] = NewBuiltin("sorted", builtinSorted)
+}
+
+// sorted(x) returns a new array with the values produced by iterating over x,
+// in increasing order as defined by Compare. The sort is stable, values that
+// compare equal keep their iteration order.
+func builtinSorted(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	var iterable Iterable
+	if err := UnpackArgs(b, args, 1, &iterable); err != nil {
+		return nil, err
+	}
+
+	var elems []Value
+	if seq, ok := iterable.(Sequence); ok {
+		n := seq.Len()
+		if err := th.checkCollectionSize("array", n); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		elems = make([]Value, 0, min(n, maxPrealloc))
+	}
+	it := iterable.Iterate()
+	defer it.Done()
+	var x Value
+	for it.Next(&x) {
+		if err := th.checkCollectionSize("array", len(elems)+1); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		elems = append(elems, x)
+	}
+	if err := iterErr(it); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+
+	var err error
+	sort.SliceStable(elems, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		var less bool
+		less, err = Compare(th, token.LT, elems[i], elems[j])
+		return less
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	return NewArray(elems), nil
+}
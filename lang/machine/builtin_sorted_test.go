@@ -0,0 +1,56 @@
+package machine_test
+
+import (
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinSorted(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want []machine.Value
+		err  string
+	}{
+		{"array", `return sorted([3, 1, 2])`,
+			[]machine.Value{machine.Int(1), machine.Int(2), machine.Int(3)}, ""},
+		{"mixed numbers", `return sorted([2.5, 1, -1.5])`,
+			[]machine.Value{machine.Float(-1.5), machine.Int(1), machine.Float(2.5)}, ""},
+		{"strings", `return sorted(["b", "c", "a"])`,
+			[]machine.Value{machine.String("a"), machine.String("b"), machine.String("c")}, ""},
+		{"range", `return sorted(range(3, 0, -1))`,
+			[]machine.Value{machine.Int(1), machine.Int(2), machine.Int(3)}, ""},
+		{"empty", `return sorted([])`, []machine.Value{}, ""},
+		{"map keys", `
+let m = {d: 1, b: 2, a: 3, c: 4}
+let keys = [null, null, null, null]
+let i = 0
+for k in m do
+	keys[i] = k
+	i = i + 1
+end
+return sorted(keys)
+`, []machine.Value{machine.String("a"), machine.String("b"), machine.String("c"), machine.String("d")}, ""},
+		{"incomparable", `return sorted([1, "a"])`, nil, "sorted: "},
+		{"not iterable", `return sorted(null)`, nil, "sorted: argument #1: want iterable, got nil"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			arr, ok := got.(*machine.Array)
+			require.True(t, ok, "got %s", got.Type())
+			elems := make([]machine.Value, arr.Len())
+			for i := range elems {
+				elems[i] = arr.Index(i)
+			}
+			require.Equal(t, c.want, elems)
+		})
+	}
+}
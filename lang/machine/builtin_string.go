@@ -0,0 +1,348 @@
+package machine
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mna/nenuphar/lang/scanner"
+	"github.com/mna/nenuphar/lang/token"
+)
+
+func init() {
+	Universe["strip"] = NewBuiltin("strip", builtinStrip)
+	Universe["lstrip"] = NewBuiltin("lstrip", builtinStrip)
+	Universe["rstrip"] = NewBuiltin("rstrip", builtinStrip)
+	Universe["pad_left"] = NewBuiltin("pad_left", builtinPad)
+	Universe["pad_right"] = NewBuiltin("pad_right", builtinPad)
+	Universe["ord"] = NewBuiltin("ord", builtinOrd)
+	Universe["chr"] = NewBuiltin("chr", builtinChr)
+	Universe["bytes_of"] = NewBuiltin("bytes_of", builtinBytesOf)
+	Universe["runes_of"] = NewBuiltin("runes_of", builtinRunesOf)
+	Universe["format"] = NewBuiltin("format", builtinFormat)
+	Universe["parse_number"] = NewBuiltin("parse_number", builtinParseNumber)
+}
+
+// strip(s, chars?), lstrip(s, chars?) and rstrip(s, chars?) remove the
+// leading and/or trailing runes of s that are part of chars, or whitespace if
+// chars is not provided.
+func builtinStrip(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 2); err != nil {
+		return nil, err
+	}
+	s, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	cutset := unicode.IsSpace
+	if args.Len() > 1 {
+		chars, err := stringArg(b, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		cutset = func(r rune) bool { return strings.ContainsRune(chars, r) }
+	}
+
+	switch b.name {
+	case "lstrip":
+		s = strings.TrimLeftFunc(s, cutset)
+	case "rstrip":
+		s = strings.TrimRightFunc(s, cutset)
+	default:
+		s = strings.TrimFunc(s, cutset)
+	}
+	return String(s), nil
+}
+
+// pad_left(s, width, fill?) and pad_right(s, width, fill?) pad s with fill
+// (a space by default) so that it is width runes long. A multi-rune fill is
+// repeated as needed and truncated to the exact number of runes required. If
+// s already has at least width runes, it is returned unchanged.
+func builtinPad(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 2, 3); err != nil {
+		return nil, err
+	}
+	s, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	width, err := intArg(b, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	fill := " "
+	if args.Len() > 2 {
+		if fill, err = stringArg(b, args, 2); err != nil {
+			return nil, err
+		}
+		if fill == "" {
+			return nil, fmt.Errorf("%s: fill must not be empty", b.name)
+		}
+	}
+
+	n := width - utf8.RuneCountInString(s)
+	if n <= 0 {
+		return String(s), nil
+	}
+	// as for the repetition of a string, the padding must not exceed maxAlloc
+	// bytes, and it is made of at most n/runes+1 repetitions of fill.
+	if reps := n/utf8.RuneCountInString(fill) + 1; int64(reps) > maxAlloc/int64(len(fill)) {
+		return nil, fmt.Errorf("%s: excessive width %d", b.name, width)
+	}
+
+	var sb strings.Builder
+	if b.name == "pad_right" {
+		sb.WriteString(s)
+	}
+	for n > 0 {
+		for _, r := range fill {
+			if n == 0 {
+				break
+			}
+			sb.WriteRune(r)
+			n--
+		}
+	}
+	if b.name == "pad_left" {
+		sb.WriteString(s)
+	}
+	return String(sb.String()), nil
+}
+
+// bytes_of(s) returns the bytes value of string s, which is its byte view:
+// its indexing and iteration yield each byte as an integer.
+func builtinBytesOf(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	s, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return Bytes(s), nil
+}
+
+// runes_of(s) returns an array of the runes of string s, each as a one-rune
+// string. This is the same view as the iteration of s, but as an indexable
+// sequence whose length is the number of runes.
+func builtinRunesOf(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	s, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	n := utf8.RuneCountInString(s)
+	if err := th.checkCollectionSize("array", n); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+
+	elems := make([]Value, 0, n)
+	it := String(s).Iterate()
+	defer it.Done()
+	var r Value
+	for it.Next(&r) {
+		elems = append(elems, r)
+	}
+	return NewArray(elems), nil
+}
+
+// ord(s) returns the Unicode code point of s, which must be a string of
+// exactly one rune.
+func builtinOrd(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	s, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	r, sz := utf8.DecodeRuneInString(s)
+	if sz == 0 || sz != len(s) {
+		return nil, fmt.Errorf("%s: want a string of one character, got %d", b.name, utf8.RuneCountInString(s))
+	}
+	if r == utf8.RuneError && sz == 1 {
+		return nil, fmt.Errorf("%s: invalid UTF-8 encoding", b.name)
+	}
+	return Int(r), nil
+}
+
+// chr(n) returns the one-character string of the Unicode code point n.
+func builtinChr(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	n, err := intArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > unicode.MaxRune || !utf8.ValidRune(rune(n)) {
+		return nil, fmt.Errorf("%s: invalid Unicode code point %d", b.name, n)
+	}
+	return String(rune(n)), nil
+}
+
+// format(f, ...) returns the string f with each {} placeholder replaced by
+// the next argument. Literal braces are written as {{ and }}. A placeholder
+// may specify a format spec after a colon, in the form {:[flags][width][.precision][verb]}:
+//   - flags are any of '-' (left-align), '+' (always print the sign) or ' '
+//     (leave a space for the sign), and '0' to pad with leading zeros
+//   - verb is one of d (decimal), x and X (hexadecimal), o (octal) and b
+//     (binary) for integers, f, e, E, g and G for numbers (integers are
+//     converted to floats) and s for strings
+//
+// The spec is validated against the type of its argument. A placeholder
+// without a verb formats its argument as a string of its value.
+func builtinFormat(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, math.MaxInt); err != nil {
+		return nil, err
+	}
+	f, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	argi := 1
+	for len(f) > 0 {
+		i := strings.IndexAny(f, "{}")
+		if i < 0 {
+			sb.WriteString(f)
+			break
+		}
+		sb.WriteString(f[:i])
+		if f[i] == '}' {
+			if !strings.HasPrefix(f[i:], "}}") {
+				return nil, fmt.Errorf("%s: single '}' encountered in format string", b.name)
+			}
+			sb.WriteByte('}')
+			f = f[i+2:]
+			continue
+		}
+		if strings.HasPrefix(f[i:], "{{") {
+			sb.WriteByte('{')
+			f = f[i+2:]
+			continue
+		}
+
+		end := strings.IndexByte(f[i:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("%s: unmatched '{' in format string", b.name)
+		}
+		placeholder := f[i : i+end+1]
+		f = f[i+end+1:]
+
+		var spec string
+		if inner := placeholder[1 : len(placeholder)-1]; inner != "" {
+			if inner[0] != ':' {
+				return nil, fmt.Errorf("%s: invalid placeholder %s", b.name, placeholder)
+			}
+			spec = inner[1:]
+		}
+		if argi >= args.Len() {
+			return nil, fmt.Errorf("%s: not enough arguments for format string", b.name)
+		}
+		if err := formatValue(&sb, spec, args.Index(argi)); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", b.name, placeholder, err)
+		}
+		argi++
+	}
+	if argi < args.Len() {
+		return nil, fmt.Errorf("%s: too many arguments for format string", b.name)
+	}
+	return String(sb.String()), nil
+}
+
+var rxFormatSpec = regexp.MustCompile(`^([-+ ]*)(0?)([0-9]*)(?:\.([0-9]+))?([a-zA-Z]?)$`)
+
+// formatValue writes v to sb, formatted according to the format spec.
+func formatValue(sb *strings.Builder, spec string, v Value) error {
+	m := rxFormatSpec.FindStringSubmatch(spec)
+	if m == nil {
+		return fmt.Errorf("invalid format spec %q", spec)
+	}
+	flags, zero, width, prec, verb := m[1], m[2], m[3], m[4], m[5]
+
+	var arg any
+	switch verb {
+	case "":
+		verb = "s"
+		if s, ok := v.(String); ok {
+			arg = string(s)
+		} else {
+			arg = v.String()
+		}
+		if prec != "" {
+			return fmt.Errorf("precision not allowed without a verb")
+		}
+
+	case "d", "x", "X", "o", "b":
+		i, ok := v.(Int)
+		if !ok {
+			return fmt.Errorf("format spec %q requires an int, got %s", spec, v.Type())
+		}
+		if prec != "" {
+			return fmt.Errorf("precision not allowed with integer format spec %q", spec)
+		}
+		arg = int64(i)
+
+	case "f", "e", "E", "g", "G":
+		switch v := v.(type) {
+		case Int:
+			arg = float64(v)
+		case Float:
+			arg = float64(v)
+		default:
+			return fmt.Errorf("format spec %q requires a number, got %s", spec, v.Type())
+		}
+
+	case "s":
+		s, ok := v.(String)
+		if !ok {
+			return fmt.Errorf("format spec %q requires a string, got %s", spec, v.Type())
+		}
+		arg = string(s)
+
+	default:
+		return fmt.Errorf("unsupported format verb %q", verb)
+	}
+
+	var gofmt strings.Builder
+	gofmt.WriteByte('%')
+	gofmt.WriteString(flags)
+	gofmt.WriteString(zero)
+	gofmt.WriteString(width)
+	if prec != "" {
+		gofmt.WriteByte('.')
+		gofmt.WriteString(prec)
+	}
+	gofmt.WriteString(verb)
+	fmt.Fprintf(sb, gofmt.String(), arg)
+	return nil
+}
+
+// parse_number(s) returns the Int or Float value of s, which must be a number
+// literal as written in the source code, optionally preceded by a sign.
+func builtinParseNumber(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	s, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, v, err := scanner.ParseNumber(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+	if tok == token.INT {
+		return Int(v.Int), nil
+	}
+	return Float(v.Float), nil
+}
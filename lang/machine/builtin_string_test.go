@@ -0,0 +1,268 @@
+package machine_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func callUniverse(t *testing.T, name string, args ...machine.Value) (machine.Value, error) {
+	t.Helper()
+	fn, ok := machine.Universe[name]
+	require.True(t, ok, "%s is not a universal built-in", name)
+	var th machine.Thread
+	return machine.Call(&th, fn, machine.NewTuple(args))
+}
+
+func TestBuiltinStripPad(t *testing.T) {
+	type S = machine.String
+	type I = machine.Int
+
+	cases := []struct {
+		fn   string
+		args []machine.Value
+		want string
+		err  string
+	}{
+		{"strip", []machine.Value{S("  \t a b \n ")}, "a b", ""},
+		{"lstrip", []machine.Value{S("  \t a b \n ")}, "a b \n ", ""},
+		{"rstrip", []machine.Value{S("  \t a b \n ")}, "  \t a b", ""},
+		{"strip", []machine.Value{S("  é ")}, "é", ""},
+		{"strip", []machine.Value{S("xxyabcyx"), S("xy")}, "abc", ""},
+		{"lstrip", []machine.Value{S("xxyabcyx"), S("xy")}, "abcyx", ""},
+		{"rstrip", []machine.Value{S("xxyabcyx"), S("xy")}, "xxyabc", ""},
+		{"strip", []machine.Value{S("«éléphant»"), S("«»é")}, "léphant", ""},
+		{"strip", []machine.Value{S("abc"), S("")}, "abc", ""},
+		{"strip", []machine.Value{}, "", "got 0 arguments, want at least 1"},
+		{"strip", []machine.Value{I(1)}, "", "argument #1: want string, got int"},
+
+		{"pad_left", []machine.Value{S("abc"), I(6)}, "   abc", ""},
+		{"pad_right", []machine.Value{S("abc"), I(6)}, "abc   ", ""},
+		{"pad_left", []machine.Value{S("abc"), I(2)}, "abc", ""},
+		{"pad_left", []machine.Value{S("abc"), I(-1)}, "abc", ""},
+		{"pad_left", []machine.Value{S("abc"), I(6), S("0")}, "000abc", ""},
+		{"pad_left", []machine.Value{S("abc"), I(8), S("xy")}, "xyxyxabc", ""},
+		{"pad_right", []machine.Value{S("abc"), I(8), S("xy")}, "abcxyxyx", ""},
+		{"pad_left", []machine.Value{S("été"), I(5)}, "  été", ""},
+		{"pad_right", []machine.Value{S("日本"), I(5), S("語·")}, "日本語·語", ""},
+		{"pad_left", []machine.Value{S("abc"), I(5), S("")}, "", "fill must not be empty"},
+		{"pad_left", []machine.Value{S(""), I(2000000000)}, "", "pad_left: excessive width 2000000000"},
+		{"pad_right", []machine.Value{S("abc"), I(1 << 29), S("日本")}, "", "pad_right: excessive width 536870912"},
+		{"pad_left", []machine.Value{S("abc")}, "", "got 1 arguments, want at least 2"},
+		{"pad_left", []machine.Value{S("abc"), S("5")}, "", "argument #2: string cannot be converted to integer"},
+	}
+	for _, c := range cases {
+		t.Run(c.fn, func(t *testing.T) {
+			got, err := callUniverse(t, c.fn, c.args...)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, machine.String(c.want), got)
+		})
+	}
+}
+
+func TestBuiltinOrdChr(t *testing.T) {
+	type S = machine.String
+	type I = machine.Int
+
+	cases := []struct {
+		fn   string
+		arg  machine.Value
+		want machine.Value
+		err  string
+	}{
+		{"ord", S("A"), I(65), ""},
+		{"ord", S("é"), I(0xE9), ""},
+		{"ord", S("😀"), I(0x1F600), ""},
+		{"ord", S(""), nil, "want a string of one character, got 0"},
+		{"ord", S("ab"), nil, "want a string of one character, got 2"},
+		{"ord", S("é!"), nil, "want a string of one character, got 2"},
+		{"ord", S("\xff"), nil, "invalid UTF-8 encoding"},
+		{"ord", I(1), nil, "argument #1: want string, got int"},
+
+		{"chr", I(65), S("A"), ""},
+		{"chr", I(0x1F600), S("😀"), ""},
+		{"chr", I(0), S("\x00"), ""},
+		{"chr", I(-1), nil, "invalid Unicode code point -1"},
+		{"chr", I(0x110000), nil, "invalid Unicode code point 1114112"},
+		{"chr", I(0xD800), nil, "invalid Unicode code point 55296"},
+		{"chr", S("A"), nil, "argument #1: string cannot be converted to integer"},
+	}
+	for _, c := range cases {
+		t.Run(c.fn, func(t *testing.T) {
+			got, err := callUniverse(t, c.fn, c.arg)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestBuiltinFormat(t *testing.T) {
+	type S = machine.String
+	type I = machine.Int
+	type F = machine.Float
+
+	cases := []struct {
+		desc string
+		args []machine.Value
+		want string
+		err  string
+	}{
+		{"no placeholder", []machine.Value{S("abc")}, "abc", ""},
+		{"escaped braces", []machine.Value{S("{{a}}")}, "{a}", ""},
+		{"default", []machine.Value{S("{}-{}-{}-{}"), S("a"), I(1), F(1.5), machine.True}, "a-1-1.5-true", ""},
+		{"zero-padded int", []machine.Value{S("{:04d}"), I(42)}, "0042", ""},
+		{"zero-padded negative int", []machine.Value{S("{:05d}"), I(-42)}, "-0042", ""},
+		{"width int", []machine.Value{S("[{:4d}]"), I(7)}, "[   7]", ""},
+		{"left-aligned int", []machine.Value{S("[{:-4d}]"), I(7)}, "[7   ]", ""},
+		{"signed int", []machine.Value{S("{:+d}"), I(7)}, "+7", ""},
+		{"fixed float", []machine.Value{S("{:.2f}"), F(3.14159)}, "3.14", ""},
+		{"fixed int as float", []machine.Value{S("{:.1f}"), I(2)}, "2.0", ""},
+		{"padded fixed float", []machine.Value{S("{:08.3f}"), F(-3.14159)}, "-003.142", ""},
+		{"exp float", []machine.Value{S("{:.2e}"), F(1234.5)}, "1.23e+03", ""},
+		{"hex", []machine.Value{S("{:x} {:X} {:04x}"), I(255), I(255), I(10)}, "ff FF 000a", ""},
+		{"octal binary", []machine.Value{S("{:o} {:b}"), I(8), I(5)}, "10 101", ""},
+		{"string", []machine.Value{S("[{:5s}]"), S("ab")}, "[   ab]", ""},
+		{"multi-byte", []machine.Value{S("é{}ü"), S("à")}, "éàü", ""},
+
+		{"d with string", []machine.Value{S("{:d}"), S("a")}, "", `{:d}: format spec "d" requires an int, got string`},
+		{"d with float", []machine.Value{S("{:d}"), F(1)}, "", `format spec "d" requires an int, got float`},
+		{"f with string", []machine.Value{S("{:f}"), S("a")}, "", `format spec "f" requires a number, got string`},
+		{"s with int", []machine.Value{S("{:s}"), I(1)}, "", `format spec "s" requires a string, got int`},
+		{"precision with int", []machine.Value{S("{:.2d}"), I(1)}, "", `precision not allowed with integer format spec ".2d"`},
+		{"unsupported verb", []machine.Value{S("{:q}"), I(1)}, "", `unsupported format verb "q"`},
+		{"invalid spec", []machine.Value{S("{:abc}"), I(1)}, "", `invalid format spec "abc"`},
+		{"invalid placeholder", []machine.Value{S("{0}"), I(1)}, "", `invalid placeholder {0}`},
+		{"unmatched open", []machine.Value{S("a{")}, "", `unmatched '{' in format string`},
+		{"single close", []machine.Value{S("a}b")}, "", `single '}' encountered in format string`},
+		{"not enough args", []machine.Value{S("{} {}"), I(1)}, "", `not enough arguments for format string`},
+		{"too many args", []machine.Value{S("{}"), I(1), I(2)}, "", `too many arguments for format string`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := callUniverse(t, "format", c.args...)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, machine.String(c.want), got)
+		})
+	}
+}
+
+func TestBuiltinParseNumber(t *testing.T) {
+	type S = machine.String
+	type I = machine.Int
+	type F = machine.Float
+
+	cases := []struct {
+		arg  machine.Value
+		want machine.Value
+		err  string
+	}{
+		{S("0x1f"), I(31), ""},
+		{S("1.5e3"), F(1500), ""},
+		{S("10_000"), I(10000), ""},
+		{S("0b101"), I(5), ""},
+		{S("0o17"), I(15), ""},
+		{S(".5"), F(0.5), ""},
+		{S("0x1p-2"), F(0.25), ""},
+		{S("-42"), I(-42), ""},
+		{S("+2.5"), F(2.5), ""},
+		{S("abc"), nil, `parse_number: invalid number syntax: "abc"`},
+		{S(""), nil, `parse_number: invalid number syntax: ""`},
+		{S("12abc"), nil, `parse_number: invalid number syntax: "12abc"`},
+		{S(" 12"), nil, `parse_number: invalid number syntax: " 12"`},
+		{S("--1"), nil, `parse_number: invalid number syntax: "--1"`},
+		{S("1__0"), nil, `parse_number: invalid number "1__0": '_' must separate successive digits`},
+		{S("0b102"), nil, `parse_number: invalid number "0b102": invalid digit '2' in binary literal`},
+		{S("99999999999999999999"), nil, `parse_number: invalid number "99999999999999999999": integer literal value out of range`},
+		{S("-9223372036854775808"), I(math.MinInt64), ""},
+		{S("-0x8000_0000_0000_0000"), I(math.MinInt64), ""},
+		{S("9223372036854775808"), nil, `parse_number: invalid number "9223372036854775808": integer literal value out of range`},
+		{S("-9223372036854775809"), nil, `parse_number: invalid number "-9223372036854775809": integer literal value out of range`},
+		{S("-1__0"), nil, `parse_number: invalid number "-1__0": '_' must separate successive digits`},
+		{I(1), nil, "argument #1: want string, got int"},
+	}
+	for _, c := range cases {
+		t.Run(c.arg.String(), func(t *testing.T) {
+			got, err := callUniverse(t, "parse_number", c.arg)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestStringRunesBytes(t *testing.T) {
+	type S = machine.String
+	type I = machine.Int
+	arr := func(vs ...machine.Value) machine.Value { return machine.NewArray(vs) }
+	tup := func(vs ...machine.Value) machine.Value { return machine.NewTuple(vs) }
+
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"iterate runes", `
+let r = []
+for c in "né日" do r.append(c) end
+return r
+`, arr(S("n"), S("é"), S("日")), ""},
+		{"len is bytes", `return (#"né日", #"")`, tup(I(6), I(0)), ""},
+		{"bytes_of", `
+let b = bytes_of("né")
+let r = []
+for x in b do r.append(x) end
+return (#b, b[1], r)
+`, tup(I(3), I(0xc3), arr(I('n'), I(0xc3), I(0xa9))), ""},
+		{"runes_of", `
+let rs = runes_of("né日")
+return (rs[0], rs[2], sorted(rs))
+`, tup(S("n"), S("日"), arr(S("n"), S("é"), S("日"))), ""},
+		{"runes_of empty", `
+for x in runes_of("") do return false end
+return true
+`, machine.True, ""},
+		{"bytes_of not string", `bytes_of(1)`, nil, "bytes_of: argument #1: want string, got int"},
+		{"runes_of arity", `runes_of()`, nil, "runes_of: got 0 arguments, want at least 1"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+
+	t.Run("iterate invalid utf8", func(t *testing.T) {
+		var got []machine.Value
+		it := S("a\xffé").Iterate()
+		defer it.Done()
+		var x machine.Value
+		for it.Next(&x) {
+			got = append(got, x)
+		}
+		require.Equal(t, []machine.Value{S("a"), S("\xff"), S("é")}, got)
+	})
+}
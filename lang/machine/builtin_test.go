@@ -0,0 +1,120 @@
+package machine_test
+
+import (
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterBuiltins(t *testing.T) {
+	pre := make(map[string]machine.Value)
+	machine.RegisterBuiltins(pre, map[string]machine.BuiltinFunc{
+		"len": func(th *machine.Thread, b *machine.Builtin, args *machine.Tuple) (machine.Value, error) {
+			var v machine.Value
+			if err := machine.UnpackArgs(b, args, 1, &v); err != nil {
+				return nil, err
+			}
+			return machine.Unary(th, token.POUND, v)
+		},
+		"repeat": func(th *machine.Thread, b *machine.Builtin, args *machine.Tuple) (machine.Value, error) {
+			var (
+				s   string
+				n   = 2
+				sep string
+			)
+			if err := machine.UnpackArgs(b, args, 1, &s, &n, &sep); err != nil {
+				return nil, err
+			}
+			var res string
+			for i := 0; i < n; i++ {
+				if i > 0 {
+					res += sep
+				}
+				res += s
+			}
+			return machine.String(res), nil
+		},
+	})
+
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"len string", `return len("abc")`, machine.Int(3), ""},
+		{"len bytes", `return len(b"ab")`, machine.Int(2), ""},
+		{"len no arg", `return len()`, nil, "len: got 0 arguments, want at least 1"},
+		{"len too many args", `return len("a", "b")`, nil, "len: got 2 arguments, want at most 1"},
+		{"len unsupported", `return len(1)`, nil, "unsupported unary op: # int"},
+		{"repeat default", `return repeat("a")`, machine.String("aa"), ""},
+		{"repeat all args", `return repeat("a", 3, "-")`, machine.String("a-a-a"), ""},
+		{"repeat bad string", `return repeat(1)`, nil, "repeat: argument #1: want string, got int"},
+		{"repeat bad int", `return repeat("a", 1.5)`, nil, "repeat: argument #2: no exact integer representation possible for float value 1.5"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			th := &machine.Thread{Predeclared: pre}
+			got, err := runSourceThread(t, th, c.src)
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestUnpackArgs(t *testing.T) {
+	b := machine.NewBuiltin("f", nil)
+	args := func(vs ...machine.Value) *machine.Tuple { return machine.NewTuple(vs) }
+
+	t.Run("all types", func(t *testing.T) {
+		var (
+			v  machine.Value
+			s  string
+			n  int
+			f  float64
+			ok bool
+			c  machine.Callable
+			it machine.Iterable
+			m  machine.Mapping
+		)
+		err := machine.UnpackArgs(b, args(machine.Nil, machine.String("s"), machine.Float(2), machine.Int(3),
+			machine.String("x"), b, machine.String("abc"), machine.NewMap(0)), 8,
+			&v, &s, &n, &f, &ok, &c, &it, &m)
+		require.NoError(t, err)
+		require.Equal(t, machine.Nil, v)
+		require.Equal(t, "s", s)
+		require.Equal(t, 2, n)
+		require.Equal(t, 3.0, f)
+		require.True(t, ok)
+		require.Equal(t, b, c)
+		require.Equal(t, machine.String("abc"), it)
+		require.NotNil(t, m)
+	})
+
+	t.Run("wrong types", func(t *testing.T) {
+		var f float64
+		err := machine.UnpackArgs(b, args(machine.String("x")), 1, &f)
+		require.EqualError(t, err, "f: argument #1: want number, got string")
+
+		var c machine.Callable
+		err = machine.UnpackArgs(b, args(machine.Int(1)), 1, &c)
+		require.EqualError(t, err, "f: argument #1: want callable, got int")
+
+		var m machine.Mapping
+		err = machine.UnpackArgs(b, args(machine.Int(1)), 0, &m)
+		require.EqualError(t, err, "f: argument #1: want mapping, got int")
+	})
+
+	t.Run("unsupported variable", func(t *testing.T) {
+		var x struct{}
+		require.Panics(t, func() {
+			_ = machine.UnpackArgs(b, args(machine.Int(1)), 1, &x)
+		})
+	})
+}
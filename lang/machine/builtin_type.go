@@ -0,0 +1,26 @@
+package machine
+
+import (
+	"fmt"
+)
+
+func init() {
+	Universe["as"] = NewBuiltin("as", builtinAs)
+}
+
+// as(x, typename) returns x if its type is typename (e.g. "int", "string",
+// "array"), otherwise it fails with an error.
+func builtinAs(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 2, 2); err != nil {
+		return nil, err
+	}
+	typ, err := stringArg(b, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	x := args.Index(0)
+	if got := x.Type(); got != typ {
+		return nil, fmt.Errorf("%s: expected %s, got %s", b.name, typ, got)
+	}
+	return x, nil
+}
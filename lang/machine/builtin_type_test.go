@@ -0,0 +1,63 @@
+package machine_test
+
+import (
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinAs(t *testing.T) {
+	arr := machine.NewArray(nil)
+	m := machine.NewMap(0)
+	cases := []struct {
+		x    machine.Value
+		typ  machine.Value
+		want machine.Value
+		err  string
+	}{
+		{machine.Int(1), machine.String("int"), machine.Int(1), ""},
+		{machine.Float(1.5), machine.String("float"), machine.Float(1.5), ""},
+		{machine.String("a"), machine.String("string"), machine.String("a"), ""},
+		{machine.True, machine.String("bool"), machine.True, ""},
+		{machine.Nil, machine.String("nil"), machine.Nil, ""},
+		{arr, machine.String("array"), arr, ""},
+		{m, machine.String("map"), m, ""},
+		{machine.Int(1), machine.String("float"), nil, "as: expected float, got int"},
+		{machine.String("1"), machine.String("int"), nil, "as: expected int, got string"},
+		{arr, machine.String("tuple"), nil, "as: expected tuple, got array"},
+		{machine.Int(1), machine.Int(1), nil, "as: argument #2: want string, got int"},
+	}
+	for _, c := range cases {
+		t.Run(c.x.Type()+" as "+c.typ.String(), func(t *testing.T) {
+			got, err := callUniverse(t, "as", c.x, c.typ)
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+
+	t.Run("arity", func(t *testing.T) {
+		_, err := callUniverse(t, "as", machine.Int(1))
+		require.EqualError(t, err, "as: got 1 arguments, want at least 2")
+	})
+
+	t.Run("catchable", func(t *testing.T) {
+		res, err := runSource(t, `
+let x = 0
+do
+	catch
+		x = 2
+	end
+	as("a", "int")
+	x = 1
+end
+return x
+`)
+		require.NoError(t, err)
+		require.Equal(t, machine.Int(2), res)
+	})
+}
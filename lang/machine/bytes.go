@@ -0,0 +1,44 @@
+package machine
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Bytes is the type of a byte string. It encapsulates an immutable sequence
+// of bytes that, unlike a String, is not meant to represent text. Indexing
+// and iteration on a Bytes value yield each byte as an Int.
+type Bytes string
+
+var (
+	_ Value     = Bytes("")
+	_ Ordered   = Bytes("")
+	_ Indexable = Bytes("")
+	_ Sequence  = Bytes("")
+	_ Hashable  = Bytes("")
+)
+
+func (b Bytes) String() string        { return "b" + strconv.Quote(string(b)) }
+func (b Bytes) Type() string          { return "bytes" }
+func (b Bytes) Len() int              { return len(b) }
+func (b Bytes) Index(i int) Value     { return Int(b[i]) }
+func (b Bytes) Iterate() Iterator     { return &bytesIterator{b: string(b)} }
+func (b Bytes) Hash() (uint32, error) { return hashString(string(b)), nil }
+func (b Bytes) Cmp(y Value) (int, error) {
+	return strings.Compare(string(b), string(y.(Bytes))), nil
+}
+
+type bytesIterator struct {
+	b string
+}
+
+func (it *bytesIterator) Next(p *Value) bool {
+	if len(it.b) > 0 {
+		*p = Int(it.b[0])
+		it.b = it.b[1:]
+		return true
+	}
+	return false
+}
+
+func (it *bytesIterator) Done() {}
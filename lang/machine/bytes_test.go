@@ -0,0 +1,59 @@
+package machine_test
+
+import (
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBytes(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"literal", `return b"a\x00\xff"`, machine.Bytes("a\x00\xff"), ""},
+		{"index", `let b = b"abc" return b[1]`, machine.Int('b'), ""},
+		{"index raw byte", `let b = b"\xff" return b[0]`, machine.Int(255), ""},
+		{"index negative", `let b = b"abc" return b[-1]`, machine.Int('c'), ""},
+		{"index out of range", `let b = b"abc" return b[3]`, nil, "bytes index 3 out of range [-3:2]"},
+		{"length", `return #b"abc"`, machine.Int(3), ""},
+		{"length escape", `return #b"\xffé"`, machine.Int(3), ""},
+		{"length empty", `return #b""`, machine.Int(0), ""},
+		{"equal", `return b"abc" == b'abc'`, machine.True, ""},
+		{"not equal", `return b"abc" != b"abd"`, machine.True, ""},
+		{"not equal string", `return b"abc" == "abc"`, machine.False, ""},
+		{"less", `return b"abc" < b"abd"`, machine.True, ""},
+		{"concat", `return b"ab" + b"c"`, machine.Bytes("abc"), ""},
+		{"concat string", `return b"ab" + "c"`, nil, "unsupported binary op: bytes + string"},
+		{"iterate", `
+let n = 0
+for b in b"\x01\x02\x03" do
+	n = n + b
+end
+return n
+`, machine.Int(6), ""},
+		{"constant tuple", `let t = (b"a", "a") return t[0]`, machine.Bytes("a"), ""},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestBytesValue(t *testing.T) {
+	b := machine.Bytes("a\xff")
+	require.Equal(t, "bytes", b.Type())
+	require.Equal(t, `b"a\xff"`, b.String())
+	require.Equal(t, 2, b.Len())
+	require.Equal(t, machine.Int(255), b.Index(1))
+}
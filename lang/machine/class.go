@@ -0,0 +1,104 @@
+package machine
+
+import "fmt"
+
+// A Class is a class defined by a class statement or expression. Its fields
+// and methods are its attributes, an attribute not defined by the class is
+// looked up in the class it inherits from, if any.
+type Class struct {
+	name     string
+	inherits *Class           // nil if the class does not inherit
+	names    []string         // names of the attributes in order of declaration
+	attrs    map[string]Value // may be a *cell shared with the methods
+	frozen   bool
+}
+
+var (
+	_ Value       = (*Class)(nil)
+	_ HasAttrs    = (*Class)(nil)
+	_ HasSetField = (*Class)(nil)
+	_ Freezable   = (*Class)(nil)
+)
+
+// newClass returns a new class. The inherited value must be Nil or a Class,
+// and members alternate the name (a String) and the value of each attribute.
+func newClass(name string, inherits Value, members []Value) (*Class, error) {
+	c := &Class{
+		name:  name,
+		names: make([]string, 0, len(members)/2),
+		attrs: make(map[string]Value, len(members)/2),
+	}
+	if inherits != Nil {
+		parent, ok := inherits.(*Class)
+		if !ok {
+			return nil, fmt.Errorf("class %s cannot inherit from %s", name, inherits.Type())
+		}
+		c.inherits = parent
+	}
+
+	for i := 0; i < len(members); i += 2 {
+		nm := string(members[i].(String)) // ok to panic otherwise, compiler error
+		c.names = append(c.names, nm)
+		c.attrs[nm] = members[i+1]
+	}
+	return c, nil
+}
+
+func (c *Class) String() string { return fmt.Sprintf("class(%p %s)", c, c.name) }
+func (c *Class) Type() string   { return "class" }
+func (c *Class) Name() string   { return c.name }
+
+// AttrNames returns the names of the attributes defined by the class, in
+// order of declaration. It does not include the inherited attributes.
+func (c *Class) AttrNames() []string { return c.names }
+
+func (c *Class) Attr(name string) (Value, error) {
+	for cl := c; cl != nil; cl = cl.inherits {
+		if v, ok := cl.attrs[name]; ok {
+			if cell, ok := v.(*cell); ok {
+				return cell.v, nil
+			}
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// SetField sets the value of an attribute defined by the class or by the
+// class it inherits from. It is an error to set an attribute that does not
+// exist or that is defined by a frozen class.
+func (c *Class) SetField(name string, val Value) error {
+	for cl := c; cl != nil; cl = cl.inherits {
+		if v, ok := cl.attrs[name]; ok {
+			if cl.frozen {
+				return frozenError(cl)
+			}
+			if cell, ok := v.(*cell); ok {
+				cell.v = val
+			} else {
+				cl.attrs[name] = val
+			}
+			return nil
+		}
+	}
+	return NoSuchAttrError(fmt.Sprintf("class %s has no .%s field or method", c.name, name))
+}
+
+// Freeze freezes the class, the values of its attributes and the class it
+// inherits from.
+func (c *Class) Freeze() {
+	if c.frozen {
+		return
+	}
+	c.frozen = true
+	for _, v := range c.attrs {
+		if cell, ok := v.(*cell); ok {
+			v = cell.v
+		}
+		Freeze(v)
+	}
+	if c.inherits != nil {
+		c.inherits.Freeze()
+	}
+}
+func (c *Class) Frozen() bool { return c.frozen }
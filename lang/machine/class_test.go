@@ -0,0 +1,159 @@
+package machine_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/compiler"
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClass(t *testing.T) {
+	// newProgram returns a program equivalent to:
+	//
+	//	class Foo(<inherits>)
+	//		let x = 1
+	//		fn get() return x end
+	//	end
+	//	<code>
+	//
+	// where Foo is stored in local 0. The class Bar, which inherits from Foo
+	// and has no member, can be created with the body function at index 3.
+	newProgram := func(inherits []byte, code ...byte) *compiler.Program {
+		p := &compiler.Program{
+			Filename:  "test.nen",
+			Names:     []string{"Foo", "x", "get", "z", "Bar"},
+			Constants: []interface{}{int64(1), int64(2), "x", "get"},
+		}
+
+		top := append(inherits,
+			byte(compiler.MAKETUPLE), 0,
+			byte(compiler.MAKEFUNC), 1,
+			byte(compiler.CALL), 0,
+			byte(compiler.MAKECLASS), 0,
+			byte(compiler.SETLOCAL), 0,
+		)
+		top = append(top, code...)
+
+		p.Functions = []*compiler.Funcode{{
+			Prog:     p,
+			Name:     "top",
+			Code:     top,
+			Locals:   []compiler.Binding{{Name: "Foo"}},
+			MaxStack: 4,
+		}, {
+			Prog: p,
+			Name: "Foo",
+			Code: []byte{
+				byte(compiler.CONSTANT), 0,
+				byte(compiler.SETLOCALCELL), 0,
+				byte(compiler.LOCAL), 0,
+				byte(compiler.MAKETUPLE), 1,
+				byte(compiler.MAKEFUNC), 2,
+				byte(compiler.SETLOCAL), 1,
+				byte(compiler.CONSTANT), 2,
+				byte(compiler.LOCAL), 0,
+				byte(compiler.CONSTANT), 3,
+				byte(compiler.LOCAL), 1,
+				byte(compiler.MAKETUPLE), 4,
+				byte(compiler.RETURN),
+			},
+			Locals:   []compiler.Binding{{Name: "x"}, {Name: "get"}},
+			Cells:    []int{0},
+			MaxStack: 4,
+		}, {
+			Prog: p,
+			Name: "get",
+			Code: []byte{
+				byte(compiler.FREECELL), 0,
+				byte(compiler.RETURN),
+			},
+			Freevars: []compiler.Binding{{Name: "x"}},
+			MaxStack: 1,
+		}, {
+			Prog: p,
+			Name: "Bar",
+			Code: []byte{
+				byte(compiler.MAKETUPLE), 0,
+				byte(compiler.RETURN),
+			},
+			MaxStack: 1,
+		}}
+		return p
+	}
+
+	noInherits := []byte{byte(compiler.NIL)}
+	cases := []struct {
+		desc     string
+		inherits []byte
+		code     []byte
+		want     machine.Value
+		err      string
+	}{
+		{"read field", noInherits, []byte{
+			byte(compiler.LOCAL), 0,
+			byte(compiler.ATTR), 1,
+			byte(compiler.RETURN),
+		}, machine.Int(1), ""},
+
+		{"call method", noInherits, []byte{
+			byte(compiler.LOCAL), 0,
+			byte(compiler.ATTR), 2,
+			byte(compiler.CALL), 0,
+			byte(compiler.RETURN),
+		}, machine.Int(1), ""},
+
+		{"set field shared with method", noInherits, []byte{
+			byte(compiler.LOCAL), 0,
+			byte(compiler.CONSTANT), 1,
+			byte(compiler.SETFIELD), 1,
+			byte(compiler.LOCAL), 0,
+			byte(compiler.ATTR), 2,
+			byte(compiler.CALL), 0,
+			byte(compiler.RETURN),
+		}, machine.Int(2), ""},
+
+		{"inherited field", noInherits, []byte{
+			byte(compiler.LOCAL), 0,
+			byte(compiler.MAKETUPLE), 0,
+			byte(compiler.MAKEFUNC), 3,
+			byte(compiler.CALL), 0,
+			byte(compiler.MAKECLASS), 4,
+			byte(compiler.ATTR), 1,
+			byte(compiler.RETURN),
+		}, machine.Int(1), ""},
+
+		{"unknown field", noInherits, []byte{
+			byte(compiler.LOCAL), 0,
+			byte(compiler.ATTR), 3,
+			byte(compiler.RETURN),
+		}, nil, "class has no .z field or method"},
+
+		{"set unknown field", noInherits, []byte{
+			byte(compiler.LOCAL), 0,
+			byte(compiler.CONSTANT), 0,
+			byte(compiler.SETFIELD), 3,
+			byte(compiler.NIL),
+			byte(compiler.RETURN),
+		}, nil, "class Foo has no .z field or method"},
+
+		{"invalid inherits", []byte{byte(compiler.CONSTANT), 0}, []byte{
+			byte(compiler.NIL),
+			byte(compiler.RETURN),
+		}, nil, "class Foo cannot inherit from int"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			var th machine.Thread
+			res, err := th.RunProgram(context.Background(), newProgram(c.inherits, c.code...))
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.want, res)
+		})
+	}
+}
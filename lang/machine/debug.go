@@ -0,0 +1,69 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mna/nenuphar/lang/compiler"
+)
+
+// debugWindow is the number of instructions before and after the failing one
+// that are included in a DebugError.
+const debugWindow = 3
+
+// A DebugError is a runtime error annotated with the location where it was
+// raised and the disassembled instructions around it, to help diagnose
+// compiler and machine bugs. It is only generated when Thread.Debug is set.
+type DebugError struct {
+	Err          error
+	Function     string
+	Filename     string
+	Pos          compiler.Position
+	PC           uint32
+	Instructions []compiler.Instruction // window of instructions around PC
+}
+
+// newDebugError returns err annotated with the debug information of the
+// instruction at pc in fcode. If err is already a DebugError (e.g. because it
+// was raised in a nested call), it is returned unchanged.
+func newDebugError(fcode *compiler.Funcode, pc uint32, err error) error {
+	var de *DebugError
+	if errors.As(err, &de) {
+		return err
+	}
+
+	insns := fcode.Instructions()
+	at := len(insns) - 1
+	for i, insn := range insns {
+		if insn.PC >= pc {
+			at = i
+			break
+		}
+	}
+	lo, hi := max(at-debugWindow, 0), min(at+debugWindow+1, len(insns))
+
+	return &DebugError{
+		Err:          err,
+		Function:     fcode.Name,
+		Filename:     fcode.Prog.Filename,
+		Pos:          fcode.Pos(pc),
+		PC:           pc,
+		Instructions: insns[lo:hi],
+	}
+}
+
+func (e *DebugError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s:%d:%d: %s: %s\n", e.Filename, e.Pos.Line, e.Pos.Col, e.Function, e.Err)
+	for _, insn := range e.Instructions {
+		marker := " "
+		if insn.PC == e.PC {
+			marker = ">"
+		}
+		fmt.Fprintf(&sb, "%s %s\n", marker, insn)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func (e *DebugError) Unwrap() error { return e.Err }
@@ -0,0 +1,72 @@
+package machine_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/compiler"
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugError(t *testing.T) {
+	newProgram := func() *compiler.Program {
+		code := []byte{
+			byte(compiler.NIL),         // 0
+			byte(compiler.POP),         // 1
+			byte(compiler.NIL),         // 2
+			byte(compiler.POP),         // 3
+			byte(compiler.CONSTANT), 0, // 4
+			byte(compiler.CONSTANT), 1, // 6
+			byte(compiler.PLUS),   // 8: fails
+			byte(compiler.RETURN), // 9
+			byte(compiler.NIL),    // 10
+			byte(compiler.RETURN), // 11
+			byte(compiler.NIL),    // 12
+			byte(compiler.RETURN), // 13
+		}
+		p := &compiler.Program{
+			Filename:  "test.nen",
+			Constants: []interface{}{int64(1), "a"},
+		}
+		p.Functions = []*compiler.Funcode{{
+			Prog:     p,
+			Name:     "top",
+			Code:     code,
+			MaxStack: 2,
+		}}
+		return p
+	}
+
+	t.Run("no debug", func(t *testing.T) {
+		var th machine.Thread
+		_, err := th.RunProgram(context.Background(), newProgram())
+		require.Error(t, err)
+
+		var de *machine.DebugError
+		require.False(t, errors.As(err, &de))
+		assert.Equal(t, "unsupported binary op: int + string", err.Error())
+	})
+
+	t.Run("debug", func(t *testing.T) {
+		th := machine.Thread{Debug: true}
+		_, err := th.RunProgram(context.Background(), newProgram())
+		require.Error(t, err)
+
+		var de *machine.DebugError
+		require.True(t, errors.As(err, &de))
+		assert.Equal(t, uint32(8), de.PC)
+		assert.Equal(t, "top", de.Function)
+		assert.Equal(t, "unsupported binary op: int + string", de.Unwrap().Error())
+		assert.Equal(t, `test.nen:0:0: top: unsupported binary op: int + string
+  3	pop
+  4	constant 0
+  6	constant 1
+> 8	plus
+  9	return
+  10	nil
+  11	return`, err.Error())
+	})
+}
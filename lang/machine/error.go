@@ -0,0 +1,100 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mna/nenuphar/lang/compiler"
+)
+
+// A CriticalError is a runtime error that cannot be caught by a catch block,
+// it always terminates the thread (deferred blocks still run). It is raised
+// by the "must" operator when its expression fails, when the thread's
+// MaxCallStackDepth or MaxSteps is exceeded and when the thread's context is
+// done. An error raised by a defer block while a critical error is being
+// handled is critical too.
+type CriticalError struct {
+	Err error
+}
+
+func (e *CriticalError) Error() string { return e.Err.Error() }
+func (e *CriticalError) Unwrap() error { return e.Err }
+
+// isCritical returns true if err is or wraps a CriticalError.
+func isCritical(err error) bool {
+	var ce *CriticalError
+	return errors.As(err, &ce)
+}
+
+// An Error is the runtime value of an error. It is created by the machine
+// when an error is raised by a compiled function, and records the source
+// position where it was raised. It is returned by the error built-in and can
+// be raised again with throw.
+//
+// It has the following attributes:
+//   - message is the error message.
+//   - position is the "filename:line:col" position where the error was
+//     raised, or an empty string if it is unknown.
+type Error struct {
+	err      error
+	filename string
+	pos      compiler.Position
+}
+
+var (
+	_ Value    = (*Error)(nil)
+	_ HasAttrs = (*Error)(nil)
+	_ error    = (*Error)(nil)
+)
+
+// NewError returns the Error value of err, without source position.
+func NewError(err error) *Error { return &Error{err: err} }
+
+// newErrorAt returns the Error value of err raised at the position of pc in
+// fcode, unless err already is or wraps an Error, in which case it is
+// returned unchanged so that it keeps the position where it was raised.
+func newErrorAt(err error, fcode *compiler.Funcode, pc uint32) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{err: err, filename: fcode.Prog.Filename, pos: fcode.Pos(pc)}
+}
+
+// asError returns the Error value of err.
+func asError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return NewError(err)
+}
+
+func (e *Error) String() string { return fmt.Sprintf("error(%q)", e.err.Error()) }
+func (e *Error) Type() string   { return "error" }
+func (e *Error) Error() string  { return e.err.Error() }
+func (e *Error) Unwrap() error  { return e.err }
+
+// Err returns the Go error of the Error value.
+func (e *Error) Err() error { return e.err }
+
+// Position returns the filename and source position where the error was
+// raised. The position is the zero value if it is unknown.
+func (e *Error) Position() (string, compiler.Position) { return e.filename, e.pos }
+
+func (e *Error) Attr(name string) (Value, error) {
+	switch name {
+	case "message":
+		return String(e.err.Error()), nil
+	case "position":
+		if e.pos.Line == 0 {
+			return String(""), nil
+		}
+		return String(fmt.Sprintf("%s:%d:%d", e.filename, e.pos.Line, e.pos.Col)), nil
+	}
+	return nil, nil
+}
+
+func (e *Error) AttrNames() []string { return errorAttrNames }
+
+var errorAttrNames = []string{"message", "position"}
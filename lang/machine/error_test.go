@@ -0,0 +1,705 @@
+package machine_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/compiler"
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jmp encodes the jump opcode op to addr, padded to 4 bytes as the compiler
+// does.
+func jmp(op compiler.Opcode, addr byte) []byte {
+	return []byte{byte(op), addr, byte(compiler.NOP), byte(compiler.NOP), byte(compiler.NOP)}
+}
+
+func cat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func TestTryMust(t *testing.T) {
+	// the code is encoded as the compiler generates it for try and must, with
+	// f a predeclared function.
+	programs := map[string]func(p *compiler.Program) *compiler.Funcode{
+		// return try f()
+		"try": func(p *compiler.Program) *compiler.Funcode {
+			return &compiler.Funcode{
+				Prog: p,
+				Name: "top",
+				Code: cat(
+					jmp(compiler.JMP, 13), // 0
+					[]byte{
+						byte(compiler.NIL),         // 5: catch
+						byte(compiler.SETLOCAL), 0, // 6
+					},
+					jmp(compiler.CATCHJMP, 19), // 8
+					[]byte{
+						byte(compiler.PREDECLARED), 0, // 13: protected
+						byte(compiler.CALL), 0, // 15
+						byte(compiler.SETLOCAL), 0, // 17
+						byte(compiler.LOCAL), 0, // 19
+						byte(compiler.RETURN), // 21
+					},
+				),
+				Locals:   []compiler.Binding{{Name: "tmp"}},
+				Catches:  []compiler.Defer{{PC0: 13, PC1: 17, StartPC: 5}},
+				MaxStack: 2,
+			}
+		},
+
+		// return must f()
+		"must": func(p *compiler.Program) *compiler.Funcode {
+			return &compiler.Funcode{
+				Prog: p,
+				Name: "top",
+				Code: cat(
+					jmp(compiler.JMP, 6), // 0
+					[]byte{
+						byte(compiler.CRITICAL),       // 5: catch
+						byte(compiler.PREDECLARED), 0, // 6: protected
+						byte(compiler.CALL), 0, // 8
+						byte(compiler.SETLOCAL), 0, // 10
+						byte(compiler.LOCAL), 0, // 12
+						byte(compiler.RETURN), // 14
+					},
+				),
+				Locals:   []compiler.Binding{{Name: "tmp"}},
+				Catches:  []compiler.Defer{{PC0: 6, PC1: 10, StartPC: 5}},
+				MaxStack: 2,
+			}
+		},
+
+		// return try (must f())
+		"try must": func(p *compiler.Program) *compiler.Funcode {
+			return &compiler.Funcode{
+				Prog: p,
+				Name: "top",
+				Code: cat(
+					jmp(compiler.JMP, 13), // 0
+					[]byte{
+						byte(compiler.NIL),         // 5: outer catch
+						byte(compiler.SETLOCAL), 1, // 6
+					},
+					jmp(compiler.CATCHJMP, 29), // 8
+					jmp(compiler.JMP, 19),      // 13: outer protected
+					[]byte{
+						byte(compiler.CRITICAL),       // 18: inner catch
+						byte(compiler.PREDECLARED), 0, // 19: inner protected
+						byte(compiler.CALL), 0, // 21
+						byte(compiler.SETLOCAL), 0, // 23
+						byte(compiler.LOCAL), 0, // 25
+						byte(compiler.SETLOCAL), 1, // 27
+						byte(compiler.LOCAL), 1, // 29
+						byte(compiler.RETURN), // 31
+					},
+				),
+				Locals: []compiler.Binding{{Name: "tmp"}, {Name: "tmp"}},
+				Catches: []compiler.Defer{
+					{PC0: 13, PC1: 27, StartPC: 5},
+					{PC0: 19, PC1: 23, StartPC: 18},
+				},
+				MaxStack: 2,
+			}
+		},
+	}
+
+	errFail := errors.New("fail")
+	cases := []struct {
+		prog string
+		fail bool
+		want machine.Value
+		err  bool // the error is errFail, wrapped in a CriticalError
+	}{
+		{"try", false, machine.Int(42), false},
+		{"try", true, machine.Nil, false},
+		{"must", false, machine.Int(42), false},
+		{"must", true, nil, true},
+		{"try must", false, machine.Int(42), false},
+		{"try must", true, nil, true},
+	}
+	for _, c := range cases {
+		name := c.prog
+		if c.fail {
+			name += " fails"
+		}
+		t.Run(name, func(t *testing.T) {
+			p := &compiler.Program{
+				Filename: "test.nen",
+				Names:    []string{"f"},
+			}
+			p.Functions = []*compiler.Funcode{programs[c.prog](p)}
+
+			f := machine.NewBuiltin("f", func(th *machine.Thread, b *machine.Builtin, args *machine.Tuple) (machine.Value, error) {
+				if c.fail {
+					return nil, errFail
+				}
+				return machine.Int(42), nil
+			})
+			th := machine.Thread{Predeclared: map[string]machine.Value{"f": f}}
+			res, err := th.RunProgram(context.Background(), p)
+			if !c.err {
+				require.NoError(t, err)
+				assert.Equal(t, c.want, res)
+				return
+			}
+
+			var ce *machine.CriticalError
+			require.True(t, errors.As(err, &ce))
+			assert.ErrorIs(t, err, errFail)
+		})
+	}
+}
+
+func TestDeferCatch(t *testing.T) {
+	// the code is encoded as the compiler generates it for defer and catch
+	// blocks, with f, g and h predeclared functions.
+	programs := map[string]func(p *compiler.Program) *compiler.Funcode{
+		// defer g() end; f()
+		"defer": func(p *compiler.Program) *compiler.Funcode {
+			return &compiler.Funcode{
+				Prog: p,
+				Name: "top",
+				Code: cat(
+					jmp(compiler.JMP, 11), // 0
+					[]byte{
+						byte(compiler.PREDECLARED), 1, // 5: defer
+						byte(compiler.CALL), 0, // 7
+						byte(compiler.POP),            // 9
+						byte(compiler.DEFEREXIT),      // 10
+						byte(compiler.PREDECLARED), 0, // 11: protected
+						byte(compiler.CALL), 0, // 13
+						byte(compiler.POP),      // 15
+						byte(compiler.RUNDEFER), // 16
+					},
+					jmp(compiler.JMP, 22), // 17
+					[]byte{
+						byte(compiler.NIL),    // 22
+						byte(compiler.RETURN), // 23
+					},
+				),
+				Defers:   []compiler.Defer{{PC0: 11, PC1: 17, StartPC: 5}},
+				MaxStack: 1,
+			}
+		},
+
+		// defer g() end; catch h() end; f()
+		"defer catch": func(p *compiler.Program) *compiler.Funcode {
+			return &compiler.Funcode{
+				Prog: p,
+				Name: "top",
+				Code: cat(
+					jmp(compiler.JMP, 11), // 0
+					[]byte{
+						byte(compiler.PREDECLARED), 1, // 5: defer
+						byte(compiler.CALL), 0, // 7
+						byte(compiler.POP),       // 9
+						byte(compiler.DEFEREXIT), // 10
+					},
+					jmp(compiler.JMP, 26), // 11: defer protected
+					[]byte{
+						byte(compiler.PREDECLARED), 2, // 16: catch
+						byte(compiler.CALL), 0, // 18
+						byte(compiler.POP), // 20
+					},
+					jmp(compiler.CATCHJMP, 31), // 21
+					[]byte{
+						byte(compiler.PREDECLARED), 0, // 26: catch protected
+						byte(compiler.CALL), 0, // 28
+						byte(compiler.POP),      // 30
+						byte(compiler.RUNDEFER), // 31
+					},
+					jmp(compiler.JMP, 37), // 32
+					[]byte{
+						byte(compiler.NIL),    // 37
+						byte(compiler.RETURN), // 38
+					},
+				),
+				Defers:   []compiler.Defer{{PC0: 11, PC1: 32, StartPC: 5}},
+				Catches:  []compiler.Defer{{PC0: 26, PC1: 30, StartPC: 16}},
+				MaxStack: 1,
+			}
+		},
+	}
+
+	errFail := errors.New("fail")
+	cases := []struct {
+		prog  string
+		fail  bool
+		calls string
+		err   bool
+	}{
+		{"defer", false, "fg", false},
+		{"defer", true, "fg", true},
+		{"defer catch", false, "fg", false},
+		{"defer catch", true, "fhg", false},
+	}
+	for _, c := range cases {
+		name := c.prog
+		if c.fail {
+			name += " fails"
+		}
+		t.Run(name, func(t *testing.T) {
+			p := &compiler.Program{
+				Filename: "test.nen",
+				Names:    []string{"f", "g", "h"},
+			}
+			p.Functions = []*compiler.Funcode{programs[c.prog](p)}
+
+			var calls string
+			predecl := make(map[string]machine.Value)
+			for _, name := range p.Names {
+				predecl[name] = machine.NewBuiltin(name, func(th *machine.Thread, b *machine.Builtin, args *machine.Tuple) (machine.Value, error) {
+					calls += b.Name()
+					if b.Name() == "f" && c.fail {
+						return nil, errFail
+					}
+					return machine.Nil, nil
+				})
+			}
+			th := machine.Thread{Predeclared: predecl}
+			res, err := th.RunProgram(context.Background(), p)
+			assert.Equal(t, c.calls, calls)
+			if c.err {
+				require.ErrorIs(t, err, errFail)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, machine.Nil, res)
+		})
+	}
+}
+
+// doneIterable is an Iterable that yields the integers 1 and 2 and records
+// whether its iterator was closed.
+type doneIterable struct{ done bool }
+
+func (it *doneIterable) String() string { return "doneIterable" }
+func (it *doneIterable) Type() string   { return "doneIterable" }
+func (it *doneIterable) Iterate() machine.Iterator {
+	return &doneIterator{it: it}
+}
+
+type doneIterator struct {
+	it *doneIterable
+	i  int
+}
+
+func (it *doneIterator) Next(p *machine.Value) bool {
+	if it.i < 2 {
+		it.i++
+		*p = machine.Int(it.i)
+		return true
+	}
+	return false
+}
+
+func (it *doneIterator) Done() { it.it.done = true }
+
+func TestDeferPanic(t *testing.T) {
+	var records []string
+	record := machine.NewBuiltin("record", func(th *machine.Thread, b *machine.Builtin, args *machine.Tuple) (machine.Value, error) {
+		records = append(records, args.Index(0).String())
+		return machine.Nil, nil
+	})
+	boom := machine.NewBuiltin("boom", func(th *machine.Thread, b *machine.Builtin, args *machine.Tuple) (machine.Value, error) {
+		panic("boom")
+	})
+	iter := &doneIterable{}
+
+	th := &machine.Thread{Predeclared: map[string]machine.Value{
+		"record": record,
+		"boom":   boom,
+		"it":     iter,
+	}}
+	_, err := runSourceThread(t, th, `
+catch
+	record("caught")
+end
+fn f()
+	defer
+		record("outer")
+	end
+	for x in it do
+		defer
+			boom()
+		end
+		record(x)
+	end
+	return 1
+end
+return f()
+`)
+	require.EqualError(t, err, "panic in deferred call: boom")
+	var ce *machine.CriticalError
+	require.True(t, errors.As(err, &ce))
+	require.Equal(t, []string{"1", `"outer"`}, records)
+	require.True(t, iter.done)
+
+	// the call stack of the thread was properly unwound
+	_, err = machine.Call(th, record, machine.NewTuple([]machine.Value{machine.String("after")}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", `"outer"`, `"after"`}, records)
+
+	// a panic outside of deferred execution is not recovered
+	th = &machine.Thread{Predeclared: map[string]machine.Value{"boom": boom}}
+	require.PanicsWithValue(t, "boom", func() {
+		_, _ = runSourceThread(t, th, `boom()`)
+	})
+
+	// a panic raised by an instruction other than CALL in a defer block is not
+	// recovered either, the remaining defer blocks do not run but the
+	// iterators are closed and the thread is reusable.
+	meta := machine.NewMap(1)
+	require.NoError(t, meta.SetKey(machine.String("__add"), boom))
+	obj := machine.NewMap(0)
+	obj.SetMetamap(meta)
+	records = nil
+	iter = &doneIterable{}
+	th = &machine.Thread{Predeclared: map[string]machine.Value{
+		"record": record,
+		"obj":    obj,
+		"it":     iter,
+	}}
+	require.PanicsWithValue(t, "boom", func() {
+		_, _ = runSourceThread(t, th, `
+defer
+	record("outer")
+end
+for x in it do
+	defer
+		let y = obj + 1
+	end
+	record(x)
+end
+`)
+	})
+	require.Equal(t, []string{"1"}, records)
+	require.True(t, iter.done)
+	_, err = machine.Call(th, record, machine.NewTuple([]machine.Value{machine.String("after")}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", `"after"`}, records)
+}
+
+func TestDeferredStackDepth(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+	}{
+		{"catch in loop", `
+let n = 0
+for i in 5 do
+	do
+		catch n = n + 1 end
+		fail()
+	end
+end
+return n
+`, machine.Int(5)},
+		{"continue out of failing defer", `
+let n = 0
+for i in 3 do
+	do
+		catch n = n + 1 end
+		do
+			defer fail() end
+			continue
+		end
+	end
+end
+return n
+`, machine.Int(3)},
+		{"defer in defer", `
+fn f(s)
+	defer
+		defer s.append("c") end
+		s.append("b")
+	end
+	s.append("a")
+end
+let s = []
+f(s)
+return s
+`, machine.NewArray([]machine.Value{machine.String("a"), machine.String("b"), machine.String("c")})},
+		{"sibling blocks", `
+let s = ""
+for i in 2 do
+	do
+		defer s = s + "a" end
+		catch s = s + "b" end
+		fail()
+	end
+	do
+		defer s = s + "c" end
+		if (try fail()) == null then s = s + "d" end
+	end
+end
+return s
+`, machine.String("badcbadc")},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			// in Debug mode, the machine fails if the deferred stack grows beyond
+			// the maximum depth computed by the compiler.
+			got, err := runSourceThread(t, &machine.Thread{Debug: true}, c.src)
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+
+	t.Run("tail call after caught errors", func(t *testing.T) {
+		th := &machine.Thread{RecordStackUsage: true}
+		got, err := runSourceThread(t, th, `
+fn f(n)
+	for i in 3 do
+		do
+			catch end
+			fail()
+		end
+	end
+	if n == 0 then return "done" end
+	return f(n - 1)
+end
+return f(100)
+`)
+		require.NoError(t, err)
+		require.Equal(t, machine.String("done"), got)
+		_, calls := th.StackUsage()
+		require.Equal(t, 2, calls) // top-level and f
+	})
+}
+
+func TestErrorBuiltin(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+	}{
+		{"no error", `return error()`, machine.Nil},
+		{"direct catch", `
+let r = [null]
+fn f()
+	catch
+		r[0] = error().message
+	end
+	fail()
+end
+f()
+return r[0]
+`, machine.String("failed")},
+		{"nested call", `
+let r = [null]
+fn g()
+	return error()
+end
+fn f()
+	catch
+		r[0] = g().message
+	end
+	fail()
+end
+f()
+return r[0]
+`, machine.String("failed")},
+		{"defer", `
+let r = [null]
+fn f()
+	defer
+		r[0] = error().message
+	end
+	fail()
+end
+try f()
+return r[0]
+`, machine.String("failed")},
+		{"cleared after catch", `
+fn f()
+	do
+		catch
+		end
+		fail()
+	end
+	return error()
+end
+return f()
+`, machine.Nil},
+		{"defer without error", `
+let e = 1
+do
+	defer
+		e = error()
+	end
+end
+return e
+`, machine.Nil},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+
+	t.Run("value", func(t *testing.T) {
+		e := machine.NewError(errors.New("oops"))
+		require.Equal(t, "error", e.Type())
+		require.Equal(t, `error("oops")`, e.String())
+		require.EqualError(t, e.Err(), "oops")
+	})
+}
+
+func TestThrow(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"caught error", `
+let r = [null]
+fn f()
+	catch
+		r[0] = error()
+	end
+	fail()
+end
+f()
+return (r[0].message, r[0].position)
+`, machine.NewTuple([]machine.Value{machine.String("failed"), machine.String("test:7:6")}), ""},
+
+		{"caught in caller", `
+let r = [null]
+fn g()
+	fail()
+end
+fn f()
+	catch
+		r[0] = error()
+	end
+	g()
+end
+f()
+return (r[0].message, r[0].position)
+`, machine.NewTuple([]machine.Value{machine.String("failed"), machine.String("test:4:6")}), ""},
+
+		{"throw string", `
+let r = [null]
+fn f()
+	catch
+		r[0] = error()
+	end
+	throw "oops"
+end
+f()
+return (r[0].message, r[0].position)
+`, machine.NewTuple([]machine.Value{machine.String("oops"), machine.String("test:7:2")}), ""},
+
+		{"throw caught in caller", `
+let r = [null]
+fn g(x)
+	if x > 0 then
+		throw "positive"
+	end
+	return x
+end
+fn f()
+	catch
+		r[0] = error()
+	end
+	g(-1)
+	g(1)
+end
+f()
+return (r[0].message, r[0].position)
+`, machine.NewTuple([]machine.Value{machine.String("positive"), machine.String("test:5:3")}), ""},
+
+		{"rethrow keeps position", `
+let r = [null]
+fn g()
+	catch
+		throw
+	end
+	fail()
+end
+fn f()
+	catch
+		r[0] = error()
+	end
+	g()
+end
+f()
+return (r[0].message, r[0].position)
+`, machine.NewTuple([]machine.Value{machine.String("failed"), machine.String("test:7:6")}), ""},
+
+		{"throw error value", `
+let r = [null, null]
+fn g()
+	catch
+		r[0] = error()
+	end
+	fail()
+end
+fn f()
+	catch
+		r[1] = error()
+	end
+	throw r[0]
+end
+g()
+f()
+return r[0] == r[1]
+`, machine.True, ""},
+
+		{"uncaught throw", `throw "oops"`, nil, "oops"},
+		{"uncaught throw in function", `
+fn f()
+	defer
+		let x = 1
+	end
+	throw "oops"
+end
+f()
+return 1
+`, nil, "oops"},
+		{"throw caught by try", `
+fn f()
+	throw "oops"
+end
+return try f()
+`, machine.Nil, ""},
+		{"throw invalid value", `throw 1`, nil, "throw: want error or string, got int"},
+		{"throw nil outside catch", `throw null`, nil, "throw: no error to re-throw"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+
+	t.Run("returned error position", func(t *testing.T) {
+		_, err := runSource(t, `
+let x = 1
+throw "oops"
+`)
+		var e *machine.Error
+		require.True(t, errors.As(err, &e))
+		filename, pos := e.Position()
+		require.Equal(t, "test", filename)
+		require.Equal(t, compiler.Position{Line: 3, Col: 1}, pos)
+	})
+}
@@ -1,15 +1,18 @@
 package machine
 
 import (
+	"errors"
 	"fmt"
+	"math"
 )
 
 // Float is the type of a floating point number.
 type Float float64
 
 var (
-	_ Value   = Float(0)
-	_ Ordered = Float(0)
+	_ Value    = Float(0)
+	_ Ordered  = Float(0)
+	_ Hashable = Float(0)
 )
 
 func (f Float) String() string {
@@ -18,6 +21,20 @@ func (f Float) String() string {
 
 func (f Float) Type() string { return "float" }
 
+// Hash returns the hash of the float. If it has an exact integer
+// representation, it is the same as the hash of that Int. NaN is not
+// hashable, as it is never equal to itself.
+func (f Float) Hash() (uint32, error) {
+	if math.IsNaN(float64(f)) {
+		return 0, errors.New("unhashable: NaN")
+	}
+	if i, err := floatToInt(f); err == nil {
+		return i.Hash()
+	}
+	h := math.Float64bits(float64(f))
+	return uint32(h ^ h>>32), nil
+}
+
 // Cmp implements comparison of two Float values.
 func (f Float) Cmp(v Value) (int, error) {
 	g := v.(Float)
@@ -9,6 +9,7 @@ import (
 type Frame struct {
 	callable Callable // current function (or toplevel) or callable
 	pc       uint32   // program counter (non built-in only)
+	err      error    // error handled by the running defer or catch block, if any
 }
 
 // Position returns the filename and source position of the current point of
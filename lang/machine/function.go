@@ -30,7 +30,7 @@ type Module struct {
 func (fn *Function) String() string { return fmt.Sprintf("function(%p %s)", fn, fn.Name()) }
 func (fn *Function) Type() string   { return "function" }
 func (fn *Function) CallInternal(th *Thread, args *Tuple) (Value, error) {
-	return run(th, fn, args)
+	return run(th, fn, args, nil)
 }
 func (fn *Function) Name() string {
 	nm := fn.Funcode.Name
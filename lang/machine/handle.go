@@ -0,0 +1,71 @@
+package machine
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A Handle is an opaque reference to a resource of the host, such as a file
+// or a network connection, that can be given to a script. The script cannot
+// create or inspect a handle, it can only call the methods provided by the
+// host when the handle was created.
+//
+// A handle is bound to the thread that created it: its methods fail when
+// called from any other thread. It is not meant to be used as a map key nor
+// to be shared between threads.
+type Handle struct {
+	typ     string
+	v       any
+	th      *Thread
+	methods map[string]HandleMethod
+	names   []string
+}
+
+var (
+	_ Value    = (*Handle)(nil)
+	_ HasAttrs = (*Handle)(nil)
+)
+
+// HandleMethod is the Go implementation of a method of a Handle. It is
+// called with the handle that is the receiver of the method and the
+// arguments of the call.
+type HandleMethod func(th *Thread, h *Handle, args *Tuple) (Value, error)
+
+// NewHandle returns a handle of the specified type that wraps the Go value v
+// and is bound to thread th. The methods map the name of each method of the
+// handle to its implementation, it must not be modified afterwards.
+func NewHandle(th *Thread, typ string, v any, methods map[string]HandleMethod) *Handle {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &Handle{typ: typ, v: v, th: th, methods: methods, names: names}
+}
+
+func (h *Handle) String() string { return fmt.Sprintf("%s(%p)", h.typ, h) }
+func (h *Handle) Type() string   { return h.typ }
+
+// GoValue returns the Go value wrapped by the handle.
+func (h *Handle) GoValue() any { return h.v }
+
+// Thread returns the thread to which the handle is bound.
+func (h *Handle) Thread() *Thread { return h.th }
+
+// AttrNames returns the sorted names of the methods of the handle.
+func (h *Handle) AttrNames() []string { return h.names }
+
+// Attr returns the method of the handle bound to the handle as receiver, or
+// nil if there is no such method.
+func (h *Handle) Attr(name string) (Value, error) {
+	m := h.methods[name]
+	if m == nil {
+		return nil, nil
+	}
+	return NewBuiltin(h.typ+"."+name, func(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+		if th != h.th {
+			return nil, fmt.Errorf("%s: %s handle used by another thread", b.name, h.typ)
+		}
+		return m(th, h, args)
+	}), nil
+}
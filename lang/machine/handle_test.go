@@ -0,0 +1,78 @@
+package machine_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+// newBufferHandle returns a handle bound to th that wraps buf and exposes a
+// write method.
+func newBufferHandle(th *machine.Thread, buf *bytes.Buffer) *machine.Handle {
+	return machine.NewHandle(th, "buffer", buf, map[string]machine.HandleMethod{
+		"write": func(th *machine.Thread, h *machine.Handle, args *machine.Tuple) (machine.Value, error) {
+			var n int
+			for i := 0; i < args.Len(); i++ {
+				s, ok := machine.AsString(args.Index(i))
+				if !ok {
+					s = args.Index(i).String()
+				}
+				nn, _ := h.GoValue().(*bytes.Buffer).WriteString(s)
+				n += nn
+			}
+			return machine.Int(n), nil
+		},
+	})
+}
+
+func TestHandle(t *testing.T) {
+	t.Run("call method", func(t *testing.T) {
+		var buf bytes.Buffer
+		th := &machine.Thread{}
+		th.Predeclared = map[string]machine.Value{"buf": newBufferHandle(th, &buf)}
+
+		got, err := runSourceThread(t, th, `
+let n = buf.write("abc", 1)
+return n + buf.write("d")
+`)
+		require.NoError(t, err)
+		require.Equal(t, machine.Int(5), got)
+		require.Equal(t, "abc1d", buf.String())
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		var buf bytes.Buffer
+		th := &machine.Thread{}
+		th.Predeclared = map[string]machine.Value{"buf": newBufferHandle(th, &buf)}
+
+		_, err := runSourceThread(t, th, `buf.writ("abc")`)
+		require.EqualError(t, err, "buffer has no .writ field or method (did you mean .write?)")
+	})
+
+	t.Run("other thread", func(t *testing.T) {
+		var buf bytes.Buffer
+		th1 := &machine.Thread{Name: "owner"}
+		th2 := &machine.Thread{Name: "other"}
+		th2.Predeclared = map[string]machine.Value{"buf": newBufferHandle(th1, &buf)}
+
+		_, err := runSourceThread(t, th2, `buf.write("abc")`)
+		require.EqualError(t, err, "buffer.write: buffer handle used by another thread")
+		require.Empty(t, buf.String())
+	})
+
+	t.Run("accessors", func(t *testing.T) {
+		var buf bytes.Buffer
+		th := &machine.Thread{}
+		h := newBufferHandle(th, &buf)
+		require.Equal(t, "buffer", h.Type())
+		require.Same(t, &buf, h.GoValue())
+		require.Same(t, th, h.Thread())
+		require.Equal(t, []string{"write"}, h.AttrNames())
+
+		v, err := h.Attr("nope")
+		require.NoError(t, err)
+		require.Nil(t, v)
+	})
+}
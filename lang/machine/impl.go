@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"strings"
+	"unsafe"
 
+	"github.com/mna/nenuphar/internal/spell"
 	"github.com/mna/nenuphar/lang/token"
 )
 
@@ -15,6 +18,18 @@ import (
 
 // Call calls the function or Callable value v with the specified arguments.
 func Call(th *Thread, v Value, args *Tuple) (Value, error) {
+	return call(th, v, args, nil)
+}
+
+// namedArg is a named argument of a call.
+type namedArg struct {
+	name  string
+	value Value
+}
+
+// call is like Call but also accepts named arguments, which are only
+// supported by compiled functions.
+func call(th *Thread, v Value, args *Tuple, named []namedArg) (Value, error) {
 	if args == nil {
 		args = NilaryTuple
 	}
@@ -24,17 +39,28 @@ func Call(th *Thread, v Value, args *Tuple) (Value, error) {
 	case Callable:
 		cb = v
 	case HasMetamap:
-		if meta := v.Metamap(); meta != nil {
-			//res, err := CallMetamethod(meta, op, v, args) // TODO: translate op to metamethod name
-			//if res != nil || err != nil {
-			//	return res, err
-			//}
+		// the __call metamethod receives the called value as implicit first
+		// argument.
+		fn := lookupMetamethod("__call", v)
+		if fn == nil {
+			return nil, fmt.Errorf("invalid call of non-callable (%s)", v.Type())
 		}
-		return nil, fmt.Errorf("invalid call of non-callable (%s)", v.Type())
+		if cb, _ = fn.(Callable); cb == nil {
+			return nil, fmt.Errorf("invalid __call metamethod of %s: non-callable (%s)", v.Type(), fn.Type())
+		}
+		vals := make([]Value, 0, args.Len()+1)
+		vals = append(vals, v)
+		vals = append(vals, args.elems...)
+		args = NewTuple(vals)
 	default:
 		return nil, fmt.Errorf("invalid call of non-callable (%s)", v.Type())
 	}
 
+	fn, _ := cb.(*Function)
+	if len(named) > 0 && fn == nil {
+		return nil, fmt.Errorf("%s does not accept named arguments", cb.Name())
+	}
+
 	// Allocate and push a new frame. As an optimization, use slack portion of
 	// thread.callStack slice as a freelist of empty frames.
 	var fr *Frame
@@ -48,7 +74,14 @@ func Call(th *Thread, v Value, args *Tuple) (Value, error) {
 	if th.callStack == nil {
 		th.init()
 	}
+	if th.MaxCallStackDepth > 0 && len(th.callStack) >= th.MaxCallStackDepth {
+		th.ctxCancel(nil)
+		return nil, &CriticalError{Err: fmt.Errorf("call stack depth exceeded: max %d", th.MaxCallStackDepth)}
+	}
 	th.callStack = append(th.callStack, fr) // push
+	if th.RecordStackUsage && len(th.callStack) > th.peakCalls {
+		th.peakCalls = len(th.callStack)
+	}
 
 	// Use defer to ensure that panics from built-ins pass through the
 	// interpreter without leaving it in a bad state.
@@ -59,7 +92,13 @@ func Call(th *Thread, v Value, args *Tuple) (Value, error) {
 	}()
 
 	fr.callable = cb
-	result, err := cb.CallInternal(th, args)
+	var result Value
+	var err error
+	if fn != nil {
+		result, err = run(th, fn, args, named)
+	} else {
+		result, err = cb.CallInternal(th, args)
+	}
 
 	// Sanity check: nil is not a valid value.
 	if result == nil && err == nil {
@@ -74,8 +113,8 @@ func Call(th *Thread, v Value, args *Tuple) (Value, error) {
 // that do not support it.
 //
 // Equality first compares the type of its operands. For values of same type,
-// the values of the operands are compared. Strings are equal if they have the
-// same byte content. Numbers are equal if they denote the same mathematical
+// the values of the operands are compared. Strings (and bytes) are equal if
+// they have the same byte content. Numbers are equal if they denote the same mathematical
 // value, NaN values are greater than any other. Other values of the same type
 // are compared by identity.
 //
@@ -87,8 +126,12 @@ func Call(th *Thread, v Value, args *Tuple) (Value, error) {
 // metamethods for comparison.
 //
 // Metamethods can be used to customize comparison for a value that supports
-// it. The != operator is the negation of equality and cannot be customized.
-func Compare(op token.Token, x, y Value) (bool, error) {
+// it. The __eq metamethod is only called for operands of the same type that
+// are neither Ordered nor HasEqual. The __lt and __le metamethods are called
+// for the ordered operators, with > and >= translated to < and <= with
+// swapped operands. If __le is not defined, a <= b is evaluated as not (b <
+// a). The != operator is the negation of equality and cannot be customized.
+func Compare(th *Thread, op token.Token, x, y Value) (bool, error) {
 	if sameType(x, y) {
 		if xcomp, ok := x.(Ordered); ok {
 			t, err := xcomp.Cmp(y)
@@ -100,7 +143,7 @@ func Compare(op token.Token, x, y Value) (bool, error) {
 
 		if op == token.EQEQ || op == token.BANGEQ {
 			if xeq, ok := x.(HasEqual); ok {
-				eq, err := xeq.Equals(y)
+				eq, err := xeq.Equals(th, y)
 				if err != nil {
 					return false, err
 				}
@@ -111,23 +154,8 @@ func Compare(op token.Token, x, y Value) (bool, error) {
 			}
 		}
 
-		if x, ok := x.(HasMetamap); ok {
-			if meta := x.Metamap(); meta != nil {
-				// TODO: translate >= to <=, > to < with operands swapped, or just use a __cmp metamethod?
-				//res, err := CallMetamethod(meta, op, x, y, Left) // TODO: translate op to metamethod name
-				//if res != nil || err != nil {
-				//	return res, err
-				//}
-			}
-		}
-		if y, ok := y.(HasMetamap); ok {
-			if meta := y.Metamap(); meta != nil {
-				// TODO: translate >= to <=, > to < with operands swapped, or just use a __cmp metamethod?
-				//res, err := CallMetamethod(meta, op, x, y, Right) // TODO: translate op to metamethod name
-				//if res != nil || err != nil {
-				//	return res, err
-				//}
-			}
+		if res, ok, err := compareMetamethod(th, op, x, y); ok || err != nil {
+			return res, err
 		}
 
 		// use identity comparison
@@ -137,7 +165,7 @@ func Compare(op token.Token, x, y Value) (bool, error) {
 		case token.BANGEQ:
 			return x != y, nil
 		}
-		return false, fmt.Errorf("%s %s %s not implemented", x.Type(), op, y.Type())
+		return false, unsupportedOpError(op, compareMetamethods[op], x, y)
 	}
 
 	// different types
@@ -187,22 +215,10 @@ func Compare(op token.Token, x, y Value) (bool, error) {
 		}
 	}
 
-	if x, ok := x.(HasMetamap); ok {
-		if meta := x.Metamap(); meta != nil {
-			// TODO: translate >= to <=, > to < with operands swapped, or just use a __cmp metamethod?
-			//res, err := CallMetamethod(meta, op, x, y, Left) // TODO: translate op to metamethod name
-			//if res != nil || err != nil {
-			//	return res, err
-			//}
-		}
-	}
-	if y, ok := y.(HasMetamap); ok {
-		if meta := y.Metamap(); meta != nil {
-			// TODO: translate >= to <=, > to < with operands swapped, or just use a __cmp metamethod?
-			//res, err := CallMetamethod(meta, op, x, y, Right) // TODO: translate op to metamethod name
-			//if res != nil || err != nil {
-			//	return res, err
-			//}
+	if op != token.EQEQ && op != token.BANGEQ {
+		// equality metamethods are only called for values of the same type
+		if res, ok, err := compareMetamethod(th, op, x, y); ok || err != nil {
+			return res, err
 		}
 	}
 
@@ -213,7 +229,101 @@ func Compare(op token.Token, x, y Value) (bool, error) {
 	case token.BANGEQ:
 		return true, nil
 	}
-	return false, fmt.Errorf("%s %s %s not implemented", x.Type(), op, y.Type())
+	return false, unsupportedOpError(op, compareMetamethods[op], x, y)
+}
+
+// compareMetamethods lists the metamethods that can implement the ordered
+// comparison operators.
+var compareMetamethods = map[token.Token][]string{
+	token.LT: {"__lt"},
+	token.GT: {"__lt"},
+	token.LE: {"__le", "__lt"},
+	token.GE: {"__le", "__lt"},
+}
+
+// compareMetamethod attempts to compare x and y using a comparison metamethod
+// of x, or of y if x does not define it. It returns ok == false if no
+// suitable metamethod exists.
+func compareMetamethod(th *Thread, op token.Token, x, y Value) (res, ok bool, err error) {
+	switch op {
+	case token.EQEQ, token.BANGEQ:
+		res, ok, err = callCompareMetamethod(th, "__eq", x, y)
+		if op == token.BANGEQ {
+			res = !res
+		}
+		return res, ok, err
+
+	case token.LT:
+		return callCompareMetamethod(th, "__lt", x, y)
+	case token.GT:
+		return callCompareMetamethod(th, "__lt", y, x)
+
+	case token.LE, token.GE:
+		if op == token.GE {
+			x, y = y, x
+		}
+		if res, ok, err = callCompareMetamethod(th, "__le", x, y); ok || err != nil {
+			return res, ok, err
+		}
+		res, ok, err = callCompareMetamethod(th, "__lt", y, x)
+		return !res, ok, err
+	}
+	return false, false, nil
+}
+
+func callCompareMetamethod(th *Thread, name string, x, y Value) (bool, bool, error) {
+	fn := lookupMetamethod(name, x, y)
+	if fn == nil {
+		return false, false, nil
+	}
+	res, err := Call(th, fn, NewTuple([]Value{x, y}))
+	if err != nil {
+		return false, true, err
+	}
+	return bool(Truth(res)), true, nil
+}
+
+// lookupMetamethod returns the metamethod name of the first value in vals
+// that defines it, or nil if none does.
+func lookupMetamethod(name string, vals ...Value) Value {
+	for _, v := range vals {
+		mv, ok := v.(HasMetamap)
+		if !ok {
+			continue
+		}
+		meta := mv.Metamap()
+		if meta == nil {
+			continue
+		}
+		if fn, ok, _ := meta.Get(String(name)); ok && fn != Nil {
+			return fn
+		}
+	}
+	return nil
+}
+
+// unsupportedOpError returns the error for an operator op that is not
+// supported by its operands (one for a unary operator, two for a binary one).
+// The message includes the operator's symbol and the type of the operands, and
+// if any operand has a metamap, the names of the metamethods that could
+// implement the operator.
+func unsupportedOpError(op token.Token, metamethods []string, operands ...Value) error {
+	var sb strings.Builder
+	if len(operands) == 1 {
+		fmt.Fprintf(&sb, "unsupported unary op: %s %s", op, operands[0].Type())
+	} else {
+		fmt.Fprintf(&sb, "unsupported binary op: %s %s %s", operands[0].Type(), op, operands[1].Type())
+	}
+
+	if len(metamethods) > 0 {
+		for _, v := range operands {
+			if mv, ok := v.(HasMetamap); ok && mv.Metamap() != nil {
+				fmt.Fprintf(&sb, " (no %s metamethod defined)", strings.Join(metamethods, " or "))
+				break
+			}
+		}
+	}
+	return errors.New(sb.String())
 }
 
 func sameType(x, y Value) bool {
@@ -254,10 +364,15 @@ func Truth(v Value) Bool {
 }
 
 // setIndex implements x[y] = z.
-func setIndex(x, y, z Value) error {
+func setIndex(th *Thread, x, y, z Value) error {
 	// TODO: add support for metamap, see how Lua does it.
 	switch x := x.(type) {
 	case HasSetKey:
+		if m, ok := x.(*Map); ok {
+			if err := th.checkMapKey(m, y); err != nil {
+				return err
+			}
+		}
 		if err := x.SetKey(y, z); err != nil {
 			return err
 		}
@@ -283,8 +398,9 @@ func setIndex(x, y, z Value) error {
 	return nil
 }
 
-// getIndex implements x[y].
-func getIndex(x, y Value) (Value, error) {
+// getIndex implements x[y]. A Mapping that does not contain y evaluates to
+// nil, unless th.StrictIndex is set.
+func getIndex(th *Thread, x, y Value) (Value, error) {
 	fail := true
 
 	switch x := x.(type) {
@@ -325,17 +441,20 @@ func getIndex(x, y Value) (Value, error) {
 		}
 	}
 	if !fail {
+		if th.StrictIndex {
+			return nil, fmt.Errorf("key not found in %s: %s", x.Type(), y)
+		}
 		return Nil, nil
 	}
 	return nil, fmt.Errorf("unsupported index operation %s[%s]", x.Type(), y.Type())
 }
 
 // getAttr implements x.dot.
-func getAttr(x Value, name string) (Value, error) {
+func getAttr(th *Thread, x Value, name string) (Value, error) {
 	hasAttr, ok := x.(HasAttrs)
 	if !ok {
 		// fallback to getIndex, which will use metamap if available.
-		return getIndex(x, String(name))
+		return getIndex(th, x, String(name))
 	}
 
 	var errmsg string
@@ -352,29 +471,27 @@ func getAttr(x Value, name string) (Value, error) {
 		return nil, err // return error as is
 	}
 
-	//// TODO: add spelling hint
-	//if n := spell.Nearest(name, hasAttr.AttrNames()); n != "" {
-	//	errmsg = fmt.Sprintf("%s (did you mean .%s?)", errmsg, n)
-	//}
+	if n := spell.Nearest(name, hasAttr.AttrNames()); n != "" {
+		errmsg = fmt.Sprintf("%s (did you mean .%s?)", errmsg, n)
+	}
 
 	return nil, errors.New(errmsg)
 }
 
 // setField implements x.name = y.
-func setField(x Value, name string, y Value) error {
+func setField(th *Thread, x Value, name string, y Value) error {
 	if x, ok := x.(HasSetField); ok {
 		err := x.SetField(name, y)
 		if _, ok := err.(NoSuchAttrError); ok {
-			//// TODO: No such field: check spelling.
-			//if n := spell.Nearest(name, x.AttrNames()); n != "" {
-			//	err = fmt.Errorf("%s (did you mean .%s?)", err, n)
-			//}
+			if n := spell.Nearest(name, x.AttrNames()); n != "" {
+				err = fmt.Errorf("%s (did you mean .%s?)", err, n)
+			}
 		}
 		return err
 	}
 
 	// fallback to setIndex
-	return setIndex(x, String(name), y)
+	return setIndex(th, x, String(name), y)
 }
 
 // AsExactInt enforces the type conversion rules for a value to an integer.
@@ -411,12 +528,25 @@ func AsString(v Value) (string, bool) {
 }
 
 // Binary applies a strict binary operator (not AND or OR) to its operands. For
-// equality tests or ordered comparisons, use Compare instead.
-func Binary(op token.Token, l, r Value) (Value, error) {
+// equality tests or ordered comparisons, use Compare instead. If the operands
+// do not support the operator natively, the corresponding metamethod of the
+// left operand, or of the right one if the left does not define it, is called
+// (see binaryMetamethods).
+//
+// For arithmetic and bitwise operators on numbers, the type of the result
+// depends on the operator and the types of the operands:
+//   - +, -, *, // and % produce an int if both operands are ints, otherwise
+//     the int operand is converted to float and the result is a float.
+//   - / and ^ always produce a float, even if both operands are ints.
+//   - &, |, ~, << and >> always produce an int, a float operand is converted
+//     to int and the operation fails if it has no exact integer
+//     representation.
+func Binary(th *Thread, op token.Token, l, r Value) (Value, error) {
 	// first try to perform the binary operations supported as built-ins.
 	switch op {
 	case token.PLUS:
-		// + concatenation: only works on strings, no implicit conversion
+		// + concatenation: only works on strings or on bytes, no implicit
+		// conversion
 		//
 		// + arithmetic addition: if both operands are integers, the operation is
 		// performed over integers and the result is an integer. Otherwise, if both
@@ -428,6 +558,10 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 			if r, ok := r.(String); ok {
 				return l + r, nil
 			}
+		case Bytes:
+			if r, ok := r.(Bytes); ok {
+				return l + r, nil
+			}
 		case Int:
 			switch r := r.(type) {
 			case Int:
@@ -477,6 +611,11 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 		// Otherwise, if both operands are numbers, then they are converted to
 		// floats, the operation is performed following Go's rules for
 		// floating-point arithmetic (IEEE 754), and the result is a float.
+		//
+		// * repetition: if one operand is a string, bytes or an array and the
+		// other is an integer, the result is a new value of the same type as the
+		// first operand, with its content repeated that many times. The count
+		// must not be negative.
 		switch l := l.(type) {
 		case Int:
 			switch r := r.(type) {
@@ -485,6 +624,8 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 			case Float:
 				lf := Float(l)
 				return lf * r, nil
+			case String, Bytes, *Array:
+				return repeat(th, r, l)
 			}
 		case Float:
 			switch r := r.(type) {
@@ -494,6 +635,10 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 				rf := Float(r)
 				return l * rf, nil
 			}
+		case String, Bytes, *Array:
+			if r, ok := r.(Int); ok {
+				return repeat(th, l, r)
+			}
 		}
 
 	case token.SLASH:
@@ -569,7 +714,7 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 			}
 		}
 
-	case token.PERCENT: // TODO: test and compare with Lua/Python for correctness
+	case token.PERCENT:
 		// % modulo division: returns the remainder of a division that rounds the
 		// quotient towards minus infinity (floor division). If both operands are
 		// integers, the operation is performed over integers and the result is an
@@ -704,6 +849,12 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 				}
 				return li | ri, nil
 			}
+		case *Set:
+			// the union of sets is handled here rather than by Set.Binary so that
+			// the thread's MaxCollectionSize is enforced.
+			if r, ok := r.(*Set); ok {
+				return l.union(th, r)
+			}
 		}
 
 	case token.TILDE:
@@ -755,7 +906,7 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 			switch r := r.(type) {
 			case Int:
 				if r < 0 {
-					return Int(uint(l) >> -r), nil
+					return Int(uint64(l) >> -r), nil
 				}
 				return l << r, nil
 			case Float:
@@ -764,7 +915,7 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 					return nil, err
 				}
 				if ri < 0 {
-					return Int(uint(l) >> -ri), nil
+					return Int(uint64(l) >> -ri), nil
 				}
 				return l << ri, nil
 			}
@@ -776,7 +927,7 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 					return nil, err
 				}
 				if r < 0 {
-					return Int(uint(li) >> -r), nil
+					return Int(uint64(li) >> -r), nil
 				}
 				return li << r, nil
 			case Float:
@@ -789,7 +940,7 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 					return nil, err
 				}
 				if ri < 0 {
-					return Int(uint(li) >> -ri), nil
+					return Int(uint64(li) >> -ri), nil
 				}
 				return li << ri, nil
 			}
@@ -808,7 +959,7 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 				if r < 0 {
 					return l << -r, nil
 				}
-				return Int(uint(l) >> r), nil
+				return Int(uint64(l) >> r), nil
 			case Float:
 				ri, err := floatToInt(r)
 				if err != nil {
@@ -817,7 +968,7 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 				if ri < 0 {
 					return l << -ri, nil
 				}
-				return Int(uint(l) >> ri), nil
+				return Int(uint64(l) >> ri), nil
 			}
 		case Float:
 			switch r := r.(type) {
@@ -829,7 +980,7 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 				if r < 0 {
 					return li << -r, nil
 				}
-				return Int(uint(li) >> r), nil
+				return Int(uint64(li) >> r), nil
 			case Float:
 				li, err := floatToInt(l)
 				if err != nil {
@@ -842,7 +993,7 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 				if ri < 0 {
 					return li << -ri, nil
 				}
-				return Int(uint(li) >> ri), nil
+				return Int(uint64(li) >> ri), nil
 			}
 		}
 
@@ -866,27 +1017,66 @@ func Binary(op token.Token, l, r Value) (Value, error) {
 		}
 	}
 
-	// user-defined types with metatable support
-	// (nil, nil) => no metamethod found
-	if l, ok := l.(HasMetamap); ok {
-		if meta := l.Metamap(); meta != nil {
-			//res, err := CallMetamethod(meta, op, l, r, Left) // TODO: translate op to metamethod name
-			//if res != nil || err != nil {
-			//	return res, err
-			//}
-		}
-	}
-	if r, ok := r.(HasMetamap); ok {
-		if meta := r.Metamap(); meta != nil {
-			//res, err := CallMetamethod(meta, op, l, r, Right) // TODO: translate op to metamethod name
-			//if res != nil || err != nil {
-			//	return res, err
-			//}
+	// user-defined types with metamap support
+	if name := binaryMetamethods[op]; name != "" {
+		if fn := lookupMetamethod(name, l, r); fn != nil {
+			return Call(th, fn, NewTuple([]Value{l, r}))
 		}
 	}
 
 unknown:
-	return nil, fmt.Errorf("unsupported binary op: %s %s %s", l.Type(), op, r.Type())
+	var names []string
+	if name := binaryMetamethods[op]; name != "" {
+		names = []string{name}
+	}
+	return nil, unsupportedOpError(op, names, l, r)
+}
+
+// maxAlloc is the maximum number of bytes that can be allocated by an
+// operation that creates a value of arbitrary size, such as the repetition
+// of a string or an array.
+const maxAlloc = 1 << 30
+
+// maxPrealloc is the maximum number of values preallocated based on a length
+// hint, such as the length of a Sequence that is then iterated.
+const maxPrealloc = maxAlloc / int(unsafe.Sizeof(Value(nil)))
+
+// repeat returns the String, Bytes or *Array x repeated n times. The
+// resulting array must not exceed the thread's MaxCollectionSize.
+func repeat(th *Thread, x Value, n Int) (Value, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("%s repetition: negative count %d", x.Type(), n)
+	}
+
+	var size, elemSize int // number of elements of x and size of each in bytes
+	switch x := x.(type) {
+	case String:
+		size, elemSize = len(x), 1
+	case Bytes:
+		size, elemSize = len(x), 1
+	case *Array:
+		size, elemSize = x.Len(), int(unsafe.Sizeof(Value(nil)))
+	}
+	if size > 0 && int64(n) > maxAlloc/int64(size*elemSize) {
+		return nil, fmt.Errorf("%s repetition: excessive size (%d * %d)", x.Type(), size, n)
+	}
+
+	switch x := x.(type) {
+	case String:
+		return String(strings.Repeat(string(x), int(n))), nil
+	case Bytes:
+		return Bytes(strings.Repeat(string(x), int(n))), nil
+	default:
+		a := x.(*Array)
+		if err := th.checkCollectionSize(a.Type(), size*int(n)); err != nil {
+			return nil, fmt.Errorf("%s repetition: %w", a.Type(), err)
+		}
+		elems := make([]Value, 0, size*int(n))
+		for i := 0; i < int(n); i++ {
+			elems = append(elems, a.elems...)
+		}
+		return NewArray(elems), nil
+	}
 }
 
 func floorDiv(l, r Int) Int {
@@ -904,17 +1094,21 @@ func modInt(l, r Int) Int {
 	return (l%r + r) % r
 }
 
+// modFloat returns the floored modulo of l and r, which has the sign of r
+// (math.Mod returns a result with the sign of l).
 func modFloat(l, r Float) Float {
 	v := Float(math.Mod(float64(l), float64(r)))
-	if v < 0 {
+	if v != 0 && (v < 0) != (r < 0) {
 		v += r
 	}
 	return v
 }
 
 // Unary applies a unary operator (only +, -, ~, # and "not" as the others -
-// "try" and "must" - are compiled to catch statements) to its operand.
-func Unary(op token.Token, x Value) (Value, error) {
+// "try" and "must" - are compiled to catch statements) to its operand. If the
+// operand does not support the operator natively, the corresponding
+// metamethod is called if it is defined (see unaryMetamethods).
+func Unary(th *Thread, op token.Token, x Value) (Value, error) {
 	// The NOT operator is not customizable.
 	if op == token.NOT {
 		return !Truth(x), nil
@@ -941,26 +1135,28 @@ func Unary(op token.Token, x Value) (Value, error) {
 		}
 
 	case token.TILDE:
-		// ~ unary bitwise NOT: converts the operand to int and switches all bits,
-		// as if the integer was unsigned. The result is an integer. The operation
+		// ~ unary bitwise NOT: converts the operand to int and switches all 64
+		// bits, as if the integer was unsigned. The result is an integer. The operation
 		// fails if the float is not representable as an integer.
 		switch x := x.(type) {
 		case Int:
-			return Int(^uint(x)), nil
+			return Int(^uint64(x)), nil
 		case Float:
 			xi, err := floatToInt(x)
 			if err != nil {
 				return nil, err
 			}
-			return Int(^uint(xi)), nil
+			return Int(^uint64(xi)), nil
 		}
 
 	case token.POUND:
-		// # len operator: the length of a string is its number of bytes, as an
-		// integer.
+		// # len operator: the length of a string or bytes is its number of
+		// bytes, as an integer.
 		switch x := x.(type) {
 		case String:
 			return Int(len(x)), nil
+		case Bytes:
+			return Int(len(x)), nil
 		}
 
 	default:
@@ -977,19 +1173,58 @@ func Unary(op token.Token, x Value) (Value, error) {
 		}
 	}
 
-	// user-defined types with metatable support
-	// (nil, nil) => no metamethod found
-	if x, ok := x.(HasMetamap); ok {
-		if meta := x.Metamap(); meta != nil {
-			//res, err := CallMetamethod(meta, op, x) // TODO: translate op to metamethod name
-			//if res != nil || err != nil {
-			//	return res, err
-			//}
+	// user-defined types with metamap support
+	if name := unaryMetamethods[op]; name != "" {
+		if fn := lookupMetamethod(name, x); fn != nil {
+			return Call(th, fn, NewTuple([]Value{x}))
 		}
 	}
 
 unknown:
-	return nil, fmt.Errorf("unsupported unary op: %s %s", op, x.Type())
+	var names []string
+	if name := unaryMetamethods[op]; name != "" {
+		names = []string{name}
+	}
+	return nil, unsupportedOpError(op, names, x)
+}
+
+// binaryMetamethods maps the binary operators that can be customized to the
+// name of their metamethod. The metamethod is called with the left and right
+// operands as arguments and its return value is the result of the operation.
+var binaryMetamethods = map[token.Token]string{
+	token.PLUS:       "__add",
+	token.MINUS:      "__sub",
+	token.STAR:       "__mul",
+	token.SLASH:      "__div",
+	token.SLASHSLASH: "__idiv",
+	token.PERCENT:    "__mod",
+	token.CIRCUMFLEX: "__pow",
+	token.AMPERSAND:  "__band",
+	token.PIPE:       "__bor",
+	token.TILDE:      "__bxor",
+	token.LTLT:       "__shl",
+	token.GTGT:       "__shr",
+}
+
+// unaryMetamethods maps the unary operators that can be customized to the
+// name of their metamethod. The metamethod is called with the operand as
+// single argument and its return value is the result of the operation.
+var unaryMetamethods = map[token.Token]string{
+	token.POUND: "__len",
+}
+
+// Freeze freezes x if it is Freezable, otherwise it does nothing (e.g. for
+// values that are always immutable, such as numbers and strings).
+func Freeze(x Value) {
+	if x, ok := x.(Freezable); ok {
+		x.Freeze()
+	}
+}
+
+// frozenError returns the error reported when trying to modify the frozen
+// value x.
+func frozenError(x Value) error {
+	return fmt.Errorf("cannot modify frozen %s", x.Type())
 }
 
 func Iterate(x Value) Iterator {
@@ -1001,3 +1236,66 @@ func Iterate(x Value) Iterator {
 	// interface.
 	return nil
 }
+
+// iterErr returns the error that stopped the iteration of iter, if it is an
+// ErrIterator. It must be called after Next returned false.
+func iterErr(iter Iterator) error {
+	if ei, ok := iter.(ErrIterator); ok {
+		return ei.Err()
+	}
+	return nil
+}
+
+// Contains implements the "k in x" membership test. For a Mapping, it
+// reports whether x has an entry for k, regardless of the truthiness of its
+// value. This is the found component of x.Get, the same lookup as used to
+// evaluate x[k]. For a String, k must be a string and it reports whether k is
+// a substring of x. For a Set, it reports whether k is one of its values,
+// compared the same way as the keys of a Map. For an Indexable or a Sequence,
+// it reports whether an element of x is equal to k (see Compare).
+func Contains(th *Thread, x, k Value) (bool, error) {
+	switch x := x.(type) {
+	case Mapping:
+		_, found, err := x.Get(k)
+		if err != nil {
+			return false, err
+		}
+		return found, nil
+
+	case *Set:
+		return x.Has(k)
+
+	case String:
+		if ks, ok := k.(String); ok {
+			return strings.Contains(string(x), string(ks)), nil
+		}
+
+	case Indexable:
+		for i, n := 0, x.Len(); i < n; i++ {
+			eq, err := Compare(th, token.EQEQ, x.Index(i), k)
+			if err != nil {
+				return false, err
+			}
+			if eq {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case Sequence:
+		iter := x.Iterate()
+		defer iter.Done()
+		var elem Value
+		for iter.Next(&elem) {
+			eq, err := Compare(th, token.EQEQ, elem, k)
+			if err != nil {
+				return false, err
+			}
+			if eq {
+				return true, nil
+			}
+		}
+		return false, iterErr(iter)
+	}
+	return false, fmt.Errorf("unsupported in operation: %s in %s", k.Type(), x.Type())
+}
@@ -0,0 +1,661 @@
+package machine_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/compiler"
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFunc is a Callable implemented by a Go function, for tests.
+type testFunc struct {
+	name string
+	fn   func(th *machine.Thread, args *machine.Tuple) (machine.Value, error)
+}
+
+func (f *testFunc) String() string { return f.name }
+func (f *testFunc) Type() string   { return "function" }
+func (f *testFunc) Name() string   { return f.name }
+func (f *testFunc) CallInternal(th *machine.Thread, args *machine.Tuple) (machine.Value, error) {
+	return f.fn(th, args)
+}
+
+// vector is a test type that only supports customization via its metamap.
+type vector struct {
+	x, y int
+	meta *machine.Map
+}
+
+func (v *vector) String() string            { return fmt.Sprintf("vector(%d, %d)", v.x, v.y) }
+func (v *vector) Type() string              { return "vector" }
+func (v *vector) Metamap() *machine.Map     { return v.meta }
+func (v *vector) SetMetamap(m *machine.Map) { v.meta = m }
+
+func (v *vector) lenSquared() int { return v.x*v.x + v.y*v.y }
+
+func TestCompareMetamethods(t *testing.T) {
+	var calls int
+	meta := machine.NewMap(1)
+	require.NoError(t, meta.SetKey(machine.String("__lt"), &testFunc{
+		name: "__lt",
+		fn: func(th *machine.Thread, args *machine.Tuple) (machine.Value, error) {
+			calls++
+			l, r := args.Index(0).(*vector), args.Index(1).(*vector)
+			return machine.Bool(l.lenSquared() < r.lenSquared()), nil
+		},
+	}))
+
+	small := &vector{x: 1, y: 1, meta: meta}
+	big := &vector{x: 2, y: 3, meta: meta}
+	same := &vector{x: 1, y: 1, meta: meta}
+
+	cases := []struct {
+		x    *vector
+		op   token.Token
+		y    *vector
+		want bool
+	}{
+		{small, token.LT, big, true},
+		{big, token.LT, small, false},
+		{small, token.LT, same, false},
+		{small, token.GT, big, false},
+		{big, token.GT, small, true},
+		{small, token.GT, same, false},
+		{small, token.LE, big, true},
+		{big, token.LE, small, false},
+		{small, token.LE, same, true},
+		{small, token.GE, big, false},
+		{big, token.GE, small, true},
+		{small, token.GE, same, true},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s %s %s", c.x, c.op, c.y), func(t *testing.T) {
+			var th machine.Thread
+			calls = 0
+			got, err := machine.Compare(&th, c.op, c.x, c.y)
+			require.NoError(t, err)
+			assert.Equal(t, c.want, got)
+			assert.Equal(t, 1, calls)
+		})
+	}
+
+	t.Run("equality uses identity", func(t *testing.T) {
+		var th machine.Thread
+		calls = 0
+		eq, err := machine.Compare(&th, token.EQEQ, small, same)
+		require.NoError(t, err)
+		assert.False(t, eq)
+		neq, err := machine.Compare(&th, token.BANGEQ, small, same)
+		require.NoError(t, err)
+		assert.True(t, neq)
+		assert.Equal(t, 0, calls)
+	})
+
+	t.Run("__eq", func(t *testing.T) {
+		var th machine.Thread
+		eqMeta := machine.NewMap(1)
+		require.NoError(t, eqMeta.SetKey(machine.String("__eq"), &testFunc{
+			name: "__eq",
+			fn: func(th *machine.Thread, args *machine.Tuple) (machine.Value, error) {
+				l, r := args.Index(0).(*vector), args.Index(1).(*vector)
+				return machine.Bool(l.x == r.x && l.y == r.y), nil
+			},
+		}))
+		a := &vector{x: 1, y: 2, meta: eqMeta}
+		b := &vector{x: 1, y: 2, meta: eqMeta}
+		c := &vector{x: 2, y: 1, meta: eqMeta}
+
+		eq, err := machine.Compare(&th, token.EQEQ, a, b)
+		require.NoError(t, err)
+		assert.True(t, eq)
+		neq, err := machine.Compare(&th, token.BANGEQ, a, b)
+		require.NoError(t, err)
+		assert.False(t, neq)
+		neq, err = machine.Compare(&th, token.BANGEQ, a, c)
+		require.NoError(t, err)
+		assert.True(t, neq)
+
+		// no ordered metamethod defined
+		_, err = machine.Compare(&th, token.LT, a, b)
+		require.Error(t, err)
+	})
+}
+
+func TestCallMetamethod(t *testing.T) {
+	tbl := machine.NewMap(0)
+	meta := machine.NewMap(1)
+	require.NoError(t, meta.SetKey(machine.String("__call"), &testFunc{
+		name: "__call",
+		fn: func(th *machine.Thread, args *machine.Tuple) (machine.Value, error) {
+			if args.Len() != 3 || args.Index(0) != tbl {
+				return nil, fmt.Errorf("unexpected arguments")
+			}
+			return machine.Binary(th, token.PLUS, args.Index(1), args.Index(2))
+		},
+	}))
+
+	t.Run("no metamap", func(t *testing.T) {
+		var th machine.Thread
+		_, err := machine.Call(&th, tbl, machine.NewTuple([]machine.Value{machine.Int(1), machine.Int(2)}))
+		require.ErrorContains(t, err, "invalid call of non-callable (map)")
+	})
+
+	t.Run("with __call", func(t *testing.T) {
+		var th machine.Thread
+		tbl.SetMetamap(meta)
+		defer tbl.SetMetamap(nil)
+
+		res, err := machine.Call(&th, tbl, machine.NewTuple([]machine.Value{machine.Int(1), machine.Int(2)}))
+		require.NoError(t, err)
+		assert.Equal(t, machine.Int(3), res)
+	})
+
+	t.Run("non-callable __call", func(t *testing.T) {
+		var th machine.Thread
+		badMeta := machine.NewMap(1)
+		require.NoError(t, badMeta.SetKey(machine.String("__call"), machine.Int(1)))
+		tbl.SetMetamap(badMeta)
+		defer tbl.SetMetamap(nil)
+
+		_, err := machine.Call(&th, tbl, nil)
+		require.ErrorContains(t, err, "invalid __call metamethod of map: non-callable (int)")
+	})
+}
+
+func TestLenMetamethod(t *testing.T) {
+	meta := machine.NewMap(1)
+	require.NoError(t, meta.SetKey(machine.String("__len"), &testFunc{
+		name: "__len",
+		fn: func(th *machine.Thread, args *machine.Tuple) (machine.Value, error) {
+			switch v := args.Index(0).(type) {
+			case *vector:
+				return machine.Int(v.lenSquared()), nil
+			case *machine.Map:
+				n, _, _ := v.Get(machine.String("n"))
+				return n, nil
+			}
+			return nil, fmt.Errorf("unexpected argument %s", args.Index(0).Type())
+		},
+	}))
+
+	// a map instance that stores its length in a field
+	inst := machine.NewMap(1)
+	require.NoError(t, inst.SetKey(machine.String("n"), machine.Int(42)))
+	inst.SetMetamap(meta)
+
+	errMeta := machine.NewMap(1)
+	require.NoError(t, errMeta.SetKey(machine.String("__len"), &testFunc{
+		name: "__len",
+		fn: func(th *machine.Thread, args *machine.Tuple) (machine.Value, error) {
+			return nil, fmt.Errorf("no length")
+		},
+	}))
+
+	cases := []struct {
+		desc string
+		x    machine.Value
+		want machine.Value
+		err  string
+	}{
+		{"string", machine.String("abc"), machine.Int(3), ""},
+		{"vector with __len", &vector{x: 2, y: 3, meta: meta}, machine.Int(13), ""},
+		{"map with __len", inst, machine.Int(42), ""},
+		{"vector without metamap", &vector{x: 2, y: 3}, nil, "unsupported unary op: # vector"},
+		{"vector without __len", &vector{x: 2, y: 3, meta: machine.NewMap(0)}, nil, "unsupported unary op: # vector (no __len metamethod defined)"},
+		{"map without metamap", machine.NewMap(0), nil, "unsupported unary op: # map"},
+		{"failing __len", &vector{meta: errMeta}, nil, "no length"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			var th machine.Thread
+			got, err := machine.Unary(&th, token.POUND, c.x)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.want, got)
+		})
+	}
+
+	t.Run("no metamethod for other operators", func(t *testing.T) {
+		var th machine.Thread
+		_, err := machine.Unary(&th, token.MINUS, &vector{x: 2, y: 3, meta: meta})
+		require.ErrorContains(t, err, "unsupported unary op: - vector")
+	})
+
+	t.Run("machine", func(t *testing.T) {
+		p := &compiler.Program{
+			Filename: "test.nen",
+			Names:    []string{"v"},
+		}
+		p.Functions = []*compiler.Funcode{{
+			Prog: p,
+			Name: "top",
+			Code: []byte{
+				byte(compiler.PREDECLARED), 0,
+				byte(compiler.POUND),
+				byte(compiler.RETURN),
+			},
+			MaxStack: 1,
+		}}
+
+		th := machine.Thread{Predeclared: map[string]machine.Value{"v": inst}}
+		res, err := th.RunProgram(context.Background(), p)
+		require.NoError(t, err)
+		assert.Equal(t, machine.Int(42), res)
+
+		th = machine.Thread{Predeclared: map[string]machine.Value{"v": machine.NewMap(0)}}
+		_, err = th.RunProgram(context.Background(), p)
+		require.EqualError(t, err, "unsupported unary op: # map")
+	})
+}
+
+func TestBitwiseOps(t *testing.T) {
+	type I = machine.Int
+	type F = machine.Float
+
+	t.Run("unary", func(t *testing.T) {
+		cases := []struct {
+			x    machine.Value
+			want machine.Value
+		}{
+			{I(0), I(-1)},
+			{I(5), I(-6)},
+			{I(-1), I(0)},
+			{I(math.MaxInt64), I(math.MinInt64)},
+			{I(0xFFFFFFFF), I(-0x100000000)},
+			{F(2), I(-3)},
+		}
+		for _, c := range cases {
+			t.Run(fmt.Sprintf("~%s", c.x), func(t *testing.T) {
+				var th machine.Thread
+				got, err := machine.Unary(&th, token.TILDE, c.x)
+				require.NoError(t, err)
+				assert.Equal(t, c.want, got)
+			})
+		}
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		cases := []struct {
+			l    machine.Value
+			op   token.Token
+			r    machine.Value
+			want machine.Value
+		}{
+			{I(0x0F), token.AMPERSAND, I(0x3C), I(0x0C)},
+			{I(0x0F), token.PIPE, I(0x3C), I(0x3F)},
+			{I(0x0F), token.TILDE, I(0x3C), I(0x33)},
+			{I(-1), token.AMPERSAND, I(1 << 40), I(1 << 40)},
+
+			// results that would differ with a 32-bit uint
+			{I(1), token.LTLT, I(40), I(1 << 40)},
+			{I(1), token.LTLT, I(63), I(math.MinInt64)},
+			{I(1), token.LTLT, I(64), I(0)},
+			{I(-1), token.GTGT, I(32), I(0xFFFFFFFF)},
+			{I(-1), token.GTGT, I(63), I(1)},
+			{I(-1), token.GTGT, I(64), I(0)},
+			{I(-8), token.LTLT, I(-1), I(0x7FFFFFFFFFFFFFFC)},
+			{I(1 << 40), token.GTGT, I(-8), I(1 << 48)},
+			{F(-1), token.GTGT, I(32), I(0xFFFFFFFF)},
+			{I(-1), token.GTGT, F(32), I(0xFFFFFFFF)},
+		}
+		for _, c := range cases {
+			t.Run(fmt.Sprintf("%s %s %s", c.l, c.op, c.r), func(t *testing.T) {
+				var th machine.Thread
+				got, err := machine.Binary(&th, c.op, c.l, c.r)
+				require.NoError(t, err)
+				assert.Equal(t, c.want, got)
+			})
+		}
+	})
+}
+
+func TestUnsupportedOpErrors(t *testing.T) {
+	empty := machine.NewMap(0)
+	cases := []struct {
+		desc     string
+		operands []machine.Value
+		op       token.Token
+		err      string
+	}{
+		{"array plus int", []machine.Value{machine.NewArray([]machine.Value{machine.Int(1)}), machine.Int(2)}, token.PLUS,
+			"unsupported binary op: array + int"},
+		{"minus string", []machine.Value{machine.String("x")}, token.MINUS,
+			"unsupported unary op: - string"},
+		{"vector without __add", []machine.Value{&vector{meta: empty}, machine.Int(1)}, token.PLUS,
+			"unsupported binary op: vector + int (no __add metamethod defined)"},
+		{"int shift vector without __shl", []machine.Value{machine.Int(1), &vector{meta: empty}}, token.LTLT,
+			"unsupported binary op: int << vector (no __shl metamethod defined)"},
+		{"len vector without __len", []machine.Value{&vector{meta: empty}}, token.POUND,
+			"unsupported unary op: # vector (no __len metamethod defined)"},
+		{"negate vector with metamap", []machine.Value{&vector{meta: empty}}, token.MINUS,
+			"unsupported unary op: - vector"},
+		{"int less than string", []machine.Value{machine.Int(1), machine.String("x")}, token.LT,
+			"unsupported binary op: int < string"},
+		{"vector greater than vector without __lt", []machine.Value{&vector{meta: empty}, &vector{meta: empty}}, token.GT,
+			"unsupported binary op: vector > vector (no __lt metamethod defined)"},
+		{"vector less or equal int without __le", []machine.Value{&vector{meta: empty}, machine.Int(1)}, token.LE,
+			"unsupported binary op: vector <= int (no __le or __lt metamethod defined)"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			var th machine.Thread
+			var err error
+			switch c.op {
+			case token.LT, token.GT, token.LE, token.GE:
+				_, err = machine.Compare(&th, c.op, c.operands[0], c.operands[1])
+			default:
+				if len(c.operands) == 1 {
+					_, err = machine.Unary(&th, c.op, c.operands[0])
+				} else {
+					_, err = machine.Binary(&th, c.op, c.operands[0], c.operands[1])
+				}
+			}
+			require.EqualError(t, err, c.err)
+		})
+	}
+}
+
+func TestNamedArgs(t *testing.T) {
+	type named struct {
+		name string
+		val  int64
+	}
+
+	// newProgram returns a program that calls fn with the positional and named
+	// arguments. If fn is nil, it calls the function f(a, b) that returns the
+	// tuple (a, b), otherwise it calls the predeclared fn.
+	newProgram := func(fn machine.Value, pos []int64, args []named) (*compiler.Program, map[string]machine.Value) {
+		p := &compiler.Program{Filename: "test.nen", Names: []string{"fn"}}
+
+		var code []byte
+		if fn == nil {
+			code = append(code, byte(compiler.MAKETUPLE), 0, byte(compiler.MAKEFUNC), 1)
+		} else {
+			code = append(code, byte(compiler.PREDECLARED), 0)
+		}
+		for _, v := range pos {
+			code = append(code, byte(compiler.CONSTANT), byte(len(p.Constants)))
+			p.Constants = append(p.Constants, v)
+		}
+		for _, arg := range args {
+			code = append(code, byte(compiler.CONSTANT), byte(len(p.Constants)))
+			p.Constants = append(p.Constants, arg.name)
+			code = append(code, byte(compiler.CONSTANT), byte(len(p.Constants)))
+			p.Constants = append(p.Constants, arg.val)
+		}
+		// the arguments counts are small enough for the encoded CALL arg to fit
+		// in 2 bytes
+		n := len(pos)<<8 | len(args)
+		code = append(code, byte(compiler.CALL), byte(n&0x7f)|0x80, byte(n>>7), byte(compiler.RETURN))
+
+		p.Functions = []*compiler.Funcode{{
+			Prog:     p,
+			Name:     "top",
+			Code:     code,
+			MaxStack: 1 + len(pos) + 2*len(args),
+		}, {
+			Prog: p,
+			Name: "f",
+			Code: []byte{
+				byte(compiler.LOCAL), 0,
+				byte(compiler.LOCAL), 1,
+				byte(compiler.MAKETUPLE), 2,
+				byte(compiler.RETURN),
+			},
+			Locals:    []compiler.Binding{{Name: "a"}, {Name: "b"}},
+			NumParams: 2,
+			MaxStack:  2,
+		}}
+		return p, map[string]machine.Value{"fn": fn}
+	}
+
+	tuple := func(vals ...machine.Value) *machine.Tuple { return machine.NewTuple(vals) }
+	cases := []struct {
+		desc  string
+		fn    machine.Value
+		pos   []int64
+		named []named
+		want  machine.Value
+		err   string
+	}{
+		{"positional", nil, []int64{1, 2}, nil, tuple(machine.Int(1), machine.Int(2)), ""},
+		{"named in order", nil, nil, []named{{"a", 1}, {"b", 2}}, tuple(machine.Int(1), machine.Int(2)), ""},
+		{"named out of order", nil, nil, []named{{"b", 2}, {"a", 1}}, tuple(machine.Int(1), machine.Int(2)), ""},
+		{"positional and named", nil, []int64{1}, []named{{"b", 2}}, tuple(machine.Int(1), machine.Int(2)), ""},
+		{"missing parameter", nil, nil, []named{{"b", 2}}, tuple(machine.Nil, machine.Int(2)), ""},
+		{"unknown name", nil, nil, []named{{"a", 1}, {"c", 3}}, nil, "function f has no parameter c"},
+		{"multiple values", nil, []int64{1}, []named{{"a", 2}}, nil, "function f got multiple values for parameter a"},
+		{"built-in", machine.Universe["getmetamap"], nil, []named{{"x", 1}}, nil, "getmetamap does not accept named arguments"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			p, predecl := newProgram(c.fn, c.pos, c.named)
+			th := machine.Thread{Predeclared: predecl}
+			res, err := th.RunProgram(context.Background(), p)
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.want, res)
+		})
+	}
+}
+
+func TestContains(t *testing.T) {
+	m := machine.NewMap(3)
+	require.NoError(t, m.SetKey(machine.String("f"), machine.False))
+	require.NoError(t, m.SetKey(machine.String("n"), machine.Nil))
+	require.NoError(t, m.SetKey(machine.Int(1), machine.Int(0)))
+
+	cases := []struct {
+		k    machine.Value
+		want bool
+	}{
+		{machine.String("f"), true},
+		{machine.String("n"), true},
+		{machine.Int(1), true},
+		{machine.String("x"), false},
+		{machine.Int(2), false},
+	}
+	for _, c := range cases {
+		t.Run(c.k.String(), func(t *testing.T) {
+			got, err := machine.Contains(nil, m, c.k)
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+
+	t.Run("not a container", func(t *testing.T) {
+		_, err := machine.Contains(nil, machine.Int(1), machine.Int(0))
+		require.EqualError(t, err, "unsupported in operation: int in int")
+	})
+}
+
+// record is a test type with a fixed set of fields, accessed and set by name.
+type record map[string]machine.Value
+
+func (r record) String() string { return "record" }
+func (r record) Type() string   { return "record" }
+
+func (r record) AttrNames() []string {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r record) Attr(name string) (machine.Value, error) {
+	if v, ok := r[name]; ok {
+		return v, nil
+	}
+	return nil, machine.NoSuchAttrError(fmt.Sprintf("record has no .%s field", name))
+}
+
+func (r record) SetField(name string, v machine.Value) error {
+	if _, ok := r[name]; !ok {
+		return machine.NoSuchAttrError(fmt.Sprintf("record has no .%s field", name))
+	}
+	r[name] = v
+	return nil
+}
+
+func TestAttrSpellingHint(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		err  string
+	}{
+		{"get near miss", `return v.nam`, "record has no .nam field (did you mean .name?)"},
+		{"get case", `return v.Count`, "record has no .Count field (did you mean .count?)"},
+		{"get not close", `return v.xyz`, "record has no .xyz field"},
+		{"get too far", `return v.nxxx`, "record has no .nxxx field"},
+		{"set near miss", `v.cuont = 1`, "record has no .cuont field (did you mean .count?)"},
+		{"set not close", `v.abc = 1`, "record has no .abc field"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			th := &machine.Thread{}
+			th.Predeclared = map[string]machine.Value{
+				"v": record{"name": machine.String("a"), "count": machine.Int(1)},
+			}
+			_, err := runSourceThread(t, th, c.src)
+			require.EqualError(t, err, c.err)
+		})
+	}
+}
+
+func TestBinaryNumericPromotion(t *testing.T) {
+	type I = machine.Int
+	type F = machine.Float
+
+	// each case is evaluated with 7 op 2 with operands int/int, int/float,
+	// float/int and float/float, in that order.
+	cases := []struct {
+		op   string
+		want [4]machine.Value
+	}{
+		{"+", [4]machine.Value{I(9), F(9), F(9), F(9)}},
+		{"-", [4]machine.Value{I(5), F(5), F(5), F(5)}},
+		{"*", [4]machine.Value{I(14), F(14), F(14), F(14)}},
+		{"/", [4]machine.Value{F(3.5), F(3.5), F(3.5), F(3.5)}},
+		{"//", [4]machine.Value{I(3), F(3), F(3), F(3)}},
+		{"%", [4]machine.Value{I(1), F(1), F(1), F(1)}},
+		{"^", [4]machine.Value{F(49), F(49), F(49), F(49)}},
+		{"&", [4]machine.Value{I(2), I(2), I(2), I(2)}},
+		{"|", [4]machine.Value{I(7), I(7), I(7), I(7)}},
+		{"~", [4]machine.Value{I(5), I(5), I(5), I(5)}},
+		{"<<", [4]machine.Value{I(28), I(28), I(28), I(28)}},
+		{">>", [4]machine.Value{I(1), I(1), I(1), I(1)}},
+	}
+	operands := [4][2]machine.Value{
+		{I(7), I(2)},
+		{I(7), F(2)},
+		{F(7), I(2)},
+		{F(7), F(2)},
+	}
+	for _, c := range cases {
+		for i, ops := range operands {
+			t.Run(fmt.Sprintf("%s %s %s", ops[0].Type(), c.op, ops[1].Type()), func(t *testing.T) {
+				th := &machine.Thread{Predeclared: map[string]machine.Value{"l": ops[0], "r": ops[1]}}
+				got, err := runSourceThread(t, th, "return l "+c.op+" r")
+				require.NoError(t, err)
+				assert.Equal(t, c.want[i], got)
+			})
+		}
+	}
+}
+
+func TestBinaryModuloSign(t *testing.T) {
+	type I = machine.Int
+	type F = machine.Float
+
+	// the floored division and modulo must agree between ints and floats, with
+	// the result of the modulo having the sign of the divisor.
+	cases := []struct {
+		l, r     int
+		div, mod int
+	}{
+		{7, 3, 2, 1},
+		{-7, 3, -3, 2},
+		{7, -3, -3, -2},
+		{-7, -3, 2, -1},
+		{6, -3, -2, 0},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%d %d", c.l, c.r), func(t *testing.T) {
+			var th machine.Thread
+			for _, ops := range [][2]machine.Value{
+				{I(c.l), I(c.r)},
+				{F(c.l), F(c.r)},
+				{I(c.l), F(c.r)},
+			} {
+				div, err := machine.Binary(&th, token.SLASHSLASH, ops[0], ops[1])
+				require.NoError(t, err)
+				mod, err := machine.Binary(&th, token.PERCENT, ops[0], ops[1])
+				require.NoError(t, err)
+
+				if _, ok := ops[1].(machine.Float); ok {
+					assert.Equal(t, F(c.div), div)
+					assert.Equal(t, F(c.mod), mod)
+				} else {
+					assert.Equal(t, I(c.div), div)
+					assert.Equal(t, I(c.mod), mod)
+				}
+			}
+		})
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"string int", `return "ab" * 3`, machine.String("ababab"), ""},
+		{"int string", `return 3 * "ab"`, machine.String("ababab"), ""},
+		{"string zero", `return "a" * 0`, machine.String(""), ""},
+		{"empty string", `return "" * 1000000000000`, machine.String(""), ""},
+		{"bytes", `return b"\x00" * 2`, machine.Bytes("\x00\x00"), ""},
+		{"array", `let a = [1, 2] * 2 return (a[0], a[1], a[2], a[-1])`,
+			machine.NewTuple([]machine.Value{machine.Int(1), machine.Int(2), machine.Int(1), machine.Int(2)}), ""},
+		{"array copy", `
+let a = [1]
+let b = a * 1
+b[0] = 2
+return a[0]
+`, machine.Int(1), ""},
+		{"negative count", `return "ab" * -1`, nil, "string repetition: negative count -1"},
+		{"negative count array", `return -2 * [1]`, nil, "array repetition: negative count -2"},
+		{"excessive size", `return "ab" * (1 << 40)`, nil, "string repetition: excessive size (2 * 1099511627776)"},
+		{"excessive size array", `return [0] * 1000000000`, nil, "array repetition: excessive size (1 * 1000000000)"},
+		{"excessive size array elements", `return [0, 1] * 50000000`, nil, "array repetition: excessive size (2 * 50000000)"},
+		{"float count", `return "ab" * 2.0`, nil, "unsupported binary op: string * float"},
+		{"string string", `return "ab" * "c"`, nil, "unsupported binary op: string * string"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
@@ -12,6 +12,7 @@ var (
 	_ Value    = Int(0)
 	_ Ordered  = Int(0)
 	_ Iterable = Int(0)
+	_ Hashable = Int(0)
 )
 
 func (i Int) String() string {
@@ -20,6 +21,12 @@ func (i Int) String() string {
 
 func (i Int) Type() string { return "int" }
 
+// Hash returns the hash of the integer, which is the same as the hash of a
+// Float with the same value.
+func (i Int) Hash() (uint32, error) {
+	return uint32(i ^ i>>32), nil
+}
+
 func (i Int) Cmp(v Value) (int, error) {
 	j := v.(Int)
 	if i > j {
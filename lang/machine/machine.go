@@ -11,14 +11,65 @@
 package machine
 
 import (
-	"context"
+	"errors"
 	"fmt"
 
 	"github.com/mna/nenuphar/lang/compiler"
 	"github.com/mna/nenuphar/lang/token"
 )
 
-func run(th *Thread, fn *Function, args *Tuple) (Value, error) {
+// run executes the compiled function fn in the current call frame. The calls
+// in tail position made by fn (and by the functions it tail-calls) reuse that
+// frame and its locals and operand stack, so that they do not grow the call
+// stack.
+func run(th *Thread, fn *Function, args *Tuple, named []namedArg) (Value, error) {
+	var (
+		space []Value
+		tc    *tailCall
+	)
+	for {
+		result, next, err := runFrame(th, fn, args, named, space)
+		if err != nil && tc != nil {
+			// the errors raised before the callee starts executing, e.g. for
+			// invalid arguments, are reported at the position of the tail call,
+			// as for a regular call. Other errors are already positioned.
+			err = newErrorAt(err, tc.fcode, tc.pc)
+			if th.Debug {
+				err = newDebugError(tc.fcode, tc.pc, err)
+			}
+		}
+		if err != nil || next == nil {
+			return result, err
+		}
+		tc = next
+		fn, args, named, space = tc.fn, tc.args, tc.named, tc.space
+
+		// the callee replaces the caller in the current call frame
+		fr := th.callStack[len(th.callStack)-1]
+		*fr = Frame{callable: fn}
+	}
+}
+
+// A tailCall is a call to a compiled function in tail position, that is, its
+// result is immediately returned by the caller. It is executed by run once
+// the caller's runFrame has returned, reusing the caller's space for its
+// locals and operand stack.
+type tailCall struct {
+	fn    *Function
+	args  *Tuple
+	named []namedArg
+	space []Value
+
+	// position of the call in the caller
+	fcode *compiler.Funcode
+	pc    uint32
+}
+
+// runFrame executes fn in the current call frame. The space slice is used
+// for the locals and operand stack if it is large enough, otherwise a new one
+// is allocated. If fn ends with a call in tail position, that call is not
+// executed and is returned as a tailCall instead.
+func runFrame(th *Thread, fn *Function, args *Tuple, named []namedArg, space []Value) (Value, *tailCall, error) {
 	fcode := fn.Funcode
 	if th.DisableRecursion {
 		// detect recursion
@@ -26,7 +77,7 @@ func run(th *Thread, fn *Function, args *Tuple) (Value, error) {
 			// We look for the same function code, not function value, otherwise the
 			// user could defeat the check by writing the Y combinator.
 			if frfn, ok := fr.callable.(*Function); ok && frfn.Funcode == fcode {
-				return nil, fmt.Errorf("function %s called recursively", fn.Name())
+				return nil, nil, fmt.Errorf("function %s called recursively", fn.Name())
 			}
 		}
 	}
@@ -39,21 +90,24 @@ func run(th *Thread, fn *Function, args *Tuple) (Value, error) {
 	nspace := nlocals + fcode.MaxStack
 	// TODO: experiment with allocating a big slice at startup (configurable)
 	// and allocate from it as a big stack when possible, measure gains.
-	space := make([]Value, nspace)
+	if cap(space) >= nspace {
+		space = space[:nspace]
+		clear(space)
+	} else {
+		space = make([]Value, nspace)
+	}
 	locals := space[:nlocals:nlocals] // local variables, starting with parameters
 	stack := space[nlocals:]          // operand stack
 
 	// digest arguments and set parameters
-	if err := setArgs(locals, fn, args); err != nil {
-		return nil, err
+	if err := setArgs(locals, fn, args, named); err != nil {
+		return nil, nil, err
 	}
 
-	// create the deferred stack
-	// TODO: currently this is naive and just counts the number of
-	// defers/catches, but the exact stack size should be known statically.
-	var deferredStack []int64
-	if n := len(fcode.Defers) + len(fcode.Catches); n > 0 {
-		deferredStack = make([]int64, 0, n)
+	// create the deferred stack, its maximum depth is computed by the compiler
+	var deferredStack []deferredExit
+	if fcode.MaxDeferred > 0 {
+		deferredStack = make([]deferredExit, 0, fcode.MaxDeferred)
 	}
 
 	// Spill indicated locals to cells. Each cell is a separate alloc to avoid
@@ -83,6 +137,7 @@ func run(th *Thread, fn *Function, args *Tuple) (Value, error) {
 	var (
 		pc          uint32
 		result      Value
+		tail        *tailCall
 		runDefer    bool
 		inFlightErr error
 	)
@@ -93,16 +148,33 @@ loop:
 	for {
 		th.steps++
 		if th.steps >= th.maxSteps {
-			th.ctxCancel()
-			// TODO: critical, non-catchable error
-			inFlightErr = fmt.Errorf("thread cancelled: %s", context.Cause(th.ctx))
+			th.ctxCancel(fmt.Errorf("step limit exceeded: max %d", th.MaxSteps))
+			inFlightErr = th.cancelledError()
 			break loop
 		}
+		if th.steps >= th.nextCancelCheck {
+			th.nextCancelCheck = th.steps + th.cancelCheck
+			th.isCancelled()
+		}
 		if th.cancelled.Load() {
-			// TODO: critical, non-catchable error
-			inFlightErr = fmt.Errorf("thread cancelled: %s", context.Cause(th.ctx))
+			inFlightErr = th.cancelledError()
+			break loop
+		}
+
+		if th.RecordStackUsage && sp > th.peakStack {
+			th.peakStack = sp
+		}
+		if th.Debug && sp > fcode.MaxStack {
+			// consistency check of the stack depth computed by the compiler
+			inFlightErr = fmt.Errorf("internal error: operand stack depth %d exceeds MaxStack %d", sp, fcode.MaxStack)
 			break loop
 		}
+		if th.Debug && len(deferredStack) > fcode.MaxDeferred {
+			// consistency check of the deferred stack depth computed by the
+			// compiler, it returns immediately as running the deferred blocks
+			// would grow it further.
+			return nil, nil, fmt.Errorf("internal error: deferred stack depth %d exceeds MaxDeferred %d", len(deferredStack), fcode.MaxDeferred)
+		}
 
 		fr.pc = pc
 
@@ -146,7 +218,7 @@ loop:
 			y := stack[sp-1]
 			x := stack[sp-2]
 			sp -= 2
-			ok, err := Compare(op, x, y)
+			ok, err := Compare(th, op, x, y)
 			if err != nil {
 				inFlightErr = err
 				break loop
@@ -163,7 +235,7 @@ loop:
 			y := stack[sp-1]
 			x := stack[sp-2]
 			sp -= 2
-			z, err := Binary(binop, x, y)
+			z, err := Binary(th, binop, x, y)
 			if err != nil {
 				inFlightErr = err
 				break loop
@@ -171,6 +243,18 @@ loop:
 			stack[sp] = z
 			sp++
 
+		case compiler.IN:
+			y := stack[sp-1]
+			x := stack[sp-2]
+			sp -= 2
+			ok, err := Contains(th, y, x)
+			if err != nil {
+				inFlightErr = err
+				break loop
+			}
+			stack[sp] = Bool(ok)
+			sp++
+
 		case compiler.UPLUS, compiler.UMINUS, compiler.UTILDE, compiler.POUND:
 			var unop token.Token
 			switch op {
@@ -185,7 +269,7 @@ loop:
 			}
 			x := stack[sp-1]
 			sp--
-			y, err := Unary(unop, x)
+			y, err := Unary(th, unop, x)
 			if err != nil {
 				inFlightErr = err
 				break loop
@@ -208,44 +292,91 @@ loop:
 		case compiler.JMP:
 			if runDefer {
 				runDefer = false
-				if hasDeferredExecution(int64(fr.pc), int64(arg), fcode.Defers, nil, &pc) {
-					deferredStack = append(deferredStack, int64(arg)) // push
+				resumeSP := sp
+				if d, ok := hasDeferredExecution(fcode, int64(fr.pc), int64(arg), false, &pc, &sp, &iterstack); ok {
+					deferredStack = append(deferredStack, deferredExit{int64(arg), fr.pc, resumeSP, d}) // push
 					break
 				}
 			}
 			pc = arg
 
-		case compiler.CALL /*, compiler.CALL_VAR*/ :
-			//var varArgs Value
-			//if op == compiler.CALL_VAR {
-			//	varArgs = stack[sp-1]
-			//	sp--
-			//}
+		case compiler.CALL, compiler.CALL_VAR:
+			var named []namedArg
+			if n := int(arg & 0xff); n > 0 {
+				named = make([]namedArg, n)
+				sp -= 2 * n
+				for i := range named {
+					named[i] = namedArg{
+						name:  string(stack[sp+2*i].(String)),
+						value: stack[sp+2*i+1],
+					}
+				}
+			}
+
+			var spread Value
+			if op == compiler.CALL_VAR {
+				spread = stack[sp-1]
+				sp--
+			}
 
 			var positional []Value
-			if arg > 0 {
-				positional = stack[sp-int(arg) : sp]
-				sp -= int(arg)
+			if n := int(arg >> 8); n > 0 {
+				positional = stack[sp-n : sp]
+				sp -= n
 
 				// Copy positional arguments into a new array, unless the callee is
 				// another Function, in which case it can be trusted not to mutate
-				// them.
-				if _, ok := stack[sp-1].(*Function); !ok /*|| varArgs != nil*/ {
+				// them, and there is no spread to append to them.
+				if _, ok := stack[sp-1].(*Function); !ok || spread != nil {
 					positional = append([]Value(nil), positional...)
 				}
 			}
-			//if varArgs != nil {
-			//	// TODO: implement vararg parameter passing
-			//}
+			if spread != nil {
+				iter := Iterate(spread)
+				if iter == nil {
+					inFlightErr = fmt.Errorf("spread argument: %s value is not iterable", spread.Type())
+					break loop
+				}
+				var elem Value
+				for iter.Next(&elem) {
+					positional = append(positional, elem)
+				}
+				err := iterErr(iter)
+				iter.Done()
+				if err != nil {
+					inFlightErr = err
+					break loop
+				}
+			}
 
 			function := stack[sp-1]
 			sp--
 
+			if callee, ok := function.(*Function); ok && th.isTailCall(fcode, fr.pc, code[pc], len(deferredStack)) {
+				// the positional arguments may still refer to the operand stack,
+				// which is reused by the callee.
+				if spread == nil && len(positional) > 0 {
+					positional = append([]Value(nil), positional...)
+				}
+				argsTup := NilaryTuple
+				if len(positional) > 0 {
+					argsTup = NewTuple(positional)
+				}
+				tail = &tailCall{fn: callee, args: argsTup, named: named, space: space, fcode: fcode, pc: fr.pc}
+				break loop
+			}
+
 			argsTup := NilaryTuple
 			if len(positional) > 0 {
 				argsTup = NewTuple(positional)
 			}
-			z, err := Call(th, function, argsTup)
+			var z Value
+			var err error
+			if len(deferredStack) > 0 {
+				z, err = callDeferred(th, function, argsTup, named)
+			} else {
+				z, err = call(th, function, argsTup, named)
+			}
 			if err != nil {
 				inFlightErr = err
 				break loop
@@ -267,11 +398,50 @@ loop:
 			iter := iterstack[len(iterstack)-1]
 			if iter.Next(&stack[sp]) {
 				sp++
+			} else {
+				if err := iterErr(iter); err != nil {
+					inFlightErr = err
+					break loop
+				}
+				if runDefer {
+					runDefer = false
+					resumeSP := sp
+					if d, ok := hasDeferredExecution(fcode, int64(fr.pc), int64(arg), false, &pc, &sp, &iterstack); ok {
+						deferredStack = append(deferredStack, deferredExit{int64(arg), fr.pc, resumeSP, d}) // push
+						break
+					}
+				}
+				pc = arg
+			}
+
+		case compiler.RANGEPUSH:
+			// the arguments are validated as for a call to range, the loop state
+			// is then the current value, stop and step of the range.
+			v, err := builtinRange(th, rangeBuiltin, NewTuple(stack[sp-3:sp]))
+			if err != nil {
+				inFlightErr = err
+				break loop
+			}
+			r := v.(*Range)
+			stack[sp-3], stack[sp-2], stack[sp-1] = Int(r.start), Int(r.stop), Int(r.step)
+
+		case compiler.RANGEJMP:
+			cur, stop, step := stack[sp-3].(Int), stack[sp-2].(Int), stack[sp-1].(Int)
+			if step > 0 && cur < stop || step < 0 && cur > stop {
+				next := cur + step
+				if (next > cur) != (step > 0) {
+					// the next value overflows, so it is past stop
+					next = stop
+				}
+				stack[sp] = stack[sp-3]
+				stack[sp-3] = next
+				sp++
 			} else {
 				if runDefer {
 					runDefer = false
-					if hasDeferredExecution(int64(fr.pc), int64(arg), fcode.Defers, nil, &pc) {
-						deferredStack = append(deferredStack, int64(arg)) // push
+					resumeSP := sp
+					if d, ok := hasDeferredExecution(fcode, int64(fr.pc), int64(arg), false, &pc, &sp, &iterstack); ok {
+						deferredStack = append(deferredStack, deferredExit{int64(arg), fr.pc, resumeSP, d}) // push
 						break
 					}
 				}
@@ -299,55 +469,81 @@ loop:
 				// a RETURN "to" address is never covered by a deferred block (it jumps
 				// outside the function), so run any defers that covers the "from" pc
 				// (ignore catch blocks).
-				if hasDeferredExecution(int64(fr.pc), -1, fcode.Defers, nil, &pc) {
+				if d, ok := hasDeferredExecution(fcode, int64(fr.pc), -1, false, &pc, &sp, &iterstack); ok {
 					// -1 means break loop and return whatever result and inFlightErr are
 					// present
-					deferredStack = append(deferredStack, -1) // push
+					deferredStack = append(deferredStack, deferredExit{-1, fr.pc, 0, d}) // push
 					break
 				}
 			}
 			break loop
 
 		case compiler.MAKEMAP:
+			if err := th.checkCollectionSize("map", int(arg)); err != nil {
+				inFlightErr = err
+				break loop
+			}
 			stack[sp] = NewMap(int(arg))
 			sp++
 
-		//case compiler.UNPACK:
-		//	n := int(arg)
-		//	iterable := stack[sp-1]
-		//	sp--
-
-		//	iter := Iterate(iterable)
-		//	if iter == nil {
-		//		inFlightErr = fmt.Errorf("%s value is not iterable", iterable.Type())
-		//		break loop
-		//	}
-
-		//	i := 0
-		//	sp += n
-		//	for i < n && iter.Next(&stack[sp-1-i]) {
-		//		i++
-		//	}
-
-		//	// TODO: define UNPACK semantics - fill missing values with null, ignore extra ones?
-		//	//var dummy Value
-		//	//if iter.Next(&dummy) {
-		//	//	// NB: Len may return -1 here in obscure cases.
-		//	//	inFlightErr = fmt.Errorf("too many values to unpack (got %d, want %d)", Len(iterable), n)
-		//	//	break loop
-		//	//}
-		//	iter.Done()
-		//	//if i < n {
-		//	//	inFlightErr = fmt.Errorf("too few values to unpack (got %d, want %d)", i, n)
-		//	//	break loop
-		//	//}
+		case compiler.MAKECLASS:
+			members := stack[sp-1].(*Tuple) // ok to panic otherwise, compiler error
+			inherits := stack[sp-2]
+			sp--
+			cl, err := newClass(fn.Module.Program.Names[arg], inherits, members.elems)
+			if err != nil {
+				inFlightErr = err
+				break loop
+			}
+			stack[sp-1] = cl
+
+		case compiler.UNPACK:
+			// the iterable must produce exactly n values, the first one ends up on
+			// top of the stack.
+			n := int(arg)
+			iterable := stack[sp-1]
+			sp--
+
+			iter := Iterate(iterable)
+			if iter == nil {
+				inFlightErr = fmt.Errorf("%s value is not iterable", iterable.Type())
+				break loop
+			}
+
+			i := 0
+			sp += n
+			for i < n && iter.Next(&stack[sp-1-i]) {
+				i++
+			}
+			var extra Value
+			tooMany := i == n && iter.Next(&extra)
+			err := iterErr(iter)
+			iter.Done()
+			if err != nil {
+				inFlightErr = err
+				break loop
+			}
+
+			if tooMany {
+				if seq, ok := iterable.(Sequence); ok {
+					inFlightErr = fmt.Errorf("too many values to unpack (got %d, want %d)", seq.Len(), n)
+				} else {
+					inFlightErr = fmt.Errorf("too many values to unpack (want %d)", n)
+				}
+				break loop
+			}
+			if i < n {
+				inFlightErr = fmt.Errorf("too few values to unpack (got %d, want %d)", i, n)
+				break loop
+			}
 
 		case compiler.CJMP:
 			if Truth(stack[sp-1]) {
 				if runDefer {
 					runDefer = false
-					if hasDeferredExecution(int64(fr.pc), int64(arg), fcode.Defers, nil, &pc) {
-						deferredStack = append(deferredStack, int64(arg)) // push
+					resumeSP := sp - 1 // the condition is popped
+					if d, ok := hasDeferredExecution(fcode, int64(fr.pc), int64(arg), false, &pc, &sp, &iterstack); ok {
+						deferredStack = append(deferredStack, deferredExit{int64(arg), fr.pc, resumeSP, d}) // push
 						break
 					}
 				}
@@ -369,12 +565,26 @@ loop:
 
 		case compiler.MAKEARRAY:
 			n := int(arg)
+			if err := th.checkCollectionSize("array", n); err != nil {
+				inFlightErr = err
+				break loop
+			}
 			elems := make([]Value, n)
 			sp -= n
 			copy(elems, stack[sp:])
 			stack[sp] = NewArray(elems)
 			sp++
 
+		case compiler.COPYARRAY:
+			tuple := stack[sp-1].(*Tuple) // ok to panic otherwise, compiler error
+			if err := th.checkCollectionSize("array", len(tuple.elems)); err != nil {
+				inFlightErr = err
+				break loop
+			}
+			elems := make([]Value, len(tuple.elems))
+			copy(elems, tuple.elems)
+			stack[sp-1] = NewArray(elems)
+
 		case compiler.MAKEFUNC:
 			funcode := fn.Module.Program.Functions[arg]
 			freevars := stack[sp-1].(*Tuple) // ok to panic otherwise, compiler error
@@ -412,7 +622,7 @@ loop:
 			y := stack[sp-2]
 			x := stack[sp-3]
 			sp -= 3
-			if err := setIndex(x, y, z); err != nil {
+			if err := setIndex(th, x, y, z); err != nil {
 				inFlightErr = err
 				break loop
 			}
@@ -421,7 +631,7 @@ loop:
 			y := stack[sp-1]
 			x := stack[sp-2]
 			sp -= 2
-			z, err := getIndex(x, y)
+			z, err := getIndex(th, x, y)
 			if err != nil {
 				inFlightErr = err
 				break loop
@@ -433,7 +643,7 @@ loop:
 			x := stack[sp-1]
 			sp--
 			name := fn.Module.Program.Names[arg]
-			y, err := getAttr(x, name)
+			y, err := getAttr(th, x, name)
 			if err != nil {
 				inFlightErr = err
 				break loop
@@ -446,7 +656,7 @@ loop:
 			x := stack[sp-2]
 			sp -= 2
 			name := fn.Module.Program.Names[arg]
-			if err := setField(x, name, y); err != nil {
+			if err := setField(th, x, name, y); err != nil {
 				inFlightErr = err
 				break loop
 			}
@@ -456,6 +666,10 @@ loop:
 			k := stack[sp-2]
 			v := stack[sp-1]
 			sp -= 3
+			if err := th.checkMapKey(m, k); err != nil {
+				inFlightErr = err
+				break loop
+			}
 			if err := m.SetKey(k, v); err != nil {
 				inFlightErr = err
 				break loop
@@ -526,17 +740,16 @@ loop:
 		case compiler.DEFEREXIT:
 			// read target address but do not pop it yet, depends if there's more
 			// deferred execution to run.
-			returnTo := deferredStack[len(deferredStack)-1] // peek
+			exit := deferredStack[len(deferredStack)-1] // peek
+			returnTo := exit.returnTo
 
 			// if there's an in-flight error, the next deferred execution could be a
 			// catch (e.g. a defer could've been the first deferred execution when it
 			// was raised, and a catch is still possible). Otherwise, do not consider
-			// them.
-			var catch []compiler.Defer
-			if inFlightErr != nil {
-				catch = fcode.Catches
-			}
-			if hasDeferredExecution(int64(fr.pc), returnTo, fcode.Defers, catch, &pc) {
+			// them, nor if the error is critical.
+			catch := inFlightErr != nil && !isCritical(inFlightErr)
+			if d, ok := hasDeferredExecution(fcode, int64(fr.pc), returnTo, catch, &pc, &sp, &iterstack); ok {
+				deferredStack[len(deferredStack)-1].running = d
 				break
 			}
 
@@ -545,11 +758,64 @@ loop:
 				break loop
 			}
 			pc = uint32(returnTo)
+			sp = exit.sp
+
+		case compiler.CRITICAL:
+			// this is the exit of a catch block that converts the error to a
+			// critical one, so that no other catch block can handle it.
+			if !isCritical(inFlightErr) {
+				inFlightErr = &CriticalError{Err: inFlightErr}
+			}
+			break loop
+
+		case compiler.THROW:
+			switch x := stack[sp-1].(type) {
+			case *Error:
+				inFlightErr = x
+			case String:
+				inFlightErr = errors.New(string(x))
+			case NilType:
+				inFlightErr = fr.err
+				if inFlightErr == nil {
+					inFlightErr = errors.New("throw: no error to re-throw")
+				}
+			default:
+				inFlightErr = fmt.Errorf("throw: want error or string, got %s", x.Type())
+			}
+			sp--
+			break loop
+
+		case compiler.APPEND:
+			elem := stack[sp-1]
+			arr, ok := stack[sp-2].(*Array)
+			sp -= 2
+			if !ok {
+				inFlightErr = fmt.Errorf("append: want array, got %s", stack[sp].Type())
+				break loop
+			}
+			if err := th.checkCollectionSize(arr.Type(), arr.Len()+1); err != nil {
+				inFlightErr = err
+				break loop
+			}
+			if err := arr.Append(elem); err != nil {
+				inFlightErr = err
+				break loop
+			}
 
 		case compiler.CATCHJMP:
 			// this is the normal exit of a catch block, so it clears the inFlightErr
-			// TODO: put that in the frame so the "error" built-in has access to it?
 			inFlightErr = nil
+			fr.err = nil
+
+			// discard the deferred exit of the error handled by this catch block,
+			// and those triggered by the instructions that it protects (e.g. a
+			// jump out of a failing defer block), as execution does not resume
+			// there.
+			c := deferredStack[len(deferredStack)-1].running
+			deferredStack = deferredStack[:len(deferredStack)-1] // pop
+			for n := len(deferredStack); n > 0 && c.Covers(int64(deferredStack[n-1].from)); n-- {
+				deferredStack = deferredStack[:n-1] // pop
+			}
 
 			// special-case: if jump address is 0 - which is impossible for a
 			// CATCHJMP because it always jumps forward to after the parent block -,
@@ -562,8 +828,9 @@ loop:
 				result = Nil
 				returnTo = -1
 			}
-			if hasDeferredExecution(int64(fr.pc), returnTo, fcode.Defers, nil, &pc) {
-				deferredStack = append(deferredStack, returnTo) // push
+			resumeSP := sp
+			if d, ok := hasDeferredExecution(fcode, int64(fr.pc), returnTo, false, &pc, &sp, &iterstack); ok {
+				deferredStack = append(deferredStack, deferredExit{returnTo, fr.pc, resumeSP, d}) // push
 				break
 			}
 			if returnTo < 0 {
@@ -577,24 +844,74 @@ loop:
 	}
 
 	if inFlightErr != nil {
-		if hasDeferredExecution(int64(fr.pc), -1, fcode.Defers, fcode.Catches, &pc) {
+		inFlightErr = newErrorAt(inFlightErr, fcode, fr.pc)
+		if isCritical(fr.err) && !isCritical(inFlightErr) {
+			// an error raised by a defer block that runs for a critical error is
+			// critical too, so that it cannot be caught in place of that error.
+			inFlightErr = &CriticalError{Err: inFlightErr}
+		}
+		if th.Debug {
+			inFlightErr = newDebugError(fcode, fr.pc, inFlightErr)
+		}
+		catch := !isCritical(inFlightErr)
+		if d, ok := hasDeferredExecution(fcode, int64(fr.pc), -1, catch, &pc, &sp, &iterstack); ok {
 			// by default, pending action is to exit the function
-			deferredStack = append(deferredStack, -1) // push
+			deferredStack = append(deferredStack, deferredExit{-1, fr.pc, 0, d}) // push
+			// make the error available to the error built-in
+			fr.err = inFlightErr
 			goto loop
 		}
 	}
 
-	return result, inFlightErr
+	return result, tail, inFlightErr
+}
+
+// isTailCall returns true if the CALL instruction at pc in fcode, followed
+// by the opcode next, can be executed as a tail call. It must be immediately
+// followed by RETURN, it must not be covered by a defer or catch block and it
+// must not be executed by a defer or catch block, as indicated by the number
+// of pending deferred executions. Tail calls are disabled if the thread
+// disallows recursion, so that it can be detected in the call stack.
+func (th *Thread) isTailCall(fcode *compiler.Funcode, pc uint32, next byte, pending int) bool {
+	if th.DisableRecursion || pending > 0 || compiler.Opcode(next) != compiler.RETURN {
+		return false
+	}
+	return !fcode.Covered(int64(pc))
+}
+
+// callDeferred is like call, but it is used for the calls made while a
+// defer or catch block is executing. A Go panic raised by the call is
+// recovered and returned as a critical error, so that the remaining
+// deferred blocks still run and the deferred stack is drained as for any
+// other error, instead of unwinding the frame in the middle of its deferred
+// execution.
+//
+// Only the panics raised by the callee of a CALL instruction are recovered.
+// A panic raised by another instruction of a defer or catch block, e.g. by a
+// metamethod implemented in Go and invoked by an operator, is not, and it
+// unwinds the frame without running the remaining deferred blocks. The
+// iterators of the frame are still closed and the call stack of the thread
+// is still popped.
+func callDeferred(th *Thread, fn Value, args *Tuple, named []namedArg) (v Value, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			v, err = nil, &CriticalError{Err: fmt.Errorf("panic in deferred call: %v", x)}
+		}
+	}()
+	return call(th, fn, args, named)
 }
 
 // setArgs sets the values of the formal parameters of function fn in
-// based on the actual parameter values in args and kwargs.
-func setArgs(locals []Value, fn *Function, args *Tuple) error {
+// based on the actual parameter values in args and named.
+func setArgs(locals []Value, fn *Function, args *Tuple, named []namedArg) error {
 
 	// Arguments are processed as follows:
 	// - positional arguments are bound to locals
 	// - surplus positional arguments are bound to the final local if the function
 	//   accepts varargs
+	// - named arguments are bound to the parameter of that name, which must not
+	//   be already bound by a positional argument
+	// - parameters without an argument are set to nil
 
 	// nparams is the number of parameters
 	nparams := fn.Funcode.NumParams
@@ -605,6 +922,9 @@ func setArgs(locals []Value, fn *Function, args *Tuple) error {
 		if nargs > 0 {
 			return fmt.Errorf("function %s accepts no arguments (%d given)", fn.Name(), nargs)
 		}
+		if len(named) > 0 {
+			return fmt.Errorf("function %s has no parameter %s", fn.Name(), named[0].name)
+		}
 		return nil
 	}
 
@@ -614,45 +934,87 @@ func setArgs(locals []Value, fn *Function, args *Tuple) error {
 		return fmt.Errorf("function %s accepts at most %d arguments (%d given)", fn.Name(), nparams, nargs)
 	}
 
-	// bind positional arguments (TODO: should Nil values be already in args, or should it be padded here?)
+	// bind positional arguments
 	for i := 0; i < nparams; i++ {
-		locals[i] = args.Index(i)
+		if i < nargs {
+			locals[i] = args.Index(i)
+		} else {
+			locals[i] = Nil
+		}
 	}
 
 	// bind surplus positional arguments to *args parameter
 	if fn.Funcode.HasVarArg {
-		elems := make([]Value, nargs-nparams)
-		for i := nparams; i < nargs; i++ {
-			elems[i-nparams] = args.Index(i)
+		var elems []Value
+		if nargs > nparams {
+			elems = make([]Value, nargs-nparams)
+			for i := nparams; i < nargs; i++ {
+				elems[i-nparams] = args.Index(i)
+			}
 		}
 		locals[nparams] = NewTuple(elems)
 	}
+
+	// bind named arguments, the vararg parameter cannot be named (the resolver
+	// guarantees that the names are unique).
+	for _, arg := range named {
+		i := paramIndex(fn.Funcode, nparams, arg.name)
+		if i < 0 {
+			return fmt.Errorf("function %s has no parameter %s", fn.Name(), arg.name)
+		}
+		if i < nargs {
+			return fmt.Errorf("function %s got multiple values for parameter %s", fn.Name(), arg.name)
+		}
+		locals[i] = arg.value
+	}
 	return nil
 }
 
-// TODO(opt): check if this would benefit from being done inline, and if
-// something like an interval tree would be faster than looping through all
-// defers/catches (I suspect looping is faster when n is small and would
-// generally be very small, i.e. < 10 and probably even < 5).
-func hasDeferredExecution(from, to int64, defr, catch []compiler.Defer, pc *uint32) bool {
-	target := -1
-	for _, d := range defr {
-		if d.Covers(from) && !d.Covers(to) {
-			if int(d.StartPC) > target {
-				target = int(d.StartPC)
-			}
+// paramIndex returns the index of the parameter name among the first nparams
+// parameters of fcode, or -1 if there is no such parameter.
+func paramIndex(fcode *compiler.Funcode, nparams int, name string) int {
+	for i := 0; i < nparams; i++ {
+		if fcode.Locals[i].Name == name {
+			return i
 		}
 	}
-	for _, d := range catch {
-		if d.Covers(from) && !d.Covers(to) {
-			if int(d.StartPC) > target {
-				target = int(d.StartPC)
-			}
+	return -1
+}
+
+// A deferredExit is an entry of the deferred stack, it is pushed when the
+// execution of defer or catch blocks is triggered by the instruction at pc
+// from. Once they have run, execution continues at returnTo with the operand
+// stack depth sp, or exits the function if it is -1. The block currently
+// running is stored in running.
+type deferredExit struct {
+	returnTo int64
+	from     uint32
+	sp       int
+	running  compiler.Defer
+}
+
+// hasDeferredExecution returns the defer block of fcode - or catch block if
+// catch is true - that covers pc from but not pc to and true if there is one,
+// in which case it must run before the jump from one to the other (see
+// Funcode.Deferred).
+//
+// TODO(opt): check if this would benefit from being done inline.
+//
+// If there is deferred execution to run, pc is set to its start and sp to the
+// operand stack depth expected there, discarding any values left by the
+// instructions that were interrupted. Likewise, the iterators of the loops
+// interrupted by an error are done and removed from iters.
+func hasDeferredExecution(fcode *compiler.Funcode, from, to int64, catch bool, pc *uint32, sp *int, iters *[]Iterator) (compiler.Defer, bool) {
+	d, ok := fcode.Deferred(from, to, catch)
+	if ok {
+		*pc = d.StartPC
+		*sp = int(d.Stack)
+		if n := int(d.Iters); len(*iters) > n {
+			for _, iter := range (*iters)[n:] {
+				iter.Done()
+			}
+			*iters = (*iters)[:n]
 		}
 	}
-	if target >= 0 {
-		*pc = uint32(target)
-		return true
-	}
-	return false
+	return d, ok
 }
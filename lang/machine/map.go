@@ -7,51 +7,187 @@ import (
 )
 
 // A Map represents a map or dictionary. If you know the exact final number of
-// entries, it is more efficient to call NewMap.
+// entries, it is more efficient to call NewMap. Keys must be Hashable, and a
+// Float key with an exact integer value is stored as the corresponding Int.
+//
+// The entries of a map are iterated in insertion order. Setting the value of
+// an existing key does not change its position, but deleting a key and
+// inserting it again moves it to the end.
 type Map struct {
-	m *swiss.Map[Value, Value]
+	m       *swiss.Map[Value, int] // index of the key in entries
+	entries []mapEntry             // in insertion order, deleted entries have a nil key
+	deleted int                    // number of deleted entries
+	meta    *Map
+	frozen  bool
+}
+
+type mapEntry struct {
+	k, v Value
 }
 
 var (
-	_ Value     = (*Map)(nil)
-	_ Mapping   = (*Map)(nil)
-	_ HasSetKey = (*Map)(nil)
-	_ Iterable  = (*Map)(nil)
+	_ Value      = (*Map)(nil)
+	_ Mapping    = (*Map)(nil)
+	_ HasSetKey  = (*Map)(nil)
+	_ Iterable   = (*Map)(nil)
+	_ HasMetamap = (*Map)(nil)
+	_ Freezable  = (*Map)(nil)
 )
 
 // NewMap returns a map with initial capacity for at least size items.
 func NewMap(size int) *Map {
-	m := swiss.NewMap[Value, Value](uint32(size))
-	return &Map{m: m}
+	m := swiss.NewMap[Value, int](uint32(size))
+	return &Map{m: m, entries: make([]mapEntry, 0, size)}
 }
 
 func (m *Map) String() string { return fmt.Sprintf("map(%p)", m) }
 func (m *Map) Type() string   { return "map" }
+func (m *Map) Len() int       { return m.m.Count() }
 func (m *Map) Get(k Value) (Value, bool, error) {
-	v, ok := m.m.Get(k)
-	return v, ok, nil
+	k, err := hashKey(k)
+	if err != nil {
+		return nil, false, err
+	}
+	if i, ok := m.m.Get(k); ok {
+		return m.entries[i].v, true, nil
+	}
+	return nil, false, nil
 }
+func (m *Map) Metamap() *Map        { return m.meta }
+func (m *Map) SetMetamap(meta *Map) { m.meta = meta }
 func (m *Map) SetKey(k, v Value) error {
-	m.m.Put(k, v)
+	if m.frozen {
+		return frozenError(m)
+	}
+	k, err := hashKey(k)
+	if err != nil {
+		return err
+	}
+	if i, ok := m.m.Get(k); ok {
+		m.entries[i].v = v
+		return nil
+	}
+	m.m.Put(k, len(m.entries))
+	m.entries = append(m.entries, mapEntry{k: k, v: v})
 	return nil
 }
 
+// Delete removes the entry of key k from the map and reports whether it was
+// found.
+func (m *Map) Delete(k Value) (found bool, err error) {
+	if m.frozen {
+		return false, frozenError(m)
+	}
+	k, err = hashKey(k)
+	if err != nil {
+		return false, err
+	}
+	i, ok := m.m.Get(k)
+	if !ok {
+		return false, nil
+	}
+	m.m.Delete(k)
+	m.entries[i] = mapEntry{}
+	m.deleted++
+	if m.deleted > len(m.entries)/2 {
+		m.compact()
+	}
+	return true, nil
+}
+
+// compact removes the deleted entries and updates the indices of the others.
+func (m *Map) compact() {
+	entries := make([]mapEntry, 0, len(m.entries)-m.deleted)
+	for _, e := range m.entries {
+		if e.k != nil {
+			m.m.Put(e.k, len(entries))
+			entries = append(entries, e)
+		}
+	}
+	m.entries = entries
+	m.deleted = 0
+}
+
+// Items returns a tuple of the key and value of each entry of the map, in
+// insertion order.
+func (m *Map) Items() []*Tuple {
+	items := make([]*Tuple, 0, m.Len())
+	for _, e := range m.entries {
+		if e.k != nil {
+			items = append(items, NewTuple([]Value{e.k, e.v}))
+		}
+	}
+	return items
+}
+
+// Freeze freezes the map and its keys and values. Its metamap, if any, is
+// not frozen as it is typically shared by many values, but it cannot be
+// changed once the map is frozen.
+func (m *Map) Freeze() {
+	if m.frozen {
+		return
+	}
+	m.frozen = true
+	for _, e := range m.entries {
+		if e.k != nil {
+			Freeze(e.k)
+			Freeze(e.v)
+		}
+	}
+}
+func (m *Map) Frozen() bool { return m.frozen }
+
+// Iterate returns an iterator over the keys of the map, in insertion order.
+// Setting the value of existing keys during iteration is safe, the effect of
+// other changes to the map on the iteration is unspecified.
 func (m *Map) Iterate() Iterator {
-	panic("unimplemented")
+	return &mapIterator{m: m}
 }
 
 type mapIterator struct {
-	it *swiss.Iterator[Value, Value]
+	m *Map
+	i int
 }
 
 func (it *mapIterator) Next(p *Value) bool {
-	if !it.it.Next() {
-		return false
+	for it.i < len(it.m.entries) {
+		e := it.m.entries[it.i]
+		it.i++
+		if e.k != nil {
+			*p = e.k
+			return true
+		}
 	}
-
-	k, v := it.it.Pair()
-	*p = NewTuple([]Value{k, v})
-	return true
+	return false
 }
 
 func (it *mapIterator) Done() {}
+
+// hashKey returns the key to use in the underlying map for k, or an error if
+// k is not Hashable. A Float with an exact integer value is converted to Int
+// so that equal numbers are the same key.
+func hashKey(k Value) (Value, error) {
+	h, ok := k.(Hashable)
+	if !ok {
+		return nil, fmt.Errorf("unhashable type: %s", k.Type())
+	}
+	if _, err := h.Hash(); err != nil {
+		return nil, err
+	}
+	if f, ok := k.(Float); ok {
+		if i, err := floatToInt(f); err == nil {
+			return i, nil
+		}
+	}
+	return k, nil
+}
+
+// hashString returns the 32-bit FNV-1a hash of s.
+func hashString(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
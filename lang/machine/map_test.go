@@ -0,0 +1,189 @@
+package machine_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHash(t *testing.T) {
+	hash := func(v machine.Value) uint32 {
+		h, err := v.(machine.Hashable).Hash()
+		require.NoError(t, err)
+		return h
+	}
+
+	require.Equal(t, hash(machine.Int(1)), hash(machine.Float(1)))
+	require.Equal(t, hash(machine.Int(-3)), hash(machine.Float(-3)))
+	require.Equal(t, hash(machine.Int(0)), hash(machine.Float(math.Copysign(0, -1))))
+	require.Equal(t, hash(machine.String("abc")), hash(machine.String("abc")))
+	require.Equal(t, hash(machine.String("abc")), hash(machine.Bytes("abc")))
+	require.NotEqual(t, hash(machine.String("abc")), hash(machine.String("abd")))
+	require.NotEqual(t, hash(machine.True), hash(machine.False))
+	_ = hash(machine.Nil)
+	_ = hash(machine.Float(1.5))
+}
+
+func TestMapKeys(t *testing.T) {
+	t.Run("int and float collide", func(t *testing.T) {
+		m := machine.NewMap(0)
+		require.NoError(t, m.SetKey(machine.Int(1), machine.String("int")))
+		require.NoError(t, m.SetKey(machine.Float(1), machine.String("float")))
+
+		v, found, err := m.Get(machine.Int(1))
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, machine.String("float"), v)
+
+		// the key is stored as an int
+		it := m.Iterate()
+		defer it.Done()
+		var k machine.Value
+		require.True(t, it.Next(&k))
+		require.Equal(t, machine.Int(1), k)
+		require.False(t, it.Next(&k))
+	})
+
+	t.Run("distinct keys", func(t *testing.T) {
+		m := machine.NewMap(0)
+		keys := []machine.Value{machine.Int(1), machine.Float(1.5), machine.String("1"),
+			machine.Bytes("1"), machine.True, machine.Nil}
+		for i, k := range keys {
+			require.NoError(t, m.SetKey(k, machine.Int(i)))
+		}
+		for i, k := range keys {
+			v, found, err := m.Get(k)
+			require.NoError(t, err)
+			require.True(t, found, k.String())
+			require.Equal(t, machine.Int(i), v, k.String())
+		}
+	})
+
+	t.Run("unhashable", func(t *testing.T) {
+		m := machine.NewMap(0)
+		arr := machine.NewArray(nil)
+		require.EqualError(t, m.SetKey(arr, machine.Nil), "unhashable type: array")
+		_, _, err := m.Get(machine.NewMap(0))
+		require.EqualError(t, err, "unhashable type: map")
+	})
+
+	t.Run("script", func(t *testing.T) {
+		cases := []struct {
+			desc string
+			src  string
+			want machine.Value
+			err  string
+		}{
+			{"index collision", `
+let m = {}
+m[1] = "a"
+m[1.0] = "b"
+return (m[1] == m[1.0], m[1])
+`, machine.NewTuple([]machine.Value{machine.True, machine.String("b")}), ""},
+			{"in collision", `
+let m = {[2.0]: true}
+return (2 in m, 2.5 in m)
+`, machine.NewTuple([]machine.Value{machine.True, machine.False}), ""},
+			{"set collision", `
+return sorted(set([1, 1.0, 2]))
+`, machine.NewArray([]machine.Value{machine.Int(1), machine.Int(2)}), ""},
+			{"unhashable index", `
+let m, k = {}, [1]
+m[k] = 1
+`, nil, "unhashable type: array"},
+			{"unhashable literal", `
+return {[(1, 2)]: 1}
+`, nil, "unhashable type: tuple"},
+			{"unhashable NaN", `
+let inf = 1e308 * 10
+let m = {}
+m[inf - inf] = 1
+`, nil, "unhashable: NaN"},
+		}
+		for _, c := range cases {
+			t.Run(c.desc, func(t *testing.T) {
+				got, err := runSource(t, c.src)
+				if c.err != "" {
+					require.ErrorContains(t, err, c.err)
+					return
+				}
+				require.NoError(t, err)
+				require.Equal(t, c.want, got)
+			})
+		}
+	})
+}
+
+func TestMapOrder(t *testing.T) {
+	keys := func(m *machine.Map) []machine.Value {
+		var ks []machine.Value
+		it := m.Iterate()
+		defer it.Done()
+		var k machine.Value
+		for it.Next(&k) {
+			ks = append(ks, k)
+		}
+		return ks
+	}
+	type S = machine.String
+
+	m := machine.NewMap(0)
+	for i, k := range []string{"d", "b", "a", "c"} {
+		require.NoError(t, m.SetKey(S(k), machine.Int(i)))
+	}
+	require.Equal(t, []machine.Value{S("d"), S("b"), S("a"), S("c")}, keys(m))
+
+	// updating existing keys keeps the order
+	require.NoError(t, m.SetKey(S("b"), machine.Int(10)))
+	require.NoError(t, m.SetKey(S("d"), machine.Int(20)))
+	require.Equal(t, []machine.Value{S("d"), S("b"), S("a"), S("c")}, keys(m))
+
+	items := m.Items()
+	require.Len(t, items, 4)
+	require.Equal(t, machine.NewTuple([]machine.Value{S("d"), machine.Int(20)}), items[0])
+	require.Equal(t, machine.NewTuple([]machine.Value{S("b"), machine.Int(10)}), items[1])
+	require.Equal(t, machine.NewTuple([]machine.Value{S("c"), machine.Int(3)}), items[3])
+
+	// re-inserting a deleted key moves it to the end
+	found, err := m.Delete(S("d"))
+	require.NoError(t, err)
+	require.True(t, found)
+	require.NoError(t, m.SetKey(S("d"), machine.Int(30)))
+	require.Equal(t, []machine.Value{S("b"), S("a"), S("c"), S("d")}, keys(m))
+
+	// deleting most keys compacts the map, the order is preserved
+	for _, k := range []string{"b", "c"} {
+		found, err := m.Delete(S(k))
+		require.NoError(t, err)
+		require.True(t, found)
+	}
+	found, err = m.Delete(S("x"))
+	require.NoError(t, err)
+	require.False(t, found)
+	require.Equal(t, []machine.Value{S("a"), S("d")}, keys(m))
+	require.Equal(t, 2, m.Len())
+	v, found, err := m.Get(S("d"))
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, machine.Int(30), v)
+
+	m.Freeze()
+	_, err = m.Delete(S("a"))
+	require.EqualError(t, err, "cannot modify frozen map")
+
+	t.Run("for in", func(t *testing.T) {
+		got, err := runSource(t, `
+let m = {c: 1, a: 2, b: 3}
+m.a = 20
+let s = ""
+for k in m do
+	s = s + k
+end
+return s
+`)
+		require.NoError(t, err)
+		require.Equal(t, S("cab"), got)
+	})
+}
@@ -0,0 +1,236 @@
+package machine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// IOOptions configures the io module returned by NewIOModule.
+type IOOptions struct {
+	// Open is called by io.open to open the file at path with the specified
+	// mode. If it is nil, io.open always fails, so that scripts have no access
+	// to the filesystem. OpenFile can be used to give full access to the
+	// filesystem of the host.
+	Open func(th *Thread, path, mode string) (io.ReadWriteCloser, error)
+}
+
+// OpenFile opens the file at path using the os package. The mode is one of
+// "r" (read-only), "w" (write-only, created or truncated), "a" (write-only,
+// created or appended to) or "r+" (read-write).
+func OpenFile(th *Thread, path, mode string) (io.ReadWriteCloser, error) {
+	var flag int
+	switch mode {
+	case "r":
+		flag = os.O_RDONLY
+	case "w":
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case "a":
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	case "r+":
+		flag = os.O_RDWR
+	default:
+		return nil, fmt.Errorf("invalid mode: %q", mode)
+	}
+	return os.OpenFile(path, flag, 0o666)
+}
+
+// NewIOModule returns the io module, which provides the stdin, stdout and
+// stderr file handles of thread th (its Stdin, Stdout and Stderr fields, or
+// the corresponding os ones if nil) and the open function, whose access to
+// the filesystem is controlled by opts. The handles are bound to th.
+//
+// A file handle has the following methods:
+//   - read_line() returns the next line without its trailing newline, or nil
+//     at the end of the file.
+//   - read_all() returns the rest of the file as a string.
+//   - write(...) writes each string or bytes argument to the file and returns
+//     the number of bytes written.
+//   - close() closes the file.
+func NewIOModule(th *Thread, opts *IOOptions) *Map {
+	var open func(*Thread, string, string) (io.ReadWriteCloser, error)
+	if opts != nil {
+		open = opts.Open
+	}
+
+	var (
+		stdin  io.Reader = os.Stdin
+		stdout io.Writer = os.Stdout
+		stderr io.Writer = os.Stderr
+	)
+	if th.Stdin != nil {
+		stdin = th.Stdin
+	}
+	if th.Stdout != nil {
+		stdout = th.Stdout
+	}
+	if th.Stderr != nil {
+		stderr = th.Stderr
+	}
+
+	m := NewMap(4)
+	_ = m.SetKey(String("stdin"), newFileHandle(th, "stdin", stdin, nil, nil))
+	_ = m.SetKey(String("stdout"), newFileHandle(th, "stdout", nil, stdout, nil))
+	_ = m.SetKey(String("stderr"), newFileHandle(th, "stderr", nil, stderr, nil))
+	_ = m.SetKey(String("open"), NewBuiltin("open", func(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+		return builtinOpen(th, b, args, open)
+	}))
+	return m
+}
+
+// open(path, mode="r") opens the file at path and returns its file handle.
+func builtinOpen(th *Thread, b *Builtin, args *Tuple, open func(*Thread, string, string) (io.ReadWriteCloser, error)) (Value, error) {
+	if err := checkArity(b, args, 1, 2); err != nil {
+		return nil, err
+	}
+	path, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	mode := "r"
+	if args.Len() > 1 {
+		if mode, err = stringArg(b, args, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	if open == nil {
+		return nil, fmt.Errorf("%s: filesystem access is not allowed", b.name)
+	}
+	f, err := open(th, path, mode)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.name, err)
+	}
+
+	var (
+		r io.Reader
+		w io.Writer
+	)
+	if strings.HasPrefix(mode, "r") {
+		r = f
+	}
+	if mode != "r" {
+		w = f
+	}
+	return newFileHandle(th, path, r, w, f), nil
+}
+
+// file is the Go value of a file handle. Its reader, writer and closer are
+// nil if the file does not support the corresponding operation.
+type file struct {
+	name string
+	r    *bufio.Reader
+	w    io.Writer
+	c    io.Closer
+}
+
+var fileMethods = map[string]HandleMethod{
+	"read_line": fileReadLine,
+	"read_all":  fileReadAll,
+	"write":     fileWrite,
+	"close":     fileClose,
+}
+
+func newFileHandle(th *Thread, name string, r io.Reader, w io.Writer, c io.Closer) *Handle {
+	f := &file{name: name, w: w, c: c}
+	if r != nil {
+		f.r = bufio.NewReader(r)
+	}
+	return NewHandle(th, "file", f, fileMethods)
+}
+
+// fileRecv returns the file of handle h, the receiver of the method, after
+// checking that it was called with the expected number of arguments (any
+// number if arity < 0).
+func fileRecv(h *Handle, method string, args *Tuple, arity int) (*file, error) {
+	f := h.GoValue().(*file)
+	if arity >= 0 && args.Len() != arity {
+		return nil, fmt.Errorf("%s: got %d arguments, want %d", method, args.Len(), arity)
+	}
+	return f, nil
+}
+
+func fileReadLine(th *Thread, h *Handle, args *Tuple) (Value, error) {
+	f, err := fileRecv(h, "read_line", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if f.r == nil {
+		return nil, fmt.Errorf("read_line: %s is not readable", f.name)
+	}
+
+	line, err := f.r.ReadString('\n')
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("read_line: %w", err)
+		}
+		if line == "" {
+			return Nil, nil
+		}
+	}
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return String(line), nil
+}
+
+func fileReadAll(th *Thread, h *Handle, args *Tuple) (Value, error) {
+	f, err := fileRecv(h, "read_all", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if f.r == nil {
+		return nil, fmt.Errorf("read_all: %s is not readable", f.name)
+	}
+
+	b, err := io.ReadAll(f.r)
+	if err != nil {
+		return nil, fmt.Errorf("read_all: %w", err)
+	}
+	return String(b), nil
+}
+
+func fileWrite(th *Thread, h *Handle, args *Tuple) (Value, error) {
+	f, err := fileRecv(h, "write", args, -1)
+	if err != nil {
+		return nil, err
+	}
+	if f.w == nil {
+		return nil, fmt.Errorf("write: %s is not writable", f.name)
+	}
+
+	var n int
+	for i := 0; i < args.Len(); i++ {
+		var s string
+		switch v := args.Index(i).(type) {
+		case String:
+			s = string(v)
+		case Bytes:
+			s = string(v)
+		default:
+			return nil, fmt.Errorf("write: argument #%d: want string or bytes, got %s", i+1, v.Type())
+		}
+		nn, err := io.WriteString(f.w, s)
+		n += nn
+		if err != nil {
+			return nil, fmt.Errorf("write: %w", err)
+		}
+	}
+	return Int(n), nil
+}
+
+func fileClose(th *Thread, h *Handle, args *Tuple) (Value, error) {
+	f, err := fileRecv(h, "close", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if f.c == nil {
+		return nil, fmt.Errorf("close: %s cannot be closed", f.name)
+	}
+	if err := f.c.Close(); err != nil {
+		return nil, fmt.Errorf("close: %w", err)
+	}
+	return Nil, nil
+}
@@ -0,0 +1,118 @@
+package machine_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIOModule(t *testing.T) {
+	t.Run("write stdout", func(t *testing.T) {
+		var out, errOut bytes.Buffer
+		th := &machine.Thread{Stdout: &out, Stderr: &errOut}
+		th.Predeclared = map[string]machine.Value{"io": machine.NewIOModule(th, nil)}
+
+		got, err := runSourceThread(t, th, `
+let n = io.stdout.write("abc", b"\x64")
+io.stderr.write("e")
+return n
+`)
+		require.NoError(t, err)
+		require.Equal(t, machine.Int(4), got)
+		require.Equal(t, "abcd", out.String())
+		require.Equal(t, "e", errOut.String())
+	})
+
+	t.Run("read stdin", func(t *testing.T) {
+		th := &machine.Thread{Stdin: strings.NewReader("a\r\nb\nc")}
+		th.Predeclared = map[string]machine.Value{"io": machine.NewIOModule(th, nil)}
+
+		got, err := runSourceThread(t, th, `
+let a = io.stdin.read_line()
+let b = io.stdin.read_line()
+let c = io.stdin.read_line()
+let d = io.stdin.read_line()
+return (a, b, c, d)
+`)
+		require.NoError(t, err)
+		require.Equal(t, machine.NewTuple([]machine.Value{
+			machine.String("a"), machine.String("b"), machine.String("c"), machine.Nil}), got)
+	})
+
+	t.Run("read all", func(t *testing.T) {
+		th := &machine.Thread{Stdin: strings.NewReader("a\nb\nc\n")}
+		th.Predeclared = map[string]machine.Value{"io": machine.NewIOModule(th, nil)}
+
+		got, err := runSourceThread(t, th, `
+io.stdin.read_line()
+return io.stdin.read_all()
+`)
+		require.NoError(t, err)
+		require.Equal(t, machine.String("b\nc\n"), got)
+	})
+
+	t.Run("write stdin", func(t *testing.T) {
+		th := &machine.Thread{Stdin: strings.NewReader("")}
+		th.Predeclared = map[string]machine.Value{"io": machine.NewIOModule(th, nil)}
+
+		_, err := runSourceThread(t, th, `io.stdin.write("a")`)
+		require.EqualError(t, err, "write: stdin is not writable")
+	})
+
+	t.Run("write invalid", func(t *testing.T) {
+		var out bytes.Buffer
+		th := &machine.Thread{Stdout: &out}
+		th.Predeclared = map[string]machine.Value{"io": machine.NewIOModule(th, nil)}
+
+		_, err := runSourceThread(t, th, `io.stdout.write("a", 1)`)
+		require.EqualError(t, err, "write: argument #2: want string or bytes, got int")
+	})
+
+	t.Run("open not allowed", func(t *testing.T) {
+		th := &machine.Thread{}
+		th.Predeclared = map[string]machine.Value{"io": machine.NewIOModule(th, nil)}
+
+		_, err := runSourceThread(t, th, `io.open("/etc/passwd")`)
+		require.EqualError(t, err, "open: filesystem access is not allowed")
+	})
+
+	t.Run("open file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "f.txt")
+		th := &machine.Thread{}
+		th.Predeclared = map[string]machine.Value{
+			"io":   machine.NewIOModule(th, &machine.IOOptions{Open: machine.OpenFile}),
+			"path": machine.String(path),
+		}
+
+		got, err := runSourceThread(t, th, `
+let f = io.open(path, "w")
+f.write("x\ny\n")
+f.close()
+f = io.open(path)
+let line = f.read_line()
+f.close()
+return line
+`)
+		require.NoError(t, err)
+		require.Equal(t, machine.String("x"), got)
+
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "x\ny\n", string(b))
+	})
+
+	t.Run("open invalid mode", func(t *testing.T) {
+		th := &machine.Thread{}
+		th.Predeclared = map[string]machine.Value{
+			"io": machine.NewIOModule(th, &machine.IOOptions{Open: machine.OpenFile}),
+		}
+
+		_, err := runSourceThread(t, th, `io.open("f", "x")`)
+		require.EqualError(t, err, `open: invalid mode: "x"`)
+	})
+}
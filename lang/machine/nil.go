@@ -6,8 +6,12 @@ type NilType byte
 
 const Nil = NilType(0)
 
-// Nil is a Value.
-var _ Value = Nil
+// Nil is a hashable Value.
+var (
+	_ Value    = Nil
+	_ Hashable = Nil
+)
 
-func (NilType) String() string { return "nil" }
-func (NilType) Type() string   { return "nil" }
+func (NilType) String() string        { return "nil" }
+func (NilType) Type() string          { return "nil" }
+func (NilType) Hash() (uint32, error) { return 0, nil }
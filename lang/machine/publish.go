@@ -0,0 +1,95 @@
+package machine
+
+import (
+	"fmt"
+)
+
+// Publish makes x safe to share with the host or with other threads: it
+// checks that x does not contain, directly or transitively, a value bound to
+// a thread such as a Handle, and if so it freezes x. It returns an error
+// without freezing anything if x cannot be published.
+func Publish(x Value) error {
+	if err := checkPublishable(x, make(map[Value]bool)); err != nil {
+		return err
+	}
+	Freeze(x)
+	return nil
+}
+
+// checkPublishable returns an error if x or a value reachable from x cannot
+// be published. The seen map records the containers already visited, so
+// that cyclic structures are supported.
+func checkPublishable(x Value, seen map[Value]bool) error {
+	switch x := x.(type) {
+	case *Handle:
+		return fmt.Errorf("cannot publish %s value: handles are bound to their thread", x.Type())
+
+	case *Array:
+		if seen[x] {
+			return nil
+		}
+		seen[x] = true
+		for _, v := range x.elems {
+			if err := checkPublishable(v, seen); err != nil {
+				return err
+			}
+		}
+
+	case *Tuple:
+		for _, v := range x.elems {
+			if err := checkPublishable(v, seen); err != nil {
+				return err
+			}
+		}
+
+	case *Map:
+		if seen[x] {
+			return nil
+		}
+		seen[x] = true
+		for _, e := range x.entries {
+			if e.k == nil {
+				continue
+			}
+			if err := checkPublishable(e.k, seen); err != nil {
+				return err
+			}
+			if err := checkPublishable(e.v, seen); err != nil {
+				return err
+			}
+		}
+		if x.meta != nil {
+			return checkPublishable(x.meta, seen)
+		}
+
+	case *Set:
+		if seen[x] {
+			return nil
+		}
+		seen[x] = true
+		for _, v := range x.values {
+			if err := checkPublishable(v, seen); err != nil {
+				return err
+			}
+		}
+
+	case *Class:
+		if seen[x] {
+			return nil
+		}
+		seen[x] = true
+		for _, nm := range x.names {
+			v := x.attrs[nm]
+			if cell, ok := v.(*cell); ok {
+				v = cell.v
+			}
+			if err := checkPublishable(v, seen); err != nil {
+				return err
+			}
+		}
+		if x.inherits != nil {
+			return checkPublishable(x.inherits, seen)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/mna/nenuphar/lang/token"
+)
+
+// Range is the type of an arithmetic progression of integers, as returned by
+// the range built-in. It represents the integers from start (included) to
+// stop (excluded) by increments of step, without allocating them. Indexing
+// and iteration on a Range yield each integer as an Int, and the # operator
+// returns its number of elements.
+type Range struct {
+	start, stop, step int
+	len               int
+}
+
+var (
+	_ Value     = (*Range)(nil)
+	_ Indexable = (*Range)(nil)
+	_ Sequence  = (*Range)(nil)
+	_ HasUnary  = (*Range)(nil)
+)
+
+// NewRange returns a Range of the integers from start to stop (excluded) by
+// increments of step. It panics if step is 0.
+func NewRange(start, stop, step int) *Range {
+	if step == 0 {
+		panic("range step must not be zero")
+	}
+	return &Range{start: start, stop: stop, step: step, len: rangeLen(start, stop, step)}
+}
+
+func (r *Range) String() string {
+	if r.step == 1 {
+		return fmt.Sprintf("range(%d, %d)", r.start, r.stop)
+	}
+	return fmt.Sprintf("range(%d, %d, %d)", r.start, r.stop, r.step)
+}
+func (r *Range) Type() string      { return "range" }
+func (r *Range) Len() int          { return r.len }
+func (r *Range) Index(i int) Value { return Int(r.start + i*r.step) }
+func (r *Range) Iterate() Iterator { return &rangeIterator{r: r} }
+func (r *Range) Unary(op token.Token) (Value, error) {
+	if op == token.POUND {
+		return Int(r.len), nil
+	}
+	return nil, nil
+}
+
+// rangeLen returns the number of elements in the range, computed with uint64
+// arithmetic so that the distance between start and stop cannot overflow.
+func rangeLen(start, stop, step int) int {
+	switch {
+	case step > 0 && start < stop:
+		return int((uint64(stop-start)-1)/uint64(step) + 1)
+	case step < 0 && start > stop:
+		return int((uint64(start-stop)-1)/uint64(-step) + 1)
+	default:
+		return 0
+	}
+}
+
+type rangeIterator struct {
+	r *Range
+	i int
+}
+
+func (it *rangeIterator) Next(p *Value) bool {
+	if it.i < it.r.len {
+		*p = it.r.Index(it.i)
+		it.i++
+		return true
+	}
+	return false
+}
+
+func (it *rangeIterator) Done() {}
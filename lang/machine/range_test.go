@@ -0,0 +1,85 @@
+package machine_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRange(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"iterate", `
+let n = 0
+for i in range(0, 5) do
+	n = n * 10 + i
+end
+return n
+`, machine.Int(1234), ""},
+		{"iterate negative step", `
+let n = 0
+for i in range(5, 0, -1) do
+	n = n * 10 + i
+end
+return n
+`, machine.Int(54321), ""},
+		{"iterate step", `
+let n = 0
+for i in range(1, 8, 3) do
+	n = n * 10 + i
+end
+return n
+`, machine.Int(147), ""},
+		{"iterate empty", `
+let n = 0
+for i in range(5, 0) do
+	n = n + 1
+end
+return n
+`, machine.Int(0), ""},
+		{"length", `let r = range(0, 10, 3) return #r`, machine.Int(4), ""},
+		{"length negative step", `let r = range(10, -10, -5) return #r`, machine.Int(4), ""},
+		{"length empty", `let r = range(0, 10, -1) return #r`, machine.Int(0), ""},
+		{"length equal bounds", `let r = range(3, 3) return #r`, machine.Int(0), ""},
+		{"index", `let r = range(10, 20, 2) return r[3]`, machine.Int(16), ""},
+		{"index negative", `let r = range(10, 20, 2) return r[-1]`, machine.Int(18), ""},
+		{"index negative step", `let r = range(0, -10, -3) return r[2]`, machine.Int(-6), ""},
+		{"index out of range", `let r = range(0, 3) return r[3]`, nil, "range index 3 out of range [-3:2]"},
+		{"index empty", `let r = range(0, 0) return r[0]`, nil, "range index 0 out of range [0:-1]"},
+		{"zero step", `return range(0, 1, 0)`, nil, "range: step cannot be zero"},
+		{"missing stop", `return range(1)`, nil, "range: got 1 arguments, want at least 2"},
+		{"invalid start", `return range("a", 1)`, nil, "range: argument #1: string cannot be converted to integer"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestRangeValue(t *testing.T) {
+	r := machine.NewRange(0, 10, 3)
+	require.Equal(t, "range", r.Type())
+	require.Equal(t, "range(0, 10, 3)", r.String())
+	require.Equal(t, "range(1, 2)", machine.NewRange(1, 2, 1).String())
+	require.Equal(t, 4, r.Len())
+	require.Equal(t, machine.Int(9), r.Index(3))
+
+	big := machine.NewRange(math.MinInt64, math.MaxInt64, math.MaxInt64)
+	require.Equal(t, 3, big.Len())
+	require.Equal(t, machine.Int(math.MaxInt64-1), big.Index(2))
+
+	require.Panics(t, func() { machine.NewRange(0, 1, 0) })
+}
@@ -0,0 +1,1072 @@
+package machine_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/compiler"
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/resolver"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/require"
+)
+
+// runSource parses, resolves, compiles and runs src. The predeclared
+// identifier fail is a function that always returns an error.
+func runSource(t *testing.T, src string) (machine.Value, error) {
+	t.Helper()
+	return runSourceThread(t, &machine.Thread{}, src)
+}
+
+// runSourceThread is like runSource but runs src on the provided thread. The
+// predeclared identifiers of the thread, if any, are added to the default
+// ones.
+func runSourceThread(t *testing.T, th *machine.Thread, src string) (machine.Value, error) {
+	t.Helper()
+	return runSourceMode(t, th, src, 0)
+}
+
+// runSourceMode is like runSourceThread but compiles src with the provided
+// compiler mode.
+func runSourceMode(t testing.TB, th *machine.Thread, src string, mode compiler.Mode) (machine.Value, error) {
+	t.Helper()
+	pre := maps.Clone(predeclared)
+	maps.Copy(pre, th.Predeclared)
+	prog := compileSource(t, src, mode, pre)
+	th.Predeclared = pre
+	return th.RunProgram(context.Background(), prog)
+}
+
+// predeclared is the default set of predeclared identifiers available to the
+// programs run by runSource.
+var predeclared = map[string]machine.Value{
+	"fail": machine.NewBuiltin("fail", func(th *machine.Thread, b *machine.Builtin, args *machine.Tuple) (machine.Value, error) {
+		return nil, errors.New("failed")
+	}),
+}
+
+// compileSource parses, resolves, compiles and verifies src with the provided
+// compiler mode and predeclared identifiers.
+func compileSource(t testing.TB, src string, mode compiler.Mode, pre map[string]machine.Value) *compiler.Program {
+	t.Helper()
+
+	ctx := context.Background()
+	fset := token.NewFileSet()
+	ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(src))
+	require.NoError(t, err)
+	chunks := []*ast.Chunk{ch}
+	isPredeclared := func(name string) bool { _, ok := pre[name]; return ok }
+	err = resolver.ResolveFiles(ctx, fset, chunks, 0, nil, isPredeclared, machine.IsUniverse)
+	require.NoError(t, err)
+	progs, err := compiler.CompileFiles(ctx, fset, chunks, mode, nil)
+	require.NoError(t, err)
+	require.NoError(t, compiler.Verify(progs[0]))
+	return progs[0]
+}
+
+func TestRunSource(t *testing.T) {
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"call", `
+fn add(a, b)
+	return a + b
+end
+return add(1, 2)
+`, machine.Int(3), ""},
+
+		{"if else", `
+let x = 1
+if x > 1 then
+	x = 10
+else
+	x = 20
+end
+return x
+`, machine.Int(20), ""},
+
+		{"closure", `
+fn adder(n)
+	return fn(x) return x + n end
+end
+let add2 = adder(2)
+return add2(3)
+`, machine.Int(5), ""},
+
+		{"goto loop", `
+let x = 0
+::top::
+x = x + 1
+if x < 3 then goto top end
+return x
+`, machine.Int(3), ""},
+
+		{"goto out of nested loops", `
+let n = 0
+for a in [1, 2, 3] do
+	for b in [10, 20] do
+		n = n + a + b
+		goto nexta
+	end
+	::nexta::
+end
+return n
+`, machine.Int(36), ""},
+
+		{"goto out of all loops", `
+let n = 0
+for a in [1, 2, 3] do
+	for b in [10, 20] do
+		for c in (100, 200) do
+			defer n = n + 1000 end
+			n = n + a + b + c
+			if a == 2 then goto done end
+		end
+	end
+end
+::done::
+for a in [1, 2] do n = n + a end
+return n
+`, machine.Int(5779), ""},
+
+		{"defer", `
+let x = 1
+do
+	defer
+		x = x * 10
+	end
+	x = x + 1
+end
+return x
+`, machine.Int(20), ""},
+
+		{"defer after return", `
+fn f()
+	let x = 1
+	defer
+		x = 2
+	end
+	return x
+end
+return f()
+`, machine.Int(1), ""},
+
+		{"catch", `
+let x = 0
+do
+	catch
+		x = 2
+	end
+	fail()
+	x = 1
+end
+return x
+`, machine.Int(2), ""},
+
+		{"catch in loop", `
+let n = 0
+for a in [1, 2, 3] do
+	catch n = n + 10 end
+	for b in [1, 2] do
+		n = n + a
+		fail()
+	end
+end
+return n
+`, machine.Int(36), ""},
+
+		{"try", `
+fn second(a, b)
+	return b
+end
+return second(1, try fail())
+`, machine.Nil, ""},
+
+		{"must", `
+return must fail()
+`, nil, "failed"},
+
+		{"constant tuple", `
+fn f() return (1, (2, "a")) end
+return f() == f()
+`, machine.True, ""},
+
+		{"constant array is copied", `
+fn f() return [1, 2] end
+let a = f()
+a[0] = 10
+let b = f()
+return a[0] + b[0]
+`, machine.Int(11), ""},
+
+		{"map index", `
+let m = {f: false, n: null}
+return (m.f, m.n, m["x"])
+`, machine.NewTuple([]machine.Value{machine.False, machine.Nil, machine.Nil}), ""},
+
+		{"in map", `
+let m = {a: 1, n: null}
+return ("a" in m, "n" in m, "x" in m, "x" not in m)
+`, machine.NewTuple([]machine.Value{machine.True, machine.True, machine.False, machine.True}), ""},
+
+		{"in array", `
+let a = [1, "b", 3.0]
+return (1 in a, 3 in a, "b" in a, 2 in a, 2 not in a, 1 not in a)
+`, machine.NewTuple([]machine.Value{machine.True, machine.True, machine.True, machine.False, machine.True, machine.False}), ""},
+
+		{"in string", `
+let s = "hello"
+return ("ell" in s, "" in s, "x" in s, "x" not in s, "h" not in s)
+`, machine.NewTuple([]machine.Value{machine.True, machine.True, machine.False, machine.True, machine.False}), ""},
+
+		{"in condition", `
+let n = 0
+for k in [1, 2, 3, 4] do
+	if k not in (2, 4) then n = n + k end
+end
+return n
+`, machine.Int(4), ""},
+
+		{"in string non-string", `
+return 1 in "a1"
+`, nil, "unsupported in operation: int in string"},
+
+		{"in unsupported", `
+return 1 in 2
+`, nil, "unsupported in operation: int in int"},
+
+		{"map iteration", `
+let m = {a: 1, b: 2, c: 3}
+let sum = 0
+for k in m do
+	sum = sum + m[k]
+end
+return sum
+`, machine.Int(6), ""},
+
+		{"spread array into fixed arity", `
+fn add(a, b, c) return a + b + c end
+return add(1, ...[2, 3])
+`, machine.Int(6), ""},
+
+		{"spread tuple into fixed arity", `
+fn add(a, b, c) return a + b + c end
+let t = (1, 2, 3)
+return add(...t)
+`, machine.Int(6), ""},
+
+		{"spread array into vararg", `
+fn last(a, ...rest) return rest[2] end
+let xs = [1, 2, 3]
+return last(0, ...xs)
+`, machine.Int(3), ""},
+
+		{"spread tuple into vararg with named", `
+fn f(a, b, ...rest) return a end
+return f(...(1, 2, 3), b: 10)
+`, nil, "function f got multiple values for parameter b"},
+
+		{"spread too many", `
+fn add(a, b) return a + b end
+return add(1, ...(2, 3))
+`, nil, "function add accepts at most 2 arguments (3 given)"},
+
+		{"spread not iterable", `
+fn f(...rest) return rest end
+let b = true
+return f(1, ...b)
+`, nil, "spread argument: bool value is not iterable"},
+
+		{"unpack tuple", `
+let pair = (1, 2)
+let a, b = pair
+return a - b
+`, machine.Int(-1), ""},
+
+		{"unpack array", `
+let a, b, c = [1, 2, 3]
+return (c, b, a)
+`, machine.NewTuple([]machine.Value{machine.Int(3), machine.Int(2), machine.Int(1)}), ""},
+
+		{"unpack too few", `
+let a, b, c = (1, 2)
+`, nil, "too few values to unpack (got 2, want 3)"},
+
+		{"unpack too many", `
+let a, b = [1, 2, 3]
+`, nil, "too many values to unpack (got 3, want 2)"},
+
+		{"unpack not iterable", `
+let a, b = true
+`, nil, "bool value is not iterable"},
+
+		{"class", `
+class Foo!
+	let x = 1
+	fn get() return x end
+end
+Foo.x = 3
+return Foo.get()
+`, machine.Int(3), ""},
+
+		{"class attr spelling", `
+class Foo!
+	let value = 1
+end
+return Foo.valeu
+`, nil, "class has no .valeu field or method (did you mean .value?)"},
+
+		{"class set field spelling", `
+class Foo!
+	let value = 1
+end
+Foo.vaule = 2
+`, nil, "class Foo has no .vaule field or method (did you mean .value?)"},
+
+		{"class attr no spelling", `
+class Foo!
+	let value = 1
+end
+return Foo.xyz
+`, nil, "class has no .xyz field or method"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			for _, mode := range []compiler.Mode{0, compiler.CompactJumps, compiler.Optimize} {
+				res, err := runSourceMode(t, &machine.Thread{}, c.src, mode)
+				if c.err != "" {
+					require.ErrorContains(t, err, c.err)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, c.want, res)
+			}
+		})
+	}
+}
+
+// shortJumps is a program with many short jumps executed in a loop.
+const shortJumps = `
+let n = 0
+for i in 1000 do
+	if i % 2 == 0 then n = n + 1 else n = n - 1 end
+	if i % 3 == 0 then n = n + 2 end
+	if i > 500 and i < 700 then continue end
+	n = n + 1
+end
+return n
+`
+
+func TestRunCompactJumps(t *testing.T) {
+	padded := compileSource(t, shortJumps, 0, predeclared)
+	compact := compileSource(t, shortJumps, compiler.CompactJumps, predeclared)
+	require.Less(t, len(compact.Functions[0].Code), len(padded.Functions[0].Code))
+
+	want, err := (&machine.Thread{}).RunProgram(context.Background(), padded)
+	require.NoError(t, err)
+	got, err := (&machine.Thread{}).RunProgram(context.Background(), compact)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+// randomProgram generates a random program that appends values to an array
+// r and returns it, possibly failing along the way. Loops are not generated
+// in the code protected by a catch block, as an error raised in a loop and
+// caught outside of it leaves its iterator on the stack of the machine.
+func randomProgram(rnd *rand.Rand) string {
+	vars := []string{"a", "b", "c"}
+	var expr, cond func(depth int) string
+	expr = func(depth int) string {
+		if depth <= 0 {
+			switch rnd.Intn(5) {
+			case 0:
+				return fmt.Sprint(rnd.Intn(5))
+			case 1:
+				return `"s"`
+			case 2:
+				return []string{"true", "false", "null"}[rnd.Intn(3)]
+			default:
+				return vars[rnd.Intn(len(vars))]
+			}
+		}
+		switch rnd.Intn(7) {
+		case 0:
+			return "(" + expr(depth-1) + " + " + fmt.Sprint(rnd.Intn(5)) + ")"
+		case 1:
+			return "(" + expr(depth-1) + " // " + expr(depth-1) + ")"
+		case 2:
+			return "(not " + cond(depth-1) + ")"
+		case 3:
+			return "(try " + expr(depth-1) + ")"
+		case 4:
+			return "(" + cond(depth-1) + " and " + expr(depth-1) + ")"
+		default:
+			return expr(0)
+		}
+	}
+	cond = func(depth int) string {
+		switch rnd.Intn(4) {
+		case 0:
+			return "not " + expr(depth)
+		case 1:
+			return "not not " + expr(depth)
+		case 2:
+			return expr(depth) + " == " + expr(depth)
+		default:
+			return expr(depth)
+		}
+	}
+
+	var sb strings.Builder
+	var stmts func(n, depth int, indent string, caught bool)
+	stmts = func(n, depth int, indent string, caught bool) {
+		for i := 0; i < n; i++ {
+			sb.WriteString(indent)
+			k := rnd.Intn(6)
+			if depth <= 0 || caught && k == 3 {
+				k %= 2
+			}
+			switch k {
+			case 0:
+				fmt.Fprintf(&sb, "%s = %s\n", vars[rnd.Intn(len(vars))], expr(2))
+			case 1:
+				fmt.Fprintf(&sb, "r.append(%s)\n", expr(2))
+			case 2:
+				fmt.Fprintf(&sb, "if %s then\n", cond(1))
+				stmts(rnd.Intn(3), depth-1, indent+"\t", caught)
+				if rnd.Intn(2) == 0 {
+					sb.WriteString(indent + "else\n")
+					stmts(rnd.Intn(3), depth-1, indent+"\t", caught)
+				}
+				sb.WriteString(indent + "end\n")
+			case 3:
+				sb.WriteString("for i in 3 do\n")
+				stmts(rnd.Intn(3)+1, depth-1, indent+"\t", caught)
+				sb.WriteString(indent + "end\n")
+			case 4:
+				sb.WriteString("do\n")
+				fmt.Fprintf(&sb, "%s\tcatch r.append(%s) end\n", indent, expr(1))
+				stmts(rnd.Intn(3)+1, depth-1, indent+"\t", true)
+				sb.WriteString(indent + "end\n")
+			default:
+				fmt.Fprintf(&sb, "if %s then end\n", cond(1))
+			}
+		}
+	}
+
+	sb.WriteString("let a, b, c, r = 1, 2, 3, []\n")
+	stmts(5, 3, "", false)
+	sb.WriteString("return r\n")
+	return sb.String()
+}
+
+func TestRunOptimize(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		src := randomProgram(rnd)
+		want, wantErr := runSourceMode(t, &machine.Thread{}, src, 0)
+		got, gotErr := runSourceMode(t, &machine.Thread{}, src, compiler.Optimize)
+		if wantErr != nil {
+			// the error message includes its position
+			require.EqualError(t, gotErr, wantErr.Error(), src)
+			continue
+		}
+		require.NoError(t, gotErr, src)
+		require.Equal(t, want, got, src)
+	}
+
+	shorter := compileSource(t, shortJumps, compiler.Optimize, predeclared)
+	padded := compileSource(t, shortJumps, 0, predeclared)
+	require.LessOrEqual(t, len(shorter.Functions[0].Code), len(padded.Functions[0].Code))
+}
+
+func TestRunConstantFolding(t *testing.T) {
+	exprs := []string{
+		`1 + 2 * 3`, `7 // -2`, `-7 % 3`, `7.5 // 2`, `-7.5 % 2`, `7 % -2.5`,
+		`1 / 4`, `2 ^ 0.5`, `0 ^ -1`, `9223372036854775807 + 1`, `-9223372036854775807 - 1 // -1`,
+		`~1.0`, `3 & 1.0`, `1 << 63`, `1 << 64`, `-1 >> -2`, `-8 >> 1`, `1 << -9223372036854775807`,
+		`"a" + "b"`, `#"abc"`, `#(b"a" + b"bc")`, `-0.0`, `0.0 * -1`, `-(1 - 1)`,
+		`1 / 0`, `1 // 0`, `1 % 0`, `1.0 % 0`, `1 // 0.0`, `1.5 & 1`, `~0.5`, `1 << 2.5`,
+		`"a" + 1`, `"a" * 2`, `-"a"`, `#1`, `(1 + 1) / (2 - 2)`,
+	}
+	for _, e := range exprs {
+		t.Run(e, func(t *testing.T) {
+			src := "return " + e
+			want, wantErr := runSourceMode(t, &machine.Thread{}, src, 0)
+			got, gotErr := runSourceMode(t, &machine.Thread{}, src, compiler.Optimize)
+			if wantErr != nil {
+				require.EqualError(t, gotErr, wantErr.Error())
+				return
+			}
+			require.NoError(t, gotErr)
+			require.Equal(t, want, got)
+			if f, ok := want.(machine.Float); ok {
+				// e.g. a negative zero is not folded into a positive one
+				require.Equal(t, math.Signbit(float64(f)), math.Signbit(float64(got.(machine.Float))))
+			}
+		})
+	}
+}
+
+func TestRunRangeLoop(t *testing.T) {
+	srcs := []string{
+		`let s = 0; for i in range(1, 11) do s = s + i end; return s`,
+		`let r = []; for i in range(10, 0, -3) do r.append(i) end; return r`,
+		`let r = []; for i in range(0, 10, 4) do r.append(i) end; return r`,
+		`let r = []; for i in range(3, 3) do r.append(i) end; return r`,
+		`let r = []; for i in range(3, 0) do r.append(i) end; return r`,
+		`let r = []; for i in range(0, 3, -1) do r.append(i) end; return r`,
+		`let r = []; for i in (range(0, 3)) do r.append(i) end; return r`,
+		`let r = []; for i in range(9223372036854775805, 9223372036854775807, 2) do r.append(i) end; return r`,
+		`let r = []; for i in range(-9223372036854775807, -9223372036854775807 - 1, -5) do r.append(i) end; return r`,
+		`let r = []; for i in range(0, 10) do if i == 2 then continue end; if i == 5 then break end; r.append(i) end; return r`,
+		`let r = []; for i in range(0, 3) do for j in range(i, 3) do r.append(j) end end; return r`,
+		`let r = []; for i in range(0, 3) do r.append(fn() return i end) end; return r[0]() + r[2]()`,
+		`fn f() for i in range(0, 5) do if i == 3 then return i end end end; return f()`,
+		`let r = []; for i in range(0, 3) do defer r.append(-i) end; r.append(i) end; return r`,
+		`let r = []; for i in range(0, 3) do catch r.append(-i) end; if i == 1 then fail() end; r.append(i) end; return r`,
+		`let r = []; for i in range(0, 3) do for j in range(0, 3) do r.append(j); if j == i then goto next end end ::next:: end; return r`,
+		`let r = []; for i in range(0, 3) do for j in range(0, 3) do defer r.append(-j) end; if j == i then goto next end; r.append(j) end ::next:: end; return r`,
+		`let range = fn(a, b) return [b, a] end; let r = []; for i in range(1, 2) do r.append(i) end; return r`,
+		`let s = 0; for i in range(0, 2.0) do s = s + i end; return s`,
+		`for i in range(0, 10, 0) do end`,
+		`for i in range("a", 10) do end`,
+		`for i in range(0, 10, null) do end`,
+		`for i in range(0, 1.5) do end`,
+		`let x = 0
+for i in
+	range(0, "b") do
+	x = i
+end`,
+	}
+	for _, src := range srcs {
+		t.Run(src, func(t *testing.T) {
+			want, wantErr := runSourceMode(t, &machine.Thread{}, src, 0)
+			got, gotErr := runSourceMode(t, &machine.Thread{}, src, compiler.Optimize)
+			if wantErr != nil {
+				require.EqualError(t, gotErr, wantErr.Error())
+				var we, ge *machine.Error
+				require.ErrorAs(t, wantErr, &we)
+				require.ErrorAs(t, gotErr, &ge)
+				_, wantPos := we.Position()
+				_, gotPos := ge.Position()
+				require.Equal(t, wantPos, gotPos)
+				return
+			}
+			require.NoError(t, gotErr)
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+func BenchmarkRangeLoop(b *testing.B) {
+	// the loop is compiled to a generic iteration without Optimize, and to
+	// the specialized RANGEJMP loop with it.
+	src := `
+let s = 0
+for i in range(1, 10000001) do
+	s = s + i
+end
+return s
+`
+	for _, mode := range []compiler.Mode{0, compiler.Optimize} {
+		b.Run(fmt.Sprintf("mode=%d", mode), func(b *testing.B) {
+			prog := compileSource(b, src, mode, predeclared)
+			ctx := context.Background()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				v, err := (&machine.Thread{}).RunProgram(ctx, prog)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if v != machine.Int(50000005000000) {
+					b.Fatalf("want 50000005000000, got %v", v)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompactJumps(b *testing.B) {
+	for _, mode := range []compiler.Mode{0, compiler.CompactJumps} {
+		b.Run(fmt.Sprintf("mode=%d", mode), func(b *testing.B) {
+			prog := compileSource(b, shortJumps, mode, predeclared)
+			ctx := context.Background()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := (&machine.Thread{}).RunProgram(ctx, prog); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStackUsage(t *testing.T) {
+	src := `
+fn h(a, b, c) return a + b * c end
+fn g(x) return h(x, x + 1, -x) end
+fn f(x) return 1 + g(x) end
+return f(1) + f(2)
+`
+	prog := compileSource(t, src, 0, nil)
+	var maxStack int
+	for _, fn := range prog.Functions {
+		maxStack = max(maxStack, fn.MaxStack)
+	}
+
+	th := &machine.Thread{RecordStackUsage: true, Debug: true}
+	got, err := th.RunProgram(context.Background(), prog)
+	require.NoError(t, err)
+	require.Equal(t, machine.Int(-3), got)
+
+	operand, calls := th.StackUsage()
+	require.Greater(t, operand, 0)
+	require.LessOrEqual(t, operand, maxStack)
+	require.Equal(t, 3, calls) // top-level, f, and g replaced by its tail call to h
+
+	th = &machine.Thread{}
+	_, err = th.RunProgram(context.Background(), prog)
+	require.NoError(t, err)
+	operand, calls = th.StackUsage()
+	require.Zero(t, operand)
+	require.Zero(t, calls)
+}
+
+func TestMaxCollectionSize(t *testing.T) {
+	const limit = 3
+
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"append up to limit", `
+let a = [1]
+a.append(2)
+a.append(3)
+return a[2]
+`, machine.Int(3), ""},
+		{"append past limit", `
+let a = [1, 2, 3]
+a.append(4)
+`, nil, "array.append: collection size limit exceeded: array of 4 elements, max 3"},
+		{"append past limit catchable", `
+let a = [1, 2, 3]
+let r = try a.append(4)
+return r
+`, machine.Nil, ""},
+		{"constant array literal", `
+return [1, 2, 3, 4]
+`, nil, "collection size limit exceeded: array of 4 elements, max 3"},
+		{"array literal", `
+let x = 1
+return [x, x, x, x]
+`, nil, "collection size limit exceeded: array of 4 elements, max 3"},
+		{"array repetition up to limit", `
+return ([1] * 3)[2]
+`, machine.Int(1), ""},
+		{"array repetition past limit", `
+return [0] * 100
+`, nil, "array repetition: collection size limit exceeded: array of 100 elements, max 3"},
+		{"map literal", `
+return {a: 1, b: 2, c: 3, d: 4}
+`, nil, "collection size limit exceeded: map of 4 elements, max 3"},
+		{"map new key", `
+let m = {a: 1, b: 2, c: 3}
+m.d = 4
+`, nil, "collection size limit exceeded: map of 4 elements, max 3"},
+		{"map existing key", `
+let m = {a: 1, b: 2, c: 3}
+m.c = 4
+m["a"] = 5
+return m.a + m.c
+`, machine.Int(9), ""},
+		{"setdefault new key", `
+let m = {a: 1, b: 2, c: 3}
+setdefault(m, "d")
+`, nil, "setdefault: collection size limit exceeded: map of 4 elements, max 3"},
+		{"set", `
+return set((1, 2, 3, 1, 4))
+`, nil, "set: collection size limit exceeded: set of 4 elements, max 3"},
+		{"set duplicates", `
+return sorted(set((1, 2, 3, 1, 2)))
+`, machine.NewArray([]machine.Value{machine.Int(1), machine.Int(2), machine.Int(3)}), ""},
+		{"set union", `
+return sorted(set((1, 2)) | set((2, 3)))
+`, machine.NewArray([]machine.Value{machine.Int(1), machine.Int(2), machine.Int(3)}), ""},
+		{"set union past limit", `
+return set((1, 2)) | set((2, 3, 4))
+`, nil, "collection size limit exceeded: set of 4 elements, max 3"},
+		{"sorted past limit", `
+return sorted(range(0, 1 << 40))
+`, nil, "sorted: collection size limit exceeded: array of 1099511627776 elements, max 3"},
+		{"sorted iterable past limit", `
+return sorted(take(range(0, 10), 4))
+`, nil, "sorted: collection size limit exceeded: array of 4 elements, max 3"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			th := &machine.Thread{MaxCollectionSize: limit}
+			got, err := runSourceThread(t, th, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestMaxCallStackDepth(t *testing.T) {
+	const rec = `
+fn f(n)
+	if n == 0 then return 0 end
+	return 1 + f(n - 1)
+end
+`
+
+	cases := []struct {
+		desc  string
+		limit int
+		src   string
+		want  machine.Value
+		err   string
+	}{
+		{"below limit", 50, rec + `return f(40)`, machine.Int(40), ""},
+		{"no limit", 0, rec + `return f(5000)`, machine.Int(5000), ""},
+		{"negative limit", -1, rec + `return f(5000)`, machine.Int(5000), ""},
+		{"past limit", 50, rec + `return f(100)`, nil, "call stack depth exceeded: max 50"},
+		{"past limit not catchable by try", 50, rec + `
+let r = try f(100)
+return r
+`, nil, "call stack depth exceeded: max 50"},
+		{"past limit not catchable by catch", 50, rec + `
+let x = 0
+do
+	catch
+		x = 1
+	end
+	f(100)
+end
+return x
+`, nil, "call stack depth exceeded: max 50"},
+		{"exact limit", 3, `
+fn g() return 1 end
+fn f() return 1 + g() end
+return 1 + f()
+`, machine.Int(3), ""},
+		{"one past limit", 3, `
+fn h() return 1 end
+fn g() return 1 + h() end
+fn f() return 1 + g() end
+return 1 + f()
+`, nil, "call stack depth exceeded: max 3"},
+		{"tail calls", 3, `
+fn f(n)
+	if n == 0 then return 0 end
+	return f(n - 1)
+end
+return f(100)
+`, machine.Int(0), ""},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			th := &machine.Thread{MaxCallStackDepth: c.limit}
+			got, err := runSourceThread(t, th, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				var ce *machine.CriticalError
+				require.ErrorAs(t, err, &ce)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestMaxSteps(t *testing.T) {
+	cases := []struct {
+		desc  string
+		limit int
+		src   string
+		want  machine.Value
+		err   string
+	}{
+		{"below limit", 1000, `return 1 + 2`, machine.Int(3), ""},
+		{"past limit", 1000, `for do end`, nil, "thread cancelled: step limit exceeded: max 1000"},
+		{"not catchable by catch", 1000, `
+let x = 0
+do
+	catch
+		x = 1
+	end
+	for do end
+end
+return x
+`, nil, "thread cancelled: step limit exceeded: max 1000"},
+		{"not catchable by try", 1000, `
+fn f() for do end end
+return try f()
+`, nil, "thread cancelled: step limit exceeded: max 1000"},
+		{"not catchable in caller", 1000, `
+fn f() for do end end
+let x = 0
+do
+	catch
+		x = 1
+	end
+	f()
+end
+return x
+`, nil, "thread cancelled: step limit exceeded: max 1000"},
+		{"runtime error caught", 1000, `
+let x = 0
+do
+	catch
+		x = 1
+	end
+	fail()
+end
+return x
+`, machine.Int(1), ""},
+		{"runtime error caught by try", 1000, `return try fail()`, machine.Nil, ""},
+		{"must not catchable", 1000, `
+let x = 0
+do
+	catch
+		x = 1
+	end
+	must fail()
+end
+return x
+`, nil, "failed"},
+		{"defer error during must not catchable", 1000, `
+let x = 0
+do
+	catch
+		x = 1
+	end
+	defer
+		fail()
+	end
+	must fail()
+end
+return x
+`, nil, "failed"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			th := &machine.Thread{MaxSteps: c.limit}
+			got, err := runSourceThread(t, th, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				var ce *machine.CriticalError
+				require.ErrorAs(t, err, &ce)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	cases := []struct {
+		desc     string
+		interval int
+		src      string
+	}{
+		{"tight loop", 0, `for do end`},
+		{"tight loop check every step", 1, `for do end`},
+		{"tight loop large interval", 1 << 20, `for do end`},
+		{"not catchable by catch", 0, `
+do
+	catch
+		return 1
+	end
+	for do end
+end
+`},
+		{"not catchable by try", 0, `
+fn f() for do end end
+return try f()
+`},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			prog := compileSource(t, c.src, 0, nil)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			th := &machine.Thread{CancelCheckInterval: c.interval}
+			_, err := th.RunProgram(ctx, prog)
+			require.ErrorContains(t, err, "thread cancelled: context deadline exceeded")
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+			var ce *machine.CriticalError
+			require.ErrorAs(t, err, &ce)
+		})
+	}
+
+	t.Run("cause", func(t *testing.T) {
+		prog := compileSource(t, `for do end`, 0, nil)
+		ctx, cancel := context.WithCancelCause(context.Background())
+		cause := errors.New("shutting down")
+		time.AfterFunc(10*time.Millisecond, func() { cancel(cause) })
+
+		th := &machine.Thread{}
+		_, err := th.RunProgram(ctx, prog)
+		require.ErrorIs(t, err, cause)
+		require.ErrorContains(t, err, "thread cancelled: shutting down")
+	})
+}
+
+func TestTailCall(t *testing.T) {
+	t.Run("countdown", func(t *testing.T) {
+		src := `
+fn count(n)
+	if n == 0 then return "done" end
+	return count(n - 1)
+end
+let r = count(1000000)
+return r
+`
+		th := &machine.Thread{RecordStackUsage: true}
+		got, err := runSourceThread(t, th, src)
+		require.NoError(t, err)
+		require.Equal(t, machine.String("done"), got)
+		_, calls := th.StackUsage()
+		require.Equal(t, 2, calls) // top-level and count
+	})
+
+	cases := []struct {
+		desc string
+		th   *machine.Thread
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"mutual recursion", nil, `
+fn even(n, other)
+	if n == 0 then return true end
+	return other(n - 1, even)
+end
+fn odd(n, other)
+	if n == 0 then return false end
+	return other(n - 1, odd)
+end
+return (even(100001, odd), odd(100001, even))
+`, machine.NewTuple([]machine.Value{machine.False, machine.True}), ""},
+		{"accumulator", nil, `
+fn sum(n, acc)
+	if n == 0 then return acc end
+	return sum(n - 1, acc + n)
+end
+return sum(1000, 0)
+`, machine.Int(500500), ""},
+		{"different locals", nil, `
+fn g(a, b, c)
+	let d = a + b
+	return d * c
+end
+fn f(x) return g(x, 1, 2) end
+return f(3)
+`, machine.Int(8), ""},
+		{"closure", nil, `
+fn make(n)
+	fn inner(x) return x + n end
+	return inner
+end
+fn f(g, x) return g(x) end
+return f(make(10), 5)
+`, machine.Int(15), ""},
+		{"covered by catch", nil, `
+fn g() fail() end
+fn f()
+	let x = 1
+	do
+		catch
+			x = 2
+		end
+		return g()
+	end
+	return x
+end
+return f()
+`, machine.Int(2), ""},
+		{"covered by defer", nil, `
+let log = []
+fn g() log.append("g") return 1 end
+fn f()
+	defer log.append("defer") end
+	return g()
+end
+let r = f()
+return (r, log[0], log[1])
+`, machine.NewTuple([]machine.Value{machine.Int(1), machine.String("g"), machine.String("defer")}), ""},
+		{"invalid arguments", nil, `
+fn g(a) return a end
+fn f() return g(1, 2) end
+let r = f()
+`, nil, "function g accepts at most 1 arguments (2 given)"},
+		{"recursion disabled", &machine.Thread{DisableRecursion: true}, `
+fn f(n)
+	if n == 0 then return 0 end
+	return f(n - 1)
+end
+let r = f(1)
+`, nil, "function f called recursively"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			th := c.th
+			if th == nil {
+				th = &machine.Thread{}
+			}
+			got, err := runSourceThread(t, th, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func BenchmarkTailCall(b *testing.B) {
+	const src = `
+fn count(n)
+	if n == 0 then return 0 end
+	return count(n - 1)
+end
+let r = count(10000)
+return r
+`
+	prog := compileSource(b, src, 0, predeclared)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := (&machine.Thread{}).RunProgram(ctx, prog); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
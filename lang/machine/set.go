@@ -0,0 +1,164 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/dolthub/swiss"
+	"github.com/mna/nenuphar/lang/token"
+)
+
+// A Set represents a collection of distinct values. Values must be Hashable
+// and are compared the same way as the keys of a Map. Iteration over a Set
+// yields each of its values, in insertion order.
+type Set struct {
+	m      *swiss.Map[Value, int] // index of the value in values
+	values []Value                // in insertion order
+	frozen bool
+}
+
+var (
+	_ Value     = (*Set)(nil)
+	_ Iterable  = (*Set)(nil)
+	_ Sequence  = (*Set)(nil)
+	_ HasBinary = (*Set)(nil)
+	_ Freezable = (*Set)(nil)
+)
+
+// NewSet returns a set with initial capacity for at least size values.
+func NewSet(size int) *Set {
+	m := swiss.NewMap[Value, int](uint32(size))
+	return &Set{m: m, values: make([]Value, 0, size)}
+}
+
+func (s *Set) String() string { return fmt.Sprintf("set(%p)", s) }
+func (s *Set) Type() string   { return "set" }
+func (s *Set) Len() int       { return len(s.values) }
+
+// Has returns true if the set contains v, or an error if v is not Hashable.
+func (s *Set) Has(v Value) (bool, error) {
+	v, err := hashKey(v)
+	if err != nil {
+		return false, err
+	}
+	return s.m.Has(v), nil
+}
+
+// Add adds v to the set, it does nothing if the set already contains v. It
+// returns an error if v is not Hashable.
+func (s *Set) Add(v Value) error {
+	if s.frozen {
+		return frozenError(s)
+	}
+	v, err := hashKey(v)
+	if err != nil {
+		return err
+	}
+	s.put(v)
+	return nil
+}
+
+// put adds the already hashed value v to the set if it is not already
+// present.
+func (s *Set) put(v Value) {
+	if s.m.Has(v) {
+		return
+	}
+	s.m.Put(v, len(s.values))
+	s.values = append(s.values, v)
+}
+
+// Freeze freezes the set and its values.
+func (s *Set) Freeze() {
+	if s.frozen {
+		return
+	}
+	s.frozen = true
+	for _, v := range s.values {
+		Freeze(v)
+	}
+}
+func (s *Set) Frozen() bool { return s.frozen }
+
+// Binary implements the set operations when both operands are sets: the
+// union (|), the intersection (&) and the difference (-). The result is
+// always a new set, with the values in the order of the left operand followed
+// by those of the right one. Calling Binary directly does not enforce a
+// thread's MaxCollectionSize for the union, the Binary API function does.
+func (s *Set) Binary(op token.Token, y Value, side Side) (Value, error) {
+	ys, ok := y.(*Set)
+	if !ok {
+		return nil, nil
+	}
+	l, r := s, ys
+	if side == Right {
+		l, r = ys, s
+	}
+
+	switch op {
+	case token.PIPE:
+		return l.union(new(Thread), r)
+
+	case token.AMPERSAND:
+		res := NewSet(min(l.Len(), r.Len()))
+		for _, v := range l.values {
+			if r.m.Has(v) {
+				res.put(v)
+			}
+		}
+		return res, nil
+
+	case token.MINUS:
+		res := NewSet(l.Len())
+		for _, v := range l.values {
+			if !r.m.Has(v) {
+				res.put(v)
+			}
+		}
+		return res, nil
+	}
+	return nil, nil
+}
+
+// union returns a new set with the values of s and y. It fails if the
+// resulting set exceeds th.MaxCollectionSize.
+func (s *Set) union(th *Thread, y *Set) (Value, error) {
+	if err := th.checkCollectionSize(s.Type(), s.Len()); err != nil {
+		return nil, err
+	}
+	res := NewSet(s.Len() + y.Len())
+	for _, v := range s.values {
+		res.put(v)
+	}
+	for _, v := range y.values {
+		if res.m.Has(v) {
+			continue
+		}
+		if err := th.checkCollectionSize(res.Type(), res.Len()+1); err != nil {
+			return nil, err
+		}
+		res.put(v)
+	}
+	return res, nil
+}
+
+// Iterate returns an iterator over the values of the set, in insertion order.
+// The effect of adding values to the set during iteration is unspecified.
+func (s *Set) Iterate() Iterator {
+	return &setIterator{s: s}
+}
+
+type setIterator struct {
+	s *Set
+	i int
+}
+
+func (it *setIterator) Next(p *Value) bool {
+	if it.i >= len(it.s.values) {
+		return false
+	}
+	*p = it.s.values[it.i]
+	it.i++
+	return true
+}
+
+func (it *setIterator) Done() {}
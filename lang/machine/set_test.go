@@ -0,0 +1,82 @@
+package machine_test
+
+import (
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSet(t *testing.T) {
+	type I = machine.Int
+	tup := func(vs ...machine.Value) machine.Value { return machine.NewTuple(vs) }
+	arr := func(vs ...machine.Value) machine.Value { return machine.NewArray(vs) }
+
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"from array", `
+let s = set([3, 1, 2, 2, 1])
+return sorted(s)
+`, arr(I(1), I(2), I(3)), ""},
+		{"empty", `
+for x in set() do return false end
+return true
+`, machine.True, ""},
+		{"membership", `
+let s = set([1, "a", 3.5])
+return (1 in s, "a" in s, 3.5 in s, 2 in s, 2 not in s)
+`, tup(machine.True, machine.True, machine.True, machine.False, machine.True), ""},
+		{"union", `
+let s = set([1, 2]) | set([2, 3])
+return sorted(s)
+`, arr(I(1), I(2), I(3)), ""},
+		{"intersection", `
+let s = set([1, 2, 3]) & set([2, 3, 4])
+return sorted(s)
+`, arr(I(2), I(3)), ""},
+		{"difference", `
+let a, b = set([1, 2, 3]), set([2, 4])
+return (sorted(a - b), sorted(b - a))
+`, tup(arr(I(1), I(3)), arr(I(4))), ""},
+		{"operands unchanged", `
+let a, b = set([1]), set([2])
+let c = a | b
+return (sorted(a), sorted(b), sorted(c))
+`, tup(arr(I(1)), arr(I(2)), arr(I(1), I(2))), ""},
+		{"insertion order", `
+fn values(s)
+  let r = []
+  for x in s do r.append(x) end
+  return r
+end
+let s = set([3, "a", 1, 3, 2.5, "a"])
+return (values(s), values(s | set([9, 1, 8])), values(set([4, 1, 2, 3]) & set([3, 2, 1])), values(set([5, 1, 4, 2]) - set([4])))
+`, tup(
+			arr(I(3), machine.String("a"), I(1), machine.Float(2.5)),
+			arr(I(3), machine.String("a"), I(1), machine.Float(2.5), I(9), I(8)),
+			arr(I(1), I(2), I(3)),
+			arr(I(5), I(1), I(2)),
+		), ""},
+		{"unhashable NaN", `
+let inf = 1e308 * 10
+return set([1, inf - inf, inf - inf])
+`, nil, "unhashable: NaN"},
+		{"not iterable", `set(true)`, nil, "set: argument #1: want iterable, got bool"},
+		{"unsupported operand", `return set([1]) | 1`, nil, "unsupported binary op"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
@@ -1,28 +1,53 @@
 package machine
 
 import (
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // String is the type of a text string. It encapsulates an immutable sequence
-// of bytes. Iteration on a string yields each byte.
+// of bytes, usually UTF-8-encoded text. Iteration on a string yields each
+// rune as a one-rune string, while its length (the # operator) is its number
+// of bytes. An invalid UTF-8 byte is yielded as a one-byte string. The
+// bytes_of and runes_of built-ins provide the explicit byte and rune views.
 type String string
 
 var (
 	_ Value    = String("")
 	_ Ordered  = String("")
 	_ Iterable = String("")
+	_ HasAttrs = String("")
+	_ Hashable = String("")
 )
 
 func (s String) String() string { return strconv.Quote(string(s)) }
 func (s String) Type() string   { return "string" }
 
+func (s String) Hash() (uint32, error) { return hashString(string(s)), nil }
+
 func (s String) Cmp(y Value) (int, error) {
 	sb := y.(String)
 	return strings.Compare(string(s), string(sb)), nil
 }
 
+// Attr returns the method of the string bound to s as receiver, or nil if
+// there is no such method.
+func (s String) Attr(name string) (Value, error) {
+	m := stringMethods[name]
+	if m == nil {
+		return nil, nil
+	}
+	return NewBuiltin("string."+name, func(th *Thread, b *Builtin, args *Tuple) (Value, error) {
+		return m(b, string(s), args)
+	}), nil
+}
+
+// AttrNames returns the sorted names of the methods of a string.
+func (s String) AttrNames() []string { return stringMethodNames }
+
 func (s String) Iterate() Iterator {
 	return &stringIterator{s: string(s)}
 }
@@ -33,11 +58,135 @@ type stringIterator struct {
 
 func (it *stringIterator) Next(p *Value) bool {
 	if len(it.s) > 0 {
-		*p = String(it.s[0])
-		it.s = it.s[1:]
+		_, sz := utf8.DecodeRuneInString(it.s)
+		*p = String(it.s[:sz])
+		it.s = it.s[sz:]
 		return true
 	}
 	return false
 }
 
 func (it *stringIterator) Done() {}
+
+// stringMethods maps the name of each string method to its implementation,
+// which is called with the bound builtin, the receiver and the arguments.
+var stringMethods = map[string]func(b *Builtin, s string, args *Tuple) (Value, error){
+	"upper":      stringUpper,
+	"lower":      stringLower,
+	"startswith": stringStartsWith,
+	"endswith":   stringEndsWith,
+	"split":      stringSplit,
+	"replace":    stringReplace,
+	"index":      stringIndex,
+}
+
+var stringMethodNames = func() []string {
+	names := make([]string, 0, len(stringMethods))
+	for name := range stringMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}()
+
+// s.upper() returns s with all Unicode letters mapped to their upper case.
+func stringUpper(b *Builtin, s string, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 0, 0); err != nil {
+		return nil, err
+	}
+	return String(strings.ToUpper(s)), nil
+}
+
+// s.lower() returns s with all Unicode letters mapped to their lower case.
+func stringLower(b *Builtin, s string, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 0, 0); err != nil {
+		return nil, err
+	}
+	return String(strings.ToLower(s)), nil
+}
+
+// s.startswith(prefix) returns true if s starts with prefix.
+func stringStartsWith(b *Builtin, s string, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	prefix, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return Bool(strings.HasPrefix(s, prefix)), nil
+}
+
+// s.endswith(suffix) returns true if s ends with suffix.
+func stringEndsWith(b *Builtin, s string, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	suffix, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return Bool(strings.HasSuffix(s, suffix)), nil
+}
+
+// s.split(sep?) returns an array of the substrings of s separated by sep. If
+// sep is not provided, s is split around runs of whitespace and the result
+// has no empty string.
+func stringSplit(b *Builtin, s string, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 0, 1); err != nil {
+		return nil, err
+	}
+
+	var parts []string
+	if args.Len() == 0 {
+		parts = strings.Fields(s)
+	} else {
+		sep, err := stringArg(b, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		if sep == "" {
+			return nil, fmt.Errorf("%s: empty separator", b.name)
+		}
+		parts = strings.Split(s, sep)
+	}
+
+	elems := make([]Value, len(parts))
+	for i, part := range parts {
+		elems[i] = String(part)
+	}
+	return NewArray(elems), nil
+}
+
+// s.replace(old, new) returns s with all occurrences of old replaced by new.
+func stringReplace(b *Builtin, s string, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 2, 2); err != nil {
+		return nil, err
+	}
+	old, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	new, err := stringArg(b, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return String(strings.ReplaceAll(s, old, new)), nil
+}
+
+// s.index(sub) returns the byte index of the first occurrence of sub in s,
+// or an error if s does not contain sub.
+func stringIndex(b *Builtin, s string, args *Tuple) (Value, error) {
+	if err := checkArity(b, args, 1, 1); err != nil {
+		return nil, err
+	}
+	sub, err := stringArg(b, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	i := strings.Index(s, sub)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: substring not found", b.name)
+	}
+	return Int(i), nil
+}
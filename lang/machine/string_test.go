@@ -0,0 +1,58 @@
+package machine_test
+
+import (
+	"testing"
+
+	"github.com/mna/nenuphar/lang/machine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStringMethods(t *testing.T) {
+	type S = machine.String
+
+	cases := []struct {
+		desc string
+		src  string
+		want machine.Value
+		err  string
+	}{
+		{"upper", `let s = "abcé" return s.upper()`, S("ABCÉ"), ""},
+		{"lower", `let s = "AbCÉ" return s.lower()`, S("abcé"), ""},
+		{"startswith", `let s = "abc" return s.startswith("ab")`, machine.True, ""},
+		{"startswith false", `let s = "abc" return s.startswith("b")`, machine.False, ""},
+		{"endswith", `let s = "abc" return s.endswith("bc")`, machine.True, ""},
+		{"endswith false", `let s = "abc" return s.endswith("b")`, machine.False, ""},
+		{"split", `let s = "a,b,,c" let a = s.split(",") return (a[0], a[2], a[-1])`,
+			machine.NewTuple([]machine.Value{S("a"), S(""), S("c")}), ""},
+		{"split whitespace", `let s = " a \t b\n" let a = s.split() return (a[0], a[1], a[-2])`,
+			machine.NewTuple([]machine.Value{S("a"), S("b"), S("a")}), ""},
+		{"replace", `let s = "abab" return s.replace("b", "xy")`, S("axyaxy"), ""},
+		{"index", `let s = "abcb" return s.index("cb")`, machine.Int(2), ""},
+		{"bound method", `
+let s = "abc"
+let up = s.upper
+s = "def"
+return up()
+`, S("ABC"), ""},
+
+		{"upper too many args", `let s = "a" return s.upper(1)`, nil, "string.upper: got 1 arguments, want at most 0"},
+		{"startswith no arg", `let s = "a" return s.startswith()`, nil, "string.startswith: got 0 arguments, want at least 1"},
+		{"endswith not string", `let s = "a" return s.endswith(1)`, nil, "string.endswith: argument #1: want string, got int"},
+		{"split empty sep", `let s = "a" return s.split("")`, nil, "string.split: empty separator"},
+		{"replace missing arg", `let s = "a" return s.replace("a")`, nil, "string.replace: got 1 arguments, want at least 2"},
+		{"replace not string", `let s = "a" return s.replace("a", true)`, nil, "string.replace: argument #2: want string, got bool"},
+		{"index not found", `let s = "abc" return s.index("d")`, nil, "string.index: substring not found"},
+		{"unknown method", `let s = "abc" return s.uper()`, nil, "string has no .uper field or method (did you mean .upper?)"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := runSource(t, c.src)
+			if c.err != "" {
+				require.EqualError(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
@@ -25,6 +25,13 @@ type Thread struct {
 	// <= 0 means no limit.
 	MaxSteps int
 
+	// CancelCheckInterval is the number of steps between two checks of the
+	// thread's context, so that a program stops running shortly after its
+	// context is done (e.g. cancelled or past its deadline). A lower value
+	// makes the thread more responsive to cancellation at the cost of some
+	// overhead. A value <= 0 means a check every 1000 steps.
+	CancelCheckInterval int
+
 	// DisableRecursion prevents recursive execution of functions when set to
 	// true. It incurs a small performance cost for the runtime verification on
 	// each function call but can be a useful safety check when executing
@@ -36,6 +43,31 @@ type Thread struct {
 	// is reached, the thread is cancelled. A value <= 0 means no limit.
 	MaxCallStackDepth int
 
+	// MaxCollectionSize limits the number of elements of the arrays, maps and
+	// sets created or grown by the thread, e.g. by an array or map literal,
+	// by appending to or repeating an array or by setting a new key in a map.
+	// If the limit would be exceeded, the operation fails with a (catchable)
+	// error. A value <= 0 means no limit.
+	MaxCollectionSize int
+
+	// Debug enables additional diagnostics for runtime errors, at the cost of
+	// some overhead. When set, an uncaught runtime error raised by a function
+	// is returned as a *DebugError that includes the disassembled instructions
+	// around the failing one. It also checks that the depth of the operand
+	// stack never exceeds the one computed by the compiler.
+	Debug bool
+
+	// RecordStackUsage enables the recording of the peak depths of the operand
+	// stack and of the call stack reached during execution, as reported by
+	// StackUsage.
+	RecordStackUsage bool
+
+	// StrictIndex makes indexing a mapping with a key that it does not contain
+	// (e.g. m[k], or m.k for a map) fail with a "key not found" error. By
+	// default, it evaluates to nil. The get built-in provides a lookup with a
+	// default value that never fails on a missing key.
+	StrictIndex bool
+
 	// Load is an optional function value to call to load modules (called by the
 	// LOAD opcode).
 	Load func(*Thread, string) (Value, error)
@@ -47,11 +79,14 @@ type Thread struct {
 	Predeclared map[string]Value
 
 	ctx       context.Context
-	ctxCancel func()
+	ctxCancel context.CancelCauseFunc
 	callStack []*Frame
 	cancelled atomic.Bool
 
-	steps, maxSteps uint64
+	steps, maxSteps              uint64
+	cancelCheck, nextCancelCheck uint64
+
+	peakStack, peakCalls int
 
 	stdout io.Writer
 	stderr io.Writer
@@ -64,13 +99,53 @@ func (th *Thread) RunProgram(ctx context.Context, p *compiler.Program) (Value, e
 		return nil, fmt.Errorf("thread %s is already executing a program", th.Name)
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancelCause(ctx)
 	th.ctx = ctx
 	th.ctxCancel = cancel
 	topfn := makeToplevelFunction(p)
 	return Call(th, topfn, nil)
 }
 
+// StackUsage returns the peak depth of the operand stack of a function call
+// and the peak depth of the call stack reached by the thread so far. It
+// returns 0 for both if RecordStackUsage is not set.
+func (th *Thread) StackUsage() (operand, calls int) {
+	return th.peakStack, th.peakCalls
+}
+
+// checkCollectionSize returns an error if a collection of type typ with n
+// elements exceeds th.MaxCollectionSize.
+func (th *Thread) checkCollectionSize(typ string, n int) error {
+	if th.MaxCollectionSize > 0 && n > th.MaxCollectionSize {
+		return fmt.Errorf("collection size limit exceeded: %s of %d elements, max %d", typ, n, th.MaxCollectionSize)
+	}
+	return nil
+}
+
+// checkMapKey returns an error if setting key k in m would add an entry that
+// exceeds th.MaxCollectionSize.
+func (th *Thread) checkMapKey(m *Map, k Value) error {
+	if th.MaxCollectionSize <= 0 {
+		return nil
+	}
+	if _, found, _ := m.Get(k); found {
+		return nil
+	}
+	return th.checkCollectionSize(m.Type(), m.Len()+1)
+}
+
+// checkSetValue returns an error if adding v to s would exceed
+// th.MaxCollectionSize.
+func (th *Thread) checkSetValue(s *Set, v Value) error {
+	if th.MaxCollectionSize <= 0 {
+		return nil
+	}
+	if found, _ := s.Has(v); found {
+		return nil
+	}
+	return th.checkCollectionSize(s.Type(), s.Len()+1)
+}
+
 func (th *Thread) init() {
 	// one-time initialization of thread
 	if th.MaxSteps <= 0 {
@@ -78,6 +153,12 @@ func (th *Thread) init() {
 	} else {
 		th.maxSteps = uint64(th.MaxSteps)
 	}
+	if th.CancelCheckInterval <= 0 {
+		th.cancelCheck = defaultCancelCheckInterval
+	} else {
+		th.cancelCheck = uint64(th.CancelCheckInterval)
+	}
+	th.nextCancelCheck = th.cancelCheck
 	if th.Stdout != nil {
 		th.stdout = th.Stdout
 	} else {
@@ -94,32 +175,39 @@ func (th *Thread) init() {
 		th.stdin = os.Stdin
 	}
 	if th.ctx == nil {
-		th.ctx = context.Background()
-		th.ctxCancel = func() {}
-	} else {
-		go func() {
-			<-th.ctx.Done()
-			th.cancelled.Store(true)
-		}()
+		th.ctx, th.ctxCancel = context.WithCancelCause(context.Background())
+	}
+}
+
+// defaultCancelCheckInterval is the number of steps between two checks of
+// the thread's context if Thread.CancelCheckInterval is not set.
+const defaultCancelCheckInterval = 1000
+
+// isCancelled returns true if the thread is cancelled, checking its context
+// if it has not been observed as done yet. It is used by the built-ins that
+// may loop for a long time without returning control to the machine.
+func (th *Thread) isCancelled() bool {
+	if th.cancelled.Load() {
+		return true
+	}
+	if th.ctx.Err() != nil {
+		th.cancelled.Store(true)
+		return true
 	}
+	return false
+}
+
+// cancelledError returns the critical error that terminates the thread when
+// its context is done, which wraps the cause of the cancellation.
+func (th *Thread) cancelledError() error {
+	return &CriticalError{Err: fmt.Errorf("thread cancelled: %w", context.Cause(th.ctx))}
 }
 
 func makeToplevelFunction(p *compiler.Program) *Function {
 	// create the value denoted by each program constant
 	constants := make([]Value, len(p.Constants))
 	for i, c := range p.Constants {
-		var v Value
-		switch c := c.(type) {
-		case int64:
-			v = Int(c)
-		case string:
-			v = String(c)
-		case float64:
-			v = Float(c)
-		default:
-			panic(fmt.Sprintf("unexpected constant %T: %[1]v", c))
-		}
-		constants[i] = v
+		constants[i] = constantValue(c)
 	}
 
 	return &Function{
@@ -130,3 +218,29 @@ func makeToplevelFunction(p *compiler.Program) *Function {
 		},
 	}
 }
+
+// constantValue returns the value denoted by the program constant c.
+func constantValue(c interface{}) Value {
+	switch c := c.(type) {
+	case nil:
+		return Nil
+	case bool:
+		return Bool(c)
+	case int64:
+		return Int(c)
+	case string:
+		return String(c)
+	case compiler.Bytes:
+		return Bytes(c)
+	case float64:
+		return Float(c)
+	case compiler.Tuple:
+		elems := make([]Value, len(c))
+		for i, v := range c {
+			elems[i] = constantValue(v)
+		}
+		return NewTuple(elems)
+	default:
+		panic(fmt.Sprintf("unexpected constant %T: %[1]v", c))
+	}
+}
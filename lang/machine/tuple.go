@@ -22,6 +22,7 @@ var (
 	_ Iterable  = (*Tuple)(nil)
 	_ HasEqual  = (*Tuple)(nil)
 	_ Sequence  = (*Tuple)(nil)
+	_ Freezable = (*Tuple)(nil)
 )
 
 // NewTuple returns a tuple containing the specified elements. Callers should
@@ -33,14 +34,32 @@ func (t *Tuple) Type() string      { return "tuple" }
 func (t *Tuple) Iterate() Iterator { return &tupleIterator{elems: t.elems} }
 func (t *Tuple) Len() int          { return len(t.elems) }
 func (t *Tuple) Index(i int) Value { return t.elems[i] }
-func (t *Tuple) Equals(y Value) (bool, error) {
+
+// Freeze freezes the values of the tuple, which is itself always immutable.
+func (t *Tuple) Freeze() {
+	for _, v := range t.elems {
+		Freeze(v)
+	}
+}
+
+// Frozen returns true if all values of the tuple are frozen or are not
+// freezable.
+func (t *Tuple) Frozen() bool {
+	for _, v := range t.elems {
+		if f, ok := v.(Freezable); ok && !f.Frozen() {
+			return false
+		}
+	}
+	return true
+}
+func (t *Tuple) Equals(th *Thread, y Value) (bool, error) {
 	yt := y.(*Tuple)
 	if len(t.elems) != len(yt.elems) {
 		return false, nil
 	}
 	for i, xv := range t.elems {
 		yv := yt.elems[i]
-		eq, err := Compare(token.EQEQ, xv, yv)
+		eq, err := Compare(th, token.EQEQ, xv, yv)
 		if !eq || err != nil {
 			return eq, err
 		}
@@ -41,7 +41,20 @@ type HasEqual interface {
 	// Equals returns true if the receiver value is considered equal to y. Client
 	// code should not call this method. Instead, use the standalone Compare
 	// function, which is defined for all pairs of operands.
-	Equals(y Value) (bool, error)
+	Equals(th *Thread, y Value) (bool, error)
+}
+
+// A Hashable value may be used as a key of a Map or as a value of a Set. Hash
+// returns a hash of the value such that values that are equal (see Compare)
+// have the same hash, or an error if the value cannot be hashed. As the map
+// stores its keys in a Go map-like structure, a Hashable type must also be
+// comparable with the Go == operator, consistently with its Hash method.
+//
+// An Int and a Float that denote the same mathematical value have the same
+// hash and are the same key, the Float is stored as an Int.
+type Hashable interface {
+	Value
+	Hash() (uint32, error)
 }
 
 // An Iterable abstracts a sequence of values. An iterable value may be
@@ -100,13 +113,21 @@ type Iterator interface {
 	Done()
 }
 
+// An ErrIterator is an Iterator that may fail while producing its values,
+// such as one that computes them lazily. When Next returns false, Err returns
+// the error that stopped the iteration, or nil if the iterator is exhausted.
+type ErrIterator interface {
+	Iterator
+	Err() error
+}
+
 // A Mapping is a mapping from keys to values, such as a map.
 type Mapping interface {
 	Value
 	// Get returns the value corresponding to the specified key, or !found if the
-	// mapping does not contain the key. TODO: revisit: Get also defines the
-	// behavior of "v in mapping". The 'in' operator reports the 'found'
-	// component, ignoring errors.
+	// mapping does not contain the key. Get also defines the behavior of "k in
+	// mapping", which reports the 'found' component (see Contains), and of
+	// "mapping[k]", which is nil if the key is not found.
 	Get(Value) (v Value, found bool, err error)
 }
 
@@ -143,7 +164,14 @@ type HasUnary interface {
 }
 
 // HasMetamap can be implemented by values that support customization of
-// behavior via metamethods.
+// behavior via metamethods. A metamethod is a callable value stored in the
+// metamap under a well-known name:
+//   - __eq, __lt, __le: comparison operators (see Compare)
+//   - __call: calling the value (see Call)
+//   - __add, __sub, __mul, __div, __idiv, __mod, __pow, __band, __bor,
+//     __bxor, __shl, __shr: arithmetic and bitwise binary operators (see
+//     Binary)
+//   - __len: the # length operator (see Unary)
 type HasMetamap interface {
 	Value
 	Metamap() *Map
@@ -165,6 +193,17 @@ type HasAttrs interface {
 	AttrNames() []string
 }
 
+// A Freezable value can be made immutable. Freeze marks the value and,
+// transitively, the values it contains as frozen, after which any attempt to
+// modify it fails with an error. Freeze must do nothing if the value is
+// already frozen, so that cyclic structures can be frozen.
+type Freezable interface {
+	Value
+	Freeze()
+	// Frozen returns true if the value is frozen.
+	Frozen() bool
+}
+
 // A HasSetField value has fields that may be written by a dot expression (x.f
 // = y). An implementation of SetField may return a NoSuchAttrError, in which
 // case the runtime may augment the error message to warn of possible
@@ -109,6 +109,9 @@ func (p *parser) parseStmt() (stmt ast.Stmt) {
 	case token.COLONCOLON:
 		return p.parseLabelStmt()
 
+	case token.PASS:
+		return &ast.PassStmt{Start: p.expect(token.PASS)}
+
 	default:
 		// can be func call, assign stmt, augassign stmt, try or must unop.
 		return p.parseExprOrAssignStmt(nil, nil)
@@ -155,6 +158,7 @@ var (
 		token.DEFER,
 		token.CATCH,
 		token.THROW,
+		token.PASS,
 	}
 
 	eobToks = []token.Token{
@@ -183,6 +187,7 @@ var (
 		token.DEFER:      syncAt,
 		token.CATCH:      syncAt,
 		token.THROW:      syncAt,
+		token.PASS:       syncAt,
 	}
 )
 
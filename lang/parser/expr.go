@@ -6,7 +6,23 @@ import (
 )
 
 func (p *parser) parseExpr() ast.Expr {
-	return p.parseSubExpr(0)
+	// an expression nested in another one (e.g. in parentheses or as an index)
+	// is never the for..in header, so "in" is a binary operator there.
+	noIn := p.noIn
+	p.noIn = false
+	expr := p.parseSubExpr(0)
+	p.noIn = noIn
+	return expr
+}
+
+// parseExprNoIn parses an expression where "in" is not treated as a binary
+// operator at the top level, so that the "in" keyword of a for..in statement
+// ends the expressions on the left.
+func (p *parser) parseExprNoIn() ast.Expr {
+	p.noIn = true
+	expr := p.parseSubExpr(0)
+	p.noIn = false
+	return expr
 }
 
 var (
@@ -15,6 +31,7 @@ var (
 		token.AND: {2, 2},
 		token.LT:  {3, 3}, token.LE: {3, 3}, token.GT: {3, 3},
 		token.GE: {3, 3}, token.EQEQ: {3, 3}, token.BANGEQ: {3, 3},
+		token.IN: {3, 3}, token.NOTIN: {3, 3},
 		token.PIPE:      {4, 4},
 		token.TILDE:     {5, 5},
 		token.AMPERSAND: {6, 6},
@@ -42,11 +59,23 @@ func (p *parser) parseSubExpr(priority int) ast.Expr {
 		left = p.parseSimpleExpr()
 	}
 
-	for p.tok.IsBinop() && binopPriority[p.tok].left > priority {
+	for {
+		// "not" cannot follow an operand unless it is the "not in" operator.
+		op := p.tok
+		if op == token.NOT {
+			op = token.NOTIN
+		}
+		if !op.IsBinop() || (op == token.IN && p.noIn) || binopPriority[op].left <= priority {
+			break
+		}
+
 		var bin ast.BinOpExpr
 		bin.Left = left
-		bin.Type = p.tok
+		bin.Type = op
 		bin.Op = p.expect(p.tok)
+		if op == token.NOTIN {
+			p.expect(token.IN)
+		}
 		bin.Right = p.parseSubExpr(binopPriority[bin.Type].right)
 		left = &bin
 	}
@@ -78,7 +107,7 @@ func (p *parser) parseAtomExpr() *ast.LiteralExpr {
 		val = p.val.Int
 	case token.FLOAT:
 		val = p.val.Float
-	case token.STRING:
+	case token.STRING, token.BYTES:
 		val = p.val.String
 	}
 	lit := &ast.LiteralExpr{
@@ -183,6 +212,11 @@ func (p *parser) parseTupleOrSuffixedExpr() ast.Expr {
 		return primary
 	}
 
+	// Note that a suffix may be on a different line than its primary
+	// expression, so that a statement that starts with a parenthesized
+	// expression following a call continues that call (as in "f()\n(g)()",
+	// which calls the result of f() with g). A semicolon must separate the
+	// statements if they are distinct.
 loop:
 	for p.tok != token.EOF {
 		switch p.tok {
@@ -199,6 +233,12 @@ loop:
 	return primary
 }
 
+// parseTupleOrPrimaryExpr parses an identifier, a parenthesized expression or
+// a tuple, and reports whether it is a tuple. A single expression in
+// parentheses is a ParenExpr, which is transparent: (x) is assignable if x
+// is, and (f)() is the same call as f(). A tuple requires a comma, so (x,)
+// is a tuple of one item and () is the empty tuple. A tuple cannot be
+// suffixed (called, indexed or dotted).
 func (p *parser) parseTupleOrPrimaryExpr() (e ast.Expr, isTuple bool) {
 	if p.tok == token.IDENT {
 		return p.parseIdentExpr(), false
@@ -271,7 +311,7 @@ func (p *parser) parseCallExpr(fn ast.Expr) *ast.CallExpr {
 	case token.LPAREN:
 		expr.Lparen = p.expect(token.LPAREN)
 		if p.tok != token.RPAREN {
-			expr.Args, expr.Commas = p.parseExprList()
+			expr.Args, expr.Named, expr.Commas = p.parseCallArgs()
 		}
 		expr.Rparen = p.expect(token.RPAREN)
 
@@ -291,6 +331,39 @@ func (p *parser) parseCallExpr(fn ast.Expr) *ast.CallExpr {
 	return &expr
 }
 
+// parseCallArgs parses the comma-separated list of positional and named
+// arguments of a call. Named arguments must come after the positional ones.
+func (p *parser) parseCallArgs() ([]ast.Expr, []*ast.NamedArg, []token.Pos) {
+	var (
+		args   []ast.Expr
+		named  []*ast.NamedArg
+		commas []token.Pos
+	)
+
+	for {
+		expr := p.parseExpr()
+		if id, ok := expr.(*ast.IdentExpr); ok && p.tok == token.COLON {
+			var arg ast.NamedArg
+			arg.Name = id
+			arg.Colon = p.expect(token.COLON)
+			arg.Value = p.parseExpr()
+			named = append(named, &arg)
+		} else {
+			if len(named) > 0 {
+				start, _ := expr.Span()
+				p.error(start, "positional argument after named argument")
+			}
+			args = append(args, expr)
+		}
+
+		if p.tok != token.COMMA {
+			break
+		}
+		commas = append(commas, p.expect(token.COMMA))
+	}
+	return args, named, commas
+}
+
 func (p *parser) parseIdentExpr() *ast.IdentExpr {
 	var exp ast.IdentExpr
 	exp.Lit = p.val.Raw
@@ -6,7 +6,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 
 	"github.com/mna/nenuphar/lang/ast"
@@ -26,7 +25,11 @@ const (
 // ParseFiles is a helper function that parses the source files and returns the
 // fileset along with the ASTs and any error encountered. The error, if
 // non-nil, is guaranteed to be a scanner.ErrorList.
-func ParseFiles(ctx context.Context, mode Mode, files ...string) (*token.FileSet, []*ast.Chunk, error) {
+//
+// If limits is not nil, no file is parsed if there are more files than
+// allowed, and parsing stops at the first file that exceeds the total size
+// allowed.
+func ParseFiles(ctx context.Context, mode Mode, limits *token.SourceLimits, files ...string) (*token.FileSet, []*ast.Chunk, error) {
 	if len(files) == 0 {
 		return nil, nil, nil
 	}
@@ -37,10 +40,19 @@ func ParseFiles(ctx context.Context, mode Mode, files ...string) (*token.FileSet
 	res := make([]*ast.Chunk, 0, len(files))
 	fs := token.NewFileSet()
 
+	if err := limits.Check(len(files), 0); err != nil {
+		p.errors.Add(token.Position{Filename: files[0]}, err.Error())
+		return fs, nil, p.errors.Err()
+	}
+
+	var size int
 	for _, file := range files {
-		b, err := os.ReadFile(file)
+		b, err := limits.ReadFile(file, &size)
 		if err != nil {
 			p.errors.Add(token.Position{Filename: file}, err.Error())
+			if errors.Is(err, token.ErrByteLimit) {
+				break
+			}
 			continue
 		}
 
@@ -58,16 +70,22 @@ func ParseFiles(ctx context.Context, mode Mode, files ...string) (*token.FileSet
 // the provided fset for position reporting under the name specified in
 // filename. The error, if non-nil, is guaranteed to be a scanner.ErrorList.
 func ParseChunk(ctx context.Context, mode Mode, fset *token.FileSet, filename string, src []byte) (*ast.Chunk, error) {
+	return ParseChunkAt(ctx, mode, fset, filename, src, 1)
+}
+
+// ParseChunkAt is like ParseChunk, except that the first line of src is
+// reported at line startLine instead of line 1. This is useful e.g. for a
+// REPL, so that positions of a snippet entered interactively are relative to
+// the whole session. A startLine smaller than 1 is treated as 1.
+func ParseChunkAt(ctx context.Context, mode Mode, fset *token.FileSet, filename string, src []byte, startLine int) (*ast.Chunk, error) {
 	var p parser
 	p.parseComments = mode&Comments != 0
-	p.init(fset, filename, src)
+	p.initAt(fset, filename, src, startLine)
 	ch := p.parseChunk()
 	ch.Name = filename
 	return ch, p.errors.Err()
 }
 
-// TODO: ParseChunkAt to set the initial position? Would allow e.g. REPL line number to be adequate.
-
 // parser parses source files and generates an AST.
 type parser struct {
 	// those fields are immutable after p.init
@@ -80,6 +98,10 @@ type parser struct {
 	tok token.Token
 	val token.Value
 
+	// when set, "in" is not parsed as a binary operator in the current
+	// (top-level) expression, see parseExprNoIn.
+	noIn bool
+
 	// this is set in p.advance to the position before skipping any comment,
 	// which is then used to set the starting position of blocks, so that blocks
 	// always encompass the comments.
@@ -100,7 +122,16 @@ type parser struct {
 }
 
 func (p *parser) init(fset *token.FileSet, filename string, src []byte) {
+	p.initAt(fset, filename, src, 1)
+}
+
+func (p *parser) initAt(fset *token.FileSet, filename string, src []byte, startLine int) {
 	p.file = fset.AddFile(filename, -1, len(src))
+	if startLine > 1 {
+		// the line bookkeeping of the file is unchanged (it is still based on the
+		// newlines in src), only the reported positions are adjusted.
+		p.file.AddLineColumnInfo(0, filename, startLine, 1)
+	}
 	p.scanner.Init(p.file, src, p.errors.Add)
 	p.pendingComments = nil
 	p.blocksStack = p.blocksStack[:0]
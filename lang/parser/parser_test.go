@@ -5,6 +5,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -13,8 +14,10 @@ import (
 	"github.com/mna/nenuphar/internal/filetest"
 	"github.com/mna/nenuphar/internal/maincmd"
 	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/scanner"
 	"github.com/mna/nenuphar/lang/token"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testUpdateParserTests = flag.Bool("test.update-parser-tests", false, "If set, replace expected parser test results with actual results.")
@@ -38,7 +41,7 @@ func TestParser(t *testing.T) {
 					}
 
 					// error is ignored, we just want it to be printed to ebuf
-					_ = maincmd.ParseFiles(ctx, stdio, mode, token.PosOffsets, "%#v", filepath.Join(srcDir, fi.Name()))
+					_ = maincmd.ParseFiles(ctx, stdio, mode, token.PosOffsets, "%#v", nil, filepath.Join(srcDir, fi.Name()))
 					ext := fmt.Sprintf(".want%d", mode)
 					filetest.DiffCustom(t, fi, "output", ext, buf.String(), resultDir, testUpdateParserTests)
 					filetest.DiffErrors(t, fi, ebuf.String(), resultDir, testUpdateParserTests)
@@ -54,3 +57,119 @@ func TestParser(t *testing.T) {
 		})
 	}
 }
+
+func TestParseChunkAt(t *testing.T) {
+	ctx := context.Background()
+	src := "let x = 1\nlet y = \nlet z = 3\n"
+
+	cases := []struct {
+		startLine int
+		wantLine  int
+	}{
+		{0, 3},
+		{1, 3},
+		{2, 4},
+		{10, 12},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprint(c.startLine), func(t *testing.T) {
+			fset := token.NewFileSet()
+			_, err := parser.ParseChunkAt(ctx, 0, fset, "repl", []byte(src), c.startLine)
+			require.Error(t, err)
+
+			var el scanner.ErrorList
+			require.ErrorAs(t, err, &el)
+			require.Len(t, el, 1)
+			assert.Equal(t, "repl", el[0].Pos.Filename)
+			assert.Equal(t, c.wantLine, el[0].Pos.Line)
+			assert.Equal(t, 1, el[0].Pos.Column)
+			assert.Contains(t, err.Error(), fmt.Sprintf("repl:%d:1:", c.wantLine))
+		})
+	}
+
+	t.Run("positions", func(t *testing.T) {
+		fset := token.NewFileSet()
+		ch, err := parser.ParseChunkAt(ctx, 0, fset, "repl", []byte("let x = 1\n  let y = 2\n"), 5)
+		require.NoError(t, err)
+		require.Len(t, ch.Block.Stmts, 2)
+
+		file := fset.File(ch.EOF)
+		require.NotNil(t, file)
+		start, _ := ch.Block.Stmts[1].Span()
+		assert.Equal(t, "repl:6:3", token.FormatPos(token.PosLong, file, start, true))
+		// the raw, unadjusted line bookkeeping of the file is unchanged
+		assert.Equal(t, 2, file.PositionFor(start, false).Line)
+	})
+}
+
+func TestParseNoOutput(t *testing.T) {
+	ctx := context.Background()
+	srcDir := filepath.Join("testdata", "in")
+
+	// redirect stdout and stderr to a pipe to detect any extraneous write
+	// done by the parser.
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+
+	// read concurrently so that a large output does not block on a full pipe
+	outc := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		outc <- b
+	}()
+
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	func() {
+		defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+
+		for _, fi := range filetest.SourceFiles(t, srcDir, ".nen") {
+			b, err := os.ReadFile(filepath.Join(srcDir, fi.Name()))
+			require.NoError(t, err)
+			// errors are ignored, only the output matters
+			_, _ = parser.ParseChunk(ctx, 0, token.NewFileSet(), fi.Name(), b)
+		}
+	}()
+	require.NoError(t, w.Close())
+	require.Empty(t, string(<-outc))
+}
+
+func TestParseFilesLimits(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	var files []string
+	for i, src := range []string{"let a = 1\n", "let b = 2\n", "let c = 3\n"} {
+		file := filepath.Join(dir, fmt.Sprintf("f%d.nen", i))
+		require.NoError(t, os.WriteFile(file, []byte(src), 0600))
+		files = append(files, file)
+	}
+
+	cases := []struct {
+		desc   string
+		limits *token.SourceLimits
+		chunks int
+		err    error
+	}{
+		{"no limit", nil, 3, nil},
+		{"zero limits", &token.SourceLimits{}, 3, nil},
+		{"exact limits", &token.SourceLimits{MaxFiles: 3, MaxBytes: 30}, 3, nil},
+		{"too many files", &token.SourceLimits{MaxFiles: 2}, 0, token.ErrFileLimit},
+		{"too many bytes", &token.SourceLimits{MaxBytes: 25}, 2, token.ErrByteLimit},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			_, chunks, err := parser.ParseFiles(ctx, 0, c.limits, files...)
+			require.Len(t, chunks, c.chunks)
+			if c.err == nil {
+				require.NoError(t, err)
+				return
+			}
+
+			var el scanner.ErrorList
+			require.ErrorAs(t, err, &el)
+			require.Len(t, el, 1)
+			require.Contains(t, el[0].Msg, c.err.Error())
+		})
+	}
+}
@@ -90,8 +90,9 @@ func (p *parser) parseForStmt() ast.Stmt {
 		declStmt := p.parseDeclStmt()
 		return p.parseForThreePartStmt(forPos, declStmt)
 	default:
-		// parse the left expressions and decide
-		left, commas := p.parseDisambiguateSuffixedExprAssignStmt()
+		// parse the left expressions and decide, "in" cannot be a binary operator
+		// there as it would be ambiguous with the for..in statement.
+		left, commas := p.parseDisambiguateSuffixedExprAssignStmt(true)
 
 		// next token disambiguates the statement
 		switch {
@@ -313,18 +314,25 @@ func (p *parser) parseLabelStmt() *ast.LabelStmt {
 //   - IN: for..in header statement
 //   - AugBinop: AugAssignStmt
 //   - Otherwise: ExprStmt (possibly an invalid one)
-func (p *parser) parseDisambiguateSuffixedExprAssignStmt() (left []ast.Expr, commas []token.Pos) {
-	left = []ast.Expr{p.parseExpr()}
+//
+// If noIn is true, "in" is not parsed as a binary operator so that it can end
+// the left expressions of a for..in statement.
+func (p *parser) parseDisambiguateSuffixedExprAssignStmt(noIn bool) (left []ast.Expr, commas []token.Pos) {
+	parse := p.parseExpr
+	if noIn {
+		parse = p.parseExprNoIn
+	}
+	left = []ast.Expr{parse()}
 	for p.tok == token.COMMA {
 		commas = append(commas, p.expect(token.COMMA))
-		left = append(left, p.parseExpr())
+		left = append(left, parse())
 	}
 	return left, commas
 }
 
 func (p *parser) parseExprOrAssignStmt(left []ast.Expr, commas []token.Pos) ast.Stmt {
 	if left == nil {
-		left, commas = p.parseDisambiguateSuffixedExprAssignStmt()
+		left, commas = p.parseDisambiguateSuffixedExprAssignStmt(false)
 	}
 	if tokenIn(p.tok, token.EQ, token.IN) {
 		// parsing as AssignStmt even if p.tok == IN, will take care of error
@@ -0,0 +1,117 @@
+package resolver_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mna/nenuphar/lang/ast"
+	"github.com/mna/nenuphar/lang/parser"
+	"github.com/mna/nenuphar/lang/resolver"
+	"github.com/mna/nenuphar/lang/scanner"
+	"github.com/mna/nenuphar/lang/token"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFunctionLimits(t *testing.T) {
+	const max = 1 << 16
+
+	decls := func(prefix string, n int) string {
+		var sb strings.Builder
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&sb, "let %s%d\n", prefix, i)
+		}
+		return sb.String()
+	}
+
+	// uses of the first n variables declared with decls, on a single line.
+	uses := func(prefix string, n int) string {
+		var sb strings.Builder
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&sb, "%s%d = 1;", prefix, i)
+		}
+		return sb.String()
+	}
+
+	var labels strings.Builder
+	for i := 0; i <= max; i++ {
+		fmt.Fprintf(&labels, "::l%d::\n", i)
+	}
+
+	cases := []struct {
+		desc string
+		src  string
+		line int    // line of the expected error, 0 if no error expected
+		err  string // expected error message
+	}{
+		{"max locals", decls("v", max), 0, ""},
+		{"too many locals", decls("v", max+1), max + 1,
+			fmt.Sprintf("too many local variables in function (max %d)", max)},
+		{"too many locals in nested function", "fn f()\n" + decls("v", max+1) + "end", max + 2,
+			fmt.Sprintf("too many local variables in function (max %d)", max)},
+		{"too many labels", labels.String(), max + 1,
+			fmt.Sprintf("too many labels in function (max %d)", max)},
+		{"too many free variables",
+			decls("a", max/2) + "fn f()\n" + decls("b", max/2+1) + "fn g()\n" + uses("a", max/2) + uses("b", max/2+1) + "\nend\nend",
+			max + 4,
+			fmt.Sprintf("too many free variables in function (max %d)", max)},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			ctx := context.Background()
+			fset := token.NewFileSet()
+			ch, err := parser.ParseChunk(ctx, 0, fset, "test", []byte(c.src))
+			require.NoError(t, err)
+
+			err = resolver.ResolveFiles(ctx, fset, []*ast.Chunk{ch}, 0, nil, nil, nil)
+			if c.err == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			var el scanner.ErrorList
+			require.ErrorAs(t, err, &el)
+			require.Len(t, el, 1)
+			require.Equal(t, c.line, el[0].Pos.Line)
+			require.Equal(t, c.err, el[0].Msg)
+		})
+	}
+}
+
+func TestSourceLimits(t *testing.T) {
+	ctx := context.Background()
+	fset := token.NewFileSet()
+	var chunks []*ast.Chunk
+	for i := 0; i < 3; i++ {
+		ch, err := parser.ParseChunk(ctx, 0, fset, fmt.Sprintf("test%d", i), []byte("let x = 1\n"))
+		require.NoError(t, err)
+		chunks = append(chunks, ch)
+	}
+
+	cases := []struct {
+		desc   string
+		limits *token.SourceLimits
+		err    string
+	}{
+		{"no limit", nil, ""},
+		{"exact limits", &token.SourceLimits{MaxFiles: 3, MaxBytes: 30}, ""},
+		{"too many files", &token.SourceLimits{MaxFiles: 2}, "source files limit exceeded: 3 (max 2)"},
+		{"too many bytes", &token.SourceLimits{MaxBytes: 29}, "source bytes limit exceeded: 30 (max 29)"},
+	}
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			err := resolver.ResolveFiles(ctx, fset, chunks, 0, c.limits, nil, nil)
+			if c.err == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			var el scanner.ErrorList
+			require.ErrorAs(t, err, &el)
+			require.Len(t, el, 1)
+			require.Equal(t, "test0", el[0].Pos.Filename)
+			require.Equal(t, c.err, el[0].Msg)
+		})
+	}
+}
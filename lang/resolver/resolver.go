@@ -84,8 +84,10 @@ package resolver
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 
+	"github.com/mna/nenuphar/internal/spell"
 	"github.com/mna/nenuphar/lang/ast"
 	"github.com/mna/nenuphar/lang/scanner"
 	"github.com/mna/nenuphar/lang/token"
@@ -101,6 +103,21 @@ const (
 	NameBlocks Mode = 1 << iota // give unique names to blocks, useful for printing the resolved AST.
 )
 
+// maxCallArgs is the maximum number of positional arguments, and of named
+// arguments, in a call.
+const maxCallArgs = 255
+
+// maxLocals, maxFreeVars and maxLabels are the maximum number of local
+// variables (including parameters and internal temporaries), free variables
+// and labels in a single function. The compiler encodes their indices as
+// opcode arguments, a function exceeding those limits is reported as an error
+// instead of generating out-of-range indices.
+const (
+	maxLocals   = 1 << 16
+	maxFreeVars = 1 << 16
+	maxLabels   = 1 << 16
+)
+
 // ResolveFiles takes the file set and corresponding list of chunks from a
 // successful parse result and resolves the bindings used in the source code.
 // On success, the AST is enriched with binding resolution information and is
@@ -110,12 +127,26 @@ const (
 // the resolver, the behavior is undefined.
 //
 // The returned error, if non-nil, is guaranteed to be a scanner.ErrorList.
+//
+// If limits is not nil, no chunk is resolved if there are more chunks or
+// more source bytes than allowed.
 func ResolveFiles(ctx context.Context, fset *token.FileSet, chunks []*ast.Chunk,
-	mode Mode, isPredeclared, isUniversal func(name string) bool) error {
+	mode Mode, limits *token.SourceLimits, isPredeclared, isUniversal func(name string) bool) error {
 	if len(chunks) == 0 {
 		return nil
 	}
 
+	files := make([]*token.File, len(chunks))
+	for i, ch := range chunks {
+		start, _ := ch.Span()
+		files[i] = fset.File(start)
+	}
+	if err := limits.CheckFiles(files); err != nil {
+		var el scanner.ErrorList
+		el.Add(token.Position{Filename: files[0].Name()}, err.Error())
+		return el.Err()
+	}
+
 	var r resolver
 	r.isPredeclared = isPredeclared
 	if isPredeclared == nil {
@@ -126,9 +157,8 @@ func ResolveFiles(ctx context.Context, fset *token.FileSet, chunks []*ast.Chunk,
 		r.isUniversal = func(name string) bool { return false }
 	}
 
-	for _, ch := range chunks {
-		start, _ := ch.Span()
-		r.init(fset.File(start))
+	for i, ch := range chunks {
+		r.init(files[i])
 		r.block(ch.Block, ch)
 
 		if mode&NameBlocks != 0 {
@@ -225,6 +255,7 @@ func (r *resolver) block(b *ast.Block, from ast.Node) {
 	switch v := from.(type) {
 	case *ast.Chunk:
 		blk.fn = &Function{Name: "toplevel", Definition: v}
+		v.Function = blk.fn
 	case *ast.SimpleBlockStmt:
 		isDefer = v.Type == token.DEFER
 		isCatch = v.Type == token.CATCH
@@ -286,6 +317,16 @@ func (r *resolver) assertNotInternalIdent(ident *ast.IdentExpr) {
 func (r *resolver) stmt(stmt ast.Stmt) {
 	switch stmt := stmt.(type) {
 	case *ast.AssignStmt:
+		// many values are assigned one by one, only a single value can be
+		// unpacked to many variables.
+		if len(stmt.Right) > 1 && len(stmt.Left) != len(stmt.Right) {
+			vars := "variables"
+			if len(stmt.Left) == 1 {
+				vars = "variable"
+			}
+			r.errorf(stmt.AssignPos, "assignment mismatch: %d %s but %d values", len(stmt.Left), vars, len(stmt.Right))
+		}
+
 		// resolve the rhs first
 		for _, e := range stmt.Right {
 			r.expr(e, false)
@@ -307,7 +348,6 @@ func (r *resolver) stmt(stmt ast.Stmt) {
 		}
 
 		// bind the name before the body, as it can be used by itself
-		// TODO: double-check that this works once machine is implemented
 		r.bind(stmt.Name, true)
 		r.class(stmt, stmt.Body)
 
@@ -432,6 +472,9 @@ func (r *resolver) stmt(stmt ast.Stmt) {
 		}
 		r.bindLabel(stmt.Name)
 
+	case *ast.PassStmt:
+		// nothing to resolve
+
 	case *ast.ReturnLikeStmt:
 		switch stmt.Type {
 		case token.BREAK, token.CONTINUE:
@@ -496,10 +539,34 @@ func (r *resolver) expr(expr ast.Expr, assignsToIdent bool) {
 
 	case *ast.CallExpr:
 		r.expr(expr.Fn, false)
-		for _, e := range expr.Args {
+		for i, e := range expr.Args {
+			// a spread is only valid as the last positional argument, its values
+			// are expanded into the arguments of the call.
+			if u, ok := e.(*ast.UnaryOpExpr); ok && u.Type == token.DOTDOTDOT && i == len(expr.Args)-1 {
+				r.expr(u.Right, false)
+				continue
+			}
 			r.expr(e, false)
 		}
-		// TODO: fail gracefully when > max args?
+		seen := make(map[string]bool, len(expr.Named))
+		for _, arg := range expr.Named {
+			// the name is not a variable reference, it is not resolved
+			if seen[arg.Name.Lit] {
+				r.errorf(arg.Name.Start, "duplicate named argument: %s", arg.Name.Lit)
+			}
+			seen[arg.Name.Lit] = true
+			r.expr(arg.Value, false)
+		}
+
+		// the compiler encodes the number of positional and named arguments on a
+		// byte each.
+		if len(expr.Args) > maxCallArgs {
+			start, _ := expr.Args[maxCallArgs].Span()
+			r.errorf(start, "too many positional arguments in call (max %d)", maxCallArgs)
+		}
+		if len(expr.Named) > maxCallArgs {
+			r.errorf(expr.Named[maxCallArgs].Name.Start, "too many named arguments in call (max %d)", maxCallArgs)
+		}
 
 	case *ast.ClassExpr:
 		if expr.Inherits != nil && expr.Inherits.Expr != nil {
@@ -540,6 +607,9 @@ func (r *resolver) expr(expr ast.Expr, assignsToIdent bool) {
 		r.expr(expr.Expr, assignsToIdent)
 
 	case *ast.UnaryOpExpr:
+		if expr.Type == token.DOTDOTDOT {
+			r.errorf(expr.Op, "spread (...) is only allowed as the last positional argument of a call")
+		}
 		r.expr(expr.Right, false)
 		if expr.Type == token.TRY || expr.Type == token.MUST {
 			// create an internal variable identifier so that a temporary local
@@ -585,8 +655,10 @@ func (r *resolver) class(cl ast.Node, body *ast.ClassBody) {
 	switch cl := cl.(type) {
 	case *ast.ClassExpr:
 		blk.fn.Name = "anonymous"
+		cl.Function = blk.fn
 	case *ast.ClassStmt:
 		blk.fn.Name = cl.Name.Lit
+		cl.Function = blk.fn
 	}
 	r.push(blk)
 
@@ -625,6 +697,9 @@ func (r *resolver) bind(ident *ast.IdentExpr, isConst bool) {
 
 	bdg := &Binding{Scope: Local, Const: isConst, Decl: ident}
 	ix := len(r.env.fn.Locals)
+	if ix == maxLocals {
+		r.errorf(ident.Start, "too many local variables in function (max %d)", maxLocals)
+	}
 	bdg.Index = ix
 	r.env.fn.Locals = append(r.env.fn.Locals, bdg)
 
@@ -685,6 +760,9 @@ func (r *resolver) bindLabel(ident *ast.IdentExpr) {
 	}
 
 	ix := len(r.env.fn.Labels)
+	if ix == maxLabels {
+		r.errorf(ident.Start, "too many labels in function (max %d)", maxLabels)
+	}
 	bdg.Index = ix
 	r.env.fn.Labels = append(r.env.fn.Labels, bdg)
 
@@ -695,44 +773,58 @@ func (r *resolver) bindLabel(ident *ast.IdentExpr) {
 	ident.Binding = bdg
 }
 
-func (r *resolver) use(ident *ast.IdentExpr, isAssign bool) {
-	r.assertNotInternalIdent(ident)
+// lookupLexical returns the binding of ident in env or its parents, or nil if
+// there is none. When the binding is found in an enclosing function, it is
+// added to the free variables of every function from the one that declares
+// it down to the one of env, so that each closure can capture it from its
+// parent, and the enclosing function's local becomes a cell.
+func (r *resolver) lookupLexical(ident *ast.IdentExpr, env *block) *Binding {
+	if env == nil {
+		return nil
+	}
+	if bdg := env.bindings[ident.Lit]; bdg != nil {
+		return bdg
+	}
 
-	startFn := r.env.fn
-	for env := r.env; env != nil; env = env.parent {
-		if bdg := env.bindings[ident.Lit]; bdg != nil {
-			if isAssign && bdg.Const {
-				r.errorf(ident.Start, "assignment to immutable variable: %s", ident.Lit)
-			}
+	bdg := r.lookupLexical(ident, env.parent)
+	if bdg == nil || env.parent.fn == env.fn {
+		return bdg
+	}
 
-			if env.fn != startFn {
-				// Found in a parent block which belongs to enclosing function. Add the
-				// parent's binding to the function's freevars, and add a new 'free'
-				// binding to the inner function's block, and turn the parent's local
-				// into cell.
-				if bdg.Scope == Local {
-					bdg.Scope = Cell
-				}
-				ix := len(r.env.fn.FreeVars)
-				r.env.fn.FreeVars = append(r.env.fn.FreeVars, bdg)
-
-				// TODO: must the freevar be defined in every enclosing function up to
-				// the cell? Currently only in the function that references the cell.
-				bdg = &Binding{
-					Decl:  bdg.Decl,
-					Const: bdg.Const,
-					Scope: Free,
-					Index: ix,
-				}
+	// env is the top block of its function and the binding belongs to an
+	// enclosing function: add the parent's binding to the function's freevars
+	// and record a new 'free' binding in this block.
+	if bdg.Scope == Local {
+		bdg.Scope = Cell
+	}
+	ix := len(env.fn.FreeVars)
+	if ix == maxFreeVars {
+		r.errorf(ident.Start, "too many free variables in function (max %d)", maxFreeVars)
+	}
+	env.fn.FreeVars = append(env.fn.FreeVars, bdg)
 
-				if r.env.bindings == nil {
-					r.env.bindings = make(map[string]*Binding)
-				}
-				r.env.bindings[ident.Lit] = bdg
-			}
-			ident.Binding = bdg
-			return
+	bdg = &Binding{
+		Decl:  bdg.Decl,
+		Const: bdg.Const,
+		Scope: Free,
+		Index: ix,
+	}
+	if env.bindings == nil {
+		env.bindings = make(map[string]*Binding)
+	}
+	env.bindings[ident.Lit] = bdg
+	return bdg
+}
+
+func (r *resolver) use(ident *ast.IdentExpr, isAssign bool) {
+	r.assertNotInternalIdent(ident)
+
+	if bdg := r.lookupLexical(ident, r.env); bdg != nil {
+		if isAssign && bdg.Const {
+			r.errorf(ident.Start, "assignment to immutable variable: %s", ident.Lit)
 		}
+		ident.Binding = bdg
+		return
 	}
 
 	// look for a predeclared or universal binding
@@ -765,11 +857,38 @@ func (r *resolver) use(ident *ast.IdentExpr, isAssign bool) {
 		return
 	}
 
-	// TODO: maybe add a spell checker? (did you mean...)
-	r.errorf(ident.Start, "undefined: %s", ident.Lit)
+	if n := spell.Nearest(ident.Lit, r.visibleNames()); n != "" {
+		r.errorf(ident.Start, "undefined: %s (did you mean %s?)", ident.Lit, n)
+	} else {
+		r.errorf(ident.Start, "undefined: %s", ident.Lit)
+	}
 	ident.Binding = &Binding{Scope: Undefined}
 }
 
+// visibleNames returns the sorted names of the bindings visible from the
+// current block, along with the predeclared and universal names used so far
+// in the file (those cannot be enumerated otherwise).
+func (r *resolver) visibleNames() []string {
+	set := make(map[string]bool)
+	for env := r.env; env != nil; env = env.parent {
+		for name := range env.bindings {
+			set[name] = true
+		}
+	}
+	for name := range r.globals {
+		set[name] = true
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		if !strings.HasPrefix(name, "<internal-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (r *resolver) useLoopLabel(ident *ast.IdentExpr) {
 	if !r.env.isValidLoopLabel(ident.Lit) {
 		// check if the label exists, but is just not a valid loop target
@@ -37,7 +37,7 @@ func TestResolver(t *testing.T) {
 
 			// error is ignored, we just want it to be printed to ebuf
 			_ = maincmd.ResolveFiles(ctx, stdio, 0, resolver.NameBlocks,
-				token.PosOffsets, "%#v", filepath.Join(srcDir, fi.Name()))
+				token.PosOffsets, "%#v", nil, filepath.Join(srcDir, fi.Name()))
 			filetest.DiffOutput(t, fi, buf.String(), resultDir, testUpdateResolverTests)
 			filetest.DiffErrors(t, fi, ebuf.String(), resultDir, testUpdateResolverTests)
 
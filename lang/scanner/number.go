@@ -1,12 +1,71 @@
 package scanner
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
 
 	"github.com/mna/nenuphar/lang/token"
 )
 
+// ParseNumber parses s as a number literal, optionally preceded by a sign,
+// following the same rules as the scanner does for the number tokens of the
+// source code. It returns token.INT or token.FLOAT with the decoded (signed)
+// value stored in the corresponding field of the returned token.Value, or an
+// error if s is not exactly one valid number literal.
+func ParseNumber(s string) (token.Token, token.Value, error) {
+	lit, neg := s, false
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		lit, neg = s[1:], s[0] == '-'
+	}
+
+	var msg string
+	var sc Scanner
+	file := token.NewFileSet().AddFile("", -1, len(lit))
+	sc.Init(file, []byte(lit), func(_ token.Position, m string) {
+		if msg == "" {
+			msg = m
+		}
+	})
+
+	// Init skips a BOM and hashbang line, which are not valid in a number
+	var tokVal token.Value
+	tok := token.ILLEGAL
+	if sc.off == 0 && (isDecimal(sc.cur) || sc.cur == '.' && isDecimal(rune(sc.peek()))) {
+		tok = sc.Scan(&tokVal)
+	}
+	if tok != token.INT && tok != token.FLOAT || sc.cur != -1 {
+		return token.ILLEGAL, token.Value{}, fmt.Errorf("invalid number syntax: %q", s)
+	}
+	if neg && tok == token.INT && msg == errIntRange {
+		// the magnitude of the minimum int64 is out of range of a positive
+		// integer, so the range is checked again with the sign.
+		base, digits := 10, tokVal.Raw
+		if len(digits) > 1 && digits[0] == '0' {
+			switch lower(rune(digits[1])) {
+			case 'x':
+				base, digits = 16, digits[2:]
+			case 'o':
+				base, digits = 8, digits[2:]
+			case 'b':
+				base, digits = 2, digits[2:]
+			}
+		}
+		if v, err := strconv.ParseInt("-"+strings.ReplaceAll(digits, "_", ""), base, 64); err == nil {
+			tokVal.Int = v
+			return tok, tokVal, nil
+		}
+	}
+	if msg != "" {
+		return token.ILLEGAL, token.Value{}, fmt.Errorf("invalid number %q: %s", s, msg)
+	}
+	if neg {
+		tokVal.Int = -tokVal.Int
+		tokVal.Float = -tokVal.Float
+	}
+	return tok, tokVal, nil
+}
+
 func (s *Scanner) number() (tok token.Token, base int, lit string) {
 	start := s.off
 	tok = token.ILLEGAL
@@ -185,6 +244,10 @@ func lower(ch rune) rune {
 	return ('a' - 'A') | ch // returns lower-case ch iff ch is ASCII letter
 }
 
+// errIntRange is the error reported for an integer literal that does not fit
+// in an int64.
+const errIntRange = "integer literal value out of range"
+
 func numberToInt(lit string, base int) (int64, error) {
 	if base != 10 {
 		// skip the 0x/0o/0b prefix
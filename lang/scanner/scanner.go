@@ -15,7 +15,6 @@ import (
 	"errors"
 	"fmt"
 	"go/scanner"
-	"os"
 	"strconv"
 	"strings"
 	"unicode"
@@ -42,7 +41,11 @@ type TokenAndValue struct {
 // the list of tokens, grouped by the file at the same index, and produces any
 // error encountered. The error, if non-nil, is guaranteed to be an
 // ErrorList.
-func ScanFiles(ctx context.Context, files ...string) (*token.FileSet, [][]TokenAndValue, error) {
+//
+// If limits is not nil, no file is tokenized if there are more files than
+// allowed, and tokenizing stops at the first file that exceeds the total
+// size allowed.
+func ScanFiles(ctx context.Context, limits *token.SourceLimits, files ...string) (*token.FileSet, [][]TokenAndValue, error) {
 	if len(files) == 0 {
 		return nil, nil, nil
 	}
@@ -55,10 +58,19 @@ func ScanFiles(ctx context.Context, files ...string) (*token.FileSet, [][]TokenA
 
 	fs := token.NewFileSet()
 	tokensByFile := make([][]TokenAndValue, len(files))
+	if err := limits.Check(len(files), 0); err != nil {
+		el.Add(token.Position{Filename: files[0]}, err.Error())
+		return fs, nil, el.Err()
+	}
+
+	var size int
 	for i, file := range files {
-		b, err := os.ReadFile(file)
+		b, err := limits.ReadFile(file, &size)
 		if err != nil {
 			el.Add(token.Position{Filename: file}, err.Error())
+			if errors.Is(err, token.ErrByteLimit) {
+				break
+			}
 			continue
 		}
 
@@ -79,6 +91,32 @@ func ScanFiles(ctx context.Context, files ...string) (*token.FileSet, [][]TokenA
 	return fs, tokensByFile, el.Err()
 }
 
+// ScanChunk is a helper function that tokenizes a single chunk from a slice
+// of bytes and returns the list of tokens and any error encountered. The
+// chunk is added to the provided fset for position reporting under the name
+// specified in filename. The error, if non-nil, is guaranteed to be an
+// ErrorList.
+func ScanChunk(ctx context.Context, fset *token.FileSet, filename string, src []byte) ([]TokenAndValue, error) {
+	var (
+		s      Scanner
+		tokVal token.Value
+		el     ErrorList
+		toks   []TokenAndValue
+	)
+
+	fsf := fset.AddFile(filename, -1, len(src))
+	s.Init(fsf, src, el.Add)
+	for {
+		tok := s.Scan(&tokVal)
+		toks = append(toks, TokenAndValue{Token: tok, Value: tokVal})
+		if tok == token.EOF {
+			break
+		}
+	}
+	el.Sort()
+	return toks, el.Err()
+}
+
 // Scanner tokenizes source files for the parser to consume.
 type Scanner struct {
 	// immutable state after Init
@@ -90,6 +128,7 @@ type Scanner struct {
 	sb               strings.Builder // writes to Builder never fail, so errors are ignored
 	pendingSurrogate rune            // in short string literal, the first half of a surrogate pair, pending the second (or rendered as replacement rune)
 	invalidByte      byte            // when cur==RuneError due to failed utf8 decode, this is the invalid byte
+	bytesLit         bool            // in short string literal, true if it is a bytes literal
 	cur              rune            // current character
 	off              int             // character offset in bytes of cur
 	roff             int             // reading offset in bytes (position after current character)
@@ -204,6 +243,17 @@ func (s *Scanner) Scan(tokVal *token.Value) (tok token.Token) {
 	start := s.off
 
 	switch cur := s.cur; {
+	case cur == 'b' && (s.peek() == '"' || s.peek() == '\''):
+		// bytes, a short string prefixed with b
+		s.advance()
+		opening := s.cur
+		s.advance()
+		tok = token.BYTES
+		s.bytesLit = true
+		_, val := s.shortString(opening)
+		s.bytesLit = false
+		*tokVal = token.Value{Raw: string(s.src[start:s.off]), Pos: pos, String: val}
+
 	case isLetter(cur):
 		// keywords and identifiers
 		lit := s.ident()
@@ -224,7 +274,7 @@ func (s *Scanner) Scan(tokVal *token.Value) (tok token.Token) {
 			v, err := numberToInt(lit, base)
 			if err != nil && errors.Is(err, strconv.ErrRange) {
 				// syntax errors would have already generated an error, but not range
-				s.error(start, "integer literal value out of range")
+				s.error(start, errIntRange)
 			}
 			tokVal.Int = v
 		} else if tok == token.FLOAT {
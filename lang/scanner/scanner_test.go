@@ -28,7 +28,7 @@ func TestScan(t *testing.T) {
 			}
 
 			// error is ignored, we just want it to be printed to ebuf
-			_ = maincmd.TokenizeFiles(ctx, stdio, token.PosOffsets, filepath.Join(srcDir, fi.Name()))
+			_ = maincmd.TokenizeFiles(ctx, stdio, token.PosOffsets, nil, filepath.Join(srcDir, fi.Name()))
 			filetest.DiffOutput(t, fi, buf.String(), resultDir, testUpdateScannerTests)
 			filetest.DiffErrors(t, fi, ebuf.String(), resultDir, testUpdateScannerTests)
 		})
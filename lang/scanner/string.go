@@ -200,6 +200,11 @@ func (s *Scanner) escape() (skipws bool) {
 		s.error(start, msg)
 		return false
 	}
+	if max == 255 && s.bytesLit {
+		// in a bytes literal, byte escapes encode the raw byte value
+		s.writeStringLitByte(byte(rn))
+		return false
+	}
 	if utf16.IsSurrogate(rune(rn)) {
 		s.writeStringLitSurrogate(rune(rn))
 		return false
@@ -208,6 +213,15 @@ func (s *Scanner) escape() (skipws bool) {
 	return false
 }
 
+// writes a raw byte, only used for byte escapes in bytes literals
+func (s *Scanner) writeStringLitByte(b byte) {
+	if s.pendingSurrogate != 0 {
+		s.sb.WriteRune(utf8.RuneError)
+		s.pendingSurrogate = 0
+	}
+	s.sb.WriteByte(b)
+}
+
 // writes a rune that is _not_ a surrogate
 func (s *Scanner) writeStringLitRune(rn rune) {
 	if s.pendingSurrogate != 0 {
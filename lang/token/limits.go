@@ -0,0 +1,80 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SourceLimits defines the maximum number of source files (or chunks) and
+// the maximum total size in bytes of their source code that are processed by
+// a single call to the helpers that work on a set of files, such as
+// parser.ParseFiles or compiler.CompileFiles. It bounds the resources used
+// when processing untrusted input sets. A zero value for a field means no
+// limit, and a nil *SourceLimits means no limit at all.
+type SourceLimits struct {
+	MaxFiles int
+	MaxBytes int
+}
+
+// List of errors returned when a source limit is exceeded.
+var (
+	ErrFileLimit = errors.New("source files limit exceeded")
+	ErrByteLimit = errors.New("source bytes limit exceeded")
+)
+
+// Check returns an error if the number of files or the total size in bytes
+// exceeds the limits. If both are exceeded, the returned error wraps both
+// ErrFileLimit and ErrByteLimit. It is valid to call it with a nil receiver.
+func (l *SourceLimits) Check(files, bytes int) error {
+	if l == nil {
+		return nil
+	}
+
+	var errs []error
+	if l.MaxFiles > 0 && files > l.MaxFiles {
+		errs = append(errs, fmt.Errorf("%w: %d (max %d)", ErrFileLimit, files, l.MaxFiles))
+	}
+	if l.MaxBytes > 0 && bytes > l.MaxBytes {
+		errs = append(errs, fmt.Errorf("%w: %d (max %d)", ErrByteLimit, bytes, l.MaxBytes))
+	}
+	return errors.Join(errs...)
+}
+
+// CheckFiles is like Check, for the number of files and their total size.
+func (l *SourceLimits) CheckFiles(files []*File) error {
+	var size int
+	if l != nil && l.MaxBytes > 0 {
+		for _, f := range files {
+			size += f.Size()
+		}
+	}
+	return l.Check(len(files), size)
+}
+
+// ReadFile reads the source file and returns its content, after adding its
+// size to *total. It fails without reading the file if the new total exceeds
+// the bytes limit, in which case the error wraps ErrByteLimit. It is valid to
+// call it with a nil receiver.
+func (l *SourceLimits) ReadFile(file string, total *int) ([]byte, error) {
+	if l != nil && l.MaxBytes > 0 {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := l.Check(0, *total+int(fi.Size())); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	*total += len(b)
+	if err := l.Check(0, *total); err != nil {
+		// the file grew since it was checked
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,66 @@
+package token
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceLimitsCheck(t *testing.T) {
+	var nilLimits *SourceLimits
+	require.NoError(t, nilLimits.Check(1000, 1000))
+	require.NoError(t, (&SourceLimits{}).Check(1000, 1000))
+
+	l := &SourceLimits{MaxFiles: 2, MaxBytes: 10}
+	require.NoError(t, l.Check(2, 10))
+
+	err := l.Check(3, 10)
+	require.ErrorIs(t, err, ErrFileLimit)
+	require.NotErrorIs(t, err, ErrByteLimit)
+	require.EqualError(t, err, "source files limit exceeded: 3 (max 2)")
+
+	err = l.Check(1, 11)
+	require.ErrorIs(t, err, ErrByteLimit)
+	require.NotErrorIs(t, err, ErrFileLimit)
+	require.EqualError(t, err, "source bytes limit exceeded: 11 (max 10)")
+
+	err = l.Check(3, 11)
+	require.ErrorIs(t, err, ErrFileLimit)
+	require.ErrorIs(t, err, ErrByteLimit)
+
+	fset := NewFileSet()
+	files := []*File{fset.AddFile("a", -1, 6), fset.AddFile("b", -1, 4)}
+	require.NoError(t, l.CheckFiles(files))
+	files = append(files, fset.AddFile("c", -1, 1))
+	err = l.CheckFiles(files)
+	require.ErrorIs(t, err, ErrFileLimit)
+	require.ErrorIs(t, err, ErrByteLimit)
+}
+
+func TestSourceLimitsReadFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a")
+	require.NoError(t, os.WriteFile(file, []byte("abcd"), 0600))
+
+	var total int
+	var nilLimits *SourceLimits
+	b, err := nilLimits.ReadFile(file, &total)
+	require.NoError(t, err)
+	require.Equal(t, "abcd", string(b))
+	require.Equal(t, 4, total)
+
+	l := &SourceLimits{MaxBytes: 10}
+	b, err = l.ReadFile(file, &total)
+	require.NoError(t, err)
+	require.Equal(t, "abcd", string(b))
+	require.Equal(t, 8, total)
+
+	_, err = l.ReadFile(file, &total)
+	require.ErrorIs(t, err, ErrByteLimit)
+	require.Equal(t, 8, total)
+
+	_, err = l.ReadFile(filepath.Join(dir, "nope"), &total)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -17,6 +17,7 @@ const (
 	INT     // 123
 	FLOAT   // 1.23e45
 	STRING  // "foo" or 'foo' or [[foo]]
+	BYTES   // b"foo" or b'foo'
 
 	// Punctuation
 
@@ -102,12 +103,17 @@ const (
 	NOT
 	TRY
 	MUST
+	PASS
 
-	maxToken             = MUST
-	litStart, litEnd     = COMMENT, STRING
+	// NOTIN is the "not in" binary operator. It is not produced by the scanner,
+	// the parser combines "not" followed by "in" after an operand into NOTIN.
+	NOTIN
+
+	maxToken             = NOTIN
+	litStart, litEnd     = COMMENT, BYTES
 	punctStart, punctEnd = PLUS, COLONCOLON
 	augopStart, augopEnd = PLUSEQ, GTGTEQ
-	kwStart, kwEnd       = FUNCTION, MUST
+	kwStart, kwEnd       = FUNCTION, PASS
 )
 
 func (tok Token) String() string { return tokenNames[tok] }
@@ -130,6 +136,7 @@ var tokenNames = [...]string{
 	INT:     "int literal",
 	FLOAT:   "float literal",
 	STRING:  "string literal",
+	BYTES:   "bytes literal",
 
 	PLUS:       "+",
 	MINUS:      "-",
@@ -208,6 +215,9 @@ var tokenNames = [...]string{
 	NOT:      "not",
 	TRY:      "try",
 	MUST:     "must",
+	PASS:     "pass",
+
+	NOTIN: "not in",
 }
 
 var (
@@ -264,6 +274,8 @@ func (tok Token) Literal(v Value) string {
 		return v.Raw
 	case STRING:
 		return strconv.Quote(v.String)
+	case BYTES:
+		return "b" + strconv.Quote(v.String)
 	case COMMENT:
 		return v.String
 	case INT:
@@ -284,7 +296,7 @@ func (tok Token) IsAugBinop() bool {
 func (tok Token) IsBinop() bool {
 	return (tok >= PLUS && tok <= GTGT) ||
 		(tok >= EQEQ && tok <= LE) ||
-		tok == AND || tok == OR
+		tok == AND || tok == OR || tok == IN || tok == NOTIN
 }
 
 // IsUnop indicates if tok is valid as a unary operator.
@@ -294,9 +306,9 @@ func (tok Token) IsUnop() bool {
 		tok == POUND || tok == DOTDOTDOT
 }
 
-// IsAtom indicates if tok is an atom token, i.e. a literal string, number,
-// true, false or null.
+// IsAtom indicates if tok is an atom token, i.e. a literal string, bytes,
+// number, true, false or null.
 func (tok Token) IsAtom() bool {
-	return (tok >= INT && tok <= STRING) ||
+	return (tok >= INT && tok <= BYTES) ||
 		(tok >= NULL && tok <= FALSE)
 }
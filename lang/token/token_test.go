@@ -48,7 +48,8 @@ func TestIsAugBinop(t *testing.T) {
 
 func TestIsBinop(t *testing.T) {
 	for tok := Token(0); tok <= maxToken; tok++ {
-		maybe := (tok >= punctStart && tok <= punctEnd && !tok.IsAugBinop()) || tok == AND || tok == OR
+		maybe := (tok >= punctStart && tok <= punctEnd && !tok.IsAugBinop()) ||
+			tok == AND || tok == OR || tok == IN || tok == NOTIN
 		got := tok.IsBinop()
 		if !maybe {
 			require.False(t, got)